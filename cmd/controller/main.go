@@ -5,10 +5,14 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
+	"github.com/rossigee/cert-webhook-system/internal/cli"
 	"github.com/rossigee/cert-webhook-system/internal/controller"
 	"github.com/rossigee/cert-webhook-system/internal/rabbitmq"
+	"github.com/rossigee/cert-webhook-system/internal/sink"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"k8s.io/client-go/kubernetes"
@@ -45,15 +49,39 @@ var versionCmd = &cobra.Command{
 func init() {
 	rootCmd.AddCommand(versionCmd)
 
-	rootCmd.PersistentFlags().String("kubeconfig", "", "Path to kubeconfig file")
-	rootCmd.PersistentFlags().String("rabbitmq-url", "", "RabbitMQ connection URL (required)")
-	rootCmd.PersistentFlags().String("log-level", "info", "Log level (debug, info, warn, error)")
-	rootCmd.PersistentFlags().Int("health-port", 9250, "Health check HTTP port")
+	cli.AddFlags(rootCmd.PersistentFlags())
 
-	_ = viper.BindPFlag("kubeconfig", rootCmd.PersistentFlags().Lookup("kubeconfig"))
-	_ = viper.BindPFlag("rabbitmq-url", rootCmd.PersistentFlags().Lookup("rabbitmq-url"))
-	_ = viper.BindPFlag("log-level", rootCmd.PersistentFlags().Lookup("log-level"))
+	rootCmd.PersistentFlags().Duration("rabbitmq-stream-max-age", 7*24*time.Hour, "Age after which events are discarded from the stream (0 keeps them)")
+	rootCmd.PersistentFlags().Int64("rabbitmq-stream-max-bytes", 0, "Maximum size of the stream (0 unlimited)")
+	rootCmd.PersistentFlags().Int64("rabbitmq-stream-segment-bytes", 0, "Size of stream segment files retention applies to (0 broker default)")
+	rootCmd.PersistentFlags().String("rabbitmq-topology-file", "", "YAML file of queues and bindings to provision and keep reconciled")
+	rootCmd.PersistentFlags().String("rabbitmq-topology-state-configmap", "cert-webhook-topology", "ConfigMap keeping the last applied topology")
+	rootCmd.PersistentFlags().String("rabbitmq-topology-state-namespace", "", "Namespace of the topology state ConfigMap (unset keeps it in memory only)")
+	rootCmd.PersistentFlags().Int("health-port", 9250, "Health check HTTP port")
+	rootCmd.PersistentFlags().Int("admin-port", 0, "HTTP port of the dead-letter and topology endpoints (0 disables them; requires --admin-token-file)")
+	rootCmd.PersistentFlags().String("admin-token-file", "", "File holding the bearer token required by the admin endpoints (required with --admin-port)")
+	rootCmd.PersistentFlags().Int("workers", 1, "Number of certificates processed concurrently")
+	rootCmd.PersistentFlags().Int("max-attempts", 0, "Attempts per certificate before it is dead-lettered (0 retries forever); use with a durable --dead-letter-destination")
+	rootCmd.PersistentFlags().String("dead-letter-destination", "", "Where dead letters are written in addition to memory: exchange, outbox or configmap")
+	rootCmd.PersistentFlags().String("dead-letter-exchange", "certificate-events.dlx", "Exchange receiving dead letters (exchange and outbox destinations)")
+	rootCmd.PersistentFlags().String("dead-letter-configmap", "cert-webhook-dead-letters", "ConfigMap holding dead letters (configmap destination)")
+	rootCmd.PersistentFlags().String("dead-letter-namespace", "", "Namespace of the dead-letter ConfigMap (configmap destination)")
+
+	_ = viper.BindPFlag("rabbitmq-stream-max-age", rootCmd.PersistentFlags().Lookup("rabbitmq-stream-max-age"))
+	_ = viper.BindPFlag("rabbitmq-stream-max-bytes", rootCmd.PersistentFlags().Lookup("rabbitmq-stream-max-bytes"))
+	_ = viper.BindPFlag("rabbitmq-stream-segment-bytes", rootCmd.PersistentFlags().Lookup("rabbitmq-stream-segment-bytes"))
+	_ = viper.BindPFlag("rabbitmq-topology-file", rootCmd.PersistentFlags().Lookup("rabbitmq-topology-file"))
+	_ = viper.BindPFlag("rabbitmq-topology-state-configmap", rootCmd.PersistentFlags().Lookup("rabbitmq-topology-state-configmap"))
+	_ = viper.BindPFlag("rabbitmq-topology-state-namespace", rootCmd.PersistentFlags().Lookup("rabbitmq-topology-state-namespace"))
 	_ = viper.BindPFlag("health-port", rootCmd.PersistentFlags().Lookup("health-port"))
+	_ = viper.BindPFlag("admin-port", rootCmd.PersistentFlags().Lookup("admin-port"))
+	_ = viper.BindPFlag("admin-token-file", rootCmd.PersistentFlags().Lookup("admin-token-file"))
+	_ = viper.BindPFlag("workers", rootCmd.PersistentFlags().Lookup("workers"))
+	_ = viper.BindPFlag("max-attempts", rootCmd.PersistentFlags().Lookup("max-attempts"))
+	_ = viper.BindPFlag("dead-letter-destination", rootCmd.PersistentFlags().Lookup("dead-letter-destination"))
+	_ = viper.BindPFlag("dead-letter-exchange", rootCmd.PersistentFlags().Lookup("dead-letter-exchange"))
+	_ = viper.BindPFlag("dead-letter-configmap", rootCmd.PersistentFlags().Lookup("dead-letter-configmap"))
+	_ = viper.BindPFlag("dead-letter-namespace", rootCmd.PersistentFlags().Lookup("dead-letter-namespace"))
 
 	viper.SetEnvPrefix("CERT_WEBHOOK")
 	viper.AutomaticEnv()
@@ -93,23 +121,51 @@ func runController(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("failed to create kubernetes clientset: %w", err)
 	}
 
-	rmqURL := viper.GetString("rabbitmq-url")
-	if rmqURL == "" {
-		return fmt.Errorf("--rabbitmq-url is required (set via flag or CERT_WEBHOOK_RABBITMQ_URL env var)")
+	properties, err := cli.PropertyPolicy()
+	if err != nil {
+		return err
 	}
 
-	rabbitmqClient, err := rabbitmq.NewClient(rmqURL)
+	publisher, err := cli.NewPublisher(cli.Config{
+		// The controller declares the stream and owns its retention
+		StreamRetention: &rabbitmq.StreamRetention{
+			MaxAge:              viper.GetDuration("rabbitmq-stream-max-age"),
+			MaxLengthBytes:      viper.GetInt64("rabbitmq-stream-max-bytes"),
+			MaxSegmentSizeBytes: viper.GetInt64("rabbitmq-stream-segment-bytes"),
+		},
+		Logger: logger,
+	})
 	if err != nil {
-		return fmt.Errorf("failed to create RabbitMQ client: %w", err)
+		return err
+	}
+	defer func() { _ = publisher.Close() }()
+
+	deadLetterSink, err := deadLetterSink(clientset, publisher)
+	if err != nil {
+		return err
+	}
+
+	adminToken, err := adminToken()
+	if err != nil {
+		return err
 	}
-	defer func() { _ = rabbitmqClient.Close() }()
 
 	ctrl, err := controller.New(controller.Config{
-		Clientset:      clientset,
-		Config:         config,
-		RabbitMQClient: rabbitmqClient,
-		Logger:         logger,
-		HealthPort:     viper.GetInt("health-port"),
+		Clientset:              clientset,
+		Config:                 config,
+		Publisher:              publisher,
+		MetadataFilter:         cli.MetadataFilter(),
+		PropertyPolicy:         properties,
+		Logger:                 logger,
+		HealthPort:             viper.GetInt("health-port"),
+		AdminPort:              viper.GetInt("admin-port"),
+		AdminToken:             adminToken,
+		Workers:                viper.GetInt("workers"),
+		TopologyFile:           viper.GetString("rabbitmq-topology-file"),
+		TopologyStateNamespace: viper.GetString("rabbitmq-topology-state-namespace"),
+		TopologyStateConfigMap: viper.GetString("rabbitmq-topology-state-configmap"),
+		MaxAttempts:            viper.GetInt("max-attempts"),
+		DeadLetterSink:         deadLetterSink,
 	})
 	if err != nil {
 		return fmt.Errorf("failed to create controller: %w", err)
@@ -130,6 +186,45 @@ func runController(cmd *cobra.Command, args []string) error {
 	return ctrl.Run(ctx)
 }
 
+// deadLetterSink builds the configured dead-letter destination, if any
+func deadLetterSink(clientset kubernetes.Interface, publisher sink.Publisher) (controller.DeadLetterSink, error) {
+	switch destination := viper.GetString("dead-letter-destination"); destination {
+	case "":
+		return nil, nil
+	case "exchange":
+		return controller.NewExchangeDeadLetterSink(publisher, viper.GetString("dead-letter-exchange")), nil
+	case "outbox":
+		rabbitmqClient, ok := sink.As[*rabbitmq.Client](publisher)
+		if !ok {
+			return nil, fmt.Errorf("the outbox dead-letter destination requires the RabbitMQ publisher")
+		}
+		return controller.NewOutboxDeadLetterSink(rabbitmqClient, viper.GetString("dead-letter-exchange"))
+	case "configmap":
+		return controller.NewConfigMapDeadLetterStore(clientset,
+			viper.GetString("dead-letter-namespace"), viper.GetString("dead-letter-configmap"))
+	default:
+		return nil, fmt.Errorf("unsupported dead-letter destination %q (expected exchange, outbox or configmap)", destination)
+	}
+}
+
+// adminToken reads the bearer token of the admin endpoints, if configured
+func adminToken() (string, error) {
+	path := viper.GetString("admin-token-file")
+	if path == "" {
+		return "", nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read admin token file: %w", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("admin token file %s is empty", path)
+	}
+	return token, nil
+}
+
 func main() {
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
@@ -9,7 +9,8 @@ import (
 	"syscall"
 	"time"
 
-	"github.com/rossigee/cert-webhook-system/internal/rabbitmq"
+	"github.com/go-logr/logr"
+	"github.com/rossigee/cert-webhook-system/internal/cli"
 	"github.com/rossigee/cert-webhook-system/internal/webhook"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -47,15 +48,15 @@ var versionCmd = &cobra.Command{
 func init() {
 	rootCmd.AddCommand(versionCmd)
 
-	rootCmd.PersistentFlags().String("kubeconfig", "", "Path to kubeconfig file")
+	cli.AddFlags(rootCmd.PersistentFlags())
+
 	rootCmd.PersistentFlags().Int("port", 8080, "Port to listen on")
-	rootCmd.PersistentFlags().String("rabbitmq-url", "", "RabbitMQ connection URL (required)")
-	rootCmd.PersistentFlags().String("log-level", "info", "Log level (debug, info, warn, error)")
+	rootCmd.PersistentFlags().String("auth-credentials-file", "", "YAML file of the bearer tokens and HMAC secrets allowed to post webhooks, each scoped to namespaces (default unauthenticated)")
+	rootCmd.PersistentFlags().Duration("auth-max-skew", 5*time.Minute, "How far the timestamp of a signed request may be from the current time")
 
-	_ = viper.BindPFlag("kubeconfig", rootCmd.PersistentFlags().Lookup("kubeconfig"))
 	_ = viper.BindPFlag("port", rootCmd.PersistentFlags().Lookup("port"))
-	_ = viper.BindPFlag("rabbitmq-url", rootCmd.PersistentFlags().Lookup("rabbitmq-url"))
-	_ = viper.BindPFlag("log-level", rootCmd.PersistentFlags().Lookup("log-level"))
+	_ = viper.BindPFlag("auth-credentials-file", rootCmd.PersistentFlags().Lookup("auth-credentials-file"))
+	_ = viper.BindPFlag("auth-max-skew", rootCmd.PersistentFlags().Lookup("auth-max-skew"))
 
 	viper.SetEnvPrefix("CERT_WEBHOOK")
 	viper.AutomaticEnv()
@@ -76,11 +77,6 @@ func runWebhook(cmd *cobra.Command, args []string) error {
 		"log-level", viper.GetString("log-level"),
 	)
 
-	rmqURL := viper.GetString("rabbitmq-url")
-	if rmqURL == "" {
-		return fmt.Errorf("rabbitmq-url is required")
-	}
-
 	var config *rest.Config
 	var err error
 
@@ -101,16 +97,29 @@ func runWebhook(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("failed to create kubernetes clientset: %w", err)
 	}
 
-	rabbitmqClient, err := rabbitmq.NewClient(rmqURL)
+	properties, err := cli.PropertyPolicy()
+	if err != nil {
+		return err
+	}
+
+	authenticator, err := newAuthenticator(logger)
 	if err != nil {
-		return fmt.Errorf("failed to create RabbitMQ client: %w", err)
+		return err
 	}
-	defer func() { _ = rabbitmqClient.Close() }()
+
+	publisher, err := cli.NewPublisher(cli.Config{Logger: logger})
+	if err != nil {
+		return err
+	}
+	defer func() { _ = publisher.Close() }()
 
 	handler, err := webhook.New(webhook.Config{
 		Clientset:      clientset,
 		Config:         config,
-		RabbitMQClient: rabbitmqClient,
+		Publisher:      publisher,
+		MetadataFilter: cli.MetadataFilter(),
+		PropertyPolicy: properties,
+		Authenticator:  authenticator,
 		Logger:         logger,
 	})
 	if err != nil {
@@ -154,6 +163,32 @@ func runWebhook(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
+// newAuthenticator creates the authenticator of webhook requests, or nil
+// when no credentials file is configured
+func newAuthenticator(logger logr.Logger) (webhook.Authenticator, error) {
+	path := viper.GetString("auth-credentials-file")
+	if path == "" {
+		logger.Info("Accepting unauthenticated webhook requests; set auth-credentials-file to require credentials")
+		return nil, nil
+	}
+
+	credentials, err := webhook.LoadCredentials(path)
+	if err != nil {
+		return nil, err
+	}
+	authenticator, err := webhook.NewAuthenticator(webhook.AuthConfig{
+		Credentials: credentials,
+		MaxSkew:     viper.GetDuration("auth-max-skew"),
+		Logger:      logger.WithName("auth"),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid credentials file %s: %w", path, err)
+	}
+
+	logger.Info("Authenticating webhook requests", "credentials", len(credentials))
+	return authenticator, nil
+}
+
 func main() {
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
@@ -0,0 +1,29 @@
+package alertmanager
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	alertsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "alertmanager_alerts_total",
+		Help: "Total number of events handled by the Alertmanager sink by result (firing, resolved, ignored, error)",
+	}, []string{"result"})
+
+	firingAlerts = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "alertmanager_firing_alerts",
+		Help: "Number of certificate alerts this instance keeps firing",
+	})
+
+	requestDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "alertmanager_request_duration_seconds",
+		Help:    "Duration of Alertmanager API requests",
+		Buckets: prometheus.DefBuckets,
+	})
+)
+
+func init() {
+	prometheus.MustRegister(alertsTotal)
+	prometheus.MustRegister(firingAlerts)
+	prometheus.MustRegister(requestDuration)
+}
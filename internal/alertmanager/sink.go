@@ -0,0 +1,439 @@
+package alertmanager
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/rossigee/cert-webhook-system/internal/event"
+	"github.com/rossigee/cert-webhook-system/internal/tlsconfig"
+)
+
+const (
+	defaultTimeout        = 10 * time.Second
+	defaultResendInterval = time.Minute
+)
+
+// Problem states of a certificate, each raised as its own alert
+const (
+	StateFailed   = "failed"
+	StateStalled  = "stalled"
+	StateExpiring = "expiring"
+)
+
+// alertNames are the alertname labels of the problem states
+var alertNames = map[string]string{
+	StateFailed:   "CertificateFailed",
+	StateStalled:  "CertificateStalled",
+	StateExpiring: "CertificateExpiring",
+}
+
+// summaries describe the problem states
+var summaries = map[string]string{
+	StateFailed:   "Certificate %s/%s failed",
+	StateStalled:  "Certificate %s/%s is stalled",
+	StateExpiring: "Certificate %s/%s is expiring",
+}
+
+// severities are the severity labels of the problem states
+var severities = map[string]event.Severity{
+	StateFailed:   event.SeverityCritical,
+	StateStalled:  event.SeverityWarning,
+	StateExpiring: event.SeverityWarning,
+}
+
+// Config holds the configuration for the Alertmanager sink
+type Config struct {
+	// URLs are the Alertmanager base URLs. Alerts are posted to each, as
+	// Alertmanager clusters deduplicate them.
+	URLs []string
+	// BearerTokenFile holds a token sent as Authorization: Bearer, read for
+	// every request
+	BearerTokenFile string
+	TLS             tlsconfig.Config
+	// Timeout bounds each request (default 10s)
+	Timeout time.Duration
+
+	// ResendInterval is how often firing alerts are posted again, so that
+	// Alertmanager doesn't resolve them (default 1m). Alerts end four
+	// intervals after they were last posted.
+	ResendInterval time.Duration
+
+	// Labels are added to every alert, e.g. the cluster
+	Labels map[string]string
+	// GeneratorURL links alerts back to a dashboard or runbook
+	GeneratorURL string
+
+	Logger logr.Logger
+}
+
+// Alert is an alert of the Alertmanager v2 API
+type Alert struct {
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+	StartsAt     time.Time         `json:"startsAt,omitzero"`
+	EndsAt       time.Time         `json:"endsAt,omitzero"`
+	GeneratorURL string            `json:"generatorURL,omitempty"`
+}
+
+// Sink raises Alertmanager alerts for failed, stalled and expiring
+// certificates and resolves them when the certificate is renewed
+type Sink struct {
+	client         *http.Client
+	urls           []string
+	tokenFile      string
+	resendInterval time.Duration
+	labels         map[string]string
+	generatorURL   string
+	logger         logr.Logger
+
+	mu     sync.Mutex
+	firing map[string]Alert
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// New creates an Alertmanager sink and starts resending its firing alerts
+func New(config Config) (*Sink, error) {
+	if len(config.URLs) == 0 {
+		return nil, fmt.Errorf("at least one Alertmanager URL is required")
+	}
+	var urls []string
+	for _, rawURL := range config.URLs {
+		parsed, err := url.Parse(rawURL)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return nil, fmt.Errorf("invalid Alertmanager URL %q (expected http:// or https://)", rawURL)
+		}
+		urls = append(urls, strings.TrimSuffix(parsed.String(), "/")+"/api/v2/alerts")
+	}
+	if config.BearerTokenFile != "" {
+		if _, err := readToken(config.BearerTokenFile); err != nil {
+			return nil, err
+		}
+	}
+
+	tlsConfig, err := tlsconfig.New(config.TLS)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	resendInterval := config.ResendInterval
+	if resendInterval <= 0 {
+		resendInterval = defaultResendInterval
+	}
+
+	s := &Sink{
+		client:         &http.Client{Timeout: timeout, Transport: transport},
+		urls:           urls,
+		tokenFile:      config.BearerTokenFile,
+		resendInterval: resendInterval,
+		labels:         config.Labels,
+		generatorURL:   config.GeneratorURL,
+		logger:         config.Logger,
+		firing:         make(map[string]Alert),
+		stop:           make(chan struct{}),
+		done:           make(chan struct{}),
+	}
+	go s.resendLoop()
+	return s, nil
+}
+
+// readToken reads the bearer token file
+func readToken(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read Alertmanager bearer token file: %w", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("Alertmanager bearer token file %s is empty", path)
+	}
+	return token, nil
+}
+
+// Name identifies the publisher in logs and errors
+func (s *Sink) Name() string {
+	return "alertmanager"
+}
+
+// stateOf returns the problem state an event reports, or whether it reports
+// the certificate healthy again and resolves its problems
+func stateOf(eventName string) (state string, resolves bool) {
+	switch {
+	case strings.Contains(eventName, "fail"):
+		return StateFailed, false
+	case strings.Contains(eventName, "stall"):
+		return StateStalled, false
+	case strings.Contains(eventName, "expir"):
+		return StateExpiring, false
+	case strings.Contains(eventName, "renewed") || strings.Contains(eventName, "ready") || strings.Contains(eventName, "issued"):
+		return "", true
+	default:
+		return "", false
+	}
+}
+
+// Publish raises an alert for a failed, stalled or expiring certificate, or
+// resolves the certificate's alerts when it is renewed. Other events are
+// ignored.
+func (s *Sink) Publish(ctx context.Context, exchange, routingKey string, message any, props event.Properties) error {
+	n, err := event.NewNotification(exchange, routingKey, message, props)
+	if err != nil {
+		return err
+	}
+
+	state, resolves := stateOf(n.Event)
+	switch {
+	case state != "":
+		return s.raise(ctx, n, state)
+	case resolves:
+		return s.resolve(ctx, n)
+	default:
+		alertsTotal.WithLabelValues("ignored").Inc()
+		return nil
+	}
+}
+
+// alertKey identifies the alert of a certificate state
+func alertKey(namespace, certificate, state string) string {
+	return namespace + "/" + certificate + "/" + state
+}
+
+// alertLabels returns the labels of a certificate state's alert. They only
+// depend on the certificate and state, so that a renewal can resolve the
+// alert without having seen it raised.
+func (s *Sink) alertLabels(n event.Notification, state string) map[string]string {
+	labels := maps.Clone(s.labels)
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	labels["alertname"] = alertNames[state]
+	labels["namespace"] = n.Message.Namespace
+	labels["certificate"] = n.Message.Certificate
+	labels["severity"] = string(severities[state])
+	if n.Message.Issuer != "" {
+		labels["issuer"] = n.Message.Issuer
+	}
+	if n.Cluster != "" {
+		labels["cluster"] = n.Cluster
+	}
+	return labels
+}
+
+// raise posts a firing alert and keeps resending it until it is resolved
+func (s *Sink) raise(ctx context.Context, n event.Notification, state string) error {
+	now := time.Now()
+	summary := fmt.Sprintf(summaries[state], n.Message.Namespace, n.Message.Certificate)
+	description := n.Error
+	if description == "" {
+		description = "Reported by the " + n.Event + " event"
+	}
+
+	a := Alert{
+		Labels: s.alertLabels(n, state),
+		Annotations: map[string]string{
+			"summary":     summary,
+			"description": description,
+		},
+		StartsAt:     now,
+		GeneratorURL: s.generatorURL,
+	}
+
+	key := alertKey(n.Message.Namespace, n.Message.Certificate, state)
+	s.mu.Lock()
+	if existing, ok := s.firing[key]; ok {
+		// Keep the original start of an alert raised again
+		a.StartsAt = existing.StartsAt
+	}
+	s.firing[key] = a
+	firingAlerts.Set(float64(len(s.firing)))
+	s.mu.Unlock()
+
+	a.EndsAt = now.Add(4 * s.resendInterval)
+	if err := s.post(ctx, []Alert{a}); err != nil {
+		alertsTotal.WithLabelValues("error").Inc()
+		return err
+	}
+	alertsTotal.WithLabelValues("firing").Inc()
+	return nil
+}
+
+// resolve resolves every problem alert of a certificate
+func (s *Sink) resolve(ctx context.Context, n event.Notification) error {
+	now := time.Now()
+	var alerts []Alert
+	var keys []string
+
+	s.mu.Lock()
+	for state := range alertNames {
+		key := alertKey(n.Message.Namespace, n.Message.Certificate, state)
+		keys = append(keys, key)
+		a, ok := s.firing[key]
+		if !ok {
+			// Resolve it anyway, in case it was raised before a restart
+			a = Alert{Labels: s.alertLabels(n, state), StartsAt: now, GeneratorURL: s.generatorURL}
+		}
+		a.EndsAt = now
+		alerts = append(alerts, a)
+	}
+	s.mu.Unlock()
+
+	if err := s.post(ctx, alerts); err != nil {
+		alertsTotal.WithLabelValues("error").Inc()
+		return err
+	}
+
+	s.mu.Lock()
+	for _, key := range keys {
+		delete(s.firing, key)
+	}
+	firingAlerts.Set(float64(len(s.firing)))
+	s.mu.Unlock()
+
+	alertsTotal.WithLabelValues("resolved").Inc()
+	return nil
+}
+
+// resendLoop posts the firing alerts every resend interval
+func (s *Sink) resendLoop() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.resendInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+
+		endsAt := time.Now().Add(4 * s.resendInterval)
+		s.mu.Lock()
+		alerts := make([]Alert, 0, len(s.firing))
+		for _, a := range s.firing {
+			a.EndsAt = endsAt
+			alerts = append(alerts, a)
+		}
+		s.mu.Unlock()
+		if len(alerts) == 0 {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), s.resendInterval)
+		if err := s.post(ctx, alerts); err != nil {
+			s.logger.Error(err, "Failed to resend firing alerts", "alerts", len(alerts))
+		}
+		cancel()
+	}
+}
+
+// post sends alerts to every Alertmanager, succeeding if any accepts them
+func (s *Sink) post(ctx context.Context, alerts []Alert) error {
+	body, err := json.Marshal(alerts)
+	if err != nil {
+		return fmt.Errorf("failed to marshal alerts: %w", err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(s.urls))
+	for i, alertsURL := range s.urls {
+		wg.Go(func() {
+			errs[i] = s.postTo(ctx, alertsURL, body)
+		})
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err == nil {
+			return nil
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// postTo sends alerts to one Alertmanager
+func (s *Sink) postTo(ctx context.Context, alertsURL string, body []byte) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, alertsURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "cert-webhook-system")
+	if s.tokenFile != "" {
+		token, err := readToken(s.tokenFile)
+		if err != nil {
+			return err
+		}
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	start := time.Now()
+	response, err := s.client.Do(request)
+	requestDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+	defer func() { _ = response.Body.Close() }()
+	message, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("Alertmanager %s responded with status %d: %s", request.URL.Host, response.StatusCode, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+// HealthCheck fails when no Alertmanager reports itself healthy
+func (s *Sink) HealthCheck() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	var errs []error
+	for _, alertsURL := range s.urls {
+		healthURL := strings.TrimSuffix(alertsURL, "/api/v2/alerts") + "/-/healthy"
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, healthURL, nil)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		response, err := s.client.Do(request)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		_ = response.Body.Close()
+		if response.StatusCode == http.StatusOK {
+			return nil
+		}
+		errs = append(errs, fmt.Errorf("Alertmanager %s is unhealthy (status %d)", request.URL.Host, response.StatusCode))
+	}
+	return errors.Join(errs...)
+}
+
+// Close stops resending firing alerts. They end in Alertmanager four resend
+// intervals later unless another instance keeps them firing.
+func (s *Sink) Close() error {
+	close(s.stop)
+	<-s.done
+	s.client.CloseIdleConnections()
+	return nil
+}
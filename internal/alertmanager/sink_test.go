@@ -0,0 +1,203 @@
+package alertmanager
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/rossigee/cert-webhook-system/internal/event"
+)
+
+// fakeAlertmanager records the alerts posted to it, keyed by alertname and
+// certificate, like Alertmanager deduplicates them by label set
+type fakeAlertmanager struct {
+	server *httptest.Server
+
+	mu       sync.Mutex
+	alerts   map[string]Alert
+	posts    int
+	auth     string
+	status   int
+	received chan struct{}
+}
+
+func newFakeAlertmanager(t *testing.T) *fakeAlertmanager {
+	t.Helper()
+	am := &fakeAlertmanager{alerts: make(map[string]Alert), status: http.StatusOK, received: make(chan struct{}, 100)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/v2/alerts", func(w http.ResponseWriter, r *http.Request) {
+		var alerts []Alert
+		if err := json.NewDecoder(r.Body).Decode(&alerts); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		am.mu.Lock()
+		defer am.mu.Unlock()
+		am.posts++
+		am.auth = r.Header.Get("Authorization")
+		if am.status != http.StatusOK {
+			w.WriteHeader(am.status)
+			return
+		}
+		for _, a := range alerts {
+			am.alerts[a.Labels["alertname"]+"/"+a.Labels["certificate"]] = a
+		}
+		am.received <- struct{}{}
+	})
+	mux.HandleFunc("GET /-/healthy", func(w http.ResponseWriter, _ *http.Request) {})
+	am.server = httptest.NewServer(mux)
+	t.Cleanup(am.server.Close)
+	return am
+}
+
+func (am *fakeAlertmanager) alert(name string) (Alert, bool) {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	a, ok := am.alerts[name]
+	return a, ok
+}
+
+func newTestSink(t *testing.T, am *fakeAlertmanager, resendInterval time.Duration) *Sink {
+	t.Helper()
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("t0ken\n"), 0o600); err != nil {
+		t.Fatalf("failed to write token: %v", err)
+	}
+
+	s, err := New(Config{
+		URLs:            []string{am.server.URL},
+		BearerTokenFile: tokenFile,
+		ResendInterval:  resendInterval,
+		Labels:          map[string]string{"team": "platform"},
+		Logger:          logr.Discard(),
+	})
+	if err != nil {
+		t.Fatalf("failed to create sink: %v", err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+	return s
+}
+
+func publish(t *testing.T, s *Sink, eventName string, message any) {
+	t.Helper()
+	props := event.Properties{Headers: map[string]string{event.HeaderEvent: eventName}}
+	if err := s.Publish(t.Context(), event.DefaultExchange, eventName, message, props); err != nil {
+		t.Fatalf("failed to publish %s: %v", eventName, err)
+	}
+}
+
+func testMessage() event.Message {
+	return event.Message{Event: "certificate.renewed", Certificate: "api-tls", Namespace: "production", Issuer: "letsencrypt"}
+}
+
+func TestSink_RaiseAndResolve(t *testing.T) {
+	am := newFakeAlertmanager(t)
+	s := newTestSink(t, am, time.Minute)
+
+	if err := s.HealthCheck(); err != nil {
+		t.Errorf("expected healthy sink, got %v", err)
+	}
+
+	letter := map[string]any{
+		"event":   event.PublishFailedEvent,
+		"error":   "broker unreachable",
+		"message": testMessage(),
+	}
+	publish(t, s, event.PublishFailedEvent, letter)
+
+	firing, ok := am.alert("CertificateFailed/api-tls")
+	if !ok {
+		t.Fatal("expected a CertificateFailed alert")
+	}
+	want := map[string]string{
+		"alertname":   "CertificateFailed",
+		"namespace":   "production",
+		"certificate": "api-tls",
+		"issuer":      "letsencrypt",
+		"severity":    "critical",
+		"team":        "platform",
+	}
+	for name, value := range want {
+		if firing.Labels[name] != value {
+			t.Errorf("expected label %s=%q, got %q", name, value, firing.Labels[name])
+		}
+	}
+	if firing.Annotations["description"] != "broker unreachable" || !firing.EndsAt.After(time.Now()) {
+		t.Errorf("unexpected firing alert %+v", firing)
+	}
+	if am.auth != "Bearer t0ken" {
+		t.Errorf("expected the bearer token, got %q", am.auth)
+	}
+
+	// Events that are not about problems are ignored
+	posts := am.posts
+	publish(t, s, "certificate.updated", testMessage())
+	if am.posts != posts {
+		t.Error("expected the event to be ignored")
+	}
+
+	publish(t, s, "certificate.renewed", testMessage())
+	resolved, _ := am.alert("CertificateFailed/api-tls")
+	if resolved.EndsAt.After(time.Now()) || !resolved.StartsAt.Equal(firing.StartsAt) {
+		t.Errorf("expected the alert to be resolved, got %+v", resolved)
+	}
+	if _, ok := am.alert("CertificateExpiring/api-tls"); !ok {
+		t.Error("expected every state of the certificate to be resolved")
+	}
+	if len(s.firing) != 0 {
+		t.Errorf("expected no firing alerts, got %d", len(s.firing))
+	}
+}
+
+func TestSink_ResendFiring(t *testing.T) {
+	am := newFakeAlertmanager(t)
+	s := newTestSink(t, am, 50*time.Millisecond)
+
+	publish(t, s, "certificate.expiring", testMessage())
+	first, _ := am.alert("CertificateExpiring/api-tls")
+	if first.Labels["severity"] != "warning" {
+		t.Errorf("expected a warning, got %q", first.Labels["severity"])
+	}
+
+	// The initial post and two resends
+	for range 3 {
+		select {
+		case <-am.received:
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the firing alert to be resent")
+		}
+	}
+	resent, _ := am.alert("CertificateExpiring/api-tls")
+	if !resent.EndsAt.After(first.EndsAt) || !resent.StartsAt.Equal(first.StartsAt) {
+		t.Errorf("expected a resent alert to be extended, got %+v after %+v", resent, first)
+	}
+}
+
+func TestSink_PublishError(t *testing.T) {
+	am := newFakeAlertmanager(t)
+	am.status = http.StatusBadRequest
+	s := newTestSink(t, am, time.Minute)
+
+	props := event.Properties{Headers: map[string]string{event.HeaderEvent: "certificate.stalled"}}
+	if err := s.Publish(t.Context(), event.DefaultExchange, "certificate.stalled", testMessage(), props); err == nil {
+		t.Error("expected a rejected alert to fail the publish")
+	}
+}
+
+func TestNew_Validation(t *testing.T) {
+	if _, err := New(Config{}); err == nil {
+		t.Error("expected error without URLs")
+	}
+	if _, err := New(Config{URLs: []string{"alertmanager:9093"}}); err == nil {
+		t.Error("expected error for a URL without scheme")
+	}
+	if _, err := New(Config{URLs: []string{"http://alertmanager:9093"}, BearerTokenFile: "/nonexistent"}); err == nil {
+		t.Error("expected error for a missing token file")
+	}
+}
@@ -0,0 +1,171 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"text/template"
+
+	"github.com/rossigee/cert-webhook-system/internal/event"
+	"sigs.k8s.io/yaml"
+)
+
+// Format is the payload format of an incoming webhook
+type Format string
+
+const (
+	// FormatSlack posts {"text": ...} to a Slack incoming webhook, which
+	// Mattermost and Rocket.Chat also accept
+	FormatSlack Format = "slack"
+	// FormatMatrix posts {"text": ...} to a Matrix hookshot generic webhook
+	FormatMatrix Format = "matrix"
+	// FormatTeams posts an Adaptive Card message to a Microsoft Teams
+	// workflow webhook
+	FormatTeams Format = "teams"
+)
+
+// DefaultTemplate renders one line per event
+const DefaultTemplate = `[{{.Severity}}] {{.Event}}: certificate {{.Message.Namespace}}/{{.Message.Certificate}}` +
+	`{{with .Cluster}} in cluster {{.}}{{end}}{{with .Error}} ({{.}}){{end}}`
+
+// Destination is a chat incoming webhook receiving notifications
+type Destination struct {
+	// Name identifies the destination in logs and metrics
+	Name   string `json:"name"`
+	Format Format `json:"format"`
+	// URL is the incoming webhook URL. Such URLs usually embed a token, so
+	// URLFile can be used instead; it is read for every notification, so a
+	// rotated URL is used immediately.
+	URL     string `json:"url,omitempty"`
+	URLFile string `json:"urlFile,omitempty"`
+	// Template is a Go text/template rendering the notification text from
+	// an event.Notification (default DefaultTemplate)
+	Template string `json:"template,omitempty"`
+	// Namespaces are glob patterns the certificate namespace must match
+	// (default all)
+	Namespaces []string `json:"namespaces,omitempty"`
+	// MinSeverity drops events below this severity (default info)
+	MinSeverity event.Severity `json:"minSeverity,omitempty"`
+}
+
+// destinationsFile is the format of the destinations file
+type destinationsFile struct {
+	Destinations []Destination `json:"destinations"`
+}
+
+// LoadDestinations reads and validates a destinations file. Unknown fields
+// are rejected so that typos don't silently drop settings.
+func LoadDestinations(path string) ([]Destination, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chat destinations file: %w", err)
+	}
+
+	var file destinationsFile
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse chat destinations file: %w", err)
+	}
+	if len(file.Destinations) == 0 {
+		return nil, fmt.Errorf("chat destinations file %s lists no destinations", path)
+	}
+	return file.Destinations, nil
+}
+
+// parseTemplate parses the destination's template
+func (d Destination) parseTemplate() (*template.Template, error) {
+	text := d.Template
+	if text == "" {
+		text = DefaultTemplate
+	}
+	return template.New(d.Name).Funcs(event.TemplateFuncs).Parse(text)
+}
+
+// validateDestinations checks names, formats, URLs, severities and templates
+func validateDestinations(destinations []Destination) error {
+	var errs []error
+	names := make(map[string]bool)
+	for i, destination := range destinations {
+		if destination.Name == "" {
+			errs = append(errs, fmt.Errorf("chat destination %d has no name", i))
+		} else if names[destination.Name] {
+			errs = append(errs, fmt.Errorf("chat destination %q is listed twice", destination.Name))
+		}
+		names[destination.Name] = true
+
+		switch destination.Format {
+		case FormatSlack, FormatMatrix, FormatTeams:
+		default:
+			errs = append(errs, fmt.Errorf("chat destination %q has an unsupported format %q (expected slack, matrix or teams)", destination.Name, destination.Format))
+		}
+
+		switch {
+		case destination.URL != "" && destination.URLFile != "":
+			errs = append(errs, fmt.Errorf("chat destination %q sets both url and urlFile", destination.Name))
+		case destination.URL != "":
+			if err := validateURL(destination.URL); err != nil {
+				errs = append(errs, fmt.Errorf("chat destination %q: %w", destination.Name, err))
+			}
+		case destination.URLFile != "":
+			if _, err := readURL(destination.URLFile); err != nil {
+				errs = append(errs, fmt.Errorf("chat destination %q: %w", destination.Name, err))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("chat destination %q has no url or urlFile", destination.Name))
+		}
+
+		if destination.MinSeverity != "" && !destination.MinSeverity.Valid() {
+			errs = append(errs, fmt.Errorf("chat destination %q has an unknown minSeverity %q (expected info, warning or critical)", destination.Name, destination.MinSeverity))
+		}
+		if _, err := destination.parseTemplate(); err != nil {
+			errs = append(errs, fmt.Errorf("chat destination %q has an invalid template: %w", destination.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validateURL checks for an absolute HTTP(S) URL. The URL is not included
+// in errors, as it usually embeds a token.
+func validateURL(rawURL string) error {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("invalid webhook URL (expected http:// or https://)")
+	}
+	return nil
+}
+
+// readURL reads and validates a webhook URL file
+func readURL(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read webhook URL file: %w", err)
+	}
+	rawURL := strings.TrimSpace(string(data))
+	if err := validateURL(rawURL); err != nil {
+		return "", fmt.Errorf("%s: %w", path, err)
+	}
+	return rawURL, nil
+}
+
+// webhookURL returns the destination's webhook URL
+func (d Destination) webhookURL() (string, error) {
+	if d.URLFile != "" {
+		return readURL(d.URLFile)
+	}
+	return d.URL, nil
+}
+
+// matches reports whether a notification is sent to the destination
+func (d Destination) matches(n event.Notification) bool {
+	if !n.Severity.AtLeast(d.MinSeverity) {
+		return false
+	}
+	if len(d.Namespaces) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(d.Namespaces, func(pattern string) bool {
+		return event.GlobMatch(pattern, n.Message.Namespace)
+	})
+}
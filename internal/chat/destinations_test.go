@@ -0,0 +1,86 @@
+package chat
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rossigee/cert-webhook-system/internal/event"
+)
+
+func TestLoadDestinations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chat.yaml")
+	content := `destinations:
+- name: on-call
+  format: slack
+  url: https://hooks.slack.com/services/T0/B0/x
+  namespaces: ["prod-*"]
+  minSeverity: warning
+`
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	destinations, err := LoadDestinations(path)
+	if err != nil {
+		t.Fatalf("failed to load destinations: %v", err)
+	}
+	if len(destinations) != 1 || destinations[0].MinSeverity != event.SeverityWarning || destinations[0].Namespaces[0] != "prod-*" {
+		t.Errorf("unexpected destinations %+v", destinations)
+	}
+	if err := validateDestinations(destinations); err != nil {
+		t.Errorf("expected valid destinations, got %v", err)
+	}
+
+	if err := os.WriteFile(path, []byte("destinations:\n- name: a\n  formt: slack\n"), 0o600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if _, err := LoadDestinations(path); err == nil {
+		t.Error("expected unknown fields to be rejected")
+	}
+}
+
+func TestValidateDestinations(t *testing.T) {
+	tests := []struct {
+		name        string
+		destination Destination
+	}{
+		{"no name", Destination{Format: FormatSlack, URL: "https://example.com"}},
+		{"unknown format", Destination{Name: "a", Format: "irc", URL: "https://example.com"}},
+		{"no URL", Destination{Name: "a", Format: FormatSlack}},
+		{"both URLs", Destination{Name: "a", Format: FormatSlack, URL: "https://example.com", URLFile: "/url"}},
+		{"invalid URL", Destination{Name: "a", Format: FormatSlack, URL: "ftp://example.com"}},
+		{"missing URL file", Destination{Name: "a", Format: FormatSlack, URLFile: "/nonexistent"}},
+		{"unknown severity", Destination{Name: "a", Format: FormatSlack, URL: "https://example.com", MinSeverity: "urgent"}},
+		{"invalid template", Destination{Name: "a", Format: FormatSlack, URL: "https://example.com", Template: "{{.Event"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateDestinations([]Destination{tt.destination}); err == nil {
+				t.Error("expected validation error")
+			}
+		})
+	}
+}
+
+func TestDestination_Matches(t *testing.T) {
+	d := Destination{Namespaces: []string{"prod-*"}, MinSeverity: event.SeverityWarning}
+
+	tests := []struct {
+		namespace string
+		event     string
+		want      bool
+	}{
+		{"prod-web", "certificate.publish-failed", true},
+		{"prod-web", "certificate.expiring", true},
+		{"prod-web", "certificate.renewed", false},
+		{"staging", "certificate.publish-failed", false},
+	}
+	for _, tt := range tests {
+		n := event.Notification{Event: tt.event, Severity: event.SeverityOf(tt.event)}
+		n.Message.Namespace = tt.namespace
+		if got := d.matches(n); got != tt.want {
+			t.Errorf("matches(%s, %s) = %v, want %v", tt.namespace, tt.event, got, tt.want)
+		}
+	}
+}
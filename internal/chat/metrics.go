@@ -0,0 +1,23 @@
+package chat
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	notificationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "chat_notifications_total",
+		Help: "Total number of chat notifications by destination and result (sent, filtered, error)",
+	}, []string{"destination", "result"})
+
+	notificationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "chat_notification_duration_seconds",
+		Help:    "Duration of chat webhook requests by destination",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"destination"})
+)
+
+func init() {
+	prometheus.MustRegister(notificationsTotal)
+	prometheus.MustRegister(notificationDuration)
+}
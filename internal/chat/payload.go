@@ -0,0 +1,50 @@
+package chat
+
+import (
+	"github.com/rossigee/cert-webhook-system/internal/event"
+)
+
+// payload builds the webhook request body of a notification
+func payload(format Format, severity event.Severity, text string) any {
+	switch format {
+	case FormatTeams:
+		return teamsPayload(severity, text)
+	default:
+		// Slack and Matrix hookshot webhooks both take a plain text field
+		return map[string]string{"text": text}
+	}
+}
+
+// teamsPayload wraps the text in an Adaptive Card, the format of Teams
+// workflow webhooks, coloured by severity
+func teamsPayload(severity event.Severity, text string) any {
+	color := "Default"
+	switch severity {
+	case event.SeverityWarning:
+		color = "Warning"
+	case event.SeverityCritical:
+		color = "Attention"
+	}
+
+	return map[string]any{
+		"type": "message",
+		"attachments": []any{
+			map[string]any{
+				"contentType": "application/vnd.microsoft.card.adaptive",
+				"content": map[string]any{
+					"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+					"type":    "AdaptiveCard",
+					"version": "1.4",
+					"body": []any{
+						map[string]any{
+							"type":  "TextBlock",
+							"text":  text,
+							"wrap":  true,
+							"color": color,
+						},
+					},
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,212 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/rossigee/cert-webhook-system/internal/event"
+)
+
+const (
+	defaultTimeout        = 10 * time.Second
+	defaultMaxAttempts    = 3
+	defaultInitialBackoff = time.Second
+)
+
+// Config holds the configuration for the chat sink
+type Config struct {
+	Destinations []Destination
+
+	// Timeout bounds each request (default 10s)
+	Timeout time.Duration
+	// MaxAttempts is the number of requests per notification, including the
+	// first (default 3). Retries start after a second and double.
+	MaxAttempts int
+
+	Logger logr.Logger
+}
+
+// Sink posts human-readable event notifications to chat incoming webhooks
+type Sink struct {
+	client         *http.Client
+	destinations   []*destination
+	maxAttempts    int
+	initialBackoff time.Duration
+	logger         logr.Logger
+}
+
+// destination is a destination with its parsed template
+type destination struct {
+	Destination
+	template *template.Template
+}
+
+// New creates a chat sink
+func New(config Config) (*Sink, error) {
+	if len(config.Destinations) == 0 {
+		return nil, fmt.Errorf("at least one chat destination is required")
+	}
+	if err := validateDestinations(config.Destinations); err != nil {
+		return nil, err
+	}
+
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	s := &Sink{
+		client:         &http.Client{Timeout: timeout},
+		maxAttempts:    config.MaxAttempts,
+		initialBackoff: defaultInitialBackoff,
+		logger:         config.Logger,
+	}
+	if s.maxAttempts <= 0 {
+		s.maxAttempts = defaultMaxAttempts
+	}
+
+	for _, d := range config.Destinations {
+		tmpl, err := d.parseTemplate()
+		if err != nil {
+			return nil, fmt.Errorf("chat destination %q has an invalid template: %w", d.Name, err)
+		}
+		s.destinations = append(s.destinations, &destination{Destination: d, template: tmpl})
+	}
+	return s, nil
+}
+
+// Name identifies the publisher in logs and errors
+func (s *Sink) Name() string {
+	return "chat"
+}
+
+// Publish posts a notification to every matching destination in parallel
+// and fails if any post fails. Events no destination wants are dropped
+// without error: the filters choose what people are told about, not where
+// the event belongs.
+func (s *Sink) Publish(ctx context.Context, exchange, routingKey string, message any, props event.Properties) error {
+	n, err := event.NewNotification(exchange, routingKey, message, props)
+	if err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(s.destinations))
+	for i, d := range s.destinations {
+		if !d.matches(n) {
+			notificationsTotal.WithLabelValues(d.Name, "filtered").Inc()
+			continue
+		}
+		wg.Go(func() {
+			if err := s.notify(ctx, d, n); err != nil {
+				notificationsTotal.WithLabelValues(d.Name, "error").Inc()
+				errs[i] = fmt.Errorf("chat destination %q: %w", d.Name, err)
+				return
+			}
+			notificationsTotal.WithLabelValues(d.Name, "sent").Inc()
+		})
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// notify renders the notification and posts it, retrying failed requests
+func (s *Sink) notify(ctx context.Context, d *destination, n event.Notification) error {
+	var text strings.Builder
+	if err := d.template.Execute(&text, n); err != nil {
+		return fmt.Errorf("failed to render template: %w", err)
+	}
+	body, err := json.Marshal(payload(d.Format, n.Severity, text.String()))
+	if err != nil {
+		return fmt.Errorf("failed to marshal payload: %w", err)
+	}
+
+	var lastErr error
+	for attempt := range s.maxAttempts {
+		if attempt > 0 {
+			timer := time.NewTimer(s.initialBackoff << (attempt - 1))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return fmt.Errorf("%w (last error: %w)", ctx.Err(), lastErr)
+			case <-timer.C:
+			}
+		}
+
+		retry, err := s.post(ctx, d, body)
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+
+		s.logger.Info("Chat notification attempt failed",
+			"destination", d.Name,
+			"attempt", attempt+1,
+			"error", err.Error())
+
+		if !retry {
+			return err
+		}
+	}
+	return lastErr
+}
+
+// post makes a single request, reporting whether a failure may be retried
+func (s *Sink) post(ctx context.Context, d *destination, body []byte) (bool, error) {
+	webhookURL, err := d.webhookURL()
+	if err != nil {
+		return false, err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return false, fmt.Errorf("failed to create request")
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "cert-webhook-system")
+
+	start := time.Now()
+	response, err := s.client.Do(request)
+	notificationDuration.WithLabelValues(d.Name).Observe(time.Since(start).Seconds())
+	if err != nil {
+		// The error includes the URL, and the token in it
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return ctx.Err() == nil, fmt.Errorf("request failed: %w", err)
+	}
+	defer func() { _ = response.Body.Close() }()
+	_, _ = io.Copy(io.Discard, io.LimitReader(response.Body, 64<<10))
+
+	switch code := response.StatusCode; {
+	case code >= 200 && code < 300:
+		return false, nil
+	case code == http.StatusTooManyRequests || code == http.StatusRequestTimeout || code >= 500:
+		return true, fmt.Errorf("webhook responded with status %d", code)
+	default:
+		return false, fmt.Errorf("webhook rejected the notification with status %d", code)
+	}
+}
+
+// HealthCheck always succeeds: chat services are external and a failing
+// webhook should not take the binaries out of service
+func (s *Sink) HealthCheck() error {
+	return nil
+}
+
+// Close releases idle connections
+func (s *Sink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,155 @@
+package chat
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/rossigee/cert-webhook-system/internal/event"
+)
+
+// recorder is a webhook endpoint recording request bodies
+type recorder struct {
+	server *httptest.Server
+	bodies chan []byte
+	status atomic.Int32
+}
+
+func newRecorder(t *testing.T) *recorder {
+	t.Helper()
+	r := &recorder{bodies: make(chan []byte, 10)}
+	r.status.Store(http.StatusOK)
+	r.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		r.bodies <- body
+		w.WriteHeader(int(r.status.Load()))
+	}))
+	t.Cleanup(r.server.Close)
+	return r
+}
+
+func testMessage() event.Message {
+	return event.Message{Event: "certificate.renewed", Certificate: "api-tls", Namespace: "production"}
+}
+
+func testProps() event.Properties {
+	return event.Properties{Headers: map[string]string{
+		event.HeaderEvent:     "certificate.renewed",
+		event.HeaderNamespace: "production",
+		event.HeaderCluster:   "eu-1",
+	}}
+}
+
+func TestSink_PublishFormats(t *testing.T) {
+	slack, teams := newRecorder(t), newRecorder(t)
+
+	urlFile := filepath.Join(t.TempDir(), "url")
+	if err := os.WriteFile(urlFile, []byte(teams.server.URL+"\n"), 0o600); err != nil {
+		t.Fatalf("failed to write URL file: %v", err)
+	}
+
+	s, err := New(Config{
+		Destinations: []Destination{
+			{Name: "slack", Format: FormatSlack, URL: slack.server.URL},
+			{Name: "teams", Format: FormatTeams, URLFile: urlFile, Template: `{{.Message.Certificate}} renewed at {{time .Message.Timestamp}}`},
+		},
+		Logger: logr.Discard(),
+	})
+	if err != nil {
+		t.Fatalf("failed to create sink: %v", err)
+	}
+
+	if err := s.Publish(t.Context(), event.DefaultExchange, event.DefaultRoutingKey, testMessage(), testProps()); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+
+	var slackPayload map[string]string
+	if err := json.Unmarshal(<-slack.bodies, &slackPayload); err != nil {
+		t.Fatalf("invalid Slack payload: %v", err)
+	}
+	if want := "[info] certificate.renewed: certificate production/api-tls in cluster eu-1"; slackPayload["text"] != want {
+		t.Errorf("expected Slack text %q, got %q", want, slackPayload["text"])
+	}
+
+	teamsBody := string(<-teams.bodies)
+	if !strings.Contains(teamsBody, `"application/vnd.microsoft.card.adaptive"`) || !strings.Contains(teamsBody, `"api-tls renewed at 1970-01-01T00:00:00Z"`) {
+		t.Errorf("unexpected Teams payload %s", teamsBody)
+	}
+}
+
+func TestSink_PublishFailureNotice(t *testing.T) {
+	matrix := newRecorder(t)
+	s, err := New(Config{
+		Destinations: []Destination{{Name: "on-call", Format: FormatMatrix, URL: matrix.server.URL, MinSeverity: event.SeverityCritical}},
+		Logger:       logr.Discard(),
+	})
+	if err != nil {
+		t.Fatalf("failed to create sink: %v", err)
+	}
+
+	// Renewals are below the destination's severity
+	if err := s.Publish(t.Context(), event.DefaultExchange, event.DefaultRoutingKey, testMessage(), testProps()); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+
+	letter := map[string]any{
+		"event":    event.PublishFailedEvent,
+		"attempts": 5,
+		"error":    "broker unreachable",
+		"message":  testMessage(),
+	}
+	props := event.Properties{Headers: map[string]string{event.HeaderEvent: event.PublishFailedEvent}}
+	if err := s.Publish(t.Context(), event.DefaultExchange, event.PublishFailedEvent, letter, props); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+
+	var payload map[string]string
+	if err := json.Unmarshal(<-matrix.bodies, &payload); err != nil {
+		t.Fatalf("invalid Matrix payload: %v", err)
+	}
+	if want := "[critical] certificate.publish-failed: certificate production/api-tls (broker unreachable)"; payload["text"] != want {
+		t.Errorf("expected text %q, got %q", want, payload["text"])
+	}
+	if len(matrix.bodies) != 0 {
+		t.Error("expected the renewal to be filtered")
+	}
+}
+
+func TestSink_PublishErrors(t *testing.T) {
+	webhook := newRecorder(t)
+	s, err := New(Config{
+		Destinations: []Destination{{Name: "slack", Format: FormatSlack, URL: webhook.server.URL}},
+		MaxAttempts:  2,
+		Logger:       logr.Discard(),
+	})
+	if err != nil {
+		t.Fatalf("failed to create sink: %v", err)
+	}
+	s.initialBackoff = 0
+
+	webhook.status.Store(http.StatusBadRequest)
+	if err := s.Publish(t.Context(), event.DefaultExchange, event.DefaultRoutingKey, testMessage(), testProps()); err == nil {
+		t.Error("expected a rejected notification to fail")
+	}
+	if len(webhook.bodies) != 1 {
+		t.Errorf("expected a rejected notification not to be retried, got %d requests", len(webhook.bodies))
+	}
+	for len(webhook.bodies) > 0 {
+		<-webhook.bodies
+	}
+
+	webhook.status.Store(http.StatusServiceUnavailable)
+	if err := s.Publish(t.Context(), event.DefaultExchange, event.DefaultRoutingKey, testMessage(), testProps()); err == nil {
+		t.Error("expected an unavailable webhook to fail")
+	}
+	if len(webhook.bodies) != 2 {
+		t.Errorf("expected 2 attempts, got %d", len(webhook.bodies))
+	}
+}
@@ -0,0 +1,168 @@
+// Package cli holds the command-line configuration shared by the controller
+// and the webhook handler: the publisher flags and the construction of the
+// publishers from them
+package cli
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/rossigee/cert-webhook-system/internal/event"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// AddFlags registers the flags shared by both binaries on flags and binds
+// them to viper under their own names
+func AddFlags(flags *pflag.FlagSet) {
+	shared := pflag.NewFlagSet("shared", pflag.ContinueOnError)
+	shared.String("kubeconfig", "", "Path to kubeconfig file")
+	shared.String("publisher", "", "Event publisher: rabbitmq, jetstream, kafka, http, mqtt, redis, chat, smtp, alertmanager or jsonl, or a comma-separated list to publish to several (default inferred from the configured URLs)")
+	shared.String("nats-url", "", "NATS server URL, or comma-separated URLs of cluster nodes (jetstream publisher)")
+	shared.String("nats-credentials-file", "", "NATS credentials file (JWT and NKey seed)")
+	shared.String("nats-stream", "", "JetStream stream created for the event subjects if it does not exist")
+	shared.Duration("nats-publish-timeout", 5*time.Second, "Time to wait for JetStream to acknowledge a published message")
+	shared.StringSlice("kafka-brokers", nil, "Kafka seed brokers, host:port (kafka publisher)")
+	shared.Duration("kafka-produce-timeout", 10*time.Second, "Time to wait for the Kafka delivery report of a published message")
+	shared.Bool("kafka-tls", false, "Connect to Kafka with TLS (implied by the other TLS options)")
+	shared.String("kafka-tls-ca-file", "", "PEM CA bundle trusted for Kafka connections (default system roots)")
+	shared.String("kafka-tls-cert-file", "", "Client certificate for Kafka mutual TLS, reloaded when it changes")
+	shared.String("kafka-tls-key-file", "", "Client private key for Kafka mutual TLS, reloaded when it changes")
+	shared.String("kafka-tls-server-name", "", "Override the server name used to verify the Kafka broker certificates")
+	shared.String("kafka-sasl-mechanism", "", "Kafka SASL mechanism: PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512 (disabled when empty)")
+	shared.String("kafka-sasl-username", "", "Kafka SASL username")
+	shared.String("kafka-sasl-password-file", "", "File holding the Kafka SASL password, re-read on every authentication")
+	shared.String("http-url", "", "URL receiving every event as a signed POST (http publisher)")
+	shared.String("http-secret-file", "", "File holding the HMAC-SHA256 signing secret for --http-url")
+	shared.String("http-destinations-file", "", "YAML file of HTTP destinations with per-target routing (http publisher)")
+	shared.Duration("http-timeout", 10*time.Second, "Timeout of each HTTP delivery request")
+	shared.Int("http-max-attempts", 5, "Requests per HTTP delivery, including the first")
+	shared.Duration("http-initial-backoff", 500*time.Millisecond, "Delay before the first HTTP retry, doubling on each retry")
+	shared.Duration("http-max-backoff", 30*time.Second, "Maximum delay between HTTP retries")
+	shared.Int("http-failure-threshold", 5, "Consecutive failed requests that open a destination's circuit breaker")
+	shared.Duration("http-open-duration", 30*time.Second, "Time an open circuit fails deliveries before a trial request")
+	shared.String("mqtt-url", "", "MQTT broker URL (tcp://, ssl://, ws://, wss://), or comma-separated URLs (mqtt publisher)")
+	shared.String("mqtt-client-id", "", "MQTT client ID, unique per connection (default cert-webhook-<hostname>)")
+	shared.String("mqtt-username", "", "MQTT username")
+	shared.String("mqtt-password-file", "", "File holding the MQTT password, re-read on every connect")
+	shared.String("mqtt-topic-prefix", "certificates", "First level of the MQTT topics events are published to")
+	shared.Uint("mqtt-qos", 1, "MQTT QoS: 0 at most once, 1 at least once, 2 exactly once")
+	shared.Bool("mqtt-retain", true, "Retain the last message of each certificate topic on the broker")
+	shared.Duration("mqtt-publish-timeout", 5*time.Second, "Time to wait for the broker to acknowledge a published MQTT message")
+	shared.String("mqtt-tls-ca-file", "", "PEM CA bundle trusted for ssl:// and wss:// MQTT connections (default system roots)")
+	shared.String("mqtt-tls-cert-file", "", "Client certificate for MQTT mutual TLS, reloaded when it changes")
+	shared.String("mqtt-tls-key-file", "", "Client private key for MQTT mutual TLS, reloaded when it changes")
+	shared.String("mqtt-tls-server-name", "", "Override the server name used to verify the MQTT broker certificate")
+	shared.String("redis-url", "", "Redis URL, redis:// or rediss:// for TLS (redis publisher)")
+	shared.String("redis-password-file", "", "File holding the Redis password, re-read on every connect")
+	shared.String("redis-stream-key", "{exchange}", "Redis stream name; {exchange} and {routing_key} are replaced per event")
+	shared.Int64("redis-max-len", 10000, "Approximate number of entries each Redis stream is trimmed to (0 disables trimming)")
+	shared.Duration("redis-publish-timeout", 5*time.Second, "Time to wait for Redis to acknowledge an XADD")
+	shared.String("redis-tls-ca-file", "", "PEM CA bundle trusted for rediss:// connections (default system roots)")
+	shared.String("redis-tls-cert-file", "", "Client certificate for Redis mutual TLS, reloaded when it changes")
+	shared.String("redis-tls-key-file", "", "Client private key for Redis mutual TLS, reloaded when it changes")
+	shared.String("redis-tls-server-name", "", "Override the server name used to verify the Redis server certificate")
+	shared.String("chat-url", "", "Chat incoming webhook URL receiving a line per event (chat publisher)")
+	shared.String("chat-url-file", "", "File holding the chat incoming webhook URL, re-read for every notification")
+	shared.String("chat-format", "slack", "Payload format of --chat-url: slack, matrix or teams")
+	shared.String("chat-template", "", "Go template of the --chat-url notification text (default one line per event)")
+	shared.String("chat-min-severity", "", "Drop --chat-url notifications below this severity: info, warning or critical")
+	shared.StringSlice("chat-namespaces", nil, "Namespace glob patterns --chat-url notifications are limited to (default all)")
+	shared.String("chat-destinations-file", "", "YAML file of chat destinations with templates and filters (chat publisher)")
+	shared.Duration("chat-timeout", 10*time.Second, "Timeout of each chat webhook request")
+	shared.Int("chat-max-attempts", 3, "Requests per chat notification, including the first")
+	shared.String("smtp-addr", "", "SMTP server host:port emailing event notifications (smtp publisher)")
+	shared.String("smtp-tls-mode", "starttls", "SMTP connection security: starttls, tls (implicit, usually port 465) or none")
+	shared.String("smtp-tls-ca-file", "", "PEM CA bundle trusted for the SMTP server certificate (default system roots)")
+	shared.String("smtp-tls-server-name", "", "Override the server name used to verify the SMTP server certificate")
+	shared.String("smtp-username", "", "SMTP username for PLAIN authentication")
+	shared.String("smtp-password-file", "", "File holding the SMTP password, re-read for every email")
+	shared.String("smtp-from", "", "Sender address of notification emails")
+	shared.StringSlice("smtp-to", nil, "Default recipients of certificates without a notify-email annotation")
+	shared.String("smtp-recipients-file", "", "YAML file of default and per-namespace email recipients")
+	shared.StringSlice("smtp-events", nil, "Event types emailed (default warning and critical events, such as failures)")
+	shared.Duration("smtp-digest-window", 5*time.Minute, "Time events are collected into one email per recipient list (0 emails each event immediately)")
+	shared.String("smtp-subject-template", "", "Go template of the email subject (default names the event or counts the digest)")
+	shared.String("smtp-body-template-file", "", "File holding the Go template of the email body (default lists the events)")
+	shared.Duration("smtp-timeout", 30*time.Second, "Timeout of each SMTP session")
+	shared.StringSlice("alertmanager-url", nil, "Alertmanager base URLs, each sent every alert (alertmanager publisher)")
+	shared.String("alertmanager-bearer-token-file", "", "File holding a bearer token for the Alertmanager API, re-read for every request")
+	shared.String("alertmanager-tls-ca-file", "", "PEM CA bundle trusted for https:// Alertmanager URLs (default system roots)")
+	shared.String("alertmanager-tls-cert-file", "", "Client certificate for Alertmanager mutual TLS, reloaded when it changes")
+	shared.String("alertmanager-tls-key-file", "", "Client private key for Alertmanager mutual TLS, reloaded when it changes")
+	shared.Duration("alertmanager-timeout", 10*time.Second, "Timeout of each Alertmanager API request")
+	shared.Duration("alertmanager-resend-interval", time.Minute, "How often firing certificate alerts are posted again")
+	shared.StringToString("alertmanager-label", nil, "Labels added to every alert (key=value, repeatable)")
+	shared.String("alertmanager-generator-url", "", "URL linked from alerts, e.g. a runbook")
+	shared.String("sinks-file", "", "YAML file listing the publishers events are fanned out to, each with its own filter and policy; replaces --publisher")
+	shared.Duration("sinks-best-effort-timeout", 30*time.Second, "Timeout of each publish to a best-effort sink")
+	shared.Int("sinks-best-effort-max-in-flight", 100, "Publishes to best-effort sinks running at once; further events for them are dropped")
+	shared.String("jsonl-path", "", "File every event and its delivery result is appended to as JSON Lines, or - for stdout; records alongside the publisher, or alone with --publisher=jsonl")
+	shared.Int("jsonl-max-size", 100, "Size in megabytes at which the JSON Lines file is rotated")
+	shared.Int("jsonl-max-age-days", 0, "Days rotated JSON Lines files are kept (0 keeps them forever)")
+	shared.Int("jsonl-max-backups", 0, "Number of rotated JSON Lines files kept (0 keeps all)")
+	shared.Bool("jsonl-compress", true, "Gzip rotated JSON Lines files")
+	shared.String("rabbitmq-url", "", "RabbitMQ connection URL, or comma-separated URLs of cluster nodes (required)")
+	shared.String("rabbitmq-srv", "", "DNS SRV name resolved to the broker nodes; --rabbitmq-url then supplies credentials and vhost")
+	shared.String("rabbitmq-url-file", "", "File holding the RabbitMQ URL(s), replacing --rabbitmq-url; reloaded when it changes")
+	shared.String("rabbitmq-username-file", "", "File holding the RabbitMQ username; reloaded when it changes")
+	shared.String("rabbitmq-password-file", "", "File holding the RabbitMQ password; reloaded when it changes")
+	shared.Duration("rabbitmq-confirm-timeout", 5*time.Second, "Time to wait for the broker to confirm a published message")
+	shared.String("rabbitmq-alternate-exchange", "", "Alternate exchange (and queue) capturing unroutable messages instead of rejecting them")
+	shared.String("rabbitmq-outbox-dir", "", "Directory for the durable local outbox (disabled when empty). Publishes succeed once the event is on disk: events later dropped as unroutable or rejected are dead-lettered by the controller, while the webhook handler only logs them instead of answering 422")
+	shared.Int64("rabbitmq-outbox-max-bytes", 64<<20, "Maximum size of the local outbox before publishes block")
+	shared.Int64("rabbitmq-outbox-segment-bytes", 4<<20, "Size at which a new outbox segment file is started")
+	shared.Int("rabbitmq-outbox-max-attempts", 10, "Broker rejections (404, 403, 406) of an outbox message before it is dropped; transient failures are retried indefinitely")
+	shared.Int("rabbitmq-channel-pool-size", 4, "Number of AMQP channels used for concurrent publishes")
+	shared.String("rabbitmq-exchange-type", "topic", "Type of declared exchanges (topic, headers, direct, fanout)")
+	shared.StringToString("rabbitmq-exchange-arg", nil, "Arguments for declared exchanges (key=value, repeatable)")
+	shared.String("rabbitmq-declare-mode", "declare", "Exchange handling: declare, passive (verify only) or skip")
+	shared.String("rabbitmq-stream", "", "Stream queue every event is also written to for replay, declared by the controller (disabled when empty)")
+	shared.String("rabbitmq-tls-ca-file", "", "PEM CA bundle trusted for amqps:// connections (default system roots)")
+	shared.String("rabbitmq-tls-cert-file", "", "Client certificate for mutual TLS, reloaded when it changes")
+	shared.String("rabbitmq-tls-key-file", "", "Client private key for mutual TLS, reloaded when it changes")
+	shared.String("rabbitmq-tls-server-name", "", "Override the server name used to verify the broker certificate")
+	shared.Bool("rabbitmq-sasl-external", false, "Authenticate with the client certificate (SASL EXTERNAL) instead of URL credentials")
+	shared.String("log-level", "info", "Log level (debug, info, warn, error)")
+	shared.StringSlice("metadata-label-allow", nil, "Glob patterns of labels to include in event metadata (default all)")
+	shared.StringSlice("metadata-label-deny", nil, "Glob patterns of labels to exclude from event metadata")
+	shared.StringSlice("metadata-annotation-allow", nil, "Glob patterns of annotations to include in event metadata (default all)")
+	shared.StringSlice("metadata-annotation-deny", nil, "Glob patterns of annotations to exclude from event metadata")
+	shared.Bool("metadata-hash-values", false, "Hash the values of excluded labels and annotations instead of dropping them")
+	shared.String("cluster-name", "", "Cluster name set in the cluster header of every message")
+	shared.Duration("message-ttl", 0, "Default message expiration (0 never expires)")
+	shared.Uint("message-priority", 0, "Default message priority (0-255)")
+	shared.StringToString("message-header", nil, "Headers added to every message (key=value, repeatable)")
+
+	_ = viper.BindPFlags(shared)
+	flags.AddFlagSet(shared)
+}
+
+// MetadataFilter builds the label/annotation filter from configuration
+func MetadataFilter() *event.MetadataFilter {
+	return &event.MetadataFilter{
+		LabelAllow:      viper.GetStringSlice("metadata-label-allow"),
+		LabelDeny:       viper.GetStringSlice("metadata-label-deny"),
+		AnnotationAllow: viper.GetStringSlice("metadata-annotation-allow"),
+		AnnotationDeny:  viper.GetStringSlice("metadata-annotation-deny"),
+		HashValues:      viper.GetBool("metadata-hash-values"),
+	}
+}
+
+// PropertyPolicy builds the default message properties from configuration
+func PropertyPolicy() (*event.PropertyPolicy, error) {
+	priority := viper.GetUint("message-priority")
+	if priority > 255 {
+		return nil, fmt.Errorf("invalid message priority %d (expected 0-255)", priority)
+	}
+	if viper.GetDuration("message-ttl") < 0 {
+		return nil, fmt.Errorf("invalid message TTL %s", viper.GetDuration("message-ttl"))
+	}
+
+	return &event.PropertyPolicy{
+		Expiration: viper.GetDuration("message-ttl"),
+		Priority:   uint8(priority),
+		Headers:    viper.GetStringMapString("message-header"),
+		Cluster:    viper.GetString("cluster-name"),
+	}, nil
+}
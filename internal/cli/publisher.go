@@ -0,0 +1,551 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"github.com/rossigee/cert-webhook-system/internal/alertmanager"
+	"github.com/rossigee/cert-webhook-system/internal/chat"
+	"github.com/rossigee/cert-webhook-system/internal/dispatch"
+	"github.com/rossigee/cert-webhook-system/internal/email"
+	"github.com/rossigee/cert-webhook-system/internal/event"
+	"github.com/rossigee/cert-webhook-system/internal/httpsink"
+	"github.com/rossigee/cert-webhook-system/internal/jetstream"
+	"github.com/rossigee/cert-webhook-system/internal/jsonl"
+	"github.com/rossigee/cert-webhook-system/internal/kafka"
+	"github.com/rossigee/cert-webhook-system/internal/mqtt"
+	"github.com/rossigee/cert-webhook-system/internal/rabbitmq"
+	"github.com/rossigee/cert-webhook-system/internal/redisstream"
+	"github.com/rossigee/cert-webhook-system/internal/sink"
+	"github.com/rossigee/cert-webhook-system/internal/tlsconfig"
+	"github.com/spf13/viper"
+)
+
+// publisherKind returns the configured publisher, inferring it from the
+// configured URLs when --publisher is not set
+func publisherKind() string {
+	if kind := viper.GetString("publisher"); kind != "" {
+		return kind
+	}
+	if viper.GetString("nats-url") != "" || isNATSURL(viper.GetString("rabbitmq-url")) {
+		return "jetstream"
+	}
+	if len(viper.GetStringSlice("kafka-brokers")) > 0 {
+		return "kafka"
+	}
+	if viper.GetString("http-url") != "" || viper.GetString("http-destinations-file") != "" {
+		return "http"
+	}
+	if viper.GetString("mqtt-url") != "" {
+		return "mqtt"
+	}
+	if viper.GetString("redis-url") != "" {
+		return "redis"
+	}
+	if viper.GetString("chat-url") != "" || viper.GetString("chat-url-file") != "" || viper.GetString("chat-destinations-file") != "" {
+		return "chat"
+	}
+	if viper.GetString("smtp-addr") != "" {
+		return "smtp"
+	}
+	if len(viper.GetStringSlice("alertmanager-url")) > 0 {
+		return "alertmanager"
+	}
+	return "rabbitmq"
+}
+
+// isNATSURL reports whether url uses a NATS scheme
+func isNATSURL(url string) bool {
+	return strings.HasPrefix(url, "nats://") || strings.HasPrefix(url, "tls://")
+}
+
+// sinkRoutes returns the publishers to create, from --sinks-file or else
+// --publisher
+func sinkRoutes() ([]dispatch.Route, error) {
+	if path := viper.GetString("sinks-file"); path != "" {
+		return dispatch.LoadRoutes(path)
+	}
+	var routes []dispatch.Route
+	for kind := range strings.SplitSeq(publisherKind(), ",") {
+		routes = append(routes, dispatch.Route{Publisher: strings.TrimSpace(kind), Policy: dispatch.PolicyRequired})
+	}
+	return routes, nil
+}
+
+// splitList splits a comma-separated flag value, dropping blank entries
+func splitList(value string) []string {
+	var items []string
+	for item := range strings.SplitSeq(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Config configures the publishers created from the flags
+type Config struct {
+	// StreamRetention is set by the binary declaring --rabbitmq-stream; the
+	// others only verify that the stream exists
+	StreamRetention *rabbitmq.StreamRetention
+	Logger          logr.Logger
+}
+
+// NewPublisher creates the configured publishers, fanning events out to
+// them when there are several, and records their events to --jsonl-path
+// when set
+func NewPublisher(config Config) (sink.Publisher, error) {
+	logger := config.Logger
+	routes, err := sinkRoutes()
+	if err != nil {
+		return nil, err
+	}
+
+	// The jsonl publisher writes to --jsonl-path itself
+	var recorder *jsonl.Writer
+	if viper.GetString("jsonl-path") != "" && !slices.ContainsFunc(routes, func(r dispatch.Route) bool { return r.Publisher == "jsonl" }) {
+		if recorder, err = jsonl.NewWriter(jsonlConfig()); err != nil {
+			return nil, err
+		}
+		logger.Info("Recording events as JSON Lines", "path", viper.GetString("jsonl-path"))
+	}
+
+	sinks := make([]dispatch.Sink, 0, len(routes))
+	closeSinks := func() {
+		for _, s := range sinks {
+			_ = s.Publisher.Close()
+		}
+		if recorder != nil {
+			_ = recorder.Close()
+		}
+	}
+	for _, route := range routes {
+		publisher, err := newDestination(route.Publisher, config)
+		if err != nil {
+			closeSinks()
+			return nil, err
+		}
+		if recorder != nil {
+			publisher = jsonl.NewRecorder(publisher, recorder, logger.WithName("jsonl"))
+		}
+		sinks = append(sinks, dispatch.Sink{Publisher: publisher, Policy: route.Policy, Filter: route.Filter})
+	}
+
+	if len(sinks) == 1 && sinks[0].Policy == dispatch.PolicyRequired && sinks[0].Filter.IsZero() {
+		return sinks[0].Publisher, nil
+	}
+	dispatcher, err := dispatch.New(dispatch.Config{
+		Sinks:                 sinks,
+		BestEffortTimeout:     viper.GetDuration("sinks-best-effort-timeout"),
+		MaxBestEffortInFlight: viper.GetInt("sinks-best-effort-max-in-flight"),
+		Logger:                logger.WithName("dispatcher"),
+	})
+	if err != nil {
+		closeSinks()
+		return nil, err
+	}
+
+	logger.Info("Dispatching events to several sinks", "sinks", len(sinks))
+	return dispatcher, nil
+}
+
+// newDestination creates the publisher events are delivered to
+func newDestination(kind string, config Config) (sink.Publisher, error) {
+	logger := config.Logger
+	switch kind {
+	case "jsonl":
+		return newJSONLSink(logger)
+	case "rabbitmq":
+		return newRabbitMQClient(config)
+	case "jetstream":
+		return newJetStreamPublisher(logger)
+	case "kafka":
+		return newKafkaProducer(logger)
+	case "http":
+		return newHTTPSink(logger)
+	case "mqtt":
+		return newMQTTPublisher(logger)
+	case "redis":
+		return newRedisPublisher(logger)
+	case "chat":
+		return newChatSink(logger)
+	case "smtp":
+		return newEmailSink(logger)
+	case "alertmanager":
+		return newAlertmanagerSink(logger)
+	default:
+		return nil, fmt.Errorf("unsupported publisher %q (expected rabbitmq, jetstream, kafka, http, mqtt, redis, chat, smtp, alertmanager or jsonl)", kind)
+	}
+}
+
+// newRabbitMQClient creates the RabbitMQ client from configuration
+func newRabbitMQClient(config Config) (*rabbitmq.Client, error) {
+	logger := config.Logger
+	rmqURL := viper.GetString("rabbitmq-url")
+	if rmqURL == "" && viper.GetString("rabbitmq-srv") == "" && viper.GetString("rabbitmq-url-file") == "" {
+		return nil, fmt.Errorf("--rabbitmq-url or --rabbitmq-url-file is required (set via flag or CERT_WEBHOOK_RABBITMQ_URL env var)")
+	}
+
+	rabbitmqClient, err := rabbitmq.NewClient(rabbitmq.Config{
+		URLs:               splitList(rmqURL),
+		SRVName:            viper.GetString("rabbitmq-srv"),
+		URLFile:            viper.GetString("rabbitmq-url-file"),
+		UsernameFile:       viper.GetString("rabbitmq-username-file"),
+		PasswordFile:       viper.GetString("rabbitmq-password-file"),
+		ConfirmTimeout:     viper.GetDuration("rabbitmq-confirm-timeout"),
+		AlternateExchange:  viper.GetString("rabbitmq-alternate-exchange"),
+		OutboxDir:          viper.GetString("rabbitmq-outbox-dir"),
+		OutboxMaxBytes:     viper.GetInt64("rabbitmq-outbox-max-bytes"),
+		OutboxSegmentBytes: viper.GetInt64("rabbitmq-outbox-segment-bytes"),
+		OutboxMaxAttempts:  viper.GetInt("rabbitmq-outbox-max-attempts"),
+		ChannelPoolSize:    viper.GetInt("rabbitmq-channel-pool-size"),
+		ExchangeType:       viper.GetString("rabbitmq-exchange-type"),
+		ExchangeArguments:  viper.GetStringMapString("rabbitmq-exchange-arg"),
+		DeclareMode:        rabbitmq.DeclareMode(viper.GetString("rabbitmq-declare-mode")),
+		Exchanges:          []string{event.DefaultExchange},
+		Stream:             viper.GetString("rabbitmq-stream"),
+		StreamRetention:    config.StreamRetention,
+		TLSCAFile:          viper.GetString("rabbitmq-tls-ca-file"),
+		TLSCertFile:        viper.GetString("rabbitmq-tls-cert-file"),
+		TLSKeyFile:         viper.GetString("rabbitmq-tls-key-file"),
+		TLSServerName:      viper.GetString("rabbitmq-tls-server-name"),
+		SASLExternal:       viper.GetBool("rabbitmq-sasl-external"),
+		Logger:             logger.WithName("rabbitmq"),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create RabbitMQ client: %w", err)
+	}
+
+	rabbitmqClient.OnStateChange(func(from, to rabbitmq.State) {
+		logger.Info("RabbitMQ connection state changed", "from", from, "to", to, "endpoint", rabbitmqClient.Endpoint())
+	})
+
+	return rabbitmqClient, nil
+}
+
+// newJetStreamPublisher creates the NATS JetStream publisher from configuration
+func newJetStreamPublisher(logger logr.Logger) (*jetstream.Publisher, error) {
+	natsURL := viper.GetString("nats-url")
+	if natsURL == "" && isNATSURL(viper.GetString("rabbitmq-url")) {
+		natsURL = viper.GetString("rabbitmq-url")
+	}
+	if natsURL == "" {
+		return nil, fmt.Errorf("--nats-url is required for the jetstream publisher (set via flag or CERT_WEBHOOK_NATS_URL env var)")
+	}
+
+	publisher, err := jetstream.NewPublisher(jetstream.Config{
+		URL:             natsURL,
+		CredentialsFile: viper.GetString("nats-credentials-file"),
+		PublishTimeout:  viper.GetDuration("nats-publish-timeout"),
+		Stream:          viper.GetString("nats-stream"),
+		Exchanges:       []string{event.DefaultExchange},
+		Logger:          logger.WithName("jetstream"),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create JetStream publisher: %w", err)
+	}
+
+	logger.Info("Publishing events to NATS JetStream", "endpoint", publisher.Endpoint())
+	return publisher, nil
+}
+
+// newKafkaProducer creates the Kafka producer from configuration
+func newKafkaProducer(logger logr.Logger) (*kafka.Producer, error) {
+	brokers := viper.GetStringSlice("kafka-brokers")
+	if len(brokers) == 0 {
+		return nil, fmt.Errorf("--kafka-brokers is required for the kafka publisher (set via flag or CERT_WEBHOOK_KAFKA_BROKERS env var)")
+	}
+
+	producer, err := kafka.NewProducer(kafka.Config{
+		Brokers:        brokers,
+		ProduceTimeout: viper.GetDuration("kafka-produce-timeout"),
+		TLS: tlsconfig.Config{
+			Enabled:    viper.GetBool("kafka-tls"),
+			CAFile:     viper.GetString("kafka-tls-ca-file"),
+			CertFile:   viper.GetString("kafka-tls-cert-file"),
+			KeyFile:    viper.GetString("kafka-tls-key-file"),
+			ServerName: viper.GetString("kafka-tls-server-name"),
+		},
+		SASLMechanism:    viper.GetString("kafka-sasl-mechanism"),
+		SASLUsername:     viper.GetString("kafka-sasl-username"),
+		SASLPasswordFile: viper.GetString("kafka-sasl-password-file"),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Kafka producer: %w", err)
+	}
+
+	logger.Info("Publishing events to Kafka", "brokers", brokers)
+	return producer, nil
+}
+
+// newHTTPSink creates the HTTP sink from configuration
+func newHTTPSink(logger logr.Logger) (*httpsink.Sink, error) {
+	var destinations []httpsink.Destination
+	if path := viper.GetString("http-destinations-file"); path != "" {
+		loaded, err := httpsink.LoadDestinations(path)
+		if err != nil {
+			return nil, err
+		}
+		destinations = loaded
+	}
+	if url := viper.GetString("http-url"); url != "" {
+		destinations = append(destinations, httpsink.Destination{
+			Name:       "default",
+			URL:        url,
+			SecretFile: viper.GetString("http-secret-file"),
+		})
+	}
+	if len(destinations) == 0 {
+		return nil, fmt.Errorf("--http-url or --http-destinations-file is required for the http publisher")
+	}
+
+	httpSink, err := httpsink.New(httpsink.Config{
+		Destinations:     destinations,
+		Timeout:          viper.GetDuration("http-timeout"),
+		MaxAttempts:      viper.GetInt("http-max-attempts"),
+		InitialBackoff:   viper.GetDuration("http-initial-backoff"),
+		MaxBackoff:       viper.GetDuration("http-max-backoff"),
+		FailureThreshold: viper.GetInt("http-failure-threshold"),
+		OpenDuration:     viper.GetDuration("http-open-duration"),
+		Logger:           logger.WithName("http-sink"),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create HTTP sink: %w", err)
+	}
+
+	logger.Info("Publishing events to HTTP destinations", "destinations", len(destinations))
+	return httpSink, nil
+}
+
+// newMQTTPublisher creates the MQTT publisher from configuration
+func newMQTTPublisher(logger logr.Logger) (*mqtt.Publisher, error) {
+	mqttURL := viper.GetString("mqtt-url")
+	if mqttURL == "" {
+		return nil, fmt.Errorf("--mqtt-url is required for the mqtt publisher (set via flag or CERT_WEBHOOK_MQTT_URL env var)")
+	}
+	qos := viper.GetUint("mqtt-qos")
+	if qos > 2 {
+		return nil, fmt.Errorf("invalid MQTT QoS %d (expected 0, 1 or 2)", qos)
+	}
+
+	publisher, err := mqtt.NewPublisher(mqtt.Config{
+		URL:            mqttURL,
+		ClientID:       viper.GetString("mqtt-client-id"),
+		Username:       viper.GetString("mqtt-username"),
+		PasswordFile:   viper.GetString("mqtt-password-file"),
+		TopicPrefix:    viper.GetString("mqtt-topic-prefix"),
+		QoS:            byte(qos),
+		Retain:         viper.GetBool("mqtt-retain"),
+		PublishTimeout: viper.GetDuration("mqtt-publish-timeout"),
+		TLS: tlsconfig.Config{
+			CAFile:     viper.GetString("mqtt-tls-ca-file"),
+			CertFile:   viper.GetString("mqtt-tls-cert-file"),
+			KeyFile:    viper.GetString("mqtt-tls-key-file"),
+			ServerName: viper.GetString("mqtt-tls-server-name"),
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create MQTT publisher: %w", err)
+	}
+
+	logger.Info("Publishing events to MQTT", "topic-prefix", viper.GetString("mqtt-topic-prefix"))
+	return publisher, nil
+}
+
+// newRedisPublisher creates the Redis Streams publisher from configuration
+func newRedisPublisher(logger logr.Logger) (*redisstream.Publisher, error) {
+	redisURL := viper.GetString("redis-url")
+	if redisURL == "" {
+		return nil, fmt.Errorf("--redis-url is required for the redis publisher (set via flag or CERT_WEBHOOK_REDIS_URL env var)")
+	}
+	maxLen := viper.GetInt64("redis-max-len")
+	if maxLen < 0 {
+		return nil, fmt.Errorf("invalid Redis stream max length %d", maxLen)
+	}
+	if maxLen == 0 {
+		// The publisher treats a negative length as unbounded
+		maxLen = -1
+	}
+
+	publisher, err := redisstream.NewPublisher(redisstream.Config{
+		URL:            redisURL,
+		PasswordFile:   viper.GetString("redis-password-file"),
+		StreamKey:      viper.GetString("redis-stream-key"),
+		MaxLen:         maxLen,
+		PublishTimeout: viper.GetDuration("redis-publish-timeout"),
+		TLS: tlsconfig.Config{
+			CAFile:     viper.GetString("redis-tls-ca-file"),
+			CertFile:   viper.GetString("redis-tls-cert-file"),
+			KeyFile:    viper.GetString("redis-tls-key-file"),
+			ServerName: viper.GetString("redis-tls-server-name"),
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Redis publisher: %w", err)
+	}
+
+	logger.Info("Publishing events to Redis streams", "stream-key", viper.GetString("redis-stream-key"), "max-len", viper.GetInt64("redis-max-len"))
+	return publisher, nil
+}
+
+// newChatSink creates the chat sink from configuration
+func newChatSink(logger logr.Logger) (*chat.Sink, error) {
+	var destinations []chat.Destination
+	if path := viper.GetString("chat-destinations-file"); path != "" {
+		loaded, err := chat.LoadDestinations(path)
+		if err != nil {
+			return nil, err
+		}
+		destinations = loaded
+	}
+	if viper.GetString("chat-url") != "" || viper.GetString("chat-url-file") != "" {
+		destinations = append(destinations, chat.Destination{
+			Name:        "default",
+			Format:      chat.Format(viper.GetString("chat-format")),
+			URL:         viper.GetString("chat-url"),
+			URLFile:     viper.GetString("chat-url-file"),
+			Template:    viper.GetString("chat-template"),
+			Namespaces:  viper.GetStringSlice("chat-namespaces"),
+			MinSeverity: event.Severity(viper.GetString("chat-min-severity")),
+		})
+	}
+	if len(destinations) == 0 {
+		return nil, fmt.Errorf("--chat-url, --chat-url-file or --chat-destinations-file is required for the chat publisher")
+	}
+
+	chatSink, err := chat.New(chat.Config{
+		Destinations: destinations,
+		Timeout:      viper.GetDuration("chat-timeout"),
+		MaxAttempts:  viper.GetInt("chat-max-attempts"),
+		Logger:       logger.WithName("chat-sink"),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create chat sink: %w", err)
+	}
+
+	logger.Info("Publishing event notifications to chat", "destinations", len(destinations))
+	return chatSink, nil
+}
+
+// newEmailSink creates the email sink from configuration
+func newEmailSink(logger logr.Logger) (*email.Sink, error) {
+	addr := viper.GetString("smtp-addr")
+	if addr == "" {
+		return nil, fmt.Errorf("--smtp-addr is required for the smtp publisher (set via flag or CERT_WEBHOOK_SMTP_ADDR env var)")
+	}
+	if viper.GetString("smtp-from") == "" {
+		return nil, fmt.Errorf("--smtp-from is required for the smtp publisher (set via flag or CERT_WEBHOOK_SMTP_FROM env var)")
+	}
+
+	var recipients email.RecipientPolicy
+	if path := viper.GetString("smtp-recipients-file"); path != "" {
+		loaded, err := email.LoadRecipientPolicy(path)
+		if err != nil {
+			return nil, err
+		}
+		recipients = loaded
+	}
+	recipients.Default = append(recipients.Default, viper.GetStringSlice("smtp-to")...)
+
+	var bodyTemplate string
+	if path := viper.GetString("smtp-body-template-file"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read email body template: %w", err)
+		}
+		bodyTemplate = string(data)
+	}
+
+	window := viper.GetDuration("smtp-digest-window")
+	if window < 0 {
+		return nil, fmt.Errorf("invalid email digest window %s", window)
+	}
+	if window == 0 {
+		// The sink treats a negative window as sending immediately
+		window = -1
+	}
+
+	emailSink, err := email.New(email.Config{
+		Addr:    addr,
+		TLSMode: viper.GetString("smtp-tls-mode"),
+		TLS: tlsconfig.Config{
+			CAFile:     viper.GetString("smtp-tls-ca-file"),
+			ServerName: viper.GetString("smtp-tls-server-name"),
+		},
+		Username:        viper.GetString("smtp-username"),
+		PasswordFile:    viper.GetString("smtp-password-file"),
+		Timeout:         viper.GetDuration("smtp-timeout"),
+		From:            viper.GetString("smtp-from"),
+		Recipients:      recipients,
+		Events:          viper.GetStringSlice("smtp-events"),
+		DigestWindow:    window,
+		SubjectTemplate: viper.GetString("smtp-subject-template"),
+		BodyTemplate:    bodyTemplate,
+		Logger:          logger.WithName("email-sink"),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create email sink: %w", err)
+	}
+
+	logger.Info("Emailing event notifications", "smtp-addr", addr, "digest-window", viper.GetDuration("smtp-digest-window"))
+	return emailSink, nil
+}
+
+// newAlertmanagerSink creates the Alertmanager sink from configuration
+func newAlertmanagerSink(logger logr.Logger) (*alertmanager.Sink, error) {
+	urls := viper.GetStringSlice("alertmanager-url")
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("--alertmanager-url is required for the alertmanager publisher (set via flag or CERT_WEBHOOK_ALERTMANAGER_URL env var)")
+	}
+
+	alertmanagerSink, err := alertmanager.New(alertmanager.Config{
+		URLs:            urls,
+		BearerTokenFile: viper.GetString("alertmanager-bearer-token-file"),
+		TLS: tlsconfig.Config{
+			CAFile:   viper.GetString("alertmanager-tls-ca-file"),
+			CertFile: viper.GetString("alertmanager-tls-cert-file"),
+			KeyFile:  viper.GetString("alertmanager-tls-key-file"),
+		},
+		Timeout:        viper.GetDuration("alertmanager-timeout"),
+		ResendInterval: viper.GetDuration("alertmanager-resend-interval"),
+		Labels:         viper.GetStringMapString("alertmanager-label"),
+		GeneratorURL:   viper.GetString("alertmanager-generator-url"),
+		Logger:         logger.WithName("alertmanager-sink"),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Alertmanager sink: %w", err)
+	}
+
+	logger.Info("Raising certificate alerts in Alertmanager", "alertmanagers", len(urls))
+	return alertmanagerSink, nil
+}
+
+// jsonlConfig returns the JSON Lines output configuration
+func jsonlConfig() jsonl.Config {
+	return jsonl.Config{
+		Path:       viper.GetString("jsonl-path"),
+		MaxSizeMB:  viper.GetInt("jsonl-max-size"),
+		MaxAgeDays: viper.GetInt("jsonl-max-age-days"),
+		MaxBackups: viper.GetInt("jsonl-max-backups"),
+		Compress:   viper.GetBool("jsonl-compress"),
+	}
+}
+
+// newJSONLSink creates the dry-run publisher, which only records events,
+// to stdout unless --jsonl-path is set
+func newJSONLSink(logger logr.Logger) (*jsonl.Sink, error) {
+	config := jsonlConfig()
+	if config.Path == "" {
+		config.Path = "-"
+	}
+	writer, err := jsonl.NewWriter(config)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("Recording events as JSON Lines without publishing them", "path", config.Path)
+	return jsonl.NewSink(writer), nil
+}
@@ -2,24 +2,32 @@ package controller
 
 import (
 	"context"
+	"crypto/subtle"
+	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	certv1 "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
 	certclient "github.com/cert-manager/cert-manager/pkg/client/clientset/versioned"
+	certscheme "github.com/cert-manager/cert-manager/pkg/client/clientset/versioned/scheme"
 	certinformers "github.com/cert-manager/cert-manager/pkg/client/informers/externalversions"
 	certlisters "github.com/cert-manager/cert-manager/pkg/client/listers/certmanager/v1"
 	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rossigee/cert-webhook-system/internal/event"
-	"github.com/rossigee/cert-webhook-system/internal/rabbitmq"
+	"github.com/rossigee/cert-webhook-system/internal/sink"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/workqueue"
 )
 
@@ -27,9 +35,48 @@ import (
 type Config struct {
 	Clientset      kubernetes.Interface
 	Config         *rest.Config
-	RabbitMQClient *rabbitmq.Client
+	Publisher      sink.Publisher
+	MetadataFilter *event.MetadataFilter
 	Logger         logr.Logger
 	HealthPort     int
+
+	// AdminPort, when set, serves the dead-letter and topology endpoints.
+	// They are kept off the health port, which only serves probes and
+	// metrics.
+	AdminPort int
+	// AdminToken must be presented as a bearer token on every admin
+	// request. It is required with an AdminPort.
+	AdminToken string
+
+	// Workers is the number of certificates processed concurrently (default 1)
+	Workers int
+
+	// Recorder receives Kubernetes events about certificates. When nil, the
+	// controller records events through the Clientset.
+	Recorder record.EventRecorder
+
+	// TopologyFile, when set, is a RabbitMQ topology file (queues and
+	// bindings) reconciled on startup and whenever it changes
+	TopologyFile string
+	// TopologyStateNamespace and TopologyStateConfigMap name the ConfigMap
+	// the last applied topology is kept in, so that bindings removed from
+	// the file while the controller is down are unbound on startup. Without
+	// them the last applied topology is only kept in memory.
+	TopologyStateNamespace string
+	TopologyStateConfigMap string
+
+	// MaxAttempts is how many times a certificate is processed before it is
+	// dead-lettered (0 retries forever). Without a DeadLetterStore, dead
+	// letters are lost on restart.
+	MaxAttempts int
+
+	// DeadLetterSink, when set, receives certificates that exhausted
+	// MaxAttempts in addition to the in-memory dead-letter list
+	DeadLetterSink DeadLetterSink
+
+	// PropertyPolicy supplies the default message expiration, priority and
+	// headers (nil applies none)
+	PropertyPolicy *event.PropertyPolicy
 }
 
 // Controller watches Certificate resources and triggers webhooks
@@ -40,15 +87,31 @@ type Controller struct {
 	certificateLister  certlisters.CertificateLister
 	certificatesSynced cache.InformerSynced
 	workqueue          workqueue.TypedRateLimitingInterface[string]
-	rabbitmqClient     *rabbitmq.Client
+	publisher          sink.Publisher
+	metadataFilter     *event.MetadataFilter
+	propertyPolicy     *event.PropertyPolicy
+	eventBroadcaster   record.EventBroadcaster
+	recorder           record.EventRecorder
 	logger             logr.Logger
 	processedCerts     sync.Map
 	cacheSynced        atomic.Bool
 	healthPort         int
+	adminPort          int
+	adminToken         string
+	workers            int
+	topology           *topologyReconciler
+	maxAttempts        int
+	deadLetterSink     DeadLetterSink
+	deadLettersMu      sync.Mutex
+	deadLetters        map[string]DeadLetter
 }
 
 // New creates a new certificate controller
 func New(config Config) (*Controller, error) {
+	if config.AdminPort != 0 && config.AdminToken == "" {
+		return nil, fmt.Errorf("the admin port requires an admin token")
+	}
+
 	certClient, err := certclient.NewForConfig(config.Config)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create cert-manager client: %w", err)
@@ -62,6 +125,18 @@ func New(config Config) (*Controller, error) {
 		healthPort = 9250
 	}
 
+	workers := config.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+
+	recorder := config.Recorder
+	var eventBroadcaster record.EventBroadcaster
+	if recorder == nil {
+		eventBroadcaster = record.NewBroadcaster()
+		recorder = eventBroadcaster.NewRecorder(certscheme.Scheme, corev1.EventSource{Component: "cert-webhook-controller"})
+	}
+
 	controller := &Controller{
 		clientset:          config.Clientset,
 		certClient:         certClient,
@@ -69,18 +144,45 @@ func New(config Config) (*Controller, error) {
 		certificateLister:  certificateInformer.Lister(),
 		certificatesSynced: certificateInformer.Informer().HasSynced,
 		workqueue:          workqueue.NewTypedRateLimitingQueue(workqueue.DefaultTypedControllerRateLimiter[string]()),
-		rabbitmqClient:     config.RabbitMQClient,
+		publisher:          config.Publisher,
+		metadataFilter:     config.MetadataFilter,
+		propertyPolicy:     config.PropertyPolicy,
+		eventBroadcaster:   eventBroadcaster,
+		recorder:           recorder,
 		logger:             config.Logger,
 		healthPort:         healthPort,
+		adminPort:          config.AdminPort,
+		adminToken:         config.AdminToken,
+		workers:            workers,
+		maxAttempts:        config.MaxAttempts,
+		deadLetterSink:     config.DeadLetterSink,
+		deadLetters:        make(map[string]DeadLetter),
+	}
+
+	if config.TopologyFile != "" {
+		applier, ok := sink.As[topologyApplier](config.Publisher)
+		if !ok {
+			return nil, fmt.Errorf("a topology file requires the RabbitMQ publisher")
+		}
+		controller.topology = &topologyReconciler{path: config.TopologyFile, applier: applier}
+		if config.TopologyStateNamespace != "" && config.TopologyStateConfigMap != "" {
+			controller.topology.state = &topologyState{
+				clientset: config.Clientset,
+				namespace: config.TopologyStateNamespace,
+				name:      config.TopologyStateConfigMap,
+			}
+		}
+	}
+
+	if notifier, ok := sink.As[outboxDropNotifier](config.Publisher); ok {
+		notifier.OnOutboxDrop(controller.outboxDropped)
 	}
 
 	config.Logger.Info("Setting up event handlers")
 
 	_, _ = certificateInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
-		AddFunc: controller.enqueueCertificate,
-		UpdateFunc: func(old, new any) {
-			controller.enqueueCertificate(new)
-		},
+		AddFunc:    controller.enqueueCertificate,
+		UpdateFunc: controller.updateCertificate,
 	})
 
 	return controller, nil
@@ -93,9 +195,24 @@ func (c *Controller) Run(ctx context.Context) error {
 
 	c.logger.Info("Starting certificate webhook controller")
 
+	if c.eventBroadcaster != nil {
+		c.eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{
+			Interface: c.clientset.CoreV1().Events(""),
+		})
+		defer c.eventBroadcaster.Shutdown()
+	}
+
 	// Start health server
 	go c.startHealthServer(ctx)
 
+	if c.adminPort != 0 {
+		go c.startAdminServer(ctx)
+	}
+
+	if c.topology != nil {
+		go c.runTopology(ctx)
+	}
+
 	// Start informer factory
 	c.informerFactory.Start(ctx.Done())
 
@@ -105,8 +222,12 @@ func (c *Controller) Run(ctx context.Context) error {
 	}
 	c.cacheSynced.Store(true)
 
-	c.logger.Info("Starting worker")
-	go wait.UntilWithContext(ctx, c.runWorker, time.Second)
+	c.loadDeadLetters(ctx)
+
+	c.logger.Info("Starting workers", "count", c.workers)
+	for range c.workers {
+		go wait.UntilWithContext(ctx, c.runWorker, time.Second)
+	}
 
 	c.logger.Info("Controller started")
 	<-ctx.Done()
@@ -124,6 +245,8 @@ func (c *Controller) startHealthServer(ctx context.Context) {
 		_, _ = fmt.Fprint(w, "ok")
 	})
 
+	mux.Handle("/metrics", promhttp.Handler())
+
 	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
 		if !c.cacheSynced.Load() {
 			http.Error(w, "cache not synced", http.StatusServiceUnavailable)
@@ -133,9 +256,43 @@ func (c *Controller) startHealthServer(ctx context.Context) {
 		_, _ = fmt.Fprint(w, "ok")
 	})
 
+	c.serve(ctx, "health", c.healthPort, mux)
+}
+
+// startAdminServer runs the HTTP server listing and retrying dead letters
+// and reporting the topology reconciliation
+func (c *Controller) startAdminServer(ctx context.Context) {
+	mux := http.NewServeMux()
+
+	if c.topology != nil {
+		mux.HandleFunc("/topology", c.topologyHandler)
+	}
+
+	mux.HandleFunc("/deadletters", c.deadLettersHandler)
+	mux.HandleFunc("/deadletters/retry", c.deadLettersHandler)
+
+	c.serve(ctx, "admin", c.adminPort, c.requireAdminToken(mux))
+}
+
+// requireAdminToken rejects admin requests without the configured bearer
+// token
+func (c *Controller) requireAdminToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(c.adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serve runs an HTTP server on port until ctx is done
+func (c *Controller) serve(ctx context.Context, name string, port int, handler http.Handler) {
 	server := &http.Server{
-		Addr:              fmt.Sprintf(":%d", c.healthPort),
-		Handler:           mux,
+		Addr:              fmt.Sprintf(":%d", port),
+		Handler:           handler,
 		ReadHeaderTimeout: 5 * time.Second,
 	}
 
@@ -146,9 +303,9 @@ func (c *Controller) startHealthServer(ctx context.Context) {
 		_ = server.Shutdown(shutdownCtx)
 	}()
 
-	c.logger.Info("Starting health server", "port", c.healthPort)
+	c.logger.Info("Starting "+name+" server", "port", port)
 	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		c.logger.Error(err, "Health server error")
+		c.logger.Error(err, "HTTP server error", "server", name)
 	}
 }
 
@@ -171,12 +328,25 @@ func (c *Controller) processNextWorkItem(ctx context.Context) bool {
 		defer c.workqueue.Done(obj)
 		key := obj
 
-		if err := c.syncHandler(ctx, key); err != nil {
+		if c.deadLettered(key) {
+			c.workqueue.Forget(key)
+			return nil
+		}
+
+		if resourceVersion, err := c.syncHandler(ctx, key); err != nil {
+			attempts := c.workqueue.NumRequeues(key) + 1
+			if c.maxAttempts > 0 && attempts >= c.maxAttempts {
+				c.workqueue.Forget(key)
+				c.deadLetter(ctx, key, resourceVersion, attempts, err)
+				return fmt.Errorf("error syncing '%s': %s, dead-lettered after %d attempts", key, err.Error(), attempts)
+			}
+
 			c.workqueue.AddRateLimited(key)
 			return fmt.Errorf("error syncing '%s': %s, requeuing", key, err.Error())
 		}
 
 		c.workqueue.Forget(obj)
+		c.resolveDeadLetter(ctx, key)
 		c.logger.Info("Successfully synced certificate", "key", key)
 		return nil
 	}(obj)
@@ -190,20 +360,21 @@ func (c *Controller) processNextWorkItem(ctx context.Context) bool {
 }
 
 // syncHandler compares the actual state with the desired, and attempts to
-// converge the two
-func (c *Controller) syncHandler(ctx context.Context, key string) error {
+// converge the two. It returns the resource version of the certificate it
+// processed.
+func (c *Controller) syncHandler(ctx context.Context, key string) (string, error) {
 	namespace, name, err := cache.SplitMetaNamespaceKey(key)
 	if err != nil {
 		runtime.HandleError(fmt.Errorf("invalid resource key: %s", key))
-		return nil
+		return "", nil
 	}
 
 	certificate, err := c.certificateLister.Certificates(namespace).Get(name)
 	if err != nil {
-		return fmt.Errorf("error getting certificate %s/%s: %w", namespace, name, err)
+		return "", fmt.Errorf("error getting certificate %s/%s: %w", namespace, name, err)
 	}
 
-	return c.processCertificate(ctx, certificate)
+	return certificate.ResourceVersion, c.processCertificate(ctx, certificate)
 }
 
 // processCertificate processes a certificate and triggers webhook if needed
@@ -239,7 +410,7 @@ func (c *Controller) processCertificate(ctx context.Context, cert *certv1.Certif
 		"resourceVersion", cert.ResourceVersion,
 	)
 
-	if err := c.publishToRabbitMQ(ctx, cert); err != nil {
+	if err := c.publish(ctx, cert); err != nil {
 		c.processedCerts.Delete(processKey)
 		return fmt.Errorf("failed to publish event for certificate %s/%s: %w",
 			cert.Namespace, cert.Name, err)
@@ -248,26 +419,26 @@ func (c *Controller) processCertificate(ctx context.Context, cert *certv1.Certif
 	return nil
 }
 
-// publishToRabbitMQ publishes certificate renewal event to RabbitMQ
-func (c *Controller) publishToRabbitMQ(ctx context.Context, cert *certv1.Certificate) error {
-	if c.rabbitmqClient == nil {
-		return fmt.Errorf("RabbitMQ client not configured")
+// publish publishes the certificate renewal event
+func (c *Controller) publish(ctx context.Context, cert *certv1.Certificate) error {
+	if c.publisher == nil {
+		return fmt.Errorf("publisher not configured")
 	}
 
-	annotations := cert.Annotations
-	if annotations == nil {
-		annotations = make(map[string]string)
-	}
-
-	message := event.NewMessage(cert.Name, cert.Namespace, cert.Spec.SecretName, cert.Labels, annotations)
-	exchange, routingKey := event.ExchangeAndRoutingKey(annotations)
+	message, exchange, routingKey := c.buildMessage(cert)
+	props := c.messageProperties(cert, message)
 
-	if err := c.rabbitmqClient.Publish(ctx, exchange, routingKey, message); err != nil {
-		return fmt.Errorf("failed to publish to RabbitMQ: %w", err)
+	if err := c.publisher.Publish(ctx, exchange, routingKey, message, props); err != nil {
+		if errors.Is(err, sink.ErrUnroutable) {
+			c.recorder.Eventf(cert, corev1.EventTypeWarning, "Unroutable",
+				"No destination is bound to exchange %q for routing key %q", exchange, routingKey)
+		}
+		return fmt.Errorf("failed to publish to %s: %w", c.publisher.Name(), err)
 	}
 
-	c.logger.Info("Published certificate renewal event to RabbitMQ",
+	c.logger.Info("Published certificate renewal event",
 		"certificate", fmt.Sprintf("%s/%s", cert.Namespace, cert.Name),
+		"publisher", c.publisher.Name(),
 		"exchange", exchange,
 		"routing_key", routingKey,
 	)
@@ -275,6 +446,35 @@ func (c *Controller) publishToRabbitMQ(ctx context.Context, cert *certv1.Certifi
 	return nil
 }
 
+// buildMessage builds the renewal event for a certificate and resolves its
+// exchange and routing key
+func (c *Controller) buildMessage(cert *certv1.Certificate) (event.Message, string, string) {
+	annotations := cert.Annotations
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+
+	message := event.NewMessage(cert.Name, cert.Namespace, cert.Spec.SecretName, cert.Labels, annotations)
+	message.Issuer = cert.Spec.IssuerRef.Name
+	c.metadataFilter.Apply(&message)
+	exchange, routingKey := event.ExchangeAndRoutingKey(annotations)
+
+	return message, exchange, routingKey
+}
+
+// messageProperties computes the AMQP properties of a certificate's event.
+// Invalid property annotations fall back to the policy defaults and are
+// reported as a Warning event on the certificate.
+func (c *Controller) messageProperties(cert *certv1.Certificate, message event.Message) event.Properties {
+	props, err := c.propertyPolicy.Properties(message, cert.Annotations)
+	if err != nil {
+		c.recorder.Eventf(cert, corev1.EventTypeWarning, "InvalidAnnotation",
+			"Ignoring invalid message property annotations: %v", err)
+	}
+	props.ID = event.EventID(cert.Namespace, cert.Name, cert.ResourceVersion, message.Event)
+	return props
+}
+
 // enqueueCertificate takes a Certificate resource and converts it into a namespace/name
 // string which is then put onto the work queue
 func (c *Controller) enqueueCertificate(obj any) {
@@ -286,3 +486,15 @@ func (c *Controller) enqueueCertificate(obj any) {
 	}
 	c.workqueue.Add(key)
 }
+
+// updateCertificate enqueues an updated Certificate. Periodic resyncs
+// deliver the unchanged object, which is skipped: enqueuing it would retry a
+// failing certificate early, bypassing the rate limiter's backoff.
+func (c *Controller) updateCertificate(old, new any) {
+	oldCert, okOld := old.(*certv1.Certificate)
+	newCert, okNew := new.(*certv1.Certificate)
+	if okOld && okNew && oldCert.ResourceVersion == newCert.ResourceVersion {
+		return
+	}
+	c.enqueueCertificate(new)
+}
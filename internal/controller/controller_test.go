@@ -18,10 +18,10 @@ func TestNewController(t *testing.T) {
 	config := &rest.Config{}
 
 	ctrl, err := New(Config{
-		Clientset:      clientset,
-		Config:         config,
-		RabbitMQClient: nil,
-		Logger:         logr.Discard(),
+		Clientset: clientset,
+		Config:    config,
+		Publisher: nil,
+		Logger:    logr.Discard(),
 	})
 
 	if err != nil {
@@ -99,10 +99,10 @@ func TestProcessCertificate_ReadyNoRabbitMQ(t *testing.T) {
 	clientset := fake.NewClientset()
 
 	ctrl, err := New(Config{
-		Clientset:      clientset,
-		Config:         &rest.Config{},
-		RabbitMQClient: nil,
-		Logger:         logr.Discard(),
+		Clientset: clientset,
+		Config:    &rest.Config{},
+		Publisher: nil,
+		Logger:    logr.Discard(),
 	})
 	if err != nil {
 		t.Fatalf("Failed to create controller: %v", err)
@@ -146,10 +146,10 @@ func TestProcessCertificate_DeduplicatesEvents(t *testing.T) {
 	clientset := fake.NewClientset()
 
 	ctrl, err := New(Config{
-		Clientset:      clientset,
-		Config:         &rest.Config{},
-		RabbitMQClient: nil,
-		Logger:         logr.Discard(),
+		Clientset: clientset,
+		Config:    &rest.Config{},
+		Publisher: nil,
+		Logger:    logr.Discard(),
 	})
 	if err != nil {
 		t.Fatalf("Failed to create controller: %v", err)
@@ -0,0 +1,440 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rossigee/cert-webhook-system/internal/event"
+	"github.com/rossigee/cert-webhook-system/internal/rabbitmq"
+	"github.com/rossigee/cert-webhook-system/internal/sink"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
+)
+
+var (
+	deadLettersTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "controller_dead_letters_total",
+		Help: "Total number of certificates dead-lettered after exhausting their publish attempts",
+	})
+
+	deadLettersPending = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "controller_dead_letters",
+		Help: "Number of dead-lettered certificates awaiting a retry",
+	})
+
+	deadLetterSinkErrorsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "controller_dead_letter_sink_errors_total",
+		Help: "Total number of dead letters that could not be written to the dead-letter destination",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(deadLettersTotal)
+	prometheus.MustRegister(deadLettersPending)
+	prometheus.MustRegister(deadLetterSinkErrorsTotal)
+}
+
+// DeadLetter is a certificate event that could not be published within the
+// configured number of attempts
+type DeadLetter struct {
+	Event           string        `json:"event"`
+	Key             string        `json:"key"`
+	ResourceVersion string        `json:"resource_version"`
+	Exchange        string        `json:"exchange"`
+	RoutingKey      string        `json:"routing_key"`
+	Attempts        int           `json:"attempts"`
+	Error           string        `json:"error"`
+	FailedAt        time.Time     `json:"failed_at"`
+	Message         event.Message `json:"message"`
+
+	// Properties are the message properties of the dead letter itself
+	Properties event.Properties `json:"-"`
+}
+
+// DeadLetterSink receives dead letters
+type DeadLetterSink interface {
+	Write(ctx context.Context, letter DeadLetter) error
+}
+
+// DeadLetterStore is a DeadLetterSink that can list and remove dead letters,
+// so that they survive controller restarts
+type DeadLetterStore interface {
+	DeadLetterSink
+	List(ctx context.Context) ([]DeadLetter, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// deadLetter records a certificate whose event for resourceVersion exhausted
+// its attempts, emits a Warning event on it and writes it to the dead-letter
+// sink. The dead letter is identified by that resource version, so that it
+// isn't confused with a later revision; its message is rebuilt from the
+// current certificate.
+func (c *Controller) deadLetter(ctx context.Context, key, resourceVersion string, attempts int, cause error) {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return
+	}
+
+	cert, err := c.certificateLister.Certificates(namespace).Get(name)
+	if err != nil {
+		c.logger.Info("Dropping failed certificate that no longer exists", "key", key, "attempts", attempts)
+		return
+	}
+	if resourceVersion == "" {
+		resourceVersion = cert.ResourceVersion
+	}
+
+	message, exchange, routingKey := c.buildMessage(cert)
+	props := c.messageProperties(cert, message)
+	// Dead letters are kept until someone acts on them
+	props.Expiration = 0
+	props.Headers[event.HeaderEvent] = event.PublishFailedEvent
+	props.ID = event.EventID(cert.Namespace, cert.Name, resourceVersion, event.PublishFailedEvent)
+	letter := DeadLetter{
+		Event:           event.PublishFailedEvent,
+		Key:             key,
+		ResourceVersion: resourceVersion,
+		Exchange:        exchange,
+		RoutingKey:      routingKey,
+		Attempts:        attempts,
+		Error:           cause.Error(),
+		FailedAt:        time.Now(),
+		Message:         message,
+		Properties:      props,
+	}
+
+	c.deadLettersMu.Lock()
+	c.deadLetters[key] = letter
+	deadLettersPending.Set(float64(len(c.deadLetters)))
+	c.deadLettersMu.Unlock()
+	deadLettersTotal.Inc()
+
+	c.logger.Error(cause, "Dead-lettering certificate after exhausting publish attempts",
+		"key", key,
+		"attempts", attempts,
+		"exchange", exchange,
+		"routing_key", routingKey,
+	)
+	c.recorder.Eventf(cert, corev1.EventTypeWarning, "PublishFailed",
+		"Renewal event could not be published after %d attempts and was dead-lettered: %v", attempts, cause)
+
+	if c.deadLetterSink != nil {
+		if err := c.deadLetterSink.Write(ctx, letter); err != nil {
+			deadLetterSinkErrorsTotal.Inc()
+			c.logger.Error(err, "Failed to write dead letter", "key", key)
+		}
+	}
+}
+
+// outboxDropNotifier is implemented by publishers that deliver events from a
+// local outbox and report the events they drop as undeliverable
+type outboxDropNotifier interface {
+	OnOutboxDrop(fn func(ctx context.Context, drop rabbitmq.OutboxDrop))
+}
+
+// outboxDropped dead-letters the certificate of an event the outbox relay
+// dropped. Publishing to the outbox succeeds once the event is on disk, so
+// this is where an outbox deployment reports an unroutable event (with an
+// Unroutable Warning event, as a synchronous publish would) or one the
+// broker kept rejecting.
+func (c *Controller) outboxDropped(ctx context.Context, drop rabbitmq.OutboxDrop) {
+	var message event.Message
+	if err := json.Unmarshal(drop.Body, &message); err != nil || message.Namespace == "" || message.Certificate == "" {
+		return
+	}
+	// A dropped dead letter is not dead-lettered again
+	if message.Event == event.PublishFailedEvent {
+		return
+	}
+
+	if errors.Is(drop.Err, sink.ErrUnroutable) {
+		if cert, err := c.certificateLister.Certificates(message.Namespace).Get(message.Certificate); err == nil {
+			c.recorder.Eventf(cert, corev1.EventTypeWarning, "Unroutable",
+				"No destination is bound to exchange %q for routing key %q", drop.Exchange, drop.RoutingKey)
+		}
+	}
+
+	c.deadLetter(ctx, message.Namespace+"/"+message.Certificate,
+		event.ResourceVersionOf(drop.Properties.ID), drop.Attempts, drop.Err)
+}
+
+// deadLettered reports whether the certificate is dead-lettered at its
+// current resource version. It is then skipped until the dead letter is
+// retried or the certificate changes, so it isn't dead-lettered again.
+func (c *Controller) deadLettered(key string) bool {
+	c.deadLettersMu.Lock()
+	letter, ok := c.deadLetters[key]
+	c.deadLettersMu.Unlock()
+	if !ok {
+		return false
+	}
+
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return false
+	}
+	cert, err := c.certificateLister.Certificates(namespace).Get(name)
+	if err != nil {
+		return false
+	}
+	return cert.ResourceVersion == letter.ResourceVersion
+}
+
+// resolveDeadLetter removes a dead letter once its certificate has been
+// processed successfully, e.g. after its annotations were fixed
+func (c *Controller) resolveDeadLetter(ctx context.Context, key string) {
+	c.deadLettersMu.Lock()
+	_, ok := c.deadLetters[key]
+	delete(c.deadLetters, key)
+	deadLettersPending.Set(float64(len(c.deadLetters)))
+	c.deadLettersMu.Unlock()
+
+	if !ok {
+		return
+	}
+	if store, isStore := c.deadLetterSink.(DeadLetterStore); isStore {
+		if err := store.Delete(ctx, key); err != nil {
+			c.logger.Error(err, "Failed to remove dead letter", "key", key)
+		}
+	}
+}
+
+// loadDeadLetters restores dead letters kept by a DeadLetterStore
+func (c *Controller) loadDeadLetters(ctx context.Context) {
+	store, ok := c.deadLetterSink.(DeadLetterStore)
+	if !ok {
+		return
+	}
+
+	letters, err := store.List(ctx)
+	if err != nil {
+		c.logger.Error(err, "Failed to load dead letters")
+		return
+	}
+
+	c.deadLettersMu.Lock()
+	for _, letter := range letters {
+		c.deadLetters[letter.Key] = letter
+	}
+	deadLettersPending.Set(float64(len(c.deadLetters)))
+	c.deadLettersMu.Unlock()
+
+	if len(letters) > 0 {
+		c.logger.Info("Loaded dead-lettered certificates", "count", len(letters))
+	}
+}
+
+// retryDeadLetters re-queues the dead letters with the given keys, or all of
+// them when keys is empty, returning the keys that were re-queued
+func (c *Controller) retryDeadLetters(ctx context.Context, keys []string) []string {
+	c.deadLettersMu.Lock()
+	if len(keys) == 0 {
+		for key := range c.deadLetters {
+			keys = append(keys, key)
+		}
+	}
+
+	retried := []string{}
+	for _, key := range keys {
+		letter, ok := c.deadLetters[key]
+		if !ok {
+			continue
+		}
+		delete(c.deadLetters, key)
+		// A certificate dead-lettered by the outbox relay was already
+		// processed, and would otherwise be skipped as a duplicate
+		c.processedCerts.Delete(key + ":" + letter.ResourceVersion)
+		retried = append(retried, key)
+	}
+	deadLettersPending.Set(float64(len(c.deadLetters)))
+	c.deadLettersMu.Unlock()
+
+	store, _ := c.deadLetterSink.(DeadLetterStore)
+	for _, key := range retried {
+		if store != nil {
+			if err := store.Delete(ctx, key); err != nil {
+				c.logger.Error(err, "Failed to remove dead letter", "key", key)
+			}
+		}
+		c.logger.Info("Retrying dead-lettered certificate", "key", key)
+		c.workqueue.Add(key)
+	}
+
+	sort.Strings(retried)
+	return retried
+}
+
+// deadLettersHandler lists dead letters (GET) or retries them (POST to
+// /deadletters/retry, optionally limited with one or more key parameters)
+func (c *Controller) deadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/deadletters":
+		c.deadLettersMu.Lock()
+		letters := make([]DeadLetter, 0, len(c.deadLetters))
+		for _, letter := range c.deadLetters {
+			letters = append(letters, letter)
+		}
+		c.deadLettersMu.Unlock()
+
+		sort.Slice(letters, func(i, j int) bool { return letters[i].Key < letters[j].Key })
+		_ = json.NewEncoder(w).Encode(map[string]any{"dead_letters": letters})
+
+	case r.Method == http.MethodPost && r.URL.Path == "/deadletters/retry":
+		keys := r.URL.Query()["key"]
+		retried := c.retryDeadLetters(r.Context(), keys)
+		if len(keys) > 0 && len(retried) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(map[string]any{"error": "no dead letter with the given key"})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"retried": retried})
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		_ = json.NewEncoder(w).Encode(map[string]any{"error": "use GET /deadletters or POST /deadletters/retry"})
+	}
+}
+
+// exchangeDeadLetterSink publishes dead letters to an exchange
+type exchangeDeadLetterSink struct {
+	publisher sink.Publisher
+	exchange  string
+}
+
+// NewExchangeDeadLetterSink publishes dead letters to exchange with the
+// routing key certificate.publish-failed
+func NewExchangeDeadLetterSink(publisher sink.Publisher, exchange string) DeadLetterSink {
+	return &exchangeDeadLetterSink{publisher: publisher, exchange: exchange}
+}
+
+// Write implements DeadLetterSink
+func (s *exchangeDeadLetterSink) Write(ctx context.Context, letter DeadLetter) error {
+	return s.publisher.Publish(ctx, s.exchange, event.PublishFailedEvent, letter, letter.Properties)
+}
+
+// outboxDeadLetterSink appends dead letters to the RabbitMQ outbox
+type outboxDeadLetterSink struct {
+	client   *rabbitmq.Client
+	exchange string
+}
+
+// NewOutboxDeadLetterSink appends dead letters for exchange to the client's
+// local outbox, so they are kept even while the broker is unreachable
+func NewOutboxDeadLetterSink(client *rabbitmq.Client, exchange string) (DeadLetterSink, error) {
+	if _, ok := client.OutboxStats(); !ok {
+		return nil, fmt.Errorf("dead-lettering to the outbox requires the RabbitMQ outbox to be enabled")
+	}
+	return &outboxDeadLetterSink{client: client, exchange: exchange}, nil
+}
+
+// Write implements DeadLetterSink
+func (s *outboxDeadLetterSink) Write(ctx context.Context, letter DeadLetter) error {
+	return s.client.Enqueue(ctx, s.exchange, event.PublishFailedEvent, letter, letter.Properties)
+}
+
+// configMapDeadLetterStore keeps dead letters as entries of a ConfigMap
+type configMapDeadLetterStore struct {
+	clientset kubernetes.Interface
+	namespace string
+	name      string
+}
+
+// NewConfigMapDeadLetterStore keeps dead letters in the named ConfigMap,
+// creating it on first use
+func NewConfigMapDeadLetterStore(clientset kubernetes.Interface, namespace, name string) (DeadLetterStore, error) {
+	if namespace == "" || name == "" {
+		return nil, fmt.Errorf("dead-lettering to a ConfigMap requires a namespace and name")
+	}
+	return &configMapDeadLetterStore{clientset: clientset, namespace: namespace, name: name}, nil
+}
+
+// configMapKey converts a namespace/name key into a valid ConfigMap key.
+// Namespaces cannot contain underscores, so the conversion is reversible.
+func configMapKey(key string) string {
+	return strings.Replace(key, "/", "_", 1)
+}
+
+// Write implements DeadLetterSink
+func (s *configMapDeadLetterStore) Write(ctx context.Context, letter DeadLetter) error {
+	value, err := json.Marshal(letter)
+	if err != nil {
+		return fmt.Errorf("failed to marshal dead letter: %w", err)
+	}
+
+	return s.update(ctx, func(data map[string]string) {
+		data[configMapKey(letter.Key)] = string(value)
+	})
+}
+
+// List implements DeadLetterStore
+func (s *configMapDeadLetterStore) List(ctx context.Context) ([]DeadLetter, error) {
+	configMap, err := s.clientset.CoreV1().ConfigMaps(s.namespace).Get(ctx, s.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get dead-letter ConfigMap: %w", err)
+	}
+
+	letters := make([]DeadLetter, 0, len(configMap.Data))
+	for dataKey, value := range configMap.Data {
+		var letter DeadLetter
+		if err := json.Unmarshal([]byte(value), &letter); err != nil {
+			return nil, fmt.Errorf("failed to parse dead letter %s: %w", dataKey, err)
+		}
+		letters = append(letters, letter)
+	}
+	return letters, nil
+}
+
+// Delete implements DeadLetterStore
+func (s *configMapDeadLetterStore) Delete(ctx context.Context, key string) error {
+	return s.update(ctx, func(data map[string]string) {
+		delete(data, configMapKey(key))
+	})
+}
+
+// update applies fn to the ConfigMap data, creating the ConfigMap if needed
+// and retrying on conflicting updates
+func (s *configMapDeadLetterStore) update(ctx context.Context, fn func(map[string]string)) error {
+	configMaps := s.clientset.CoreV1().ConfigMaps(s.namespace)
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		configMap, err := configMaps.Get(ctx, s.name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			configMap = &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: s.name, Namespace: s.namespace},
+				Data:       map[string]string{},
+			}
+			fn(configMap.Data)
+			_, err = configMaps.Create(ctx, configMap, metav1.CreateOptions{})
+			if apierrors.IsAlreadyExists(err) {
+				return apierrors.NewConflict(corev1.Resource("configmaps"), s.name, err)
+			}
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get dead-letter ConfigMap: %w", err)
+		}
+
+		if configMap.Data == nil {
+			configMap.Data = map[string]string{}
+		}
+		fn(configMap.Data)
+		_, err = configMaps.Update(ctx, configMap, metav1.UpdateOptions{})
+		return err
+	})
+}
@@ -0,0 +1,379 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	certv1 "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	cmmeta "github.com/cert-manager/cert-manager/pkg/apis/meta/v1"
+	"github.com/go-logr/logr"
+	"github.com/rossigee/cert-webhook-system/internal/event"
+	"github.com/rossigee/cert-webhook-system/internal/rabbitmq"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
+)
+
+type memoryDeadLetterSink struct {
+	mu      sync.Mutex
+	letters []DeadLetter
+}
+
+func (s *memoryDeadLetterSink) Write(ctx context.Context, letter DeadLetter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.letters = append(s.letters, letter)
+	return nil
+}
+
+func newReadyCertificate() *certv1.Certificate {
+	return &certv1.Certificate{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "test-cert",
+			Namespace:       "default",
+			ResourceVersion: "1",
+			Labels: map[string]string{
+				event.WebhookEnabledLabel: "true",
+			},
+			Annotations: map[string]string{
+				event.AnnotationPrefix + "rabbitmq-exchange": "missing-exchange",
+			},
+		},
+		Spec: certv1.CertificateSpec{
+			SecretName: "test-cert-tls",
+		},
+		Status: certv1.CertificateStatus{
+			Conditions: []certv1.CertificateCondition{
+				{
+					Type:   certv1.CertificateConditionReady,
+					Status: cmmeta.ConditionTrue,
+					Reason: "Ready",
+				},
+			},
+		},
+	}
+}
+
+func TestProcessNextWorkItem_DeadLettersAfterMaxAttempts(t *testing.T) {
+	sink := &memoryDeadLetterSink{}
+	recorder := record.NewFakeRecorder(10)
+
+	ctrl, err := New(Config{
+		Clientset:      fake.NewClientset(),
+		Config:         &rest.Config{},
+		Logger:         logr.Discard(),
+		Recorder:       recorder,
+		MaxAttempts:    2,
+		DeadLetterSink: sink,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create controller: %v", err)
+	}
+
+	cert := newReadyCertificate()
+	_ = ctrl.informerFactory.Certmanager().V1().Certificates().Informer().GetIndexer().Add(cert)
+
+	// Publishing fails because RabbitMQ is not configured
+	ctrl.workqueue.Add("default/test-cert")
+	ctrl.processNextWorkItem(context.Background())
+	if len(sink.letters) != 0 {
+		t.Fatal("expected no dead letter after the first attempt")
+	}
+
+	ctrl.processNextWorkItem(context.Background())
+	if len(sink.letters) != 1 {
+		t.Fatalf("expected 1 dead letter after 2 attempts, got %d", len(sink.letters))
+	}
+
+	letter := sink.letters[0]
+	if letter.Event != event.PublishFailedEvent || letter.Attempts != 2 || letter.Exchange != "missing-exchange" {
+		t.Errorf("unexpected dead letter: %+v", letter)
+	}
+	if ctrl.workqueue.Len() != 0 || ctrl.workqueue.NumRequeues("default/test-cert") != 0 {
+		t.Error("expected dead-lettered key to be dropped from the workqueue")
+	}
+
+	select {
+	case e := <-recorder.Events:
+		if !strings.Contains(e, "PublishFailed") {
+			t.Errorf("expected PublishFailed event, got %q", e)
+		}
+	default:
+		t.Error("expected a Warning event on the certificate")
+	}
+}
+
+func TestProcessNextWorkItem_SkipsDeadLetteredCertificate(t *testing.T) {
+	sink := &memoryDeadLetterSink{}
+	ctrl, err := New(Config{
+		Clientset:      fake.NewClientset(),
+		Config:         &rest.Config{},
+		Logger:         logr.Discard(),
+		Recorder:       record.NewFakeRecorder(10),
+		MaxAttempts:    1,
+		DeadLetterSink: sink,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create controller: %v", err)
+	}
+
+	cert := newReadyCertificate()
+	indexer := ctrl.informerFactory.Certmanager().V1().Certificates().Informer().GetIndexer()
+	_ = indexer.Add(cert)
+	ctrl.workqueue.Add("default/test-cert")
+	ctrl.processNextWorkItem(context.Background())
+	if len(sink.letters) != 1 {
+		t.Fatalf("expected 1 dead letter, got %d", len(sink.letters))
+	}
+
+	// A resync delivers the unchanged certificate, which isn't enqueued
+	ctrl.updateCertificate(cert, cert)
+	if ctrl.workqueue.Len() != 0 {
+		t.Error("expected a resync of an unchanged certificate not to be enqueued")
+	}
+
+	// The key is enqueued again, e.g. on restart, but not dead-lettered again
+	ctrl.workqueue.Add("default/test-cert")
+	ctrl.processNextWorkItem(context.Background())
+	if len(sink.letters) != 1 {
+		t.Errorf("expected the dead-lettered certificate to be skipped, got %d dead letters", len(sink.letters))
+	}
+	if len(ctrl.deadLetters) != 1 {
+		t.Error("expected the dead letter to be kept")
+	}
+
+	// A changed certificate is processed again
+	updated := cert.DeepCopy()
+	updated.ResourceVersion = "2"
+	_ = indexer.Update(updated)
+	ctrl.updateCertificate(cert, updated)
+	ctrl.processNextWorkItem(context.Background())
+	if len(sink.letters) != 2 || sink.letters[1].ResourceVersion != "2" {
+		t.Errorf("expected the changed certificate to be processed, got %+v", sink.letters)
+	}
+}
+
+func TestDeadLettersHandler(t *testing.T) {
+	ctrl, err := New(Config{
+		Clientset:   fake.NewClientset(),
+		Config:      &rest.Config{},
+		Logger:      logr.Discard(),
+		Recorder:    record.NewFakeRecorder(10),
+		MaxAttempts: 1,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create controller: %v", err)
+	}
+
+	_ = ctrl.informerFactory.Certmanager().V1().Certificates().Informer().GetIndexer().Add(newReadyCertificate())
+	ctrl.workqueue.Add("default/test-cert")
+	ctrl.processNextWorkItem(context.Background())
+
+	rec := httptest.NewRecorder()
+	ctrl.deadLettersHandler(rec, httptest.NewRequest(http.MethodGet, "/deadletters", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"key":"default/test-cert"`) {
+		t.Fatalf("expected dead letter in listing, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	ctrl.deadLettersHandler(rec, httptest.NewRequest(http.MethodPost, "/deadletters/retry?key=default/other", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown key, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	ctrl.deadLettersHandler(rec, httptest.NewRequest(http.MethodPost, "/deadletters/retry?key=default/test-cert", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "default/test-cert") {
+		t.Fatalf("expected retry to succeed, got %d %s", rec.Code, rec.Body.String())
+	}
+	if ctrl.workqueue.Len() != 1 {
+		t.Errorf("expected retried key to be queued, queue length %d", ctrl.workqueue.Len())
+	}
+	if len(ctrl.deadLetters) != 0 {
+		t.Error("expected retried dead letter to be removed")
+	}
+}
+
+func TestConfigMapDeadLetterStore(t *testing.T) {
+	ctx := context.Background()
+	clientset := fake.NewClientset()
+
+	store, err := NewConfigMapDeadLetterStore(clientset, "cert-webhook", "dead-letters")
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+
+	for _, key := range []string{"default/a", "default/b"} {
+		if err := store.Write(ctx, DeadLetter{Key: key, Attempts: 3}); err != nil {
+			t.Fatalf("failed to write dead letter: %v", err)
+		}
+	}
+
+	configMap, err := clientset.CoreV1().ConfigMaps("cert-webhook").Get(ctx, "dead-letters", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("expected ConfigMap to be created: %v", err)
+	}
+	if _, ok := configMap.Data["default_a"]; !ok {
+		t.Errorf("expected entry default_a, got keys %v", configMap.Data)
+	}
+
+	if err := store.Delete(ctx, "default/a"); err != nil {
+		t.Fatalf("failed to delete dead letter: %v", err)
+	}
+
+	letters, err := store.List(ctx)
+	if err != nil {
+		t.Fatalf("failed to list dead letters: %v", err)
+	}
+	if len(letters) != 1 || letters[0].Key != "default/b" || letters[0].Attempts != 3 {
+		t.Errorf("unexpected dead letters: %+v", letters)
+	}
+
+	if _, err := NewConfigMapDeadLetterStore(clientset, "", "dead-letters"); err == nil {
+		t.Error("expected error without a namespace")
+	}
+}
+
+type outboxPublisher struct {
+	fakeBroker
+	onDrop func(ctx context.Context, drop rabbitmq.OutboxDrop)
+}
+
+func (p *outboxPublisher) OnOutboxDrop(fn func(ctx context.Context, drop rabbitmq.OutboxDrop)) {
+	p.onDrop = fn
+}
+
+func TestOutboxDropped_DeadLettersCertificate(t *testing.T) {
+	sink := &memoryDeadLetterSink{}
+	recorder := record.NewFakeRecorder(10)
+	publisher := &outboxPublisher{}
+
+	ctrl, err := New(Config{
+		Clientset:      fake.NewClientset(),
+		Config:         &rest.Config{},
+		Publisher:      publisher,
+		Logger:         logr.Discard(),
+		Recorder:       recorder,
+		DeadLetterSink: sink,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create controller: %v", err)
+	}
+	if publisher.onDrop == nil {
+		t.Fatal("expected the controller to register for outbox drops")
+	}
+
+	cert := newReadyCertificate()
+	_ = ctrl.informerFactory.Certmanager().V1().Certificates().Informer().GetIndexer().Add(cert)
+	// The event was accepted into the outbox, so the certificate counts as processed
+	ctrl.processedCerts.Store("default/test-cert:1", true)
+
+	message, exchange, routingKey := ctrl.buildMessage(cert)
+	body, _ := json.Marshal(message)
+	publisher.onDrop(context.Background(), rabbitmq.OutboxDrop{
+		Exchange:   exchange,
+		RoutingKey: routingKey,
+		Body:       body,
+		Properties: event.Properties{ID: event.EventID(cert.Namespace, cert.Name, "1", message.Event)},
+		Reason:     "unroutable",
+		Attempts:   1,
+		Err:        &rabbitmq.ReturnError{Exchange: exchange, RoutingKey: routingKey, ReplyCode: 312, ReplyText: "NO_ROUTE"},
+	})
+
+	if len(sink.letters) != 1 || sink.letters[0].Key != "default/test-cert" {
+		t.Fatalf("expected the certificate to be dead-lettered, got %+v", sink.letters)
+	}
+	var events []string
+	for len(recorder.Events) > 0 {
+		events = append(events, <-recorder.Events)
+	}
+	if len(events) != 2 || !strings.Contains(events[0], "Unroutable") || !strings.Contains(events[1], "PublishFailed") {
+		t.Errorf("expected Unroutable and PublishFailed events, got %v", events)
+	}
+
+	// A dropped dead letter is not dead-lettered again
+	letter, _ := json.Marshal(sink.letters[0])
+	publisher.onDrop(context.Background(), rabbitmq.OutboxDrop{Body: letter, Reason: "unroutable", Err: rabbitmq.ErrUnroutable})
+	if len(sink.letters) != 1 {
+		t.Errorf("expected the dead letter not to be dead-lettered, got %d letters", len(sink.letters))
+	}
+
+	// A drop of an older revision is recorded against that revision, so that
+	// the current one is still processed
+	renewed := cert.DeepCopy()
+	renewed.ResourceVersion = "2"
+	_ = ctrl.informerFactory.Certmanager().V1().Certificates().Informer().GetIndexer().Update(renewed)
+	ctrl.outboxDropped(context.Background(), rabbitmq.OutboxDrop{
+		Body:       body,
+		Properties: event.Properties{ID: event.EventID(cert.Namespace, cert.Name, "1", message.Event)},
+		Err:        errors.New("rejected"),
+	})
+	if letter := sink.letters[len(sink.letters)-1]; letter.ResourceVersion != "1" {
+		t.Errorf("expected the dead letter of revision 1, got %q", letter.ResourceVersion)
+	}
+	if ctrl.deadLettered("default/test-cert") {
+		t.Error("expected the renewed certificate not to be skipped")
+	}
+	_ = ctrl.informerFactory.Certmanager().V1().Certificates().Informer().GetIndexer().Update(cert)
+
+	// Retrying publishes the event again
+	ctrl.retryDeadLetters(context.Background(), nil)
+	if _, ok := ctrl.processedCerts.Load("default/test-cert:1"); ok {
+		t.Error("expected the retry to clear the processed marker")
+	}
+}
+
+func TestNew_AdminPortRequiresToken(t *testing.T) {
+	config := Config{
+		Clientset: fake.NewClientset(),
+		Config:    &rest.Config{},
+		Logger:    logr.Discard(),
+		AdminPort: 9251,
+	}
+	if _, err := New(config); err == nil {
+		t.Error("expected an admin port without a token to be refused")
+	}
+
+	config.AdminToken = "secret"
+	if _, err := New(config); err != nil {
+		t.Errorf("expected the admin port with a token to be accepted, got %v", err)
+	}
+}
+
+func TestRequireAdminToken(t *testing.T) {
+	ctrl := &Controller{adminToken: "secret"}
+	handler := ctrl.requireAdminToken(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name          string
+		authorization string
+		want          int
+	}{
+		{"missing", "", http.StatusUnauthorized},
+		{"wrong token", "Bearer other", http.StatusUnauthorized},
+		{"wrong scheme", "Basic secret", http.StatusUnauthorized},
+		{"valid", "Bearer secret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/deadletters/retry", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("expected %d, got %d", tt.want, rec.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,243 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rossigee/cert-webhook-system/internal/rabbitmq"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// topologyResyncInterval is how often the topology is re-applied even when
+// the file has not changed, to retry failures and pick up drift
+const topologyResyncInterval = 5 * time.Minute
+
+// topologyApplier is implemented by publishers that can provision a
+// RabbitMQ topology
+type topologyApplier interface {
+	ApplyTopology(topology, previous *rabbitmq.Topology) (*rabbitmq.TopologyReport, error)
+}
+
+// topologyStateKey is the ConfigMap key holding the last applied topology
+const topologyStateKey = "topology.yaml"
+
+// topologyReconciler applies the RabbitMQ topology file on startup, whenever
+// the file changes and periodically
+type topologyReconciler struct {
+	mu       sync.Mutex
+	path     string
+	applier  topologyApplier
+	state    *topologyState
+	content  []byte
+	applied  *rabbitmq.Topology
+	report   *rabbitmq.TopologyReport
+	lastErr  error
+	attempts int
+	// restored is set once the last applied topology was read from state
+	restored bool
+}
+
+// topologyState keeps the last applied topology file in a ConfigMap, so
+// that bindings removed from the file while the controller was not running
+// are still unbound
+type topologyState struct {
+	clientset kubernetes.Interface
+	namespace string
+	name      string
+}
+
+// load returns the last applied topology file, or nil if none was saved
+func (s *topologyState) load(ctx context.Context) ([]byte, error) {
+	configMap, err := s.clientset.CoreV1().ConfigMaps(s.namespace).Get(ctx, s.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get topology state ConfigMap: %w", err)
+	}
+	content, ok := configMap.Data[topologyStateKey]
+	if !ok {
+		return nil, nil
+	}
+	return []byte(content), nil
+}
+
+// save records content as the last applied topology file
+func (s *topologyState) save(ctx context.Context, content []byte) error {
+	configMaps := s.clientset.CoreV1().ConfigMaps(s.namespace)
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		configMap, err := configMaps.Get(ctx, s.name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			configMap = &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: s.name, Namespace: s.namespace},
+				Data:       map[string]string{topologyStateKey: string(content)},
+			}
+			_, err = configMaps.Create(ctx, configMap, metav1.CreateOptions{})
+			if apierrors.IsAlreadyExists(err) {
+				return apierrors.NewConflict(corev1.Resource("configmaps"), s.name, err)
+			}
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get topology state ConfigMap: %w", err)
+		}
+
+		if configMap.Data == nil {
+			configMap.Data = map[string]string{}
+		}
+		configMap.Data[topologyStateKey] = string(content)
+		_, err = configMaps.Update(ctx, configMap, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// runTopology reconciles the topology file until ctx is cancelled
+func (c *Controller) runTopology(ctx context.Context) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		c.logger.Error(err, "Failed to watch topology file, changes require a restart")
+	} else {
+		defer func() { _ = watcher.Close() }()
+		// Watch the directory rather than the file, so that atomic
+		// replacements (such as ConfigMap updates) are noticed
+		if err := watcher.Add(filepath.Dir(c.topology.path)); err != nil {
+			c.logger.Error(err, "Failed to watch topology file, changes require a restart")
+		}
+	}
+
+	c.reconcileTopology(ctx, false)
+
+	ticker := time.NewTicker(topologyResyncInterval)
+	defer ticker.Stop()
+
+	var events <-chan fsnotify.Event
+	var errs <-chan error
+	if watcher != nil {
+		events = watcher.Events
+		errs = watcher.Errors
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-events:
+			c.reconcileTopology(ctx, true)
+		case err := <-errs:
+			c.logger.Error(err, "Topology file watch error")
+		case <-ticker.C:
+			c.reconcileTopology(ctx, false)
+		}
+	}
+}
+
+// reconcileTopology loads and applies the topology file. With onlyIfChanged,
+// nothing is done unless the file content differs from the last applied one.
+func (c *Controller) reconcileTopology(ctx context.Context, onlyIfChanged bool) {
+	t := c.topology
+
+	content, err := os.ReadFile(t.path)
+	if err != nil {
+		c.logger.Error(err, "Failed to read topology file", "path", t.path)
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if onlyIfChanged && t.lastErr == nil && bytes.Equal(content, t.content) {
+		return
+	}
+
+	topology, err := rabbitmq.ParseTopology(content)
+	if err != nil {
+		t.lastErr = err
+		c.logger.Error(err, "Invalid topology file, keeping the previous topology", "path", t.path)
+		return
+	}
+
+	if t.state != nil && !t.restored {
+		// Applying without the previous topology would forget the bindings
+		// to remove, so wait until it can be read
+		previous, err := t.state.load(ctx)
+		if err != nil {
+			t.lastErr = err
+			c.logger.Error(err, "Failed to read the last applied topology, will retry")
+			return
+		}
+		if previous != nil {
+			if t.applied, err = rabbitmq.ParseTopology(previous); err != nil {
+				c.logger.Error(err, "Ignoring invalid last applied topology")
+			}
+		}
+		t.restored = true
+	}
+
+	report, err := t.applier.ApplyTopology(topology, t.applied)
+	t.attempts++
+	t.lastErr = err
+	if report != nil {
+		t.report = report
+		// Bindings that failed to apply are still remembered, so that they
+		// are removed if they are later dropped from the file
+		t.applied = topology
+		t.content = content
+		if t.state != nil {
+			if err := t.state.save(ctx, content); err != nil {
+				c.logger.Error(err, "Failed to save the applied topology")
+			}
+		}
+	}
+
+	if err != nil {
+		c.logger.Error(err, "Failed to reconcile RabbitMQ topology", "path", t.path)
+	}
+	if report == nil {
+		return
+	}
+
+	for _, drift := range report.Drift {
+		c.logger.Info("RabbitMQ topology drift detected", "object", drift)
+	}
+	for _, removed := range report.Removed {
+		c.logger.Info("Removed RabbitMQ binding no longer in topology", "object", removed)
+	}
+	c.logger.Info("Reconciled RabbitMQ topology",
+		"applied", len(report.Applied),
+		"drift", len(report.Drift),
+		"removed", len(report.Removed),
+		"errors", len(report.Errors),
+	)
+}
+
+// topologyHandler serves the last topology reconciliation report
+func (c *Controller) topologyHandler(w http.ResponseWriter, r *http.Request) {
+	t := c.topology
+
+	t.mu.Lock()
+	response := map[string]any{
+		"path":     t.path,
+		"attempts": t.attempts,
+		"report":   t.report,
+	}
+	if t.lastErr != nil {
+		response["error"] = t.lastErr.Error()
+	}
+	t.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,128 @@
+package controller
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/rossigee/cert-webhook-system/internal/event"
+	"github.com/rossigee/cert-webhook-system/internal/rabbitmq"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+)
+
+// fakeBroker is a publisher that keeps the bindings applied to it
+type fakeBroker struct {
+	bindings map[string]bool
+}
+
+func (b *fakeBroker) Name() string { return "rabbitmq" }
+
+func (b *fakeBroker) Publish(context.Context, string, string, any, event.Properties) error {
+	return nil
+}
+
+func (b *fakeBroker) HealthCheck() error { return nil }
+
+func (b *fakeBroker) Close() error { return nil }
+
+// ApplyTopology binds the topology's bindings and unbinds those only in
+// previous, like the RabbitMQ client
+func (b *fakeBroker) ApplyTopology(topology, previous *rabbitmq.Topology) (*rabbitmq.TopologyReport, error) {
+	report := &rabbitmq.TopologyReport{}
+	wanted := topologyBindings(topology)
+	for _, binding := range wanted {
+		b.bindings[binding] = true
+		report.Applied = append(report.Applied, binding)
+	}
+	for _, binding := range topologyBindings(previous) {
+		if !slices.Contains(wanted, binding) {
+			delete(b.bindings, binding)
+			report.Removed = append(report.Removed, binding)
+		}
+	}
+	return report, nil
+}
+
+func topologyBindings(topology *rabbitmq.Topology) []string {
+	var bindings []string
+	if topology == nil {
+		return bindings
+	}
+	for _, queue := range topology.Queues {
+		for _, binding := range queue.Bindings {
+			bindings = append(bindings, queue.Name+"/"+binding.Exchange+"/"+binding.RoutingKey)
+		}
+	}
+	return bindings
+}
+
+func newTopologyController(t *testing.T, clientset kubernetes.Interface, broker *fakeBroker, path string) *Controller {
+	t.Helper()
+	ctrl, err := New(Config{
+		Clientset:              clientset,
+		Config:                 &rest.Config{},
+		Publisher:              broker,
+		Logger:                 logr.Discard(),
+		TopologyFile:           path,
+		TopologyStateNamespace: "cert-webhook",
+		TopologyStateConfigMap: "topology-state",
+	})
+	if err != nil {
+		t.Fatalf("failed to create controller: %v", err)
+	}
+	return ctrl
+}
+
+func writeTopology(t *testing.T, path string, routingKeys ...string) {
+	t.Helper()
+	content := "queues:\n  - name: docker-web01\n    bindings:\n"
+	for _, routingKey := range routingKeys {
+		content += "      - exchange: certificate-events\n        routingKey: " + routingKey + "\n"
+	}
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write topology file: %v", err)
+	}
+}
+
+func TestReconcileTopology_UnbindsBindingRemovedWhileStopped(t *testing.T) {
+	ctx := context.Background()
+	clientset := fake.NewClientset()
+	broker := &fakeBroker{bindings: map[string]bool{}}
+	path := filepath.Join(t.TempDir(), "topology.yaml")
+
+	writeTopology(t, path, "certificate.renewed.web01.#", "certificate.renewed.legacy.#")
+	newTopologyController(t, clientset, broker, path).reconcileTopology(ctx, false)
+	if len(broker.bindings) != 2 {
+		t.Fatalf("expected 2 bindings, got %v", broker.bindings)
+	}
+
+	configMap, err := clientset.CoreV1().ConfigMaps("cert-webhook").Get(ctx, "topology-state", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("expected the applied topology to be saved: %v", err)
+	}
+	if configMap.Data[topologyStateKey] == "" {
+		t.Errorf("expected the topology file in key %s, got %v", topologyStateKey, configMap.Data)
+	}
+
+	// The binding is removed from the file while no controller is running,
+	// so the restarted controller only knows it from the saved state
+	writeTopology(t, path, "certificate.renewed.web01.#")
+	restarted := newTopologyController(t, clientset, broker, path)
+	restarted.reconcileTopology(ctx, false)
+
+	if broker.bindings["docker-web01/certificate-events/certificate.renewed.legacy.#"] {
+		t.Error("expected the removed binding to be unbound after the restart")
+	}
+	if !broker.bindings["docker-web01/certificate-events/certificate.renewed.web01.#"] {
+		t.Error("expected the remaining binding to be kept")
+	}
+	if report := restarted.topology.report; report == nil || len(report.Removed) != 1 {
+		t.Errorf("expected one removed binding in the report, got %+v", report)
+	}
+}
@@ -0,0 +1,297 @@
+package dispatch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/rossigee/cert-webhook-system/internal/event"
+	"github.com/rossigee/cert-webhook-system/internal/sink"
+)
+
+const (
+	defaultBestEffortTimeout     = 30 * time.Second
+	defaultMaxBestEffortInFlight = 100
+	// deliveryTTL is how long deliveries are remembered to skip the sink
+	// when the event is retried; longer than the controller's retries
+	deliveryTTL = time.Hour
+)
+
+// ErrClosed is returned when publishing to a closed dispatcher
+var ErrClosed = errors.New("dispatcher is closed")
+
+// Sink is a publisher the dispatcher fans events out to
+type Sink struct {
+	Publisher sink.Publisher
+	// Policy defaults to required
+	Policy Policy
+	Filter Filter
+}
+
+// Config holds the configuration for the dispatcher
+type Config struct {
+	Sinks []Sink
+	// BestEffortTimeout bounds each publish to a best-effort sink, which
+	// outlives the publish that started it (default 30s)
+	BestEffortTimeout time.Duration
+	// MaxBestEffortInFlight bounds the best-effort publishes running at
+	// once; events for best-effort sinks beyond it are dropped (default 100)
+	MaxBestEffortInFlight int
+	Logger                logr.Logger
+}
+
+// Dispatcher is a publisher that publishes every event to each sink whose
+// filter selects it. The publish fails when a required sink fails, so the
+// event is retried. Retries of an event with an ID (event.Properties.ID)
+// skip the sinks that already accepted it and the best-effort sinks it was
+// sent to; events without one are sent to every sink again.
+type Dispatcher struct {
+	sinks             []Sink
+	bestEffortTimeout time.Duration
+	logger            logr.Logger
+	deliveries        deliveryLog
+
+	// inFlight tracks the best-effort publishes still running, and
+	// bestEffortSlots bounds them. mu guards closed, so that no publish is
+	// added to inFlight once Close has started waiting for it.
+	mu              sync.Mutex
+	closed          bool
+	inFlight        sync.WaitGroup
+	bestEffortSlots chan struct{}
+}
+
+// New creates a dispatcher over the sinks
+func New(config Config) (*Dispatcher, error) {
+	if len(config.Sinks) == 0 {
+		return nil, fmt.Errorf("at least one sink is required")
+	}
+
+	sinks := make([]Sink, len(config.Sinks))
+	seen := make(map[string]bool)
+	for i, s := range config.Sinks {
+		name := s.Publisher.Name()
+		if seen[name] {
+			return nil, fmt.Errorf("publisher %q is configured more than once", name)
+		}
+		seen[name] = true
+
+		if s.Policy == "" {
+			s.Policy = PolicyRequired
+		} else if err := s.Policy.validate(); err != nil {
+			return nil, fmt.Errorf("sink %s: %w", name, err)
+		}
+		sinks[i] = s
+	}
+
+	timeout := config.BestEffortTimeout
+	if timeout <= 0 {
+		timeout = defaultBestEffortTimeout
+	}
+
+	maxInFlight := config.MaxBestEffortInFlight
+	if maxInFlight <= 0 {
+		maxInFlight = defaultMaxBestEffortInFlight
+	}
+
+	return &Dispatcher{
+		sinks:             sinks,
+		bestEffortTimeout: timeout,
+		logger:            config.Logger,
+		deliveries:        deliveryLog{delivered: make(map[string]time.Time)},
+		bestEffortSlots:   make(chan struct{}, maxInFlight),
+	}, nil
+}
+
+// Name identifies the publisher in logs and errors
+func (d *Dispatcher) Name() string {
+	return "dispatcher"
+}
+
+// Unwrap returns the sinks' publishers
+func (d *Dispatcher) Unwrap() []sink.Publisher {
+	publishers := make([]sink.Publisher, len(d.sinks))
+	for i, s := range d.sinks {
+		publishers[i] = s.Publisher
+	}
+	return publishers
+}
+
+// Publish publishes the event to the required sinks selecting it, returning
+// their joined errors, and starts publishing it to the best-effort ones.
+// Events no sink selects are dropped, as are events for best-effort sinks
+// while MaxBestEffortInFlight publishes are running. Once the dispatcher is
+// closed Publish fails with ErrClosed.
+func (d *Dispatcher) Publish(ctx context.Context, exchange, routingKey string, message any, props event.Properties) error {
+	d.mu.Lock()
+	closed := d.closed
+	d.mu.Unlock()
+	if closed {
+		return ErrClosed
+	}
+
+	n, err := event.NewNotification(exchange, routingKey, message, props)
+	if err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(d.sinks))
+	for i, s := range d.sinks {
+		name := s.Publisher.Name()
+		if !s.Filter.matches(n) {
+			deliveriesTotal.WithLabelValues(name, string(s.Policy), "filtered").Inc()
+			continue
+		}
+		if d.deliveries.has(name, props.ID) {
+			deliveriesTotal.WithLabelValues(name, string(s.Policy), "duplicate").Inc()
+			continue
+		}
+
+		if s.Policy == PolicyBestEffort {
+			select {
+			case d.bestEffortSlots <- struct{}{}:
+			default:
+				deliveriesTotal.WithLabelValues(name, string(s.Policy), "dropped").Inc()
+				d.logger.Info("Dropping event for best-effort sink, too many publishes in flight",
+					"sink", name, "event", n.Event, "routing_key", routingKey)
+				continue
+			}
+
+			// The publish may outlive ctx, such as a webhook request
+			started := d.startBestEffort(func() {
+				defer func() { <-d.bestEffortSlots }()
+				ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), d.bestEffortTimeout)
+				defer cancel()
+				if err := d.publish(ctx, s, exchange, routingKey, message, props); err != nil {
+					d.logger.Error(err, "Failed to publish to best-effort sink",
+						"sink", name, "event", n.Event, "routing_key", routingKey)
+				}
+			})
+			if !started {
+				<-d.bestEffortSlots
+				errs[i] = fmt.Errorf("%s: %w", name, ErrClosed)
+				continue
+			}
+			// Best-effort sinks get one attempt per event, even if it fails
+			d.deliveries.add(name, props.ID)
+			continue
+		}
+
+		wg.Go(func() {
+			if err := d.publish(ctx, s, exchange, routingKey, message, props); err != nil {
+				errs[i] = fmt.Errorf("%s: %w", name, err)
+				return
+			}
+			d.deliveries.add(name, props.ID)
+		})
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// startBestEffort runs fn as a best-effort publish tracked by inFlight,
+// reporting false without running it once the dispatcher is closed
+func (d *Dispatcher) startBestEffort(fn func()) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return false
+	}
+	d.inFlight.Go(fn)
+	return true
+}
+
+// publish publishes the event to one sink, recording the result
+func (d *Dispatcher) publish(ctx context.Context, s Sink, exchange, routingKey string, message any, props event.Properties) error {
+	name := s.Publisher.Name()
+	start := time.Now()
+	err := s.Publisher.Publish(ctx, exchange, routingKey, message, props)
+	deliveryDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		deliveriesTotal.WithLabelValues(name, string(s.Policy), "error").Inc()
+		return err
+	}
+	deliveriesTotal.WithLabelValues(name, string(s.Policy), "delivered").Inc()
+	return nil
+}
+
+// deliveryLog remembers which sinks each event was delivered to until
+// deliveryTTL has passed
+type deliveryLog struct {
+	mu         sync.Mutex
+	delivered  map[string]time.Time
+	lastPruned time.Time
+}
+
+// has reports whether the event with ID id was delivered to the sink. Events
+// without an ID are never remembered.
+func (l *deliveryLog) has(sinkName, id string) bool {
+	if id == "" {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	deliveredAt, ok := l.delivered[sinkName+"\x00"+id]
+	return ok && time.Since(deliveredAt) < deliveryTTL
+}
+
+// add records the delivery of the event with ID id to the sink
+func (l *deliveryLog) add(sinkName, id string) {
+	if id == "" {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastPruned) > time.Minute {
+		for key, deliveredAt := range l.delivered {
+			if now.Sub(deliveredAt) >= deliveryTTL {
+				delete(l.delivered, key)
+			}
+		}
+		l.lastPruned = now
+	}
+	l.delivered[sinkName+"\x00"+id] = now
+}
+
+// HealthCheck reports the joined errors of the required sinks. Unhealthy
+// best-effort sinks are logged but don't make the dispatcher unhealthy.
+func (d *Dispatcher) HealthCheck() error {
+	var errs []error
+	for _, s := range d.sinks {
+		err := s.Publisher.HealthCheck()
+		if err == nil {
+			continue
+		}
+		if s.Policy == PolicyBestEffort {
+			d.logger.Info("Best-effort sink is unhealthy", "sink", s.Publisher.Name(), "error", err.Error())
+			continue
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", s.Publisher.Name(), err))
+	}
+	return errors.Join(errs...)
+}
+
+// Close stops accepting events, waits for the best-effort publishes in
+// flight and closes the sinks
+func (d *Dispatcher) Close() error {
+	d.mu.Lock()
+	d.closed = true
+	d.mu.Unlock()
+
+	d.inFlight.Wait()
+
+	errs := make([]error, len(d.sinks))
+	for i, s := range d.sinks {
+		errs[i] = s.Publisher.Close()
+	}
+	return errors.Join(errs...)
+}
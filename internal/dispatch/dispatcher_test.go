@@ -0,0 +1,280 @@
+package dispatch
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/rossigee/cert-webhook-system/internal/event"
+	"github.com/rossigee/cert-webhook-system/internal/sink"
+)
+
+// fakePublisher records the routing keys published to it
+type fakePublisher struct {
+	name   string
+	err    error
+	health error
+	delay  time.Duration
+
+	mu        sync.Mutex
+	published []string
+	closed    bool
+}
+
+func (p *fakePublisher) Name() string { return p.name }
+
+func (p *fakePublisher) Publish(ctx context.Context, _, routingKey string, _ any, _ event.Properties) error {
+	select {
+	case <-time.After(p.delay):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return p.err
+	}
+	p.published = append(p.published, routingKey)
+	return nil
+}
+
+func (p *fakePublisher) HealthCheck() error { return p.health }
+
+func (p *fakePublisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	return nil
+}
+
+func (p *fakePublisher) routingKeys() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.published
+}
+
+func publish(d *Dispatcher, eventName, namespace string) error {
+	return publishID(d, eventName, namespace, "")
+}
+
+func publishID(d *Dispatcher, eventName, namespace, id string) error {
+	message := event.Message{Event: eventName, Certificate: "api-tls", Namespace: namespace}
+	props := event.Properties{ID: id, Headers: map[string]string{event.HeaderEvent: eventName}}
+	return d.Publish(context.Background(), event.DefaultExchange, eventName, message, props)
+}
+
+func TestDispatcher_Filters(t *testing.T) {
+	broker := &fakePublisher{name: "rabbitmq"}
+	chat := &fakePublisher{name: "chat"}
+	d, err := New(Config{
+		Sinks: []Sink{
+			{Publisher: broker},
+			{Publisher: chat, Filter: Filter{Events: []string{"*.failed"}, Namespaces: []string{"prod-*"}}},
+		},
+		Logger: logr.Discard(),
+	})
+	if err != nil {
+		t.Fatalf("failed to create dispatcher: %v", err)
+	}
+
+	for _, e := range []struct{ event, namespace string }{
+		{"certificate.renewed", "prod-eu"},
+		{"certificate.failed", "staging"},
+		{"certificate.failed", "prod-eu"},
+	} {
+		if err := publish(d, e.event, e.namespace); err != nil {
+			t.Fatalf("failed to publish: %v", err)
+		}
+	}
+
+	if got := broker.routingKeys(); len(got) != 3 {
+		t.Errorf("expected every event to reach the unfiltered sink, got %v", got)
+	}
+	if got := chat.routingKeys(); len(got) != 1 || got[0] != "certificate.failed" {
+		t.Errorf("expected only the production failure to reach the filtered sink, got %v", got)
+	}
+}
+
+func TestDispatcher_Policies(t *testing.T) {
+	broker := &fakePublisher{name: "rabbitmq", err: sink.ErrUnroutable}
+	chat := &fakePublisher{name: "chat", err: errors.New("webhook unreachable"), health: errors.New("down")}
+	audit := &fakePublisher{name: "jsonl", delay: 50 * time.Millisecond}
+	d, err := New(Config{
+		Sinks: []Sink{
+			{Publisher: broker, Policy: PolicyRequired},
+			{Publisher: chat, Policy: PolicyBestEffort},
+			{Publisher: audit, Policy: PolicyBestEffort},
+		},
+		Logger: logr.Discard(),
+	})
+	if err != nil {
+		t.Fatalf("failed to create dispatcher: %v", err)
+	}
+
+	err = publish(d, "certificate.renewed", "default")
+	if !errors.Is(err, sink.ErrUnroutable) {
+		t.Errorf("expected the required sink's error, got %v", err)
+	}
+
+	broker.err = nil
+	if err := publish(d, "certificate.renewed", "default"); err != nil {
+		t.Errorf("expected best-effort failures to be ignored, got %v", err)
+	}
+	if err := d.HealthCheck(); err != nil {
+		t.Errorf("expected an unhealthy best-effort sink to be ignored, got %v", err)
+	}
+	broker.health = errors.New("blocked")
+	if err := d.HealthCheck(); err == nil {
+		t.Error("expected an unhealthy required sink to fail the health check")
+	}
+
+	// Close waits for the delayed best-effort publishes
+	if err := d.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+	if got := audit.routingKeys(); len(got) != 2 {
+		t.Errorf("expected the best-effort publishes to finish, got %v", got)
+	}
+	if !broker.closed || !chat.closed || !audit.closed {
+		t.Error("expected every sink to be closed")
+	}
+}
+
+func TestDispatcher_RetrySkipsDeliveredSinks(t *testing.T) {
+	broker := &fakePublisher{name: "rabbitmq"}
+	kafka := &fakePublisher{name: "kafka", err: errors.New("leader not available")}
+	audit := &fakePublisher{name: "jsonl"}
+	d, err := New(Config{
+		Sinks: []Sink{
+			{Publisher: broker},
+			{Publisher: kafka},
+			{Publisher: audit, Policy: PolicyBestEffort},
+		},
+		Logger: logr.Discard(),
+	})
+	if err != nil {
+		t.Fatalf("failed to create dispatcher: %v", err)
+	}
+
+	id := event.EventID("default", "api-tls", "1", "certificate.renewed")
+	if err := publishID(d, "certificate.renewed", "default", id); err == nil {
+		t.Fatal("expected the failing required sink's error")
+	}
+	kafka.err = nil
+	if err := publishID(d, "certificate.renewed", "default", id); err != nil {
+		t.Fatalf("expected the retry to succeed, got %v", err)
+	}
+	// An event without an ID can't be recognised and goes to every sink
+	if err := publish(d, "certificate.renewed", "default"); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+	for _, p := range []*fakePublisher{broker, kafka, audit} {
+		if got := p.routingKeys(); len(got) != 2 {
+			t.Errorf("expected %s to receive each event once, got %v", p.name, got)
+		}
+	}
+}
+
+func TestDispatcher_BestEffortLimit(t *testing.T) {
+	broker := &fakePublisher{name: "rabbitmq"}
+	audit := &fakePublisher{name: "jsonl", delay: 100 * time.Millisecond}
+	d, err := New(Config{
+		Sinks: []Sink{
+			{Publisher: broker},
+			{Publisher: audit, Policy: PolicyBestEffort},
+		},
+		MaxBestEffortInFlight: 1,
+		Logger:                logr.Discard(),
+	})
+	if err != nil {
+		t.Fatalf("failed to create dispatcher: %v", err)
+	}
+
+	for range 3 {
+		if err := publish(d, "certificate.renewed", "default"); err != nil {
+			t.Fatalf("failed to publish: %v", err)
+		}
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+	if got := broker.routingKeys(); len(got) != 3 {
+		t.Errorf("expected the required sink to receive every event, got %v", got)
+	}
+	if got := audit.routingKeys(); len(got) != 1 {
+		t.Errorf("expected events beyond the in-flight limit to be dropped, got %v", got)
+	}
+}
+
+func TestDispatcher_PublishDuringClose(t *testing.T) {
+	audit := &fakePublisher{name: "jsonl", delay: time.Millisecond}
+	d, err := New(Config{
+		Sinks:                 []Sink{{Publisher: audit, Policy: PolicyBestEffort}},
+		MaxBestEffortInFlight: 1000,
+		Logger:                logr.Discard(),
+	})
+	if err != nil {
+		t.Fatalf("failed to create dispatcher: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Go(func() {
+			for {
+				if err := publish(d, "certificate.renewed", "default"); err != nil {
+					if !errors.Is(err, ErrClosed) {
+						t.Errorf("expected ErrClosed, got %v", err)
+					}
+					return
+				}
+			}
+		})
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if err := d.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+	published := len(audit.routingKeys())
+	wg.Wait()
+
+	if published == 0 {
+		t.Error("expected events to be published before closing")
+	}
+	if got := len(audit.routingKeys()); got != published {
+		t.Errorf("expected no publish to start after Close returned, got %d more", got-published)
+	}
+	if err := publish(d, "certificate.renewed", "default"); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected ErrClosed after closing, got %v", err)
+	}
+}
+
+func TestDispatcher_As(t *testing.T) {
+	broker := &fakePublisher{name: "rabbitmq"}
+	d, err := New(Config{Sinks: []Sink{{Publisher: broker}}, Logger: logr.Discard()})
+	if err != nil {
+		t.Fatalf("failed to create dispatcher: %v", err)
+	}
+	if found, ok := sink.As[*fakePublisher](d); !ok || found != broker {
+		t.Error("expected sink.As to find the sink's publisher")
+	}
+}
+
+func TestNew_Validation(t *testing.T) {
+	if _, err := New(Config{}); err == nil {
+		t.Error("expected error without sinks")
+	}
+	if _, err := New(Config{Sinks: []Sink{{Publisher: &fakePublisher{name: "chat"}}, {Publisher: &fakePublisher{name: "chat"}}}}); err == nil {
+		t.Error("expected error for a duplicate publisher")
+	}
+	if _, err := New(Config{Sinks: []Sink{{Publisher: &fakePublisher{name: "chat"}, Policy: "sometimes"}}}); err == nil {
+		t.Error("expected error for an unknown policy")
+	}
+}
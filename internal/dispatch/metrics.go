@@ -0,0 +1,23 @@
+package dispatch
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	deliveriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dispatch_deliveries_total",
+		Help: "Total number of events dispatched to each sink by policy and result (delivered, filtered, duplicate, dropped, error)",
+	}, []string{"sink", "policy", "result"})
+
+	deliveryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "dispatch_delivery_duration_seconds",
+		Help:    "Duration of publishes to each sink",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"sink"})
+)
+
+func init() {
+	prometheus.MustRegister(deliveriesTotal)
+	prometheus.MustRegister(deliveryDuration)
+}
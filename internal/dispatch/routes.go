@@ -0,0 +1,111 @@
+package dispatch
+
+import (
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/rossigee/cert-webhook-system/internal/event"
+	"sigs.k8s.io/yaml"
+)
+
+// Policy is how a sink's failures affect the publish
+type Policy string
+
+const (
+	// PolicyRequired sinks are published to before Publish returns, and
+	// their failures fail the publish so the event is retried
+	PolicyRequired Policy = "required"
+	// PolicyBestEffort sinks are published to in the background, and their
+	// failures are only logged and counted
+	PolicyBestEffort Policy = "best-effort"
+)
+
+// Filter selects the events a sink receives
+type Filter struct {
+	// Events are glob patterns the event type must match, e.g.
+	// certificate.* (default all)
+	Events []string `json:"events,omitempty"`
+	// Namespaces are glob patterns the certificate namespace must match
+	// (default all)
+	Namespaces []string `json:"namespaces,omitempty"`
+}
+
+// IsZero reports whether the filter selects every event
+func (f Filter) IsZero() bool {
+	return len(f.Events) == 0 && len(f.Namespaces) == 0
+}
+
+// matches reports whether the filter selects the event
+func (f Filter) matches(n event.Notification) bool {
+	return matchAny(f.Events, n.Event) && matchAny(f.Namespaces, n.Message.Namespace)
+}
+
+// matchAny reports whether name matches one of patterns, or patterns is empty
+func matchAny(patterns []string, name string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(patterns, func(pattern string) bool {
+		return event.GlobMatch(pattern, name)
+	})
+}
+
+// Route configures which events a publisher receives and how its failures
+// are handled
+type Route struct {
+	// Publisher is the kind of publisher, configured by its own flags, e.g.
+	// rabbitmq or chat
+	Publisher string `json:"publisher"`
+	// Policy defaults to required
+	Policy Policy `json:"policy,omitempty"`
+	Filter
+}
+
+// routesFile is the format of the sinks file
+type routesFile struct {
+	Sinks []Route `json:"sinks"`
+}
+
+// LoadRoutes reads and validates a sinks file. Unknown fields are rejected
+// so that typos don't silently drop settings.
+func LoadRoutes(path string) ([]Route, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sinks file: %w", err)
+	}
+
+	var file routesFile
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse sinks file: %w", err)
+	}
+	if len(file.Sinks) == 0 {
+		return nil, fmt.Errorf("sinks file %s lists no sinks", path)
+	}
+
+	seen := make(map[string]bool)
+	for i, route := range file.Sinks {
+		if route.Publisher == "" {
+			return nil, fmt.Errorf("sink %d has no publisher", i)
+		}
+		if seen[route.Publisher] {
+			return nil, fmt.Errorf("publisher %q is listed more than once", route.Publisher)
+		}
+		seen[route.Publisher] = true
+
+		if route.Policy == "" {
+			file.Sinks[i].Policy = PolicyRequired
+		} else if err := route.Policy.validate(); err != nil {
+			return nil, fmt.Errorf("sink %s: %w", route.Publisher, err)
+		}
+	}
+	return file.Sinks, nil
+}
+
+// validate checks the policy is known
+func (p Policy) validate() error {
+	if p != PolicyRequired && p != PolicyBestEffort {
+		return fmt.Errorf("unsupported policy %q (expected %s or %s)", p, PolicyRequired, PolicyBestEffort)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package dispatch
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rossigee/cert-webhook-system/internal/event"
+)
+
+func writeRoutes(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "sinks.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write sinks file: %v", err)
+	}
+	return path
+}
+
+func TestLoadRoutes(t *testing.T) {
+	routes, err := LoadRoutes(writeRoutes(t, `
+sinks:
+  - publisher: rabbitmq
+  - publisher: chat
+    policy: best-effort
+    events: ["certificate.*failed"]
+    namespaces: ["prod-*"]
+`))
+	if err != nil {
+		t.Fatalf("failed to load routes: %v", err)
+	}
+	if len(routes) != 2 {
+		t.Fatalf("expected 2 routes, got %d", len(routes))
+	}
+	if routes[0].Policy != PolicyRequired || !routes[0].Filter.IsZero() {
+		t.Errorf("expected a required unfiltered route, got %+v", routes[0])
+	}
+	if routes[1].Policy != PolicyBestEffort || routes[1].Events[0] != "certificate.*failed" || routes[1].Namespaces[0] != "prod-*" {
+		t.Errorf("unexpected route %+v", routes[1])
+	}
+}
+
+func TestLoadRoutes_Invalid(t *testing.T) {
+	tests := map[string]string{
+		"no sinks":      "sinks: []",
+		"no publisher":  "sinks:\n  - policy: required",
+		"duplicate":     "sinks:\n  - publisher: chat\n  - publisher: chat",
+		"bad policy":    "sinks:\n  - publisher: chat\n    policy: sometimes",
+		"unknown field": "sinks:\n  - publisher: chat\n    namespace: [default]",
+	}
+	for name, content := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := LoadRoutes(writeRoutes(t, content)); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+	if _, err := LoadRoutes("/nonexistent"); err == nil {
+		t.Error("expected error for a missing file")
+	}
+}
+
+func TestFilter_Matches(t *testing.T) {
+	filter := Filter{Events: []string{"certificate.*failed"}, Namespaces: []string{"prod-*"}}
+
+	tests := []struct {
+		event, namespace string
+		want             bool
+	}{
+		{"certificate.publish-failed", "prod-eu", true},
+		{"certificate.renewed", "prod-eu", false},
+		{"certificate.publish-failed", "staging", false},
+	}
+	for _, tt := range tests {
+		n := event.Notification{Event: tt.event, Message: event.Message{Namespace: tt.namespace}}
+		if got := filter.matches(n); got != tt.want {
+			t.Errorf("matches(%s, %s) = %v, want %v", tt.event, tt.namespace, got, tt.want)
+		}
+	}
+	if !(Filter{}).matches(event.Notification{Event: "certificate.renewed"}) {
+		t.Error("expected an empty filter to match every event")
+	}
+}
@@ -0,0 +1,35 @@
+package email
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	notificationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "email_notifications_total",
+		Help: "Total number of events handled by the email sink by result (queued, sent, filtered, no_recipients, error)",
+	}, []string{"result"})
+
+	digestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "email_digests_total",
+		Help: "Total number of email digests by result (sent, retry, dropped)",
+	}, []string{"result"})
+
+	pendingNotifications = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "email_pending_notifications",
+		Help: "Number of events waiting in email digests",
+	})
+
+	sendDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "email_send_duration_seconds",
+		Help:    "Duration of SMTP sessions sending an email",
+		Buckets: prometheus.DefBuckets,
+	})
+)
+
+func init() {
+	prometheus.MustRegister(notificationsTotal)
+	prometheus.MustRegister(digestsTotal)
+	prometheus.MustRegister(pendingNotifications)
+	prometheus.MustRegister(sendDuration)
+}
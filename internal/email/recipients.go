@@ -0,0 +1,99 @@
+package email
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"os"
+	"slices"
+
+	"github.com/rossigee/cert-webhook-system/internal/event"
+	"sigs.k8s.io/yaml"
+)
+
+// NotifyEmailAnnotation lists the comma-separated addresses notified about
+// a certificate, replacing the recipient policy
+const NotifyEmailAnnotation = event.AnnotationPrefix + "notify-email"
+
+// RecipientPolicy chooses who is emailed about certificates without a
+// notify-email annotation
+type RecipientPolicy struct {
+	// Default recipients are used when no namespace rule matches
+	Default []string `json:"default,omitempty"`
+	// Namespaces rules add recipients for matching namespaces
+	Namespaces []NamespaceRecipients `json:"namespaces,omitempty"`
+}
+
+// NamespaceRecipients emails recipients about certificates in namespaces
+// matching any of the glob patterns
+type NamespaceRecipients struct {
+	Namespaces []string `json:"namespaces"`
+	Recipients []string `json:"recipients"`
+}
+
+// LoadRecipientPolicy reads and validates a recipients file. Unknown fields
+// are rejected so that typos don't silently drop settings.
+func LoadRecipientPolicy(path string) (RecipientPolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return RecipientPolicy{}, fmt.Errorf("failed to read recipients file: %w", err)
+	}
+
+	var policy RecipientPolicy
+	if err := yaml.UnmarshalStrict(data, &policy); err != nil {
+		return RecipientPolicy{}, fmt.Errorf("failed to parse recipients file: %w", err)
+	}
+	if err := policy.validate(); err != nil {
+		return RecipientPolicy{}, err
+	}
+	return policy, nil
+}
+
+// validate checks the addresses and that every rule is complete
+func (p RecipientPolicy) validate() error {
+	var errs []error
+	if _, err := parseAddresses(p.Default); err != nil {
+		errs = append(errs, fmt.Errorf("invalid default recipients: %w", err))
+	}
+	for i, rule := range p.Namespaces {
+		if len(rule.Namespaces) == 0 || len(rule.Recipients) == 0 {
+			errs = append(errs, fmt.Errorf("namespace rule %d needs namespaces and recipients", i))
+		}
+		if _, err := parseAddresses(rule.Recipients); err != nil {
+			errs = append(errs, fmt.Errorf("namespace rule %d: %w", i, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// recipients returns the addresses notified about certificates in namespace
+func (p RecipientPolicy) recipients(namespace string) []string {
+	var recipients []string
+	for _, rule := range p.Namespaces {
+		if slices.ContainsFunc(rule.Namespaces, func(pattern string) bool {
+			return event.GlobMatch(pattern, namespace)
+		}) {
+			recipients = append(recipients, rule.Recipients...)
+		}
+	}
+	if len(recipients) == 0 {
+		recipients = p.Default
+	}
+	addresses, _ := parseAddresses(recipients)
+	return addresses
+}
+
+// parseAddresses parses addresses, returning the bare, sorted and
+// deduplicated addresses
+func parseAddresses(values []string) ([]string, error) {
+	var addresses []string
+	for _, value := range values {
+		parsed, err := mail.ParseAddress(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %q: %w", value, err)
+		}
+		addresses = append(addresses, parsed.Address)
+	}
+	slices.Sort(addresses)
+	return slices.Compact(addresses), nil
+}
@@ -0,0 +1,42 @@
+package email
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestLoadRecipientPolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recipients.yaml")
+	content := `default: [platform@example.com]
+namespaces:
+- namespaces: ["pay-*", billing]
+  recipients: ["Payments <payments@example.com>"]
+- namespaces: ["*"]
+  recipients: [audit@example.com]
+`
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	policy, err := LoadRecipientPolicy(path)
+	if err != nil {
+		t.Fatalf("failed to load policy: %v", err)
+	}
+
+	if got := policy.recipients("billing"); !slices.Equal(got, []string{"audit@example.com", "payments@example.com"}) {
+		t.Errorf("unexpected recipients %v", got)
+	}
+	policy.Namespaces = policy.Namespaces[:1]
+	if got := policy.recipients("web"); !slices.Equal(got, []string{"platform@example.com"}) {
+		t.Errorf("expected the default recipients, got %v", got)
+	}
+
+	if err := os.WriteFile(path, []byte("namespaces:\n- namespaces: [web]\n"), 0o600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if _, err := LoadRecipientPolicy(path); err == nil {
+		t.Error("expected a rule without recipients to be rejected")
+	}
+}
@@ -0,0 +1,538 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/rossigee/cert-webhook-system/internal/event"
+	"github.com/rossigee/cert-webhook-system/internal/tlsconfig"
+)
+
+// TLS modes of the SMTP connection
+const (
+	// TLSModeStartTLS upgrades the connection with STARTTLS, failing if the
+	// server does not offer it
+	TLSModeStartTLS = "starttls"
+	// TLSModeImplicit connects with TLS, usually to port 465
+	TLSModeImplicit = "tls"
+	// TLSModeNone sends in plain text, e.g. to a local relay
+	TLSModeNone = "none"
+)
+
+const (
+	defaultTimeout      = 30 * time.Second
+	defaultDigestWindow = 5 * time.Minute
+	// maxDigestAttempts is the number of times a digest is sent before its
+	// notifications are dropped
+	maxDigestAttempts = 3
+)
+
+// DefaultSubjectTemplate names the event of a single notification, or
+// counts the events of a digest
+const DefaultSubjectTemplate = `{{if eq (len .Notifications) 1}}{{with index .Notifications 0}}` +
+	`[{{.Severity}}] {{.Event}}: {{.Message.Namespace}}/{{.Message.Certificate}}{{end}}` +
+	`{{else}}{{len .Notifications}} certificate events{{end}}`
+
+// DefaultBodyTemplate lists the notifications with their certificate details
+const DefaultBodyTemplate = `{{range .Notifications}}[{{.Severity}}] {{.Event}}: certificate {{.Message.Namespace}}/{{.Message.Certificate}}
+{{- with .Cluster}} in cluster {{.}}{{end}}
+{{- with .Error}}
+  Error: {{.}}{{end}}
+{{- with .Message.SecretName}}
+  Secret: {{.}}{{end}}
+{{- with .Message.TargetType}}
+  Target: {{.}}{{end}}
+{{- if .Message.Timestamp}}
+  Time: {{time .Message.Timestamp}}{{end}}
+
+{{end}}--
+Sent by cert-webhook-system
+`
+
+// Config holds the configuration for the email sink
+type Config struct {
+	// Addr is the SMTP server host:port
+	Addr string
+	// TLSMode is starttls (default), tls or none
+	TLSMode string
+	// TLS overrides the CA and server name the server is verified with
+	TLS tlsconfig.Config
+	// Username and PasswordFile enable PLAIN authentication. The password
+	// file is read for every email.
+	Username     string
+	PasswordFile string
+	// Timeout bounds each SMTP session (default 30s)
+	Timeout time.Duration
+
+	// From is the sender address
+	From string
+	// Recipients chooses who is emailed about certificates without a
+	// notify-email annotation
+	Recipients RecipientPolicy
+	// Events are the event types emailed (default warning and critical
+	// events, such as failures and expiry warnings)
+	Events []string
+
+	// DigestWindow collects the events of the same recipients into one email
+	// sent this long after the first (default 5m). A negative window sends
+	// every event immediately, failing the publish if the email fails.
+	DigestWindow time.Duration
+
+	// SubjectTemplate and BodyTemplate are Go text/templates rendered from a
+	// Digest (defaults DefaultSubjectTemplate and DefaultBodyTemplate)
+	SubjectTemplate string
+	BodyTemplate    string
+
+	Logger logr.Logger
+}
+
+// Digest is the data email templates are rendered from
+type Digest struct {
+	Recipients    []string
+	Notifications []event.Notification
+}
+
+// Sink emails event notifications, collecting the events of the same
+// recipients into digests
+type Sink struct {
+	config   Config
+	host     string
+	from     string
+	tls      *tls.Config
+	subject  *template.Template
+	body     *template.Template
+	window   time.Duration
+	logger   logr.Logger
+	hostname string
+
+	mu      sync.Mutex
+	pending map[string]*digest
+	closed  bool
+}
+
+// digest is a digest waiting for its window to end
+type digest struct {
+	Digest
+	attempts int
+	timer    *time.Timer
+}
+
+// New creates an email sink
+func New(config Config) (*Sink, error) {
+	host, _, err := net.SplitHostPort(config.Addr)
+	if err != nil || host == "" {
+		return nil, fmt.Errorf("invalid SMTP address %q (expected host:port)", config.Addr)
+	}
+	if config.TLSMode == "" {
+		config.TLSMode = TLSModeStartTLS
+	}
+	if config.TLSMode != TLSModeStartTLS && config.TLSMode != TLSModeImplicit && config.TLSMode != TLSModeNone {
+		return nil, fmt.Errorf("unsupported SMTP TLS mode %q (expected starttls, tls or none)", config.TLSMode)
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultTimeout
+	}
+	if config.Username != "" && config.PasswordFile == "" {
+		return nil, fmt.Errorf("an SMTP password file is required with a username")
+	}
+	if config.PasswordFile != "" {
+		if _, err := readPassword(config.PasswordFile); err != nil {
+			return nil, err
+		}
+	}
+
+	from, err := mail.ParseAddress(config.From)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sender address %q: %w", config.From, err)
+	}
+	if err := config.Recipients.validate(); err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := tlsconfig.New(config.TLS)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = host
+	}
+
+	subject, err := parseTemplate("subject", config.SubjectTemplate, DefaultSubjectTemplate)
+	if err != nil {
+		return nil, err
+	}
+	body, err := parseTemplate("body", config.BodyTemplate, DefaultBodyTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	window := config.DigestWindow
+	if window == 0 {
+		window = defaultDigestWindow
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+
+	return &Sink{
+		config:   config,
+		host:     host,
+		from:     from.String(),
+		tls:      tlsConfig,
+		subject:  subject,
+		body:     body,
+		window:   window,
+		logger:   config.Logger,
+		hostname: hostname,
+		pending:  make(map[string]*digest),
+	}, nil
+}
+
+// parseTemplate parses an email template, falling back to the default
+func parseTemplate(name, text, fallback string) (*template.Template, error) {
+	if text == "" {
+		text = fallback
+	}
+	tmpl, err := template.New(name).Funcs(event.TemplateFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid email %s template: %w", name, err)
+	}
+	return tmpl, nil
+}
+
+// readPassword reads the SMTP password file
+func readPassword(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read SMTP password file: %w", err)
+	}
+	password := strings.TrimSpace(string(data))
+	if password == "" {
+		return "", fmt.Errorf("SMTP password file %s is empty", path)
+	}
+	return password, nil
+}
+
+// Name identifies the publisher in logs and errors
+func (s *Sink) Name() string {
+	return "smtp"
+}
+
+// Publish emails a notification of the event to its recipients, or adds it
+// to their pending digest. Events that are not emailed, or have no
+// recipients, are dropped without error.
+func (s *Sink) Publish(_ context.Context, exchange, routingKey string, message any, props event.Properties) error {
+	n, err := event.NewNotification(exchange, routingKey, message, props)
+	if err != nil {
+		return err
+	}
+	if !s.wanted(n) {
+		notificationsTotal.WithLabelValues("filtered").Inc()
+		return nil
+	}
+
+	recipients := s.recipients(n)
+	if len(recipients) == 0 {
+		notificationsTotal.WithLabelValues("no_recipients").Inc()
+		s.logger.V(1).Info("No email recipients for event",
+			"event", n.Event,
+			"namespace", n.Message.Namespace,
+			"certificate", n.Message.Certificate)
+		return nil
+	}
+
+	if s.window < 0 {
+		if err := s.send(Digest{Recipients: recipients, Notifications: []event.Notification{n}}); err != nil {
+			notificationsTotal.WithLabelValues("error").Inc()
+			return err
+		}
+		notificationsTotal.WithLabelValues("sent").Inc()
+		return nil
+	}
+
+	if err := s.enqueue(recipients, []event.Notification{n}, 0); err != nil {
+		return err
+	}
+	notificationsTotal.WithLabelValues("queued").Inc()
+	return nil
+}
+
+// wanted reports whether the event is emailed
+func (s *Sink) wanted(n event.Notification) bool {
+	if len(s.config.Events) > 0 {
+		return slices.Contains(s.config.Events, n.Event)
+	}
+	return n.Severity.AtLeast(event.SeverityWarning)
+}
+
+// recipients returns the addresses notified about the event: those of the
+// certificate's notify-email annotation, or else the recipient policy's
+func (s *Sink) recipients(n event.Notification) []string {
+	if value := n.Annotation(NotifyEmailAnnotation); value != "" {
+		list, err := mail.ParseAddressList(value)
+		if err == nil {
+			addresses := make([]string, 0, len(list))
+			for _, address := range list {
+				addresses = append(addresses, address.Address)
+			}
+			slices.Sort(addresses)
+			return slices.Compact(addresses)
+		}
+		s.logger.Info("Ignoring invalid notify-email annotation",
+			"namespace", n.Message.Namespace,
+			"certificate", n.Message.Certificate,
+			"error", err.Error())
+	}
+	return s.config.Recipients.recipients(n.Message.Namespace)
+}
+
+// enqueue adds notifications to the recipients' digest, starting its window
+// if it is new
+func (s *Sink) enqueue(recipients []string, notifications []event.Notification, attempts int) error {
+	key := strings.Join(recipients, ",")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return fmt.Errorf("email sink is closed")
+	}
+	pendingNotifications.Add(float64(len(notifications)))
+
+	if d, ok := s.pending[key]; ok {
+		// Earlier notifications, from a failed digest, stay first
+		if attempts > 0 {
+			d.Notifications = append(notifications, d.Notifications...)
+			d.attempts = max(d.attempts, attempts)
+		} else {
+			d.Notifications = append(d.Notifications, notifications...)
+		}
+		return nil
+	}
+
+	d := &digest{
+		Digest:   Digest{Recipients: recipients, Notifications: notifications},
+		attempts: attempts,
+	}
+	d.timer = time.AfterFunc(s.window, func() { s.flush(key) })
+	s.pending[key] = d
+	return nil
+}
+
+// flush sends a digest whose window ended. A failed digest is sent again
+// with the next window, up to maxDigestAttempts times.
+func (s *Sink) flush(key string) {
+	s.mu.Lock()
+	d, ok := s.pending[key]
+	if ok {
+		delete(s.pending, key)
+	}
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+	pendingNotifications.Sub(float64(len(d.Notifications)))
+
+	err := s.send(d.Digest)
+	if err == nil {
+		digestsTotal.WithLabelValues("sent").Inc()
+		return
+	}
+
+	d.attempts++
+	s.logger.Error(err, "Failed to send email digest",
+		"recipients", len(d.Recipients),
+		"events", len(d.Notifications),
+		"attempt", d.attempts)
+
+	if d.attempts < maxDigestAttempts {
+		if s.enqueue(d.Recipients, d.Notifications, d.attempts) == nil {
+			digestsTotal.WithLabelValues("retry").Inc()
+			return
+		}
+	}
+	digestsTotal.WithLabelValues("dropped").Inc()
+}
+
+// send renders and emails a digest
+func (s *Sink) send(d Digest) error {
+	var subject, body bytes.Buffer
+	if err := s.subject.Execute(&subject, d); err != nil {
+		return fmt.Errorf("failed to render email subject: %w", err)
+	}
+	if err := s.body.Execute(&body, d); err != nil {
+		return fmt.Errorf("failed to render email body: %w", err)
+	}
+
+	message, err := s.compose(d.Recipients, strings.TrimSpace(subject.String()), body.Bytes())
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	err = s.deliver(d.Recipients, message)
+	sendDuration.Observe(time.Since(start).Seconds())
+	return err
+}
+
+// compose builds a plain text email
+func (s *Sink) compose(recipients []string, subject string, body []byte) ([]byte, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("failed to generate message ID: %w", err)
+	}
+
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\n", s.from)
+	fmt.Fprintf(&message, "To: %s\r\n", strings.Join(recipients, ", "))
+	fmt.Fprintf(&message, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&message, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&message, "Message-ID: <%s@%s>\r\n", hex.EncodeToString(id), s.hostname)
+	message.WriteString("MIME-Version: 1.0\r\n")
+	message.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	message.WriteString("Content-Transfer-Encoding: quoted-printable\r\n")
+	message.WriteString("Auto-Submitted: auto-generated\r\n\r\n")
+
+	writer := quotedprintable.NewWriter(&message)
+	if _, err := writer.Write(bytes.ReplaceAll(body, []byte("\n"), []byte("\r\n"))); err != nil {
+		return nil, fmt.Errorf("failed to encode email body: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("failed to encode email body: %w", err)
+	}
+	return message.Bytes(), nil
+}
+
+// deliver sends an email in a single SMTP session
+func (s *Sink) deliver(recipients []string, message []byte) error {
+	dialer := &net.Dialer{Timeout: s.config.Timeout}
+	var conn net.Conn
+	var err error
+	if s.config.TLSMode == TLSModeImplicit {
+		conn, err = tls.DialWithDialer(dialer, "tcp", s.config.Addr, s.tls)
+	} else {
+		conn, err = dialer.Dial("tcp", s.config.Addr)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to connect to SMTP server: %w", err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(s.config.Timeout))
+
+	client, err := smtp.NewClient(conn, s.host)
+	if err != nil {
+		_ = conn.Close()
+		return fmt.Errorf("failed to start SMTP session: %w", err)
+	}
+	defer func() { _ = client.Close() }()
+
+	if err := client.Hello(s.hostname); err != nil {
+		return fmt.Errorf("SMTP greeting failed: %w", err)
+	}
+	if s.config.TLSMode == TLSModeStartTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("SMTP server does not offer STARTTLS")
+		}
+		if err := client.StartTLS(s.tls); err != nil {
+			return fmt.Errorf("SMTP STARTTLS failed: %w", err)
+		}
+	}
+	if s.config.Username != "" {
+		password, err := readPassword(s.config.PasswordFile)
+		if err != nil {
+			return err
+		}
+		if err := client.Auth(smtp.PlainAuth("", s.config.Username, password, s.host)); err != nil {
+			return fmt.Errorf("SMTP authentication failed: %w", err)
+		}
+	}
+
+	if err := client.Mail(s.fromAddress()); err != nil {
+		return fmt.Errorf("SMTP server rejected the sender: %w", err)
+	}
+	var errs []error
+	accepted := 0
+	for _, recipient := range recipients {
+		if err := client.Rcpt(recipient); err != nil {
+			errs = append(errs, fmt.Errorf("SMTP server rejected recipient %s: %w", recipient, err))
+			continue
+		}
+		accepted++
+	}
+	if accepted == 0 {
+		return errors.Join(errs...)
+	}
+	if len(errs) > 0 {
+		// The others still receive the email
+		s.logger.Info("Some email recipients were rejected", "error", errors.Join(errs...).Error())
+	}
+
+	writer, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("SMTP DATA failed: %w", err)
+	}
+	if _, err := writer.Write(message); err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("SMTP server rejected the email: %w", err)
+	}
+	return client.Quit()
+}
+
+// fromAddress returns the bare sender address
+func (s *Sink) fromAddress() string {
+	address, _ := mail.ParseAddress(s.from)
+	return address.Address
+}
+
+// HealthCheck always succeeds: the SMTP server is only contacted when a
+// digest is sent
+func (s *Sink) HealthCheck() error {
+	return nil
+}
+
+// Close sends the pending digests without waiting for their windows
+func (s *Sink) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	pending := s.pending
+	s.pending = make(map[string]*digest)
+	s.mu.Unlock()
+
+	var errs []error
+	for _, d := range pending {
+		d.timer.Stop()
+		pendingNotifications.Sub(float64(len(d.Notifications)))
+		if err := s.send(d.Digest); err != nil {
+			s.logger.Error(err, "Failed to send email digest on shutdown",
+				"recipients", len(d.Recipients),
+				"events", len(d.Notifications))
+			digestsTotal.WithLabelValues("dropped").Inc()
+			errs = append(errs, err)
+			continue
+		}
+		digestsTotal.WithLabelValues("sent").Inc()
+	}
+	return errors.Join(errs...)
+}
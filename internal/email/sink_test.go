@@ -0,0 +1,285 @@
+package email
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/rossigee/cert-webhook-system/internal/event"
+)
+
+// receivedMail is an email accepted by the fake SMTP server
+type receivedMail struct {
+	from       string
+	recipients []string
+	data       string
+	auth       string
+}
+
+// newFakeSMTPServer starts a minimal SMTP server accepting every email,
+// returning its address
+func newFakeSMTPServer(t *testing.T) (string, <-chan receivedMail) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	mails := make(chan receivedMail, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSMTP(conn, mails)
+		}
+	}()
+	return listener.Addr().String(), mails
+}
+
+func serveSMTP(conn net.Conn, mails chan<- receivedMail) {
+	defer func() { _ = conn.Close() }()
+	reader := bufio.NewReader(conn)
+	reply := func(line string) { _, _ = conn.Write([]byte(line + "\r\n")) }
+
+	var mail receivedMail
+	reply("220 fake ESMTP")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		command := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch command {
+		case "EHLO":
+			reply("250-fake")
+			reply("250 AUTH PLAIN")
+		case "AUTH":
+			mail.auth = line
+			reply("235 accepted")
+		case "MAIL":
+			mail.from = line
+			reply("250 ok")
+		case "RCPT":
+			mail.recipients = append(mail.recipients, line)
+			reply("250 ok")
+		case "DATA":
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				dataLine, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if dataLine == ".\r\n" {
+					break
+				}
+				data.WriteString(dataLine)
+			}
+			mail.data = data.String()
+			mails <- mail
+			mail = receivedMail{}
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func renewal(namespace, certificate, eventName string, annotations map[string]string) (event.Message, event.Properties) {
+	message := event.NewMessage(certificate, namespace, certificate+"-tls", nil, annotations)
+	message.Event = eventName
+	return message, event.Properties{Headers: map[string]string{event.HeaderEvent: eventName}}
+}
+
+func TestSink_DigestAndRecipients(t *testing.T) {
+	addr, mails := newFakeSMTPServer(t)
+
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(passwordFile, []byte("s3cret\n"), 0o600); err != nil {
+		t.Fatalf("failed to write password: %v", err)
+	}
+
+	s, err := New(Config{
+		Addr:         addr,
+		TLSMode:      TLSModeNone,
+		Username:     "mailer",
+		PasswordFile: passwordFile,
+		From:         "Certificates <certs@example.com>",
+		Recipients: RecipientPolicy{
+			Default:    []string{"platform@example.com"},
+			Namespaces: []NamespaceRecipients{{Namespaces: []string{"pay-*"}, Recipients: []string{"payments@example.com"}}},
+		},
+		DigestWindow: 100 * time.Millisecond,
+		Logger:       logr.Discard(),
+	})
+	if err != nil {
+		t.Fatalf("failed to create sink: %v", err)
+	}
+	defer func() { _ = s.Close() }()
+
+	publish := func(namespace, certificate, eventName string, annotations map[string]string) {
+		t.Helper()
+		message, props := renewal(namespace, certificate, eventName, annotations)
+		if err := s.Publish(t.Context(), event.DefaultExchange, eventName, message, props); err != nil {
+			t.Fatalf("failed to publish: %v", err)
+		}
+	}
+
+	// Renewals are not emailed by default
+	publish("pay-api", "api", "certificate.renewed", nil)
+	publish("pay-api", "api", "certificate.expiring", nil)
+	publish("pay-web", "web", "certificate.publish-failed", nil)
+	publish("web", "site", "certificate.expiring", map[string]string{NotifyEmailAnnotation: "Site Owner <owner@example.com>, ops@example.com"})
+
+	received := map[string]receivedMail{}
+	for range 2 {
+		select {
+		case mail := <-mails:
+			received[strings.Join(mail.recipients, ",")] = mail
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected two digests")
+		}
+	}
+
+	payments, ok := received["RCPT TO:<payments@example.com>"]
+	if !ok {
+		t.Fatalf("expected a digest for the payments team, got %v", received)
+	}
+	if !strings.Contains(payments.data, "Subject: 2 certificate events") ||
+		!strings.Contains(payments.data, "certificate pay-api/api") ||
+		!strings.Contains(payments.data, "certificate pay-web/web") {
+		t.Errorf("unexpected digest:\n%s", payments.data)
+	}
+	if payments.from != "MAIL FROM:<certs@example.com>" || !strings.HasPrefix(payments.auth, "AUTH PLAIN") {
+		t.Errorf("unexpected sender %q or authentication %q", payments.from, payments.auth)
+	}
+
+	owners, ok := received["RCPT TO:<ops@example.com>,RCPT TO:<owner@example.com>"]
+	if !ok {
+		t.Fatalf("expected a digest for the annotated recipients, got %v", received)
+	}
+	if !strings.Contains(owners.data, "Subject: [warning] certificate.expiring: web/site") {
+		t.Errorf("unexpected email:\n%s", owners.data)
+	}
+
+	select {
+	case mail := <-mails:
+		t.Errorf("unexpected email to %v", mail.recipients)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestSink_Immediate(t *testing.T) {
+	addr, mails := newFakeSMTPServer(t)
+
+	s, err := New(Config{
+		Addr:         addr,
+		TLSMode:      TLSModeNone,
+		From:         "certs@example.com",
+		Recipients:   RecipientPolicy{Default: []string{"platform@example.com"}},
+		Events:       []string{"certificate.renewed"},
+		DigestWindow: -1,
+		Logger:       logr.Discard(),
+	})
+	if err != nil {
+		t.Fatalf("failed to create sink: %v", err)
+	}
+
+	message, props := renewal("default", "api", "certificate.renewed", nil)
+	if err := s.Publish(t.Context(), event.DefaultExchange, event.DefaultRoutingKey, message, props); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+	select {
+	case mail := <-mails:
+		if !strings.Contains(mail.data, "Secret: api-tls") {
+			t.Errorf("unexpected email:\n%s", mail.data)
+		}
+	default:
+		t.Fatal("expected the email to be sent during the publish")
+	}
+
+	// A server without STARTTLS is refused unless TLS is disabled
+	s.config.TLSMode = TLSModeStartTLS
+	if err := s.Publish(t.Context(), event.DefaultExchange, event.DefaultRoutingKey, message, props); err == nil {
+		t.Error("expected the publish to fail without STARTTLS")
+	}
+}
+
+func TestSink_RecipientsIgnoreMetadataFilter(t *testing.T) {
+	addr, mails := newFakeSMTPServer(t)
+
+	s, err := New(Config{
+		Addr:         addr,
+		TLSMode:      TLSModeNone,
+		From:         "certs@example.com",
+		Recipients:   RecipientPolicy{Default: []string{"platform@example.com"}},
+		Events:       []string{"certificate.renewed"},
+		DigestWindow: -1,
+		Logger:       logr.Discard(),
+	})
+	if err != nil {
+		t.Fatalf("failed to create sink: %v", err)
+	}
+	defer func() { _ = s.Close() }()
+
+	annotations := map[string]string{NotifyEmailAnnotation: "owner@example.com"}
+	filters := []*event.MetadataFilter{
+		nil,
+		{AnnotationDeny: []string{NotifyEmailAnnotation}},
+		{AnnotationDeny: []string{"*"}, HashValues: true},
+	}
+	for _, filter := range filters {
+		message := event.NewMessage("api", "default", "api-tls", nil, annotations)
+		filter.Apply(&message)
+		props, err := (&event.PropertyPolicy{}).Properties(message, annotations)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if err := s.Publish(t.Context(), event.DefaultExchange, event.DefaultRoutingKey, message, props); err != nil {
+			t.Fatalf("failed to publish: %v", err)
+		}
+		select {
+		case mail := <-mails:
+			if got := strings.Join(mail.recipients, ","); got != "RCPT TO:<owner@example.com>" {
+				t.Errorf("filter %+v: expected the annotated recipient, got %s", filter, got)
+			}
+		default:
+			t.Fatal("expected the email to be sent during the publish")
+		}
+	}
+}
+
+func TestNew_Validation(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+	}{
+		{"no address", Config{From: "certs@example.com"}},
+		{"invalid TLS mode", Config{Addr: "mail:25", TLSMode: "ssl", From: "certs@example.com"}},
+		{"invalid sender", Config{Addr: "mail:25", From: "certs"}},
+		{"username without password", Config{Addr: "mail:25", From: "certs@example.com", Username: "mailer"}},
+		{"invalid recipient", Config{Addr: "mail:25", From: "certs@example.com", Recipients: RecipientPolicy{Default: []string{"nobody"}}}},
+		{"invalid template", Config{Addr: "mail:25", From: "certs@example.com", BodyTemplate: "{{.Notifications"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := New(tt.config); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
@@ -17,6 +17,10 @@ const (
 
 	// DefaultRoutingKey is the default RabbitMQ routing key
 	DefaultRoutingKey = "certificate.renewed"
+
+	// PublishFailedEvent is the event type (and routing key) of dead letters
+	// for renewal events that could not be published
+	PublishFailedEvent = "certificate.publish-failed"
 )
 
 // Message represents a certificate renewal event message
@@ -25,6 +29,7 @@ type Message struct {
 	Certificate       string         `json:"certificate"`
 	Namespace         string         `json:"namespace"`
 	SecretName        string         `json:"secret_name"`
+	Issuer            string         `json:"issuer,omitempty"`
 	TargetType        string         `json:"target_type"`
 	DockerEngine      string         `json:"docker_engine"`
 	DockerComposePath string         `json:"docker_compose_path"`
@@ -0,0 +1,146 @@
+package event
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Severity ranks events for notification filtering
+type Severity string
+
+const (
+	SeverityInfo     Severity = "info"
+	SeverityWarning  Severity = "warning"
+	SeverityCritical Severity = "critical"
+)
+
+// severities lists the severities from lowest to highest
+var severities = []Severity{SeverityInfo, SeverityWarning, SeverityCritical}
+
+// Valid reports whether s is a known severity
+func (s Severity) Valid() bool {
+	return slices.Contains(severities, s)
+}
+
+// AtLeast reports whether s is min or higher. An empty min matches all.
+func (s Severity) AtLeast(min Severity) bool {
+	return min == "" || slices.Index(severities, s) >= slices.Index(severities, min)
+}
+
+// SeverityOf classifies an event by name: failures are critical, expiry
+// warnings are warnings and everything else, such as renewals, is info
+func SeverityOf(eventName string) Severity {
+	switch {
+	case strings.Contains(eventName, "fail") || strings.Contains(eventName, "error"):
+		return SeverityCritical
+	case strings.Contains(eventName, "expir"):
+		return SeverityWarning
+	default:
+		return SeverityInfo
+	}
+}
+
+// TemplateFuncs are available in notification templates
+var TemplateFuncs = template.FuncMap{
+	// time formats a Unix timestamp as RFC 3339
+	"time": func(unix int64) string {
+		return time.Unix(unix, 0).UTC().Format(time.RFC3339)
+	},
+	"upper": strings.ToUpper,
+	"join":  strings.Join,
+}
+
+// Notification describes an event for people: it is the data notification
+// templates are rendered from
+type Notification struct {
+	// Event is the event type, e.g. certificate.renewed
+	Event    string
+	Severity Severity
+	// Exchange and RoutingKey are where the event was published
+	Exchange   string
+	RoutingKey string
+	// Cluster is the cluster header, when set
+	Cluster string
+	// Message holds the certificate details: the event itself, or the
+	// certificate event a failure notice is about
+	Message Message
+	// Error and Attempts describe failure notices, such as dead letters
+	Error    string
+	Attempts int
+	// Headers are the message headers
+	Headers map[string]string
+	// Annotations are the unfiltered routing annotations of the certificate,
+	// see Properties.Annotations
+	Annotations map[string]string
+}
+
+// NewNotification describes a published event. Failure notices wrap the
+// certificate event in a message field; other events are a certificate
+// event themselves.
+func NewNotification(exchange, routingKey string, message any, props Properties) (Notification, error) {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return Notification{}, fmt.Errorf("failed to marshal message: %w", err)
+	}
+
+	var envelope struct {
+		Event    string   `json:"event"`
+		Message  *Message `json:"message"`
+		Error    string   `json:"error"`
+		Attempts int      `json:"attempts"`
+	}
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return Notification{}, fmt.Errorf("failed to decode message: %w", err)
+	}
+
+	n := Notification{
+		Event:       props.Headers[HeaderEvent],
+		Exchange:    exchange,
+		RoutingKey:  routingKey,
+		Cluster:     props.Headers[HeaderCluster],
+		Error:       envelope.Error,
+		Attempts:    envelope.Attempts,
+		Headers:     props.Headers,
+		Annotations: props.Annotations,
+	}
+	if envelope.Message != nil {
+		n.Message = *envelope.Message
+	} else if err := json.Unmarshal(body, &n.Message); err != nil {
+		return Notification{}, fmt.Errorf("failed to decode message: %w", err)
+	}
+	if n.Event == "" {
+		n.Event = envelope.Event
+	}
+	if n.Event == "" {
+		n.Event = routingKey
+	}
+	if n.Message.Namespace == "" {
+		n.Message.Namespace = props.Headers[HeaderNamespace]
+	}
+	if n.Message.Certificate == "" {
+		n.Message.Certificate = props.Headers[HeaderCertificate]
+	}
+	n.Severity = SeverityOf(n.Event)
+	return n, nil
+}
+
+// Annotation returns a certificate annotation. It is read from the
+// unfiltered annotations when the publisher provided them, so that routing
+// does not depend on the metadata filter, or else from the message metadata.
+func (n Notification) Annotation(name string) string {
+	if n.Annotations != nil {
+		return n.Annotations[name]
+	}
+	switch annotations := n.Message.Metadata["annotations"].(type) {
+	case map[string]string:
+		return annotations[name]
+	case map[string]any:
+		value, _ := annotations[name].(string)
+		return value
+	}
+	return ""
+}
@@ -0,0 +1,137 @@
+package event
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// MessageTTLAnnotation overrides the message expiration (a Go duration)
+	MessageTTLAnnotation = AnnotationPrefix + "message-ttl"
+
+	// MessagePriorityAnnotation overrides the message priority (0-255)
+	MessagePriorityAnnotation = AnnotationPrefix + "message-priority"
+
+	// HeaderAnnotationPrefix marks annotations copied into message headers,
+	// e.g. cert-webhook.golder.tech/header.team: payments
+	HeaderAnnotationPrefix = AnnotationPrefix + "header."
+)
+
+// Core header names, always set from the event so that consumers can route
+// and filter without parsing the body
+const (
+	HeaderEvent        = "event"
+	HeaderNamespace    = "namespace"
+	HeaderCertificate  = "certificate"
+	HeaderTargetType   = "target-type"
+	HeaderDockerEngine = "docker-engine"
+	HeaderCluster      = "cluster"
+)
+
+// Properties are per-message transport attributes of an event
+type Properties struct {
+	// ID identifies the event for deduplication: retries of an event carry
+	// the same ID, see EventID. Empty when the event can't be identified.
+	ID string `json:"id,omitempty"`
+	// Expiration discards the message if it is not consumed in time (0 never)
+	Expiration time.Duration `json:"expiration,omitempty"`
+	// Priority is used by priority queues
+	Priority uint8 `json:"priority,omitempty"`
+	// Headers are copied into the message headers
+	Headers map[string]string `json:"headers,omitempty"`
+	// Annotations are the certificate's cert-webhook.golder.tech/
+	// annotations before the metadata filter, for sinks that route on them
+	// such as the email sink. They are never published.
+	Annotations map[string]string `json:"-"`
+}
+
+// EventID identifies an event about a revision of a certificate. It is the
+// same for every retry of the event, unlike the message, whose timestamp
+// changes.
+func EventID(namespace, name, resourceVersion, eventType string) string {
+	return fmt.Sprintf("%s/%s:%s:%s", namespace, name, resourceVersion, eventType)
+}
+
+// ResourceVersionOf returns the certificate resource version an EventID
+// refers to, or "" if id is not an EventID
+func ResourceVersionOf(id string) string {
+	parts := strings.SplitN(id, ":", 3)
+	if len(parts) != 3 {
+		return ""
+	}
+	return parts[1]
+}
+
+// PropertyPolicy holds the defaults applied to every event. Certificates can
+// override the expiration and priority and add headers with annotations.
+type PropertyPolicy struct {
+	Expiration time.Duration
+	Priority   uint8
+	Headers    map[string]string
+	// Cluster identifies this Kubernetes cluster in the cluster header
+	Cluster string
+}
+
+// Properties computes the properties of message from the policy and the
+// certificate annotations. Invalid annotation values are skipped in favour
+// of the policy defaults and reported in the returned error; the properties
+// are usable either way. A nil policy applies no defaults.
+func (p *PropertyPolicy) Properties(message Message, annotations map[string]string) (Properties, error) {
+	var policy PropertyPolicy
+	if p != nil {
+		policy = *p
+	}
+
+	props := Properties{
+		Expiration: policy.Expiration,
+		Priority:   policy.Priority,
+		Headers:    make(map[string]string),
+	}
+	maps.Copy(props.Headers, policy.Headers)
+
+	var errs []error
+
+	if value, ok := annotations[MessageTTLAnnotation]; ok {
+		ttl, err := time.ParseDuration(value)
+		if err != nil || ttl < 0 {
+			errs = append(errs, fmt.Errorf("invalid %s annotation %q", MessageTTLAnnotation, value))
+		} else {
+			props.Expiration = ttl
+		}
+	}
+
+	if value, ok := annotations[MessagePriorityAnnotation]; ok {
+		priority, err := strconv.ParseUint(value, 10, 8)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s annotation %q", MessagePriorityAnnotation, value))
+		} else {
+			props.Priority = uint8(priority)
+		}
+	}
+
+	for key, value := range annotations {
+		if name, ok := strings.CutPrefix(key, HeaderAnnotationPrefix); ok && name != "" {
+			props.Headers[name] = value
+		}
+		if strings.HasPrefix(key, AnnotationPrefix) {
+			if props.Annotations == nil {
+				props.Annotations = make(map[string]string)
+			}
+			props.Annotations[key] = value
+		}
+	}
+
+	// Core headers are set last so that annotations cannot spoof them
+	props.Headers[HeaderEvent] = message.Event
+	props.Headers[HeaderNamespace] = message.Namespace
+	props.Headers[HeaderCertificate] = message.Certificate
+	props.Headers[HeaderTargetType] = message.TargetType
+	props.Headers[HeaderDockerEngine] = message.DockerEngine
+	props.Headers[HeaderCluster] = policy.Cluster
+
+	return props, errors.Join(errs...)
+}
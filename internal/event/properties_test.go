@@ -0,0 +1,100 @@
+package event
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPropertyPolicy_Properties(t *testing.T) {
+	policy := &PropertyPolicy{
+		Expiration: time.Hour,
+		Priority:   2,
+		Headers:    map[string]string{"source": "cert-webhook", "team": "platform"},
+		Cluster:    "prod-eu",
+	}
+	message := Message{
+		Event:        "certificate.renewed",
+		Certificate:  "api-cert",
+		Namespace:    "default",
+		TargetType:   "docker",
+		DockerEngine: "docker-01",
+	}
+
+	annotations := map[string]string{
+		MessageTTLAnnotation:                "10m",
+		MessagePriorityAnnotation:           "7",
+		HeaderAnnotationPrefix + "team":     "payments",
+		HeaderAnnotationPrefix + "event":    "spoofed",
+		HeaderAnnotationPrefix + "cluster":  "spoofed",
+		AnnotationPrefix + "rabbitmq-route": "ignored",
+	}
+
+	props, err := policy.Properties(message, annotations)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if props.Expiration != 10*time.Minute {
+		t.Errorf("expected expiration 10m, got %s", props.Expiration)
+	}
+	if props.Priority != 7 {
+		t.Errorf("expected priority 7, got %d", props.Priority)
+	}
+
+	expected := map[string]string{
+		HeaderEvent:        "certificate.renewed",
+		HeaderNamespace:    "default",
+		HeaderCertificate:  "api-cert",
+		HeaderTargetType:   "docker",
+		HeaderDockerEngine: "docker-01",
+		HeaderCluster:      "prod-eu",
+		"source":           "cert-webhook",
+		"team":             "payments",
+	}
+	if len(props.Headers) != len(expected) {
+		t.Errorf("expected headers %v, got %v", expected, props.Headers)
+	}
+	for k, v := range expected {
+		if props.Headers[k] != v {
+			t.Errorf("header %s: expected %q, got %q", k, v, props.Headers[k])
+		}
+	}
+
+	if policy.Headers["team"] != "platform" {
+		t.Error("expected policy headers not to be modified")
+	}
+}
+
+func TestPropertyPolicy_InvalidAnnotations(t *testing.T) {
+	policy := &PropertyPolicy{Expiration: time.Hour, Priority: 2}
+
+	props, err := policy.Properties(Message{}, map[string]string{
+		MessageTTLAnnotation:      "soon",
+		MessagePriorityAnnotation: "256",
+	})
+	if err == nil {
+		t.Fatal("expected error for invalid annotations")
+	}
+	if !strings.Contains(err.Error(), MessageTTLAnnotation) || !strings.Contains(err.Error(), MessagePriorityAnnotation) {
+		t.Errorf("expected both annotations to be reported, got %v", err)
+	}
+	if props.Expiration != time.Hour || props.Priority != 2 {
+		t.Errorf("expected policy defaults, got %+v", props)
+	}
+}
+
+func TestPropertyPolicy_Nil(t *testing.T) {
+	var policy *PropertyPolicy
+
+	props, err := policy.Properties(Message{Event: "certificate.renewed"}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if props.Expiration != 0 || props.Priority != 0 {
+		t.Errorf("expected no defaults, got %+v", props)
+	}
+	if props.Headers[HeaderEvent] != "certificate.renewed" {
+		t.Errorf("expected core headers, got %v", props.Headers)
+	}
+}
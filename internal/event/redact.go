@@ -0,0 +1,117 @@
+package event
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var metadataKeysRedactedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "metadata_keys_redacted_total",
+	Help: "Total number of label and annotation keys dropped or hashed from event metadata",
+}, []string{"kind", "action"})
+
+func init() {
+	prometheus.MustRegister(metadataKeysRedactedTotal)
+}
+
+// MetadataFilter controls which labels and annotations are copied into
+// Message.Metadata. Patterns are globs where "*" matches any run of
+// characters, including "/" (e.g. "app.kubernetes.io/*" or "*argocd*").
+// A key is kept when it matches an allow pattern (or no allow patterns are
+// configured) and matches no deny pattern.
+type MetadataFilter struct {
+	LabelAllow      []string
+	LabelDeny       []string
+	AnnotationAllow []string
+	AnnotationDeny  []string
+
+	// HashValues replaces the value of a rejected key with a SHA-256 digest
+	// instead of dropping the key entirely
+	HashValues bool
+}
+
+// Apply filters the labels and annotations held in the message metadata
+func (f *MetadataFilter) Apply(msg *Message) {
+	if f == nil || msg.Metadata == nil {
+		return
+	}
+
+	if labels, ok := msg.Metadata["labels"].(map[string]string); ok {
+		msg.Metadata["labels"] = f.filter("label", labels, f.LabelAllow, f.LabelDeny)
+	}
+	if annotations, ok := msg.Metadata["annotations"].(map[string]string); ok {
+		msg.Metadata["annotations"] = f.filter("annotation", annotations, f.AnnotationAllow, f.AnnotationDeny)
+	}
+}
+
+// filter returns a copy of values with rejected keys dropped or hashed
+func (f *MetadataFilter) filter(kind string, values map[string]string, allow, deny []string) map[string]string {
+	filtered := make(map[string]string, len(values))
+	for k, v := range values {
+		if keyAllowed(k, allow, deny) {
+			filtered[k] = v
+			continue
+		}
+
+		if f.HashValues {
+			filtered[k] = HashValue(v)
+			metadataKeysRedactedTotal.WithLabelValues(kind, "hashed").Inc()
+		} else {
+			metadataKeysRedactedTotal.WithLabelValues(kind, "dropped").Inc()
+		}
+	}
+	return filtered
+}
+
+// HashValue returns a stable, non-reversible representation of a metadata value
+func HashValue(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// keyAllowed reports whether key passes the allow and deny patterns
+func keyAllowed(key string, allow, deny []string) bool {
+	if len(allow) > 0 && !matchAny(key, allow) {
+		return false
+	}
+	return !matchAny(key, deny)
+}
+
+// matchAny reports whether key matches any of the patterns
+func matchAny(key string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if GlobMatch(pattern, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// GlobMatch matches s against a pattern where "*" matches any run of
+// characters, including "/", and "?" matches exactly one. It is the glob
+// dialect of every pattern in the metadata and credential configuration.
+func GlobMatch(pattern, s string) bool {
+	px, sx := 0, 0
+	starPx, starSx := -1, 0
+	for sx < len(s) {
+		switch {
+		case px < len(pattern) && (pattern[px] == '?' || pattern[px] == s[sx]):
+			px++
+			sx++
+		case px < len(pattern) && pattern[px] == '*':
+			starPx, starSx = px, sx
+			px++
+		case starPx >= 0:
+			starSx++
+			px, sx = starPx+1, starSx
+		default:
+			return false
+		}
+	}
+	for px < len(pattern) && pattern[px] == '*' {
+		px++
+	}
+	return px == len(pattern)
+}
@@ -0,0 +1,159 @@
+package event
+
+import (
+	"testing"
+)
+
+func TestMetadataFilter_Apply(t *testing.T) {
+	labels := map[string]string{
+		"cert-webhook.golder.tech/enabled": "true",
+		"app.kubernetes.io/name":           "test-app",
+		"team":                             "platform",
+		"argocd.argoproj.io/instance":      "prod-apps",
+	}
+	annotations := map[string]string{
+		"cert-webhook.golder.tech/target":        "docker-compose",
+		"cert-webhook.golder.tech/docker-engine": "docker.example.com",
+	}
+
+	tests := []struct {
+		name                string
+		filter              *MetadataFilter
+		expectedLabels      map[string]string
+		expectedAnnotations map[string]string
+	}{
+		{
+			name:   "nil filter keeps everything",
+			filter: nil,
+			expectedLabels: map[string]string{
+				"cert-webhook.golder.tech/enabled": "true",
+				"app.kubernetes.io/name":           "test-app",
+				"team":                             "platform",
+				"argocd.argoproj.io/instance":      "prod-apps",
+			},
+			expectedAnnotations: annotations,
+		},
+		{
+			name: "allow list",
+			filter: &MetadataFilter{
+				LabelAllow: []string{"cert-webhook.golder.tech/*", "app.kubernetes.io/*"},
+			},
+			expectedLabels: map[string]string{
+				"cert-webhook.golder.tech/enabled": "true",
+				"app.kubernetes.io/name":           "test-app",
+			},
+			expectedAnnotations: annotations,
+		},
+		{
+			name: "deny list",
+			filter: &MetadataFilter{
+				LabelDeny:      []string{"team", "*argoproj.io/*"},
+				AnnotationDeny: []string{"*/docker-engine"},
+			},
+			expectedLabels: map[string]string{
+				"cert-webhook.golder.tech/enabled": "true",
+				"app.kubernetes.io/name":           "test-app",
+			},
+			expectedAnnotations: map[string]string{
+				"cert-webhook.golder.tech/target": "docker-compose",
+			},
+		},
+		{
+			name: "deny overrides allow",
+			filter: &MetadataFilter{
+				LabelAllow: []string{"*"},
+				LabelDeny:  []string{"team"},
+			},
+			expectedLabels: map[string]string{
+				"cert-webhook.golder.tech/enabled": "true",
+				"app.kubernetes.io/name":           "test-app",
+				"argocd.argoproj.io/instance":      "prod-apps",
+			},
+			expectedAnnotations: annotations,
+		},
+		{
+			name: "hash instead of drop",
+			filter: &MetadataFilter{
+				LabelDeny:  []string{"team", "argocd.argoproj.io/instance"},
+				HashValues: true,
+			},
+			expectedLabels: map[string]string{
+				"cert-webhook.golder.tech/enabled": "true",
+				"app.kubernetes.io/name":           "test-app",
+				"team":                             HashValue("platform"),
+				"argocd.argoproj.io/instance":      HashValue("prod-apps"),
+			},
+			expectedAnnotations: annotations,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := NewMessage("test-cert", "default", "test-cert-tls", labels, annotations)
+			tt.filter.Apply(&msg)
+
+			assertStringMap(t, "labels", tt.expectedLabels, msg.Metadata["labels"].(map[string]string))
+			assertStringMap(t, "annotations", tt.expectedAnnotations, msg.Metadata["annotations"].(map[string]string))
+		})
+	}
+}
+
+func TestMetadataFilter_DoesNotMutateInput(t *testing.T) {
+	labels := map[string]string{"team": "platform"}
+
+	msg := NewMessage("test-cert", "default", "test-cert-tls", labels, nil)
+	filter := &MetadataFilter{LabelDeny: []string{"team"}}
+	filter.Apply(&msg)
+
+	if labels["team"] != "platform" {
+		t.Error("expected source labels to be left untouched")
+	}
+}
+
+func TestHashValue(t *testing.T) {
+	if HashValue("a") != HashValue("a") {
+		t.Error("expected hash to be stable")
+	}
+	if HashValue("a") == HashValue("b") {
+		t.Error("expected different values to hash differently")
+	}
+	if HashValue("platform") == "platform" {
+		t.Error("expected value to be hashed")
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		key     string
+		match   bool
+	}{
+		{"*", "app.kubernetes.io/name", true},
+		{"app.kubernetes.io/*", "app.kubernetes.io/name", true},
+		{"app.kubernetes.io/*", "helm.sh/chart", false},
+		{"*argoproj.io/*", "argocd.argoproj.io/instance", true},
+		{"team", "team", true},
+		{"team", "teams", false},
+		{"team?", "teams", true},
+		{"", "", true},
+		{"", "team", false},
+	}
+
+	for _, tt := range tests {
+		if got := GlobMatch(tt.pattern, tt.key); got != tt.match {
+			t.Errorf("GlobMatch(%q, %q) = %v, expected %v", tt.pattern, tt.key, got, tt.match)
+		}
+	}
+}
+
+func assertStringMap(t *testing.T, name string, expected, actual map[string]string) {
+	t.Helper()
+	if len(actual) != len(expected) {
+		t.Fatalf("expected %d %s, got %d: %v", len(expected), name, len(actual), actual)
+	}
+	for k, v := range expected {
+		if actual[k] != v {
+			t.Errorf("expected %s[%q] = %q, got %q", name, k, v, actual[k])
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package httpsink
+
+import (
+	"sync"
+	"time"
+)
+
+// breakerState is the state of a destination's circuit breaker
+type breakerState string
+
+const (
+	// breakerClosed lets requests through
+	breakerClosed breakerState = "closed"
+	// breakerOpen fails requests immediately
+	breakerOpen breakerState = "open"
+	// breakerHalfOpen lets a single trial request through
+	breakerHalfOpen breakerState = "half-open"
+)
+
+var breakerStates = []breakerState{breakerClosed, breakerOpen, breakerHalfOpen}
+
+// circuitBreaker stops sending to a destination after consecutive failed
+// requests, so that an unavailable destination does not hold up every
+// publish with retries. After openDuration a single trial request is let
+// through; its outcome closes or re-opens the circuit.
+type circuitBreaker struct {
+	threshold    int
+	openDuration time.Duration
+	now          func() time.Time
+	// onChange is called with the new state, under the breaker lock
+	onChange func(breakerState)
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	trial    bool
+}
+
+func newCircuitBreaker(threshold int, openDuration time.Duration, onChange func(breakerState)) *circuitBreaker {
+	b := &circuitBreaker{
+		threshold:    threshold,
+		openDuration: openDuration,
+		now:          time.Now,
+		onChange:     onChange,
+		state:        breakerClosed,
+	}
+	b.onChange(breakerClosed)
+	return b
+}
+
+// allow reports whether a request may be sent
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if b.now().Sub(b.openedAt) < b.openDuration {
+			return false
+		}
+		b.setState(breakerHalfOpen)
+		b.trial = true
+		return true
+	case breakerHalfOpen:
+		// Only one trial request at a time
+		if b.trial {
+			return false
+		}
+		b.trial = true
+		return true
+	default:
+		return true
+	}
+}
+
+// success records a request that reached the destination
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	b.trial = false
+	if b.state != breakerClosed {
+		b.setState(breakerClosed)
+	}
+}
+
+// failure records a failed request, opening the circuit when the threshold
+// is reached or a trial request fails
+func (b *circuitBreaker) failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	b.trial = false
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.failures >= b.threshold) {
+		b.openedAt = b.now()
+		b.setState(breakerOpen)
+	}
+}
+
+// current returns the breaker state
+func (b *circuitBreaker) current() breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+func (b *circuitBreaker) setState(state breakerState) {
+	b.state = state
+	b.onChange(state)
+}
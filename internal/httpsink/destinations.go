@@ -0,0 +1,110 @@
+package httpsink
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/rossigee/cert-webhook-system/internal/event"
+	"sigs.k8s.io/yaml"
+)
+
+// Destination is an HTTP endpoint receiving events
+type Destination struct {
+	// Name identifies the destination in logs and metrics
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	// SecretFile holds the HMAC-SHA256 signing key. It is read for every
+	// request, so a rotated secret is used immediately. Requests are not
+	// signed without it.
+	SecretFile string `json:"secretFile,omitempty"`
+	// TargetTypes limits the destination to certificates with one of these
+	// target annotations (default all)
+	TargetTypes []string `json:"targetTypes,omitempty"`
+	// RoutingKeys are topic patterns the routing key must match, where *
+	// matches one word and # zero or more (default all)
+	RoutingKeys []string `json:"routingKeys,omitempty"`
+	// Headers are added to every request
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// destinationsFile is the format of the destinations file
+type destinationsFile struct {
+	Destinations []Destination `json:"destinations"`
+}
+
+// LoadDestinations reads and validates a destinations file. Unknown fields
+// are rejected so that typos don't silently drop settings.
+func LoadDestinations(path string) ([]Destination, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read destinations file: %w", err)
+	}
+
+	var file destinationsFile
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse destinations file: %w", err)
+	}
+	if len(file.Destinations) == 0 {
+		return nil, fmt.Errorf("destinations file %s lists no destinations", path)
+	}
+	return file.Destinations, nil
+}
+
+// validateDestinations checks that destinations have unique names and
+// absolute HTTP(S) URLs
+func validateDestinations(destinations []Destination) error {
+	var errs []error
+	names := make(map[string]bool)
+	for i, destination := range destinations {
+		if destination.Name == "" {
+			errs = append(errs, fmt.Errorf("destination %d has no name", i))
+		} else if names[destination.Name] {
+			errs = append(errs, fmt.Errorf("destination %q is listed twice", destination.Name))
+		}
+		names[destination.Name] = true
+
+		parsed, err := url.Parse(destination.URL)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			errs = append(errs, fmt.Errorf("destination %q has an invalid URL (expected http:// or https://)", destination.Name))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// matches reports whether an event is sent to the destination
+func (d Destination) matches(routingKey string, props event.Properties) bool {
+	if len(d.TargetTypes) > 0 && !slices.Contains(d.TargetTypes, props.Headers[event.HeaderTargetType]) {
+		return false
+	}
+	if len(d.RoutingKeys) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(d.RoutingKeys, func(pattern string) bool {
+		return topicMatch(strings.Split(pattern, "."), strings.Split(routingKey, "."))
+	})
+}
+
+// topicMatch matches routing key words against topic pattern words with
+// AMQP semantics
+func topicMatch(pattern, key []string) bool {
+	if len(pattern) == 0 {
+		return len(key) == 0
+	}
+	if pattern[0] == "#" {
+		// # matches zero or more words
+		for i := 0; i <= len(key); i++ {
+			if topicMatch(pattern[1:], key[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(key) == 0 || (pattern[0] != "*" && pattern[0] != key[0]) {
+		return false
+	}
+	return topicMatch(pattern[1:], key[1:])
+}
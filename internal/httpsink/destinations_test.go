@@ -0,0 +1,60 @@
+package httpsink
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTopicMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		key     string
+		want    bool
+	}{
+		{"certificate.renewed", "certificate.renewed", true},
+		{"certificate.*", "certificate.renewed", true},
+		{"certificate.*", "certificate.publish.failed", false},
+		{"certificate.#", "certificate.publish.failed", true},
+		{"certificate.#", "certificate", true},
+		{"#", "anything.at.all", true},
+		{"*.renewed", "certificate.expired", false},
+	}
+	for _, tt := range tests {
+		if got := topicMatch(strings.Split(tt.pattern, "."), strings.Split(tt.key, ".")); got != tt.want {
+			t.Errorf("topicMatch(%q, %q) = %v, want %v", tt.pattern, tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestLoadDestinations(t *testing.T) {
+	dir := t.TempDir()
+
+	path := filepath.Join(dir, "destinations.yaml")
+	content := `destinations:
+  - name: cdn
+    url: https://cdn.example.com/hooks/certificates
+    secretFile: /etc/cert-webhook/http/cdn
+    targetTypes: [cdn]
+`
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	destinations, err := LoadDestinations(path)
+	if err != nil {
+		t.Fatalf("failed to load destinations: %v", err)
+	}
+	if len(destinations) != 1 || destinations[0].Name != "cdn" || destinations[0].TargetTypes[0] != "cdn" {
+		t.Errorf("unexpected destinations %+v", destinations)
+	}
+
+	typo := filepath.Join(dir, "typo.yaml")
+	if err := os.WriteFile(typo, []byte("destinations:\n  - name: cdn\n    urll: https://example.com\n"), 0o600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if _, err := LoadDestinations(typo); err == nil {
+		t.Error("expected error for an unknown field")
+	}
+}
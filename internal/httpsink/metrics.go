@@ -0,0 +1,35 @@
+package httpsink
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_sink_requests_total",
+		Help: "Total number of HTTP sink requests by destination and response status (error when no response)",
+	}, []string{"destination", "status"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_sink_request_duration_seconds",
+		Help:    "Duration of HTTP sink requests",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"destination"})
+
+	retriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_sink_retries_total",
+		Help: "Total number of HTTP sink requests retried after a failure",
+	}, []string{"destination"})
+
+	circuitState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "http_sink_circuit_state",
+		Help: "Current circuit breaker state of each destination (1 for the current state)",
+	}, []string{"destination", "state"})
+)
+
+func init() {
+	prometheus.MustRegister(requestsTotal)
+	prometheus.MustRegister(requestDuration)
+	prometheus.MustRegister(retriesTotal)
+	prometheus.MustRegister(circuitState)
+}
@@ -0,0 +1,378 @@
+package httpsink
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/rossigee/cert-webhook-system/internal/event"
+	"github.com/rossigee/cert-webhook-system/internal/sink"
+)
+
+const (
+	defaultTimeout          = 10 * time.Second
+	defaultMaxAttempts      = 5
+	defaultInitialBackoff   = 500 * time.Millisecond
+	defaultMaxBackoff       = 30 * time.Second
+	defaultFailureThreshold = 5
+	defaultOpenDuration     = 30 * time.Second
+)
+
+// Request headers set on every delivery
+const (
+	HeaderTimestamp  = "X-Cert-Webhook-Timestamp"
+	HeaderSignature  = "X-Cert-Webhook-Signature"
+	HeaderDelivery   = "X-Cert-Webhook-Delivery"
+	HeaderEvent      = "X-Cert-Webhook-Event"
+	HeaderRoutingKey = "X-Cert-Webhook-Routing-Key"
+)
+
+// ErrCircuitOpen is returned for a destination whose circuit breaker is open
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// Config holds the configuration for the HTTP sink
+type Config struct {
+	Destinations []Destination
+
+	// Timeout bounds each request (default 10s)
+	Timeout time.Duration
+	// MaxAttempts is the number of requests per delivery, including the
+	// first (default 5)
+	MaxAttempts int
+	// InitialBackoff is the delay before the first retry, doubling up to
+	// MaxBackoff (defaults 500ms and 30s). Half of each delay is randomised.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	// FailureThreshold is the number of consecutive failed requests that
+	// opens a destination's circuit (default 5)
+	FailureThreshold int
+	// OpenDuration is how long an open circuit fails deliveries before a
+	// trial request is let through (default 30s)
+	OpenDuration time.Duration
+
+	Logger logr.Logger
+}
+
+// Sink delivers events to HTTP destinations as signed JSON POST requests
+type Sink struct {
+	client         *http.Client
+	destinations   []*destination
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	logger         logr.Logger
+}
+
+// destination is a destination with its circuit breaker
+type destination struct {
+	Destination
+	breaker *circuitBreaker
+}
+
+// New creates an HTTP sink
+func New(config Config) (*Sink, error) {
+	if len(config.Destinations) == 0 {
+		return nil, fmt.Errorf("at least one HTTP destination is required")
+	}
+	if err := validateDestinations(config.Destinations); err != nil {
+		return nil, err
+	}
+
+	s := &Sink{
+		client:         &http.Client{Timeout: orDefault(config.Timeout, defaultTimeout)},
+		maxAttempts:    config.MaxAttempts,
+		initialBackoff: orDefault(config.InitialBackoff, defaultInitialBackoff),
+		maxBackoff:     orDefault(config.MaxBackoff, defaultMaxBackoff),
+		logger:         config.Logger,
+	}
+	if s.maxAttempts <= 0 {
+		s.maxAttempts = defaultMaxAttempts
+	}
+
+	threshold := config.FailureThreshold
+	if threshold <= 0 {
+		threshold = defaultFailureThreshold
+	}
+	openDuration := orDefault(config.OpenDuration, defaultOpenDuration)
+
+	for _, d := range config.Destinations {
+		s.destinations = append(s.destinations, &destination{
+			Destination: d,
+			breaker: newCircuitBreaker(threshold, openDuration, func(state breakerState) {
+				for _, candidate := range breakerStates {
+					value := 0.0
+					if candidate == state {
+						value = 1
+					}
+					circuitState.WithLabelValues(d.Name, string(candidate)).Set(value)
+				}
+			}),
+		})
+	}
+
+	return s, nil
+}
+
+func orDefault(value, fallback time.Duration) time.Duration {
+	if value <= 0 {
+		return fallback
+	}
+	return value
+}
+
+// Name identifies the publisher in logs and errors
+func (s *Sink) Name() string {
+	return "http"
+}
+
+// Publish delivers a message to every matching destination in parallel and
+// fails if any delivery fails. An event no destination matches fails with
+// sink.ErrUnroutable.
+func (s *Sink) Publish(ctx context.Context, exchange, routingKey string, message any, props event.Properties) error {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+
+	var matching []*destination
+	for _, d := range s.destinations {
+		if d.matches(routingKey, props) {
+			matching = append(matching, d)
+		}
+	}
+	if len(matching) == 0 {
+		return fmt.Errorf("%w: no HTTP destination matches routing key %q", sink.ErrUnroutable, routingKey)
+	}
+
+	delivery := deliveryID(exchange, routingKey, props.ID, body)
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(matching))
+	for i, d := range matching {
+		wg.Go(func() {
+			if err := s.deliver(ctx, d, delivery, routingKey, body, props); err != nil {
+				errs[i] = fmt.Errorf("destination %q: %w", d.Name, err)
+			}
+		})
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// deliver sends the event to one destination, retrying failed requests with
+// jittered exponential backoff
+func (s *Sink) deliver(ctx context.Context, d *destination, delivery, routingKey string, body []byte, props event.Properties) error {
+	var lastErr error
+	for attempt := range s.maxAttempts {
+		if attempt > 0 {
+			retriesTotal.WithLabelValues(d.Name).Inc()
+			delay := s.backoffDelay(attempt - 1)
+			var retryAfter *retryAfterError
+			if errors.As(lastErr, &retryAfter) && retryAfter.delay > delay && retryAfter.delay <= s.maxBackoff {
+				delay = retryAfter.delay
+			}
+
+			timer := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return fmt.Errorf("%w (last error: %w)", ctx.Err(), lastErr)
+			case <-timer.C:
+			}
+		}
+
+		if !d.breaker.allow() {
+			if lastErr != nil {
+				return fmt.Errorf("%w (last error: %w)", ErrCircuitOpen, lastErr)
+			}
+			return ErrCircuitOpen
+		}
+
+		retry, err := s.send(ctx, d, delivery, routingKey, body, props)
+		if err == nil {
+			d.breaker.success()
+			return nil
+		}
+		lastErr = err
+
+		s.logger.Info("HTTP delivery attempt failed",
+			"destination", d.Name,
+			"attempt", attempt+1,
+			"error", err.Error())
+
+		if !retry {
+			// The destination answered, so it is reachable; the request
+			// itself is rejected and retrying cannot help
+			d.breaker.success()
+			return err
+		}
+		d.breaker.failure()
+	}
+	return lastErr
+}
+
+// send makes a single request, reporting whether a failure may be retried
+func (s *Sink) send(ctx context.Context, d *destination, delivery, routingKey string, body []byte, props event.Properties) (bool, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, d.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	for name, value := range d.Headers {
+		request.Header.Set(name, value)
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "cert-webhook-system")
+	request.Header.Set(HeaderDelivery, delivery)
+	request.Header.Set(HeaderEvent, props.Headers[event.HeaderEvent])
+	request.Header.Set(HeaderRoutingKey, routingKey)
+
+	if d.SecretFile != "" {
+		secret, err := readSecret(d.SecretFile)
+		if err != nil {
+			return false, err
+		}
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		request.Header.Set(HeaderTimestamp, timestamp)
+		request.Header.Set(HeaderSignature, Sign(secret, timestamp, body))
+	}
+
+	start := time.Now()
+	response, err := s.client.Do(request)
+	requestDuration.WithLabelValues(d.Name).Observe(time.Since(start).Seconds())
+	if err != nil {
+		requestsTotal.WithLabelValues(d.Name, "error").Inc()
+		return ctx.Err() == nil, fmt.Errorf("request failed: %w", err)
+	}
+	defer func() { _ = response.Body.Close() }()
+	_, _ = io.Copy(io.Discard, io.LimitReader(response.Body, 64<<10))
+
+	requestsTotal.WithLabelValues(d.Name, strconv.Itoa(response.StatusCode)).Inc()
+	s.logger.V(1).Info("HTTP delivery response",
+		"destination", d.Name,
+		"status", response.StatusCode,
+		"delivery", delivery)
+
+	switch code := response.StatusCode; {
+	case code >= 200 && code < 300:
+		return false, nil
+	case code == http.StatusTooManyRequests || code == http.StatusServiceUnavailable:
+		err := fmt.Errorf("destination responded with status %d", code)
+		if delay, ok := parseRetryAfter(response.Header.Get("Retry-After")); ok {
+			return true, &retryAfterError{err: err, delay: delay}
+		}
+		return true, err
+	case code == http.StatusRequestTimeout || code >= 500:
+		return true, fmt.Errorf("destination responded with status %d", code)
+	default:
+		return false, fmt.Errorf("destination rejected the event with status %d", code)
+	}
+}
+
+// backoffDelay returns the delay before retry n: exponential, capped at the
+// maximum backoff, with half of it randomised
+func (s *Sink) backoffDelay(retry int) time.Duration {
+	delay := s.maxBackoff
+	if retry < 16 {
+		delay = min(s.initialBackoff<<retry, s.maxBackoff)
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// HealthCheck fails when the circuit of every destination is open
+func (s *Sink) HealthCheck() error {
+	for _, d := range s.destinations {
+		if d.breaker.current() != breakerOpen {
+			return nil
+		}
+	}
+	return fmt.Errorf("circuit breaker open for every HTTP destination")
+}
+
+// Close releases idle connections
+func (s *Sink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+// Sign computes the signature header value: the hex HMAC-SHA256 of the
+// timestamp, a dot and the body. Receivers should recompute it and reject
+// requests whose timestamp is too old, to prevent replays.
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliveryID identifies an event, staying the same when a publish is
+// retried, so receivers can discard duplicates. It derives from the event ID,
+// which retries share although their bodies differ in timestamp; events
+// without an ID fall back to the body.
+func deliveryID(exchange, routingKey, id string, body []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(exchange))
+	hash.Write([]byte{0})
+	hash.Write([]byte(routingKey))
+	hash.Write([]byte{0})
+	if id != "" {
+		hash.Write([]byte(id))
+	} else {
+		hash.Write(body)
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:32]
+}
+
+// readSecret reads a signing secret file
+func readSecret(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing secret: %w", err)
+	}
+	secret := bytes.TrimSpace(data)
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("signing secret file %s is empty", path)
+	}
+	return secret, nil
+}
+
+// retryAfterError carries the delay a destination asked for
+type retryAfterError struct {
+	err   error
+	delay time.Duration
+}
+
+func (e *retryAfterError) Error() string { return e.err.Error() }
+func (e *retryAfterError) Unwrap() error { return e.err }
+
+// parseRetryAfter parses a Retry-After header in seconds or as an HTTP date
+func parseRetryAfter(value string) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(time.Until(date), 0), true
+	}
+	return 0, false
+}
@@ -0,0 +1,223 @@
+package httpsink
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rossigee/cert-webhook-system/internal/event"
+	"github.com/rossigee/cert-webhook-system/internal/sink"
+)
+
+var testProps = event.Properties{Headers: map[string]string{
+	event.HeaderEvent:      "certificate.renewed",
+	event.HeaderTargetType: "cdn",
+}}
+
+func newTestSink(t *testing.T, config Config) *Sink {
+	t.Helper()
+	config.InitialBackoff = time.Millisecond
+	config.MaxBackoff = 5 * time.Millisecond
+	s, err := New(config)
+	if err != nil {
+		t.Fatalf("failed to create sink: %v", err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+	return s
+}
+
+func TestSink_PublishSigned(t *testing.T) {
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secretFile, []byte("s3cret\n"), 0o600); err != nil {
+		t.Fatalf("failed to write secret: %v", err)
+	}
+
+	var received *http.Request
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	s := newTestSink(t, Config{Destinations: []Destination{{
+		Name:       "cdn",
+		URL:        server.URL,
+		SecretFile: secretFile,
+		Headers:    map[string]string{"X-Team": "payments"},
+	}}})
+
+	if err := s.Publish(t.Context(), event.DefaultExchange, "certificate.renewed", map[string]string{"event": "certificate.renewed"}, testProps); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+
+	timestamp := received.Header.Get(HeaderTimestamp)
+	if received.Header.Get(HeaderSignature) != Sign([]byte("s3cret"), timestamp, body) {
+		t.Errorf("signature %q does not match the body", received.Header.Get(HeaderSignature))
+	}
+	if received.Header.Get(HeaderEvent) != "certificate.renewed" || received.Header.Get("X-Team") != "payments" {
+		t.Errorf("unexpected headers %v", received.Header)
+	}
+	if received.Header.Get(HeaderDelivery) == "" {
+		t.Error("expected a delivery ID")
+	}
+}
+
+func TestSink_DeliveryIDStableAcrossRetries(t *testing.T) {
+	var deliveries []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deliveries = append(deliveries, r.Header.Get(HeaderDelivery))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	s := newTestSink(t, Config{Destinations: []Destination{{Name: "cdn", URL: server.URL}}})
+
+	props := testProps
+	props.ID = event.EventID("default", "api", "42", "certificate.renewed")
+	for _, timestamp := range []int64{1700000000, 1700000060} {
+		message := event.Message{Event: "certificate.renewed", Certificate: "api", Namespace: "default", Timestamp: timestamp}
+		if err := s.Publish(t.Context(), event.DefaultExchange, "certificate.renewed", message, props); err != nil {
+			t.Fatalf("failed to publish: %v", err)
+		}
+	}
+	// Events without an ID are told apart by their body
+	for _, timestamp := range []int64{1700000000, 1700000060} {
+		message := event.Message{Event: "certificate.renewed", Certificate: "api", Namespace: "default", Timestamp: timestamp}
+		if err := s.Publish(t.Context(), event.DefaultExchange, "certificate.renewed", message, testProps); err != nil {
+			t.Fatalf("failed to publish: %v", err)
+		}
+	}
+
+	if len(deliveries) != 4 || deliveries[0] == "" || deliveries[0] != deliveries[1] {
+		t.Errorf("expected retries of an event to share a delivery ID, got %v", deliveries)
+	}
+	if deliveries[2] == deliveries[3] || deliveries[2] == deliveries[0] {
+		t.Errorf("expected distinct delivery IDs without an event ID, got %v", deliveries)
+	}
+}
+
+func TestSink_RetriesServerErrors(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	s := newTestSink(t, Config{Destinations: []Destination{{Name: "bot", URL: server.URL}}})
+	if err := s.Publish(t.Context(), event.DefaultExchange, "certificate.renewed", map[string]string{}, testProps); err != nil {
+		t.Fatalf("expected delivery after retries, got %v", err)
+	}
+	if requests.Load() != 3 {
+		t.Errorf("expected 3 requests, got %d", requests.Load())
+	}
+}
+
+func TestSink_DoesNotRetryClientErrors(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	s := newTestSink(t, Config{Destinations: []Destination{{Name: "bot", URL: server.URL}}})
+	if err := s.Publish(t.Context(), event.DefaultExchange, "certificate.renewed", map[string]string{}, testProps); err == nil {
+		t.Fatal("expected error for a rejected event")
+	}
+	if requests.Load() != 1 {
+		t.Errorf("expected 1 request, got %d", requests.Load())
+	}
+}
+
+func TestSink_CircuitBreaker(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	s := newTestSink(t, Config{
+		Destinations:     []Destination{{Name: "bot", URL: server.URL}},
+		MaxAttempts:      5,
+		FailureThreshold: 2,
+		OpenDuration:     time.Hour,
+	})
+
+	err := s.Publish(t.Context(), event.DefaultExchange, "certificate.renewed", map[string]string{}, testProps)
+	if !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected the circuit to open, got %v", err)
+	}
+	if requests.Load() != 2 {
+		t.Errorf("expected 2 requests before the circuit opened, got %d", requests.Load())
+	}
+	if err := s.HealthCheck(); err == nil {
+		t.Error("expected unhealthy sink with every circuit open")
+	}
+
+	if err := s.Publish(t.Context(), event.DefaultExchange, "certificate.renewed", map[string]string{}, testProps); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("expected open circuit to fail fast, got %v", err)
+	}
+	if requests.Load() != 2 {
+		t.Errorf("expected no request while the circuit is open, got %d", requests.Load())
+	}
+}
+
+func TestSink_Routing(t *testing.T) {
+	var cdn, bot atomic.Int32
+	cdnServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { cdn.Add(1) }))
+	defer cdnServer.Close()
+	botServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { bot.Add(1) }))
+	defer botServer.Close()
+
+	s := newTestSink(t, Config{Destinations: []Destination{
+		{Name: "cdn", URL: cdnServer.URL, TargetTypes: []string{"cdn"}},
+		{Name: "bot", URL: botServer.URL, RoutingKeys: []string{"certificate.#"}},
+	}})
+
+	if err := s.Publish(t.Context(), event.DefaultExchange, "certificate.renewed", map[string]string{}, testProps); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+	if cdn.Load() != 1 || bot.Load() != 1 {
+		t.Errorf("expected both destinations, got cdn=%d bot=%d", cdn.Load(), bot.Load())
+	}
+
+	err := s.Publish(t.Context(), event.DefaultExchange, "other.event", map[string]string{}, event.Properties{})
+	if !errors.Is(err, sink.ErrUnroutable) {
+		t.Errorf("expected ErrUnroutable, got %v", err)
+	}
+}
+
+func TestNew_Validation(t *testing.T) {
+	for name, destinations := range map[string][]Destination{
+		"none":      nil,
+		"no name":   {{URL: "http://example.com"}},
+		"bad url":   {{Name: "a", URL: "ftp://example.com"}},
+		"duplicate": {{Name: "a", URL: "http://example.com"}, {Name: "a", URL: "http://example.org"}},
+	} {
+		if _, err := New(Config{Destinations: destinations}); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if delay, ok := parseRetryAfter("3"); !ok || delay != 3*time.Second {
+		t.Errorf("unexpected delay %v", delay)
+	}
+	if _, ok := parseRetryAfter("soon"); ok {
+		t.Error("expected invalid Retry-After to be ignored")
+	}
+}
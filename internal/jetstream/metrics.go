@@ -0,0 +1,23 @@
+package jetstream
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	publishesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "jetstream_publishes_total",
+		Help: "Total number of JetStream publishes by result (success, duplicate, unroutable, error)",
+	}, []string{"result"})
+
+	publishDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "jetstream_publish_duration_seconds",
+		Help:    "Time between publishing a message and receiving the JetStream acknowledgement",
+		Buckets: prometheus.DefBuckets,
+	})
+)
+
+func init() {
+	prometheus.MustRegister(publishesTotal)
+	prometheus.MustRegister(publishDuration)
+}
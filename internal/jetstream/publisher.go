@@ -0,0 +1,292 @@
+package jetstream
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/nats-io/nats.go"
+	natsjs "github.com/nats-io/nats.go/jetstream"
+	"github.com/rossigee/cert-webhook-system/internal/event"
+	"github.com/rossigee/cert-webhook-system/internal/sink"
+)
+
+const (
+	defaultPublishTimeout = 5 * time.Second
+	defaultDuplicates     = 2 * time.Minute
+)
+
+// Config holds the configuration for the JetStream publisher
+type Config struct {
+	// URL is the NATS server URL, or comma-separated URLs of cluster nodes
+	URL string
+	// CredentialsFile is a NATS credentials (JWT and NKey seed) file
+	CredentialsFile string
+
+	// PublishTimeout bounds how long Publish waits for the JetStream
+	// acknowledgement (default 5s)
+	PublishTimeout time.Duration
+
+	// Stream, when set, is created if it does not exist, capturing the
+	// subjects of Exchanges. Otherwise a stream must already capture the
+	// published subjects.
+	Stream string
+	// Exchanges are the exchanges whose subjects the created stream captures
+	Exchanges []string
+	// Duplicates is the deduplication window of the created stream
+	// (default 2m)
+	Duplicates time.Duration
+
+	// Logger reports a stream that could not be created in the background
+	Logger logr.Logger
+}
+
+// Publisher publishes events to NATS JetStream. The exchange and routing key
+// form the subject, e.g. certificate-events.certificate.renewed.
+type Publisher struct {
+	conn           *nats.Conn
+	js             natsjs.JetStream
+	publishTimeout time.Duration
+	config         Config
+	logger         logr.Logger
+
+	// ready is closed once the fields above are set, so that connection
+	// callbacks can use them
+	ready chan struct{}
+	// streamEnsured is set once the configured stream is known to exist
+	streamEnsured atomic.Bool
+}
+
+// NewPublisher connects to NATS and, when configured, ensures the stream
+// exists. If the server is not reachable yet, the connection is retried in
+// the background and the stream is ensured once it is established; until
+// then publishes fail.
+func NewPublisher(config Config) (*Publisher, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("NATS URL is required")
+	}
+
+	publishTimeout := config.PublishTimeout
+	if publishTimeout <= 0 {
+		publishTimeout = defaultPublishTimeout
+	}
+
+	p := &Publisher{
+		publishTimeout: publishTimeout,
+		config:         config,
+		logger:         config.Logger,
+		ready:          make(chan struct{}),
+	}
+
+	options := []nats.Option{
+		nats.Name("cert-webhook-system"),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+		nats.ConnectHandler(p.connected),
+		nats.ReconnectHandler(p.connected),
+	}
+	if config.CredentialsFile != "" {
+		options = append(options, nats.UserCredentials(config.CredentialsFile))
+	}
+
+	conn, err := nats.Connect(config.URL, options...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+
+	js, err := natsjs.New(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to create JetStream context: %w", err)
+	}
+
+	p.conn = conn
+	p.js = js
+
+	// A reachable server is expected to accept the stream, so that a
+	// misconfiguration fails at startup
+	if config.Stream != "" && conn.IsConnected() {
+		if err := p.ensureStream(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	close(p.ready)
+
+	return p, nil
+}
+
+// connected ensures the configured stream once a connection established in
+// the background is up, until that succeeds
+func (p *Publisher) connected(*nats.Conn) {
+	<-p.ready
+	if p.config.Stream == "" || p.streamEnsured.Load() {
+		return
+	}
+	if err := p.ensureStream(); err != nil {
+		p.logger.Error(err, "Failed to ensure the JetStream stream", "stream", p.config.Stream)
+	}
+}
+
+// ensureStream creates the configured stream unless it already exists. An
+// existing stream is left untouched, so it can be managed elsewhere.
+func (p *Publisher) ensureStream() error {
+	config := p.config
+	ctx, cancel := context.WithTimeout(context.Background(), p.publishTimeout)
+	defer cancel()
+
+	_, err := p.js.Stream(ctx, config.Stream)
+	if err == nil {
+		p.streamEnsured.Store(true)
+		return nil
+	}
+	if !errors.Is(err, natsjs.ErrStreamNotFound) {
+		return fmt.Errorf("failed to look up stream %q: %w", config.Stream, err)
+	}
+
+	duplicates := config.Duplicates
+	if duplicates <= 0 {
+		duplicates = defaultDuplicates
+	}
+
+	subjects := make([]string, 0, len(config.Exchanges))
+	for _, exchange := range config.Exchanges {
+		subjects = append(subjects, exchange+".>")
+	}
+
+	if _, err := p.js.CreateStream(ctx, natsjs.StreamConfig{
+		Name:       config.Stream,
+		Subjects:   subjects,
+		Storage:    natsjs.FileStorage,
+		Duplicates: duplicates,
+	}); err != nil && !errors.Is(err, natsjs.ErrStreamNameAlreadyInUse) {
+		return fmt.Errorf("failed to create stream %q: %w", config.Stream, err)
+	}
+	p.streamEnsured.Store(true)
+	return nil
+}
+
+// Name identifies the publisher in logs and errors
+func (p *Publisher) Name() string {
+	return "jetstream"
+}
+
+// Publish publishes a message and waits for JetStream to acknowledge that it
+// was stored. Expiration and priority have no JetStream equivalent and are
+// carried as headers only. A subject no stream captures fails with
+// sink.ErrUnroutable.
+func (p *Publisher) Publish(ctx context.Context, exchange, routingKey string, message any, props event.Properties) error {
+	msg, err := newMsg(exchange, routingKey, message, props)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.publishTimeout)
+	defer cancel()
+
+	start := time.Now()
+	ack, err := p.js.PublishMsg(ctx, msg)
+	publishDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		if errors.Is(err, natsjs.ErrNoStreamResponse) || errors.Is(err, nats.ErrNoResponders) {
+			publishesTotal.WithLabelValues("unroutable").Inc()
+			return fmt.Errorf("%w: no stream captures subject %q", sink.ErrUnroutable, msg.Subject)
+		}
+		publishesTotal.WithLabelValues("error").Inc()
+		return fmt.Errorf("failed to publish to subject %q: %w", msg.Subject, err)
+	}
+
+	if ack.Duplicate {
+		publishesTotal.WithLabelValues("duplicate").Inc()
+	} else {
+		publishesTotal.WithLabelValues("success").Inc()
+	}
+	return nil
+}
+
+// HealthCheck reports whether the NATS connection is established
+func (p *Publisher) HealthCheck() error {
+	switch status := p.conn.Status(); status {
+	case nats.CONNECTED:
+		return nil
+	case nats.CLOSED:
+		return fmt.Errorf("client is closed")
+	default:
+		if err := p.conn.LastError(); err != nil {
+			return fmt.Errorf("connection is %s: %w", strings.ToLower(status.String()), err)
+		}
+		return fmt.Errorf("connection is %s", strings.ToLower(status.String()))
+	}
+}
+
+// Endpoint returns the URL of the NATS server the client is connected to
+func (p *Publisher) Endpoint() string {
+	return p.conn.ConnectedUrlRedacted()
+}
+
+// Close closes the NATS connection
+func (p *Publisher) Close() error {
+	p.conn.Close()
+	return nil
+}
+
+// subject maps an exchange and routing key to a NATS subject
+func subject(exchange, routingKey string) string {
+	if routingKey == "" {
+		return exchange
+	}
+	return exchange + "." + routingKey
+}
+
+// headers converts the message properties to NATS headers
+func headers(props event.Properties) nats.Header {
+	header := nats.Header{}
+	for name, value := range props.Headers {
+		header.Set(name, value)
+	}
+	if props.Expiration > 0 {
+		header.Set("expiration", props.Expiration.String())
+	}
+	if props.Priority > 0 {
+		header.Set("priority", strconv.Itoa(int(props.Priority)))
+	}
+	return header
+}
+
+// newMsg builds the NATS message of an event
+func newMsg(exchange, routingKey string, message any, props event.Properties) (*nats.Msg, error) {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal message: %w", err)
+	}
+
+	msg := &nats.Msg{
+		Subject: subject(exchange, routingKey),
+		Data:    body,
+		Header:  headers(props),
+	}
+	if props.ID != "" {
+		msg.Header.Set(nats.MsgIdHdr, messageID(msg.Subject, props.ID))
+	}
+	return msg, nil
+}
+
+// messageID derives the Nats-Msg-Id from the subject and the event ID, so
+// that retries of an event published within the stream's duplicate window
+// are stored once. The body isn't used since its timestamp differs between
+// retries.
+func messageID(subject, id string) string {
+	hash := sha256.New()
+	hash.Write([]byte(subject))
+	hash.Write([]byte{0})
+	hash.Write([]byte(id))
+	return hex.EncodeToString(hash.Sum(nil))
+}
@@ -0,0 +1,207 @@
+package jetstream
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	natsjs "github.com/nats-io/nats.go/jetstream"
+	"github.com/rossigee/cert-webhook-system/internal/event"
+	"github.com/rossigee/cert-webhook-system/internal/sink"
+)
+
+// newTestServer starts an in-process NATS server with JetStream enabled on
+// the given port (-1 for a random one)
+func newTestServer(t *testing.T, port int) *server.Server {
+	t.Helper()
+	s, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      port,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	s.Start()
+	t.Cleanup(s.Shutdown)
+	if !s.ReadyForConnections(5 * time.Second) {
+		t.Fatal("server not ready")
+	}
+	return s
+}
+
+func newTestPublisher(t *testing.T, url, stream string) *Publisher {
+	t.Helper()
+	publisher, err := NewPublisher(Config{
+		URL:            url,
+		PublishTimeout: 2 * time.Second,
+		Stream:         stream,
+		Exchanges:      []string{event.DefaultExchange},
+	})
+	if err != nil {
+		t.Fatalf("failed to create publisher: %v", err)
+	}
+	t.Cleanup(func() { _ = publisher.Close() })
+	return publisher
+}
+
+// streamOf returns a handle on a stream of the server
+func streamOf(t *testing.T, s *server.Server, name string) (natsjs.Stream, error) {
+	t.Helper()
+	conn, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	t.Cleanup(conn.Close)
+	js, err := natsjs.New(conn)
+	if err != nil {
+		t.Fatalf("failed to create JetStream context: %v", err)
+	}
+	return js.Stream(t.Context(), name)
+}
+
+func TestNewPublisher_EmptyURL(t *testing.T) {
+	if _, err := NewPublisher(Config{}); err == nil {
+		t.Error("expected error for empty URL")
+	}
+}
+
+func TestPublisher_Publish(t *testing.T) {
+	s := newTestServer(t, -1)
+	publisher := newTestPublisher(t, s.ClientURL(), "CERTIFICATE_EVENTS")
+
+	if err := publisher.HealthCheck(); err != nil {
+		t.Fatalf("expected healthy publisher, got %v", err)
+	}
+
+	message := map[string]string{"event": "certificate.renewed"}
+	props := event.Properties{
+		ID:         event.EventID("default", "api-tls", "1", "certificate.renewed"),
+		Expiration: time.Minute,
+		Headers:    map[string]string{event.HeaderNamespace: "default"},
+	}
+	for range 2 {
+		if err := publisher.Publish(t.Context(), event.DefaultExchange, "certificate.renewed", message, props); err != nil {
+			t.Fatalf("failed to publish: %v", err)
+		}
+	}
+
+	stream, err := streamOf(t, s, "CERTIFICATE_EVENTS")
+	if err != nil {
+		t.Fatalf("expected the stream to be created: %v", err)
+	}
+	if msgs := stream.CachedInfo().State.Msgs; msgs != 1 {
+		t.Fatalf("expected the duplicate to be dropped, got %d messages", msgs)
+	}
+	stored, err := stream.GetMsg(t.Context(), 1)
+	if err != nil {
+		t.Fatalf("failed to get message: %v", err)
+	}
+	if stored.Subject != "certificate-events.certificate.renewed" {
+		t.Errorf("unexpected subject %q", stored.Subject)
+	}
+	if stored.Header.Get("Nats-Msg-Id") == "" {
+		t.Error("expected a Nats-Msg-Id header")
+	}
+	if stored.Header.Get(event.HeaderNamespace) != "default" || stored.Header.Get("expiration") != "1m0s" {
+		t.Errorf("unexpected headers %v", stored.Header)
+	}
+	if string(stored.Data) != `{"event":"certificate.renewed"}` {
+		t.Errorf("unexpected body %s", stored.Data)
+	}
+}
+
+func TestNewPublisher_StreamCreatedOnceConnected(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	_ = listener.Close()
+
+	// The server is not running yet, which must not fail the publisher
+	publisher := newTestPublisher(t, fmt.Sprintf("nats://127.0.0.1:%d", port), "CERTIFICATE_EVENTS")
+	if err := publisher.HealthCheck(); err == nil {
+		t.Error("expected the publisher to be unhealthy before connecting")
+	}
+
+	s := newTestServer(t, port)
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if _, err := streamOf(t, s, "CERTIFICATE_EVENTS"); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the stream to be created once connected")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err := publisher.Publish(t.Context(), event.DefaultExchange, "certificate.renewed", map[string]string{}, event.Properties{}); err != nil {
+		t.Errorf("failed to publish: %v", err)
+	}
+}
+
+func TestNewMsg_StableMessageID(t *testing.T) {
+	props := event.Properties{ID: event.EventID("default", "api-tls", "1", "certificate.renewed")}
+	build := func(props event.Properties, timestamp int64) string {
+		t.Helper()
+		message := event.Message{Event: "certificate.renewed", Certificate: "api-tls", Namespace: "default", Timestamp: timestamp}
+		msg, err := newMsg(event.DefaultExchange, "certificate.renewed", message, props)
+		if err != nil {
+			t.Fatalf("failed to build message: %v", err)
+		}
+		return msg.Header.Get("Nats-Msg-Id")
+	}
+
+	first := build(props, 1700000000)
+	if first == "" {
+		t.Fatal("expected a Nats-Msg-Id header")
+	}
+	if retried := build(props, 1700000060); retried != first {
+		t.Errorf("expected a retry to keep message ID %s, got %s", first, retried)
+	}
+
+	renewed := event.Properties{ID: event.EventID("default", "api-tls", "2", "certificate.renewed")}
+	if build(renewed, 1700000000) == first {
+		t.Error("expected a new resource version to get a new message ID")
+	}
+	if id := build(event.Properties{}, 1700000000); id != "" {
+		t.Errorf("expected no message ID without an event ID, got %s", id)
+	}
+}
+
+func TestPublisher_PublishUnroutable(t *testing.T) {
+	s := newTestServer(t, -1)
+	publisher := newTestPublisher(t, s.ClientURL(), "")
+
+	err := publisher.Publish(t.Context(), "other-events", "certificate.renewed", map[string]string{}, event.Properties{})
+	if !errors.Is(err, sink.ErrUnroutable) {
+		t.Errorf("expected ErrUnroutable, got %v", err)
+	}
+}
+
+func TestPublisher_Closed(t *testing.T) {
+	s := newTestServer(t, -1)
+	publisher := newTestPublisher(t, s.ClientURL(), "")
+
+	_ = publisher.Close()
+	if err := publisher.HealthCheck(); err == nil {
+		t.Error("expected closed publisher to be unhealthy")
+	}
+}
+
+func TestSubject(t *testing.T) {
+	if got := subject("certificate-events", "certificate.renewed"); got != "certificate-events.certificate.renewed" {
+		t.Errorf("unexpected subject %q", got)
+	}
+	if got := subject("certificate-events", ""); got != "certificate-events" {
+		t.Errorf("unexpected subject %q", got)
+	}
+}
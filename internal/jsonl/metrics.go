@@ -0,0 +1,14 @@
+package jsonl
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var recordsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "jsonl_records_total",
+	Help: "Total number of JSON Lines event records by result (written, error)",
+}, []string{"result"})
+
+func init() {
+	prometheus.MustRegister(recordsTotal)
+}
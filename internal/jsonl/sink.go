@@ -0,0 +1,100 @@
+package jsonl
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/rossigee/cert-webhook-system/internal/event"
+	"github.com/rossigee/cert-webhook-system/internal/sink"
+)
+
+// Sink writes events to JSON Lines only, for dry runs
+type Sink struct {
+	writer *Writer
+}
+
+// NewSink creates a dry-run publisher writing to writer
+func NewSink(writer *Writer) *Sink {
+	return &Sink{writer: writer}
+}
+
+// Name identifies the publisher in logs and errors
+func (s *Sink) Name() string {
+	return "jsonl"
+}
+
+// Publish writes the event as a recorded record
+func (s *Sink) Publish(_ context.Context, exchange, routingKey string, message any, props event.Properties) error {
+	return s.writer.Write(Record{
+		Time:        time.Now().UTC(),
+		Destination: s.Name(),
+		Exchange:    exchange,
+		RoutingKey:  routingKey,
+		Result:      ResultRecorded,
+		Properties:  props,
+		Message:     message,
+	})
+}
+
+// HealthCheck always succeeds
+func (s *Sink) HealthCheck() error {
+	return nil
+}
+
+// Close closes the output
+func (s *Sink) Close() error {
+	return s.writer.Close()
+}
+
+// Recorder is a publisher that records every event, and the result of
+// publishing it, after publishing it with the publisher it wraps
+type Recorder struct {
+	sink.Publisher
+	writer *Writer
+	logger logr.Logger
+}
+
+// NewRecorder wraps publisher, recording its events to writer
+func NewRecorder(publisher sink.Publisher, writer *Writer, logger logr.Logger) *Recorder {
+	return &Recorder{Publisher: publisher, writer: writer, logger: logger}
+}
+
+// Unwrap returns the wrapped publisher
+func (r *Recorder) Unwrap() sink.Publisher {
+	return r.Publisher
+}
+
+// Publish publishes the event and records the result. A record that cannot
+// be written is logged but does not fail the publish, which has already
+// happened.
+func (r *Recorder) Publish(ctx context.Context, exchange, routingKey string, message any, props event.Properties) error {
+	start := time.Now()
+	err := r.Publisher.Publish(ctx, exchange, routingKey, message, props)
+
+	record := Record{
+		Time:        start.UTC(),
+		Destination: r.Publisher.Name(),
+		Exchange:    exchange,
+		RoutingKey:  routingKey,
+		Result:      ResultPublished,
+		DurationMS:  float64(time.Since(start).Microseconds()) / 1000,
+		Properties:  props,
+		Message:     message,
+	}
+	if err != nil {
+		record.Result = ResultFailed
+		record.Error = err.Error()
+	}
+	if writeErr := r.writer.Write(record); writeErr != nil {
+		r.logger.Error(writeErr, "Failed to record event", "routing_key", routingKey)
+	}
+
+	return err
+}
+
+// Close closes the wrapped publisher and the output
+func (r *Recorder) Close() error {
+	return errors.Join(r.Publisher.Close(), r.writer.Close())
+}
@@ -0,0 +1,156 @@
+package jsonl
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/rossigee/cert-webhook-system/internal/event"
+	"github.com/rossigee/cert-webhook-system/internal/sink"
+)
+
+// fakePublisher fails publishes with err
+type fakePublisher struct {
+	err    error
+	closed bool
+}
+
+func (p *fakePublisher) Name() string { return "fake" }
+func (p *fakePublisher) Publish(context.Context, string, string, any, event.Properties) error {
+	return p.err
+}
+func (p *fakePublisher) HealthCheck() error { return nil }
+func (p *fakePublisher) Close() error {
+	p.closed = true
+	return nil
+}
+
+func readRecords(t *testing.T, path string) []map[string]any {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open records: %v", err)
+	}
+	defer func() { _ = file.Close() }()
+
+	var records []map[string]any
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var record map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("invalid record %q: %v", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("failed to read records: %v", err)
+	}
+	return records
+}
+
+func TestRecorder_Publish(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit", "events.jsonl")
+	writer, err := NewWriter(Config{Path: path})
+	if err != nil {
+		t.Fatalf("failed to create writer: %v", err)
+	}
+
+	publisher := &fakePublisher{}
+	recorder := NewRecorder(publisher, writer, logr.Discard())
+	if recorder.Name() != "fake" {
+		t.Errorf("expected the wrapped publisher's name, got %q", recorder.Name())
+	}
+	if unwrapped, ok := sink.As[*fakePublisher](recorder); !ok || unwrapped != publisher {
+		t.Error("expected sink.As to find the wrapped publisher")
+	}
+
+	message := event.Message{Event: "certificate.renewed", Certificate: "api-tls", Namespace: "default"}
+	if err := recorder.Publish(t.Context(), event.DefaultExchange, event.DefaultRoutingKey, message, event.Properties{}); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+
+	publisher.err = errors.New("broker unreachable")
+	if err := recorder.Publish(t.Context(), event.DefaultExchange, event.DefaultRoutingKey, message, event.Properties{}); err == nil {
+		t.Error("expected the publish error to be returned")
+	}
+	if err := recorder.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+	if !publisher.closed {
+		t.Error("expected the wrapped publisher to be closed")
+	}
+
+	records := readRecords(t, path)
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(records))
+	}
+	if records[0]["destination"] != "fake" || records[0]["result"] != ResultPublished || records[0]["routing_key"] != event.DefaultRoutingKey {
+		t.Errorf("unexpected record %v", records[0])
+	}
+	if records[1]["result"] != ResultFailed || records[1]["error"] != "broker unreachable" {
+		t.Errorf("unexpected record %v", records[1])
+	}
+	if records[1]["message"].(map[string]any)["certificate"] != "api-tls" {
+		t.Errorf("expected the message in the record, got %v", records[1]["message"])
+	}
+}
+
+func TestSink_DryRun(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	writer, err := NewWriter(Config{Path: path, MaxSizeMB: 1, Compress: true})
+	if err != nil {
+		t.Fatalf("failed to create writer: %v", err)
+	}
+	s := NewSink(writer)
+
+	// Enough records to rotate the 1 MB file
+	message := map[string]string{"padding": strings.Repeat("x", 64<<10)}
+	for range 20 {
+		if err := s.Publish(t.Context(), event.DefaultExchange, event.DefaultRoutingKey, message, event.Properties{}); err != nil {
+			t.Fatalf("failed to publish: %v", err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	records := readRecords(t, path)
+	if len(records) == 0 || len(records) == 20 || records[0]["result"] != ResultRecorded {
+		t.Errorf("expected the file to be rotated, got %d records", len(records))
+	}
+
+	// Rotated files are compressed in the background
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		compressed, _ := filepath.Glob(filepath.Join(filepath.Dir(path), "events-*.jsonl.gz"))
+		uncompressed, _ := filepath.Glob(filepath.Join(filepath.Dir(path), "events-*.jsonl"))
+		if len(compressed) > 0 && len(uncompressed) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected a compressed rotated file")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNewWriter_Validation(t *testing.T) {
+	if _, err := NewWriter(Config{}); err == nil {
+		t.Error("expected error without a path")
+	}
+	blocker := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(blocker, nil, 0o600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if _, err := NewWriter(Config{Path: filepath.Join(blocker, "events.jsonl")}); err == nil {
+		t.Error("expected error for an unusable directory")
+	}
+}
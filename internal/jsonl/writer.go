@@ -0,0 +1,127 @@
+package jsonl
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rossigee/cert-webhook-system/internal/event"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+const defaultMaxSizeMB = 100
+
+// Delivery results of a record
+const (
+	// ResultPublished records an event the publisher accepted
+	ResultPublished = "published"
+	// ResultFailed records an event the publisher failed to publish
+	ResultFailed = "failed"
+	// ResultRecorded records an event that was only written to the file, in
+	// a dry run
+	ResultRecorded = "recorded"
+)
+
+// Config holds the configuration for the JSON Lines writer
+type Config struct {
+	// Path is the file records are appended to, or "-" for stdout
+	Path string
+	// MaxSizeMB rotates the file when it reaches this size (default 100)
+	MaxSizeMB int
+	// MaxAgeDays removes rotated files older than this (default never)
+	MaxAgeDays int
+	// MaxBackups is the number of rotated files kept (default all)
+	MaxBackups int
+	// Compress gzips rotated files
+	Compress bool
+}
+
+// Record is one line of the file: an event and how its delivery went
+type Record struct {
+	Time time.Time `json:"time"`
+	// Destination is the publisher the event was sent to
+	Destination string           `json:"destination"`
+	Exchange    string           `json:"exchange"`
+	RoutingKey  string           `json:"routing_key"`
+	Result      string           `json:"result"`
+	Error       string           `json:"error,omitempty"`
+	DurationMS  float64          `json:"duration_ms,omitempty"`
+	Properties  event.Properties `json:"properties"`
+	Message     any              `json:"message"`
+}
+
+// Writer appends records to stdout or a rotating file, one JSON object per
+// line
+type Writer struct {
+	mu  sync.Mutex
+	out io.Writer
+	// closer is nil for stdout, which is not closed
+	closer io.Closer
+}
+
+// NewWriter opens the JSON Lines output
+func NewWriter(config Config) (*Writer, error) {
+	if config.Path == "" {
+		return nil, fmt.Errorf("a JSON Lines path is required (- for stdout)")
+	}
+	if config.Path == "-" {
+		return &Writer{out: os.Stdout}, nil
+	}
+
+	// Fail at startup rather than on the first event if the directory is
+	// missing or not writable
+	if err := os.MkdirAll(filepath.Dir(config.Path), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create JSON Lines directory: %w", err)
+	}
+	file, err := os.OpenFile(config.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open JSON Lines file: %w", err)
+	}
+	_ = file.Close()
+
+	maxSize := config.MaxSizeMB
+	if maxSize <= 0 {
+		maxSize = defaultMaxSizeMB
+	}
+	logger := &lumberjack.Logger{
+		Filename:   config.Path,
+		MaxSize:    maxSize,
+		MaxAge:     config.MaxAgeDays,
+		MaxBackups: config.MaxBackups,
+		Compress:   config.Compress,
+	}
+	return &Writer{out: logger, closer: logger}, nil
+}
+
+// Write appends a record
+func (w *Writer) Write(record Record) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		recordsTotal.WithLabelValues("error").Inc()
+		return fmt.Errorf("failed to marshal record: %w", err)
+	}
+	line = append(line, '\n')
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, err := w.out.Write(line); err != nil {
+		recordsTotal.WithLabelValues("error").Inc()
+		return fmt.Errorf("failed to write record: %w", err)
+	}
+	recordsTotal.WithLabelValues("written").Inc()
+	return nil
+}
+
+// Close closes the file
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closer == nil {
+		return nil
+	}
+	return w.closer.Close()
+}
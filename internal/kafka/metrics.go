@@ -0,0 +1,23 @@
+package kafka
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	producesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kafka_produces_total",
+		Help: "Total number of Kafka delivery reports by topic and result (success, unroutable, error)",
+	}, []string{"topic", "result"})
+
+	produceDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "kafka_produce_duration_seconds",
+		Help:    "Time between producing a record and receiving its delivery report",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"topic"})
+)
+
+func init() {
+	prometheus.MustRegister(producesTotal)
+	prometheus.MustRegister(produceDuration)
+}
@@ -0,0 +1,239 @@
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rossigee/cert-webhook-system/internal/event"
+	"github.com/rossigee/cert-webhook-system/internal/sink"
+	"github.com/rossigee/cert-webhook-system/internal/tlsconfig"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/sasl"
+	"github.com/twmb/franz-go/pkg/sasl/plain"
+	"github.com/twmb/franz-go/pkg/sasl/scram"
+)
+
+const (
+	defaultProduceTimeout = 10 * time.Second
+	healthCheckTimeout    = 5 * time.Second
+)
+
+// SASL mechanisms supported by the producer
+const (
+	SASLPlain       = "PLAIN"
+	SASLScramSHA256 = "SCRAM-SHA-256"
+	SASLScramSHA512 = "SCRAM-SHA-512"
+)
+
+// Config holds the configuration for the Kafka producer
+type Config struct {
+	// Brokers are the seed brokers used to discover the cluster
+	Brokers []string
+
+	// ProduceTimeout bounds how long Publish waits for the delivery report
+	// (default 10s)
+	ProduceTimeout time.Duration
+
+	// TLS configures encryption and client certificates
+	TLS tlsconfig.Config
+
+	// SASLMechanism is PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512 (disabled when
+	// empty)
+	SASLMechanism string
+	// SASLUsername is the SASL user
+	SASLUsername string
+	// SASLPasswordFile holds the SASL password. It is read on every
+	// authentication, so a rotated password is used on the next connection.
+	SASLPasswordFile string
+}
+
+// Producer publishes events to Kafka. The exchange is the topic and the
+// namespace/certificate is the partition key, so events of one certificate
+// stay in order.
+type Producer struct {
+	client         *kgo.Client
+	produceTimeout time.Duration
+}
+
+// NewProducer creates an idempotent producer. Brokers are connected lazily,
+// so the producer can be created while the cluster is unreachable.
+func NewProducer(config Config) (*Producer, error) {
+	if len(config.Brokers) == 0 {
+		return nil, fmt.Errorf("at least one Kafka broker is required")
+	}
+
+	produceTimeout := config.ProduceTimeout
+	if produceTimeout <= 0 {
+		produceTimeout = defaultProduceTimeout
+	}
+
+	options := []kgo.Opt{
+		kgo.SeedBrokers(config.Brokers...),
+		kgo.ClientID("cert-webhook-system"),
+		// Idempotent writes require acknowledgement by all in-sync replicas
+		kgo.RequiredAcks(kgo.AllISRAcks()),
+		kgo.RecordDeliveryTimeout(produceTimeout),
+		// Fail fast on missing topics rather than waiting for the timeout
+		kgo.UnknownTopicRetries(2),
+		kgo.ProducerLinger(0),
+	}
+
+	tlsConfig, err := tlsconfig.New(config.TLS)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		options = append(options, kgo.DialTLSConfig(tlsConfig))
+	}
+
+	if config.SASLMechanism != "" {
+		mechanism, err := saslMechanism(config)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, kgo.SASL(mechanism))
+	}
+
+	client, err := kgo.NewClient(options...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Kafka client: %w", err)
+	}
+
+	return &Producer{
+		client:         client,
+		produceTimeout: produceTimeout,
+	}, nil
+}
+
+// saslMechanism builds the configured SASL mechanism
+func saslMechanism(config Config) (sasl.Mechanism, error) {
+	if config.SASLUsername == "" || config.SASLPasswordFile == "" {
+		return nil, fmt.Errorf("SASL authentication requires a username and a password file")
+	}
+	if _, err := readPassword(config.SASLPasswordFile); err != nil {
+		return nil, err
+	}
+
+	scramAuth := func(context.Context) (scram.Auth, error) {
+		password, err := readPassword(config.SASLPasswordFile)
+		return scram.Auth{User: config.SASLUsername, Pass: password}, err
+	}
+
+	switch strings.ToUpper(config.SASLMechanism) {
+	case SASLPlain:
+		return plain.Plain(func(context.Context) (plain.Auth, error) {
+			password, err := readPassword(config.SASLPasswordFile)
+			return plain.Auth{User: config.SASLUsername, Pass: password}, err
+		}), nil
+	case SASLScramSHA256:
+		return scram.Sha256(scramAuth), nil
+	case SASLScramSHA512:
+		return scram.Sha512(scramAuth), nil
+	default:
+		return nil, fmt.Errorf("unsupported SASL mechanism %q (expected %s, %s or %s)",
+			config.SASLMechanism, SASLPlain, SASLScramSHA256, SASLScramSHA512)
+	}
+}
+
+// readPassword reads the SASL password file
+func readPassword(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read Kafka SASL password file: %w", err)
+	}
+	password := strings.TrimSpace(string(data))
+	if password == "" {
+		return "", fmt.Errorf("Kafka SASL password file %s is empty", path)
+	}
+	return password, nil
+}
+
+// Name identifies the publisher in logs and errors
+func (p *Producer) Name() string {
+	return "kafka"
+}
+
+// Publish produces a message to the exchange topic and waits for its
+// delivery report. A topic that does not exist fails with
+// sink.ErrUnroutable.
+func (p *Producer) Publish(ctx context.Context, exchange, routingKey string, message any, props event.Properties) error {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+
+	record := &kgo.Record{
+		Topic:   exchange,
+		Key:     partitionKey(props),
+		Value:   body,
+		Headers: headers(routingKey, props),
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.produceTimeout)
+	defer cancel()
+
+	start := time.Now()
+	err = p.client.ProduceSync(ctx, record).FirstErr()
+	produceDuration.WithLabelValues(exchange).Observe(time.Since(start).Seconds())
+	if err != nil {
+		if errors.Is(err, kerr.UnknownTopicOrPartition) || errors.Is(err, kerr.UnknownTopicID) {
+			producesTotal.WithLabelValues(exchange, "unroutable").Inc()
+			return fmt.Errorf("%w: topic %q does not exist", sink.ErrUnroutable, exchange)
+		}
+		producesTotal.WithLabelValues(exchange, "error").Inc()
+		return fmt.Errorf("failed to produce to topic %q: %w", exchange, err)
+	}
+
+	producesTotal.WithLabelValues(exchange, "success").Inc()
+	return nil
+}
+
+// HealthCheck reports whether a broker of the cluster is reachable
+func (p *Producer) HealthCheck() error {
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+
+	if err := p.client.Ping(ctx); err != nil {
+		return fmt.Errorf("no Kafka broker reachable: %w", err)
+	}
+	return nil
+}
+
+// Close flushes buffered records and closes the client
+func (p *Producer) Close() error {
+	p.client.Close()
+	return nil
+}
+
+// partitionKey keys records by namespace/certificate, falling back to no key
+// (spreading records over partitions) for events without a certificate
+func partitionKey(props event.Properties) []byte {
+	namespace := props.Headers[event.HeaderNamespace]
+	certificate := props.Headers[event.HeaderCertificate]
+	if namespace == "" || certificate == "" {
+		return nil
+	}
+	return []byte(namespace + "/" + certificate)
+}
+
+// headers converts the routing key and message properties to record headers
+func headers(routingKey string, props event.Properties) []kgo.RecordHeader {
+	headers := []kgo.RecordHeader{{Key: "routing-key", Value: []byte(routingKey)}}
+	for name, value := range props.Headers {
+		headers = append(headers, kgo.RecordHeader{Key: name, Value: []byte(value)})
+	}
+	if props.Expiration > 0 {
+		headers = append(headers, kgo.RecordHeader{Key: "expiration", Value: []byte(props.Expiration.String())})
+	}
+	if props.Priority > 0 {
+		headers = append(headers, kgo.RecordHeader{Key: "priority", Value: []byte(strconv.Itoa(int(props.Priority)))})
+	}
+	return headers
+}
@@ -0,0 +1,128 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rossigee/cert-webhook-system/internal/event"
+	"github.com/rossigee/cert-webhook-system/internal/sink"
+	"github.com/twmb/franz-go/pkg/kfake"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+func newTestCluster(t *testing.T) *kfake.Cluster {
+	t.Helper()
+	cluster, err := kfake.NewCluster(kfake.NumBrokers(1), kfake.SeedTopics(3, event.DefaultExchange))
+	if err != nil {
+		t.Fatalf("failed to start Kafka cluster: %v", err)
+	}
+	t.Cleanup(cluster.Close)
+	return cluster
+}
+
+func newTestProducer(t *testing.T, cluster *kfake.Cluster) *Producer {
+	t.Helper()
+	producer, err := NewProducer(Config{Brokers: cluster.ListenAddrs(), ProduceTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatalf("failed to create producer: %v", err)
+	}
+	t.Cleanup(func() { _ = producer.Close() })
+	return producer
+}
+
+func TestNewProducer_Validation(t *testing.T) {
+	if _, err := NewProducer(Config{}); err == nil {
+		t.Error("expected error without brokers")
+	}
+
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(passwordFile, []byte("secret\n"), 0o600); err != nil {
+		t.Fatalf("failed to write password: %v", err)
+	}
+
+	if _, err := NewProducer(Config{Brokers: []string{"localhost:9092"}, SASLMechanism: "GSSAPI", SASLUsername: "user", SASLPasswordFile: passwordFile}); err == nil {
+		t.Error("expected error for an unsupported SASL mechanism")
+	}
+	if _, err := NewProducer(Config{Brokers: []string{"localhost:9092"}, SASLMechanism: SASLPlain}); err == nil {
+		t.Error("expected error for SASL without credentials")
+	}
+
+	producer, err := NewProducer(Config{Brokers: []string{"localhost:9092"}, SASLMechanism: "scram-sha-512", SASLUsername: "user", SASLPasswordFile: passwordFile})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_ = producer.Close()
+}
+
+func TestProducer_Publish(t *testing.T) {
+	cluster := newTestCluster(t)
+	producer := newTestProducer(t, cluster)
+
+	if err := producer.HealthCheck(); err != nil {
+		t.Fatalf("expected healthy producer, got %v", err)
+	}
+
+	message := map[string]string{"event": "certificate.renewed"}
+	props := event.Properties{Headers: map[string]string{
+		event.HeaderNamespace:   "default",
+		event.HeaderCertificate: "my-cert",
+	}}
+	if err := producer.Publish(t.Context(), event.DefaultExchange, "certificate.renewed", message, props); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+
+	consumer, err := kgo.NewClient(
+		kgo.SeedBrokers(cluster.ListenAddrs()...),
+		kgo.ConsumeTopics(event.DefaultExchange),
+	)
+	if err != nil {
+		t.Fatalf("failed to create consumer: %v", err)
+	}
+	defer consumer.Close()
+
+	ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+	defer cancel()
+	fetches := consumer.PollFetches(ctx)
+	if err := fetches.Err(); err != nil {
+		t.Fatalf("failed to consume: %v", err)
+	}
+	records := fetches.Records()
+	if len(records) != 1 {
+		t.Fatalf("expected 1 record, got %d", len(records))
+	}
+
+	record := records[0]
+	if string(record.Key) != "default/my-cert" {
+		t.Errorf("unexpected partition key %q", record.Key)
+	}
+	if string(record.Value) != `{"event":"certificate.renewed"}` {
+		t.Errorf("unexpected value %s", record.Value)
+	}
+	found := map[string]string{}
+	for _, header := range record.Headers {
+		found[header.Key] = string(header.Value)
+	}
+	if found["routing-key"] != "certificate.renewed" || found[event.HeaderCertificate] != "my-cert" {
+		t.Errorf("unexpected headers %v", found)
+	}
+}
+
+func TestProducer_PublishUnknownTopic(t *testing.T) {
+	cluster := newTestCluster(t)
+	producer := newTestProducer(t, cluster)
+
+	err := producer.Publish(t.Context(), "other-events", "certificate.renewed", map[string]string{}, event.Properties{})
+	if !errors.Is(err, sink.ErrUnroutable) {
+		t.Errorf("expected ErrUnroutable, got %v", err)
+	}
+}
+
+func TestPartitionKey(t *testing.T) {
+	if key := partitionKey(event.Properties{}); key != nil {
+		t.Errorf("expected no key without certificate headers, got %q", key)
+	}
+}
@@ -0,0 +1,29 @@
+package mqtt
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	publishesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mqtt_publishes_total",
+		Help: "Total number of MQTT publishes by result (success, timeout, error)",
+	}, []string{"result"})
+
+	publishDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "mqtt_publish_duration_seconds",
+		Help:    "Time between publishing a message and the broker acknowledgement",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	connected = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "mqtt_connected",
+		Help: "Whether the MQTT broker connection is established (1) or not (0)",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(publishesTotal)
+	prometheus.MustRegister(publishDuration)
+	prometheus.MustRegister(connected)
+}
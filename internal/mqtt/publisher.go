@@ -0,0 +1,219 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/rossigee/cert-webhook-system/internal/event"
+	"github.com/rossigee/cert-webhook-system/internal/tlsconfig"
+)
+
+const (
+	defaultTopicPrefix    = "certificates"
+	defaultPublishTimeout = 5 * time.Second
+)
+
+// Config holds the configuration for the MQTT publisher
+type Config struct {
+	// URL is the broker URL (tcp://, ssl://, ws:// or wss://), or
+	// comma-separated URLs tried in order
+	URL string
+	// ClientID identifies the connection to the broker and must be unique
+	// (default cert-webhook-<hostname>)
+	ClientID string
+	// Username and PasswordFile authenticate the connection. The password
+	// file is re-read on every (re)connect.
+	Username     string
+	PasswordFile string
+
+	// TopicPrefix is the first topic level (default certificates)
+	TopicPrefix string
+	// QoS is the delivery guarantee: 0 at most once, 1 at least once, 2
+	// exactly once
+	QoS byte
+	// Retain keeps the last message of each topic on the broker, so that a
+	// subscriber learns the latest state of a certificate on connect
+	Retain bool
+
+	// PublishTimeout bounds how long Publish waits for the broker to
+	// acknowledge a message (default 5s)
+	PublishTimeout time.Duration
+
+	// TLS configures encryption and client certificates for ssl:// and
+	// wss:// URLs
+	TLS tlsconfig.Config
+}
+
+// Publisher publishes events to an MQTT broker (protocol 3.1.1, which MQTT 5
+// brokers also accept). Events are published to
+// <prefix>/<namespace>/<certificate>/<action>, e.g.
+// certificates/default/my-cert/renewed.
+type Publisher struct {
+	client         paho.Client
+	topicPrefix    string
+	qos            byte
+	retain         bool
+	publishTimeout time.Duration
+}
+
+// NewPublisher creates a publisher. The connection is established and
+// re-established in the background, so the broker need not be reachable yet.
+func NewPublisher(config Config) (*Publisher, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("MQTT URL is required")
+	}
+	if config.QoS > 2 {
+		return nil, fmt.Errorf("invalid MQTT QoS %d (expected 0, 1 or 2)", config.QoS)
+	}
+
+	clientID := config.ClientID
+	if clientID == "" {
+		hostname, _ := os.Hostname()
+		clientID = "cert-webhook-" + hostname
+	}
+
+	options := paho.NewClientOptions().
+		SetClientID(clientID).
+		SetProtocolVersion(4).
+		SetCleanSession(true).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetOrderMatters(false)
+	for _, url := range strings.Split(config.URL, ",") {
+		if url = strings.TrimSpace(url); url != "" {
+			options.AddBroker(url)
+		}
+	}
+
+	tlsConfig, err := tlsconfig.New(config.TLS)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		options.SetTLSConfig(tlsConfig)
+	}
+
+	if config.Username != "" || config.PasswordFile != "" {
+		if _, err := readPassword(config.PasswordFile); config.PasswordFile != "" && err != nil {
+			return nil, err
+		}
+		options.SetCredentialsProvider(func() (string, string) {
+			if config.PasswordFile == "" {
+				return config.Username, ""
+			}
+			// A failed read is reported by the broker rejecting the login
+			password, _ := readPassword(config.PasswordFile)
+			return config.Username, password
+		})
+	}
+
+	options.SetOnConnectHandler(func(paho.Client) {
+		connected.Set(1)
+	})
+	options.SetConnectionLostHandler(func(paho.Client, error) {
+		connected.Set(0)
+	})
+
+	client := paho.NewClient(options)
+	// With connect retry the token only completes once connected
+	client.Connect()
+
+	topicPrefix := config.TopicPrefix
+	if topicPrefix == "" {
+		topicPrefix = defaultTopicPrefix
+	}
+	publishTimeout := config.PublishTimeout
+	if publishTimeout <= 0 {
+		publishTimeout = defaultPublishTimeout
+	}
+
+	return &Publisher{
+		client:         client,
+		topicPrefix:    strings.TrimSuffix(topicPrefix, "/"),
+		qos:            config.QoS,
+		retain:         config.Retain,
+		publishTimeout: publishTimeout,
+	}, nil
+}
+
+// readPassword reads the password file
+func readPassword(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read MQTT password file: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// Name identifies the publisher in logs and errors
+func (p *Publisher) Name() string {
+	return "mqtt"
+}
+
+// Publish publishes a message and, for QoS 1 and 2, waits for the broker to
+// acknowledge it. MQTT 3.1.1 has no message headers or expiration, so the
+// message properties are not sent; the exchange is not part of the topic.
+func (p *Publisher) Publish(ctx context.Context, exchange, routingKey string, message any, props event.Properties) error {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+
+	topic := p.topic(routingKey, props)
+
+	ctx, cancel := context.WithTimeout(ctx, p.publishTimeout)
+	defer cancel()
+
+	start := time.Now()
+	token := p.client.Publish(topic, p.qos, p.retain, body)
+	select {
+	case <-token.Done():
+	case <-ctx.Done():
+		publishesTotal.WithLabelValues("timeout").Inc()
+		return fmt.Errorf("timed out publishing to topic %q: %w", topic, ctx.Err())
+	}
+	publishDuration.Observe(time.Since(start).Seconds())
+
+	if err := token.Error(); err != nil {
+		publishesTotal.WithLabelValues("error").Inc()
+		return fmt.Errorf("failed to publish to topic %q: %w", topic, err)
+	}
+
+	publishesTotal.WithLabelValues("success").Inc()
+	return nil
+}
+
+// topic maps an event to its topic. The action is the routing key without
+// the certificate. prefix, with dots as levels; events without a certificate
+// are published directly below the topic prefix.
+func (p *Publisher) topic(routingKey string, props event.Properties) string {
+	action := strings.ReplaceAll(strings.TrimPrefix(routingKey, "certificate."), ".", "/")
+
+	namespace := props.Headers[event.HeaderNamespace]
+	certificate := props.Headers[event.HeaderCertificate]
+	if namespace == "" || certificate == "" {
+		return p.topicPrefix + "/" + action
+	}
+	return p.topicPrefix + "/" + namespace + "/" + certificate + "/" + action
+}
+
+// HealthCheck reports whether the broker connection is established
+func (p *Publisher) HealthCheck() error {
+	if !p.client.IsConnectionOpen() {
+		return fmt.Errorf("not connected to the MQTT broker")
+	}
+	return nil
+}
+
+// Close disconnects from the broker, giving in-flight messages time to be
+// acknowledged
+func (p *Publisher) Close() error {
+	p.client.Disconnect(uint(p.publishTimeout.Milliseconds()))
+	connected.Set(0)
+	return nil
+}
@@ -0,0 +1,107 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/rossigee/cert-webhook-system/internal/event"
+)
+
+// newTestBroker starts an in-process MQTT broker, returning its URL
+func newTestBroker(t *testing.T) (*mochi.Server, string) {
+	t.Helper()
+
+	server := mochi.New(&mochi.Options{InlineClient: true})
+	if err := server.AddHook(new(auth.AllowHook), nil); err != nil {
+		t.Fatalf("failed to add auth hook: %v", err)
+	}
+	listener := listeners.NewTCP(listeners.Config{ID: "tcp", Address: "127.0.0.1:0"})
+	if err := server.AddListener(listener); err != nil {
+		t.Fatalf("failed to add listener: %v", err)
+	}
+	go func() { _ = server.Serve() }()
+	t.Cleanup(func() { _ = server.Close() })
+
+	return server, "tcp://" + listener.Address()
+}
+
+func newTestPublisher(t *testing.T, url string) *Publisher {
+	t.Helper()
+	publisher, err := NewPublisher(Config{URL: url, ClientID: t.Name(), QoS: 1, Retain: true})
+	if err != nil {
+		t.Fatalf("failed to create publisher: %v", err)
+	}
+	t.Cleanup(func() { _ = publisher.Close() })
+
+	deadline := time.Now().Add(5 * time.Second)
+	for publisher.HealthCheck() != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("publisher did not connect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return publisher
+}
+
+func TestNewPublisher_Validation(t *testing.T) {
+	if _, err := NewPublisher(Config{}); err == nil {
+		t.Error("expected error for empty URL")
+	}
+	if _, err := NewPublisher(Config{URL: "tcp://localhost:1883", QoS: 3}); err == nil {
+		t.Error("expected error for invalid QoS")
+	}
+}
+
+func TestPublisher_PublishRetained(t *testing.T) {
+	server, url := newTestBroker(t)
+	publisher := newTestPublisher(t, url)
+
+	props := event.Properties{Headers: map[string]string{
+		event.HeaderNamespace:   "default",
+		event.HeaderCertificate: "my-cert",
+	}}
+	if err := publisher.Publish(t.Context(), event.DefaultExchange, "certificate.renewed", map[string]string{"event": "certificate.renewed"}, props); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+
+	// A subscriber connecting afterwards receives the retained message
+	received := make(chan packets.Packet, 1)
+	if err := server.Subscribe("certificates/#", 1, func(_ *mochi.Client, _ packets.Subscription, pk packets.Packet) {
+		received <- pk
+	}); err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+
+	select {
+	case pk := <-received:
+		if pk.TopicName != "certificates/default/my-cert/renewed" {
+			t.Errorf("unexpected topic %q", pk.TopicName)
+		}
+		if !pk.FixedHeader.Retain {
+			t.Error("expected a retained message")
+		}
+		if string(pk.Payload) != `{"event":"certificate.renewed"}` {
+			t.Errorf("unexpected payload %s", pk.Payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the retained message")
+	}
+}
+
+func TestPublisher_Topic(t *testing.T) {
+	publisher := &Publisher{topicPrefix: "certificates"}
+
+	if got := publisher.topic("certificate.publish-failed", event.Properties{Headers: map[string]string{
+		event.HeaderNamespace:   "web",
+		event.HeaderCertificate: "site",
+	}}); got != "certificates/web/site/publish-failed" {
+		t.Errorf("unexpected topic %q", got)
+	}
+	if got := publisher.topic("certificate.renewed", event.Properties{}); got != "certificates/renewed" {
+		t.Errorf("unexpected topic %q", got)
+	}
+}
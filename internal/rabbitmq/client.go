@@ -3,153 +3,398 @@ package rabbitmq
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"math"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/go-logr/logr"
 	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/rossigee/cert-webhook-system/internal/event"
 )
 
 const (
-	maxReconnectAttempts = 5
-	initialBackoff       = 1 * time.Second
-	maxBackoff           = 30 * time.Second
+	initialBackoff           = 1 * time.Second
+	maxBackoff               = 30 * time.Second
+	defaultConfirmTimeout    = 5 * time.Second
+	defaultOutboxMaxAttempts = 10
 )
 
-// Client represents a RabbitMQ client
+var (
+	// ErrNacked is returned when the broker nacks a message or the channel
+	// closes before the message is confirmed
+	ErrNacked = errors.New("message not acknowledged by broker")
+
+	// ErrConfirmTimeout is returned when the broker does not confirm a message in time
+	ErrConfirmTimeout = errors.New("timed out waiting for publisher confirm")
+)
+
+// Config holds the configuration for the RabbitMQ client
+type Config struct {
+	// URL is the broker URL. With SRVName it only supplies the scheme,
+	// credentials and vhost.
+	URL string
+	// URLs are further endpoints of the same cluster. The client spreads
+	// connections over URL and URLs and fails over between them.
+	URLs []string
+	// SRVName is a DNS SRV name (e.g. _amqp._tcp.rabbitmq.example.com)
+	// resolved to the broker endpoints on every connect
+	SRVName string
+
+	// URLFile is a file holding the broker URLs (comma or newline
+	// separated), replacing URL and URLs
+	URLFile string
+	// UsernameFile and PasswordFile hold the credentials used with every
+	// URL, replacing any in the URL itself. Credential files are watched and
+	// the client reconnects gracefully when they change.
+	UsernameFile string
+	PasswordFile string
+
+	// ConfirmTimeout bounds how long Publish waits for the broker to
+	// acknowledge a message (default 5s)
+	ConfirmTimeout time.Duration
+
+	// AlternateExchange, when set, is configured as the alternate exchange of
+	// every exchange the client declares. Unroutable messages are then
+	// captured in a queue of the same name instead of being returned.
+	AlternateExchange string
+
+	// OutboxDir, when set, enables the durable local outbox. Publish then
+	// appends messages to segment files in this directory and a background
+	// relay delivers them to the broker in order.
+	OutboxDir string
+	// OutboxMaxBytes bounds the outbox size; Publish blocks when it is full
+	// (default 64MiB)
+	OutboxMaxBytes int64
+	// OutboxSegmentBytes is the size at which a new segment file is started
+	// (default 4MiB)
+	OutboxSegmentBytes int64
+	// OutboxMaxAttempts is how many times the broker may reject a message
+	// (access refused, a missing exchange, a conflicting declaration) before
+	// the relay drops it, so that such a message doesn't block the outbox
+	// forever (default 10). Transient failures such as disconnects and
+	// confirm timeouts don't count and are retried indefinitely.
+	OutboxMaxAttempts int
+
+	// ChannelPoolSize is the number of AMQP channels used for concurrent
+	// publishes (default 4)
+	ChannelPoolSize int
+
+	// ExchangeType is the type of exchanges declared by the client: topic
+	// (default), headers, direct or fanout
+	ExchangeType string
+	// ExchangeArguments are passed when declaring exchanges
+	ExchangeArguments map[string]string
+	// DeclareMode selects whether exchanges are declared (default), only
+	// passively verified, or left alone entirely
+	DeclareMode DeclareMode
+	// Exchanges are declared or verified when connecting, so that
+	// misconfiguration is reported by HealthCheck rather than on first publish
+	Exchanges []string
+
+	// Stream, when set, is a stream queue every message is also written to,
+	// so that consumers can replay past events from an offset or timestamp
+	Stream string
+	// StreamRetention, when set, declares the stream with these limits.
+	// Without it the stream is only verified to exist.
+	StreamRetention *StreamRetention
+
+	// TLSCAFile is a PEM bundle of CAs trusted for amqps:// connections
+	// (default the system roots)
+	TLSCAFile string
+	// TLSCertFile and TLSKeyFile are the client certificate for mutual TLS.
+	// They are reloaded from disk when they change.
+	TLSCertFile string
+	TLSKeyFile  string
+	// TLSServerName overrides the host name used to verify the broker certificate
+	TLSServerName string
+	// SASLExternal authenticates with the client certificate (SASL EXTERNAL)
+	// instead of the credentials in the URL
+	SASLExternal bool
+
+	// Logger reports problems that don't fail a publish, such as a failed
+	// stream copy
+	Logger logr.Logger
+}
+
+// urls returns URL followed by URLs, without blank entries
+func (c Config) urls() []string {
+	var urls []string
+	for _, raw := range append([]string{c.URL}, c.URLs...) {
+		if raw = strings.TrimSpace(raw); raw != "" {
+			urls = append(urls, raw)
+		}
+	}
+	return urls
+}
+
+// Client represents a RabbitMQ client. Publishes are spread over a pool of
+// channels sharing one connection, so concurrent callers do not serialise on
+// a single channel.
 type Client struct {
-	mu      sync.Mutex
-	conn    *amqp.Connection
-	channel *amqp.Channel
-	url     string
-	closed  bool
+	mu                sync.Mutex
+	conn              *amqp.Connection
+	pool              chan *channelSlot
+	endpoints         *endpointSet
+	connURL           string
+	tls               *tlsSettings
+	credentials       credentialFiles
+	confirmTimeout    time.Duration
+	alternateExchange string
+	exchangeType      string
+	exchangeArguments map[string]string
+	declareMode       DeclareMode
+	verifyExchanges   []string
+	stream            string
+	streamRetention   *StreamRetention
+	exchanges         exchangeCache
+	topologyErr       error
+	outbox            *Outbox
+	outboxMaxAttempts int
+	dropHandlers      []func(ctx context.Context, drop OutboxDrop)
+	state             stateTracker
+	logger            logr.Logger
+	done              chan struct{}
+	supervisorDone    chan struct{}
+	relayDone         chan struct{}
+	credentialsDone   chan struct{}
+	rotate            chan struct{}
+	closed            bool
+}
+
+// pendingPublish is a message that has been sent and awaits its confirm
+type pendingPublish struct {
+	messageID    string
+	exchange     string
+	routingKey   string
+	confirmation *amqp.DeferredConfirmation
+	returns      <-chan amqp.Return
+	tracker      *returnTracker
+	closed       *closeReason
+	// stream marks the copy published to the stream
+	stream bool
 }
 
 // NewClient creates a new RabbitMQ client
-func NewClient(url string) (*Client, error) {
-	client := &Client{
-		url: url,
+func NewClient(config Config) (*Client, error) {
+	confirmTimeout := config.ConfirmTimeout
+	if confirmTimeout <= 0 {
+		confirmTimeout = defaultConfirmTimeout
 	}
 
-	if err := client.connect(); err != nil {
-		return nil, fmt.Errorf("failed to connect to RabbitMQ: %w", err)
+	exchangeType := config.ExchangeType
+	if exchangeType == "" {
+		exchangeType = "topic"
+	}
+	declareMode := config.DeclareMode
+	if declareMode == "" {
+		declareMode = DeclareModeDeclare
+	}
+	if err := validateExchangeConfig(exchangeType, declareMode); err != nil {
+		return nil, err
 	}
 
-	client.watchConnection()
-
-	return client, nil
-}
-
-// connect establishes a connection to RabbitMQ
-func (c *Client) connect() error {
-	var err error
+	credentials := credentialFiles{
+		urlFile:      config.URLFile,
+		usernameFile: config.UsernameFile,
+		passwordFile: config.PasswordFile,
+	}
+	configured := config.urls()
+	urls, err := credentials.apply(configured)
+	if err != nil {
+		return nil, err
+	}
 
-	c.conn, err = amqp.Dial(c.url)
+	endpoints, err := newEndpointSet(urls, config.SRVName)
 	if err != nil {
-		return fmt.Errorf("failed to connect to RabbitMQ: %w", err)
+		return nil, err
 	}
 
-	c.channel, err = c.conn.Channel()
+	tlsSettings, err := newTLSSettings(config, endpoints.schemes())
 	if err != nil {
-		_ = c.conn.Close()
-		return fmt.Errorf("failed to open channel: %w", err)
+		return nil, fmt.Errorf("invalid TLS configuration: %w", err)
 	}
 
-	return nil
-}
+	client := &Client{
+		pool:              newChannelPool(config.ChannelPoolSize),
+		endpoints:         endpoints,
+		tls:               tlsSettings,
+		credentials:       credentials,
+		confirmTimeout:    confirmTimeout,
+		alternateExchange: config.AlternateExchange,
+		exchangeType:      exchangeType,
+		exchangeArguments: config.ExchangeArguments,
+		declareMode:       declareMode,
+		verifyExchanges:   config.Exchanges,
+		stream:            config.Stream,
+		streamRetention:   config.StreamRetention,
+		done:              make(chan struct{}),
+		supervisorDone:    make(chan struct{}),
+		rotate:            make(chan struct{}, 1),
+		logger:            config.Logger,
+	}
 
-// watchConnection listens for connection close events and triggers reconnection
-func (c *Client) watchConnection() {
-	go func() {
-		closeCh := c.conn.NotifyClose(make(chan *amqp.Error, 1))
-		err := <-closeCh
-		if err == nil {
-			return // graceful close
+	if config.OutboxDir != "" {
+		outbox, err := OpenOutbox(config.OutboxDir, config.OutboxMaxBytes, config.OutboxSegmentBytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open outbox: %w", err)
+		}
+		client.outbox = outbox
+		client.outboxMaxAttempts = config.OutboxMaxAttempts
+		if client.outboxMaxAttempts <= 0 {
+			client.outboxMaxAttempts = defaultOutboxMaxAttempts
 		}
+	}
 
-		c.mu.Lock()
-		if c.closed {
-			c.mu.Unlock()
-			return
+	if _, err := client.connect(); err != nil {
+		// With an outbox, messages are accepted while the broker is
+		// unreachable and the supervisor keeps trying to connect
+		if client.outbox == nil {
+			return nil, fmt.Errorf("failed to connect to RabbitMQ: %w", err)
 		}
-		c.mu.Unlock()
+		client.setState(StateReconnecting, err)
+	} else {
+		client.setState(connectedState(client.topologyErr), client.topologyErr)
+	}
 
-		_ = c.reconnectWithBackoff()
-	}()
-}
+	go client.superviseConnection()
 
-// reconnectWithBackoff attempts to reconnect with exponential backoff
-func (c *Client) reconnectWithBackoff() error {
-	for attempt := range maxReconnectAttempts {
-		backoff := time.Duration(math.Min(
-			float64(initialBackoff)*math.Pow(2, float64(attempt)),
-			float64(maxBackoff),
-		))
-		time.Sleep(backoff)
+	if credentials.enabled() {
+		client.credentialsDone = make(chan struct{})
+		go client.watchCredentials(configured, urls)
+	}
 
-		c.mu.Lock()
-		if c.closed {
-			c.mu.Unlock()
-			return fmt.Errorf("client closed during reconnection")
-		}
+	if client.outbox != nil {
+		client.relayDone = make(chan struct{})
+		go client.relayOutbox()
+	}
 
-		if err := c.reconnect(); err != nil {
-			c.mu.Unlock()
-			continue
-		}
+	return client, nil
+}
 
-		c.mu.Unlock()
-		c.watchConnection()
-		return nil
+// connect establishes a connection to the first reachable endpoint and
+// makes it the current one, returning the connection it replaced. c.mu is
+// only held for the swap, so that while a slow broker is dialed publishes
+// fail fast with ErrNotConnected. Pool channels are opened lazily on the new
+// connection the next time each one is acquired.
+func (c *Client) connect() (*amqp.Connection, error) {
+	conn, connURL, err := c.dial()
+	if err != nil {
+		return nil, err
 	}
 
-	return fmt.Errorf("failed to reconnect after %d attempts", maxReconnectAttempts)
+	// Topology problems don't prevent connecting; they are reported by
+	// HealthCheck and by publishes to the affected exchanges
+	topologyErr := c.verifyTopology(conn)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		_ = conn.Close()
+		return nil, fmt.Errorf("client is closed")
+	}
+	old := c.conn
+	c.conn = conn
+	c.connURL = connURL
+	c.topologyErr = topologyErr
+	return old, nil
 }
 
-// reconnect attempts to reconnect to RabbitMQ
-func (c *Client) reconnect() error {
-	if c.channel != nil {
-		_ = c.channel.Close()
+// dial connects to the first reachable endpoint and returns the connection
+// and the URL it was made to
+func (c *Client) dial() (*amqp.Connection, string, error) {
+	candidates, err := c.endpoints.candidates()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to connect to RabbitMQ: %w", err)
 	}
-	if c.conn != nil && !c.conn.IsClosed() {
-		_ = c.conn.Close()
+
+	var errs []error
+	for _, candidate := range candidates {
+		// The TLS configuration is rebuilt per dial, since dialing sets the
+		// server name from the URL
+		dialConfig, err := c.tls.dialConfig()
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to prepare TLS configuration: %w", err)
+		}
+
+		conn, err := amqp.DialConfig(candidate, dialConfig)
+		if err != nil {
+			connectionAttemptsTotal.WithLabelValues(endpointName(candidate), "failure").Inc()
+			c.endpoints.failed(candidate)
+			err = redactError(err, candidate)
+			c.logger.Info("Failed to connect to RabbitMQ endpoint", "url", redactURL(candidate), "error", err.Error())
+			errs = append(errs, fmt.Errorf("%s: %w", endpointName(candidate), err))
+			continue
+		}
+
+		connectionAttemptsTotal.WithLabelValues(endpointName(candidate), "success").Inc()
+		c.endpoints.connected(candidate)
+		c.logger.Info("Connected to RabbitMQ endpoint", "url", redactURL(candidate))
+		return conn, candidate, nil
 	}
 
-	return c.connect()
+	return nil, "", fmt.Errorf("failed to connect to RabbitMQ: %w", errors.Join(errs...))
 }
 
-// ensureConnection ensures the connection is healthy and reconnects if necessary
-func (c *Client) ensureConnection() error {
+// requireConnection returns the current connection. Reconnecting is left
+// to the supervisor, so while the connection is down this fails fast with
+// ErrNotConnected instead of every caller dialing the broker.
+func (c *Client) requireConnection() (*amqp.Connection, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if c.conn == nil || c.conn.IsClosed() || c.channel == nil {
-		return c.reconnect()
+	if c.closed {
+		return nil, fmt.Errorf("client is closed")
 	}
-	return nil
+	if c.conn == nil || c.conn.IsClosed() {
+		return nil, ErrNotConnected
+	}
+	return c.conn, nil
 }
 
-// Publish publishes a message to RabbitMQ
-func (c *Client) Publish(ctx context.Context, exchange, routingKey string, message any) error {
-	if err := c.ensureConnection(); err != nil {
-		return fmt.Errorf("failed to ensure connection: %w", err)
+// Publish publishes a message to RabbitMQ and waits for the broker to
+// confirm it. A nack or a missing confirm within the configured timeout is
+// reported as an error so that the caller can retry. Messages are published
+// as mandatory; if the broker cannot route one to any queue the returned
+// error matches ErrUnroutable.
+//
+// When the outbox is enabled, Publish returns once the message is durably
+// written to the outbox and delivery happens in the background. Unroutable
+// or rejected messages are then not reported to the caller but to the
+// OnOutboxDrop handlers.
+func (c *Client) Publish(ctx context.Context, exchange, routingKey string, message any, props event.Properties) error {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
 	}
 
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	record := outboxRecord{
+		ID:         newMessageID(),
+		Exchange:   exchange,
+		RoutingKey: routingKey,
+		Body:       body,
+		Properties: props,
+		EnqueuedAt: time.Now(),
+	}
 
-	// Declare exchange (idempotent)
-	if err := c.channel.ExchangeDeclare(
-		exchange,
-		"topic",
-		true,  // durable
-		false, // auto-deleted
-		false, // internal
-		false, // no-wait
-		nil,
-	); err != nil {
-		return fmt.Errorf("failed to declare exchange: %w", err)
+	if c.outbox != nil {
+		return c.outbox.Append(ctx, record)
+	}
+
+	return c.deliver(ctx, record)
+}
+
+// Enqueue appends a message to the outbox and returns once it is durably
+// written, leaving delivery to the relay. Unlike Publish it fails when the
+// outbox is not enabled, for callers that must not depend on the broker
+// being reachable.
+func (c *Client) Enqueue(ctx context.Context, exchange, routingKey string, message any, props event.Properties) error {
+	if c.outbox == nil {
+		return ErrOutboxDisabled
 	}
 
 	body, err := json.Marshal(message)
@@ -157,80 +402,274 @@ func (c *Client) Publish(ctx context.Context, exchange, routingKey string, messa
 		return fmt.Errorf("failed to marshal message: %w", err)
 	}
 
-	err = c.channel.PublishWithContext(
+	return c.outbox.Append(ctx, outboxRecord{
+		ID:         newMessageID(),
+		Exchange:   exchange,
+		RoutingKey: routingKey,
+		Body:       body,
+		Properties: props,
+		EnqueuedAt: time.Now(),
+	})
+}
+
+// deliver sends a message to the broker and waits for its confirm
+func (c *Client) deliver(ctx context.Context, record outboxRecord) error {
+	if _, err := c.requireConnection(); err != nil {
+		return err
+	}
+
+	slot, err := c.acquire(ctx)
+	if err != nil {
+		return err
+	}
+
+	pending, err := c.publish(ctx, slot, record)
+
+	var streamPending *pendingPublish
+	if err == nil && c.stream != "" {
+		var streamErr error
+		if streamPending, streamErr = c.publishToStream(ctx, slot, record); streamErr != nil {
+			c.streamCopyFailed(record, streamErr)
+		}
+	}
+
+	// The channel is free for other publishers while we wait for the confirm
+	c.release(slot)
+
+	if err != nil {
+		return err
+	}
+
+	err = c.waitForConfirm(ctx, pending)
+	if streamPending != nil {
+		if streamErr := c.waitForConfirm(ctx, streamPending); streamErr != nil {
+			c.streamCopyFailed(record, streamErr)
+		}
+	}
+	return err
+}
+
+// streamCopyFailed records a failed stream copy. The copy is secondary: the
+// publish doesn't fail, since retrying it would duplicate the original on
+// the exchange.
+func (c *Client) streamCopyFailed(record outboxRecord, err error) {
+	streamCopyFailuresTotal.Inc()
+	c.logger.Error(err, "Failed to copy message to stream",
+		"stream", c.stream, "exchange", record.Exchange, "routing_key", record.RoutingKey, "message_id", record.ID)
+}
+
+// publish ensures the exchange exists and sends the message on the slot's
+// channel, returning the pending confirmation
+func (c *Client) publish(ctx context.Context, slot *channelSlot, record outboxRecord) (*pendingPublish, error) {
+	if err := c.ensureExchange(slot, record.Exchange); err != nil {
+		return nil, err
+	}
+
+	slot.tracker.register(record.Exchange, record.ID)
+
+	confirmation, err := slot.channel.PublishWithDeferredConfirmWithContext(
 		ctx,
-		exchange,
-		routingKey,
-		false, // mandatory
+		record.Exchange,
+		record.RoutingKey,
+		true,  // mandatory
 		false, // immediate
-		amqp.Publishing{
-			ContentType:  "application/json",
-			Body:         body,
-			DeliveryMode: amqp.Persistent,
-			Timestamp:    time.Now(),
-		},
+		publishing(record),
 	)
 	if err != nil {
-		return fmt.Errorf("failed to publish message: %w", err)
+		slot.tracker.forget(record.Exchange, record.ID)
+		return nil, fmt.Errorf("failed to publish message: %w", err)
 	}
 
-	return nil
+	return &pendingPublish{
+		messageID:    record.ID,
+		exchange:     record.Exchange,
+		routingKey:   record.RoutingKey,
+		confirmation: confirmation,
+		returns:      slot.returns,
+		tracker:      slot.tracker,
+		closed:       slot.closed,
+	}, nil
 }
 
-// HealthCheck performs a health check on the RabbitMQ connection
-func (c *Client) HealthCheck() error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+// publishing builds the AMQP message for a record, mapping its properties
+// onto the message expiration, priority and headers
+func publishing(record outboxRecord) amqp.Publishing {
+	msg := amqp.Publishing{
+		ContentType:  "application/json",
+		Body:         record.Body,
+		DeliveryMode: amqp.Persistent,
+		MessageId:    record.ID,
+		Timestamp:    time.Now(),
+		Priority:     record.Properties.Priority,
+	}
 
-	if c.conn == nil || c.conn.IsClosed() {
-		return fmt.Errorf("connection is closed")
+	if record.Properties.Expiration > 0 {
+		// The broker expects whole milliseconds; round up so that a short
+		// TTL doesn't become 0 and expire immediately
+		ms := (record.Properties.Expiration + time.Millisecond - 1) / time.Millisecond
+		msg.Expiration = strconv.FormatInt(int64(ms), 10)
 	}
-	if c.channel == nil {
-		return fmt.Errorf("channel is nil")
+
+	if len(record.Properties.Headers) > 0 {
+		msg.Headers = amqp.Table{}
+		for k, v := range record.Properties.Headers {
+			msg.Headers[k] = v
+		}
 	}
 
-	// Use a passive queue inspect on a non-existent queue to verify channel liveness.
-	// QueueInspect returns an error for non-existent queues, but the channel stays open
-	// if the connection is healthy. We use an empty-name auto-delete queue declare instead.
-	_, err := c.channel.QueueDeclare(
-		"",    // empty name = server-generated
-		false, // durable
-		true,  // auto-delete
-		true,  // exclusive
-		false, // no-wait (we want the server response)
-		nil,
-	)
+	return msg
+}
+
+// waitForConfirm blocks until the broker acks or nacks the message, the
+// confirm timeout expires or ctx is cancelled, then checks whether the
+// message was returned as unroutable
+func (c *Client) waitForConfirm(ctx context.Context, pending *pendingPublish) error {
+	start := time.Now()
+
+	confirmCtx, cancel := context.WithTimeout(ctx, c.confirmTimeout)
+	defer cancel()
+
+	acked, err := pending.confirmation.WaitContext(confirmCtx)
 	if err != nil {
-		return fmt.Errorf("health check failed: %w", err)
+		pending.tracker.forget(pending.exchange, pending.messageID)
+		if ctx.Err() != nil {
+			publishConfirmsTotal.WithLabelValues(c.exchangeLabel(pending.exchange), "canceled").Inc()
+			return fmt.Errorf("failed waiting for publisher confirm: %w", err)
+		}
+		publishConfirmsTotal.WithLabelValues(c.exchangeLabel(pending.exchange), "timeout").Inc()
+		return fmt.Errorf("%w after %s", ErrConfirmTimeout, c.confirmTimeout)
+	}
+
+	publishConfirmDuration.WithLabelValues(c.exchangeLabel(pending.exchange)).Observe(time.Since(start).Seconds())
+
+	ret := pending.tracker.resolve(pending.exchange, pending.messageID, pending.returns)
+
+	if !acked {
+		publishConfirmsTotal.WithLabelValues(c.exchangeLabel(pending.exchange), "nack").Inc()
+		if reason := pending.closed.get(); reason != nil {
+			return fmt.Errorf("%w: channel closed: %w", ErrNacked, reason)
+		}
+		return ErrNacked
+	}
+
+	publishConfirmsTotal.WithLabelValues(c.exchangeLabel(pending.exchange), "ack").Inc()
+
+	if ret != nil && pending.stream {
+		// Not ErrUnroutable: the message itself was routed, and retrying
+		// succeeds once the stream is declared
+		return fmt.Errorf("stream %q is not available: %d %s", pending.routingKey, ret.ReplyCode, ret.ReplyText)
+	}
+
+	if ret != nil {
+		unroutableTotal.WithLabelValues(c.exchangeLabel(pending.exchange)).Inc()
+		return &ReturnError{
+			Exchange:   pending.exchange,
+			RoutingKey: pending.routingKey,
+			ReplyCode:  ret.ReplyCode,
+			ReplyText:  ret.ReplyText,
+		}
 	}
 
 	return nil
 }
 
-// Close closes the RabbitMQ connection
+// otherExchange is the exchange label of exchanges that aren't configured.
+// Annotations can name any exchange, so labelling each would make the
+// metrics unbounded.
+const otherExchange = "other"
+
+// exchangeLabel returns the metric label of an exchange: its name if it is
+// configured (or the default exchange, used for stream copies), otherwise
+// otherExchange
+func (c *Client) exchangeLabel(exchange string) string {
+	if exchange == "" || exchange == c.alternateExchange || slices.Contains(c.verifyExchanges, exchange) {
+		return exchange
+	}
+	return otherExchange
+}
+
+// Name implements sink.Publisher
+func (c *Client) Name() string {
+	return "rabbitmq"
+}
+
+// HealthCheck reports an error unless the client is connected and the
+// topology check passed. It only inspects the connection state maintained by
+// the supervisor, so probes don't generate broker traffic.
+func (c *Client) HealthCheck() error {
+	c.state.mu.Lock()
+	state, lastErr := c.state.state, c.state.lastErr
+	c.state.mu.Unlock()
+
+	switch state {
+	case StateConnected:
+		return nil
+	case StateDegraded:
+		return fmt.Errorf("topology check failed: %w", lastErr)
+	case StateClosed:
+		return fmt.Errorf("client is closed")
+	default:
+		if lastErr != nil {
+			return fmt.Errorf("connection is reconnecting: %w", lastErr)
+		}
+		return fmt.Errorf("connection is closed")
+	}
+}
+
+// Endpoint returns the host and port of the broker the client is connected
+// to, or "" when disconnected
+func (c *Client) Endpoint() string {
+	return c.endpoints.connectedName()
+}
+
+// OutboxStats reports the state of the local outbox. The second return value
+// is false when the outbox is not enabled.
+func (c *Client) OutboxStats() (OutboxStats, bool) {
+	if c.outbox == nil {
+		return OutboxStats{}, false
+	}
+	return c.outbox.Stats(), true
+}
+
+// Close stops the supervisor and closes the RabbitMQ connection. Messages
+// still in the outbox remain on disk and are delivered by the next client
+// using the same directory.
 func (c *Client) Close() error {
 	c.mu.Lock()
-	defer c.mu.Unlock()
-
+	stopping := !c.closed
 	c.closed = true
+	c.mu.Unlock()
 
-	var err error
-
-	if c.channel != nil {
-		if channelErr := c.channel.Close(); channelErr != nil {
-			err = fmt.Errorf("failed to close channel: %w", channelErr)
+	if stopping && c.done != nil {
+		close(c.done)
+		<-c.supervisorDone
+		if c.relayDone != nil {
+			<-c.relayDone
 		}
+		if c.credentialsDone != nil {
+			<-c.credentialsDone
+		}
+	}
+	if c.outbox != nil {
+		_ = c.outbox.Close()
+	}
+	if stopping {
+		c.setState(StateClosed, nil)
 	}
 
-	if c.conn != nil {
-		if connErr := c.conn.Close(); connErr != nil {
-			if err != nil {
-				err = fmt.Errorf("%v; failed to close connection: %w", err, connErr)
-			} else {
-				err = fmt.Errorf("failed to close connection: %w", connErr)
-			}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if stopping && c.endpoints != nil && c.connURL != "" {
+		c.endpoints.disconnected(c.connURL)
+	}
+
+	// Closing the connection also closes every pool channel
+	if c.conn != nil && !c.conn.IsClosed() {
+		if err := c.conn.Close(); err != nil {
+			return fmt.Errorf("failed to close connection: %w", err)
 		}
 	}
 
-	return err
+	return nil
 }
@@ -1,25 +1,41 @@
 package rabbitmq
 
 import (
+	"slices"
 	"testing"
+	"time"
+
+	"github.com/rossigee/cert-webhook-system/internal/event"
 )
 
 func TestNewClient_InvalidURL(t *testing.T) {
-	_, err := NewClient("invalid://url")
+	_, err := NewClient(Config{URL: "invalid://url"})
 	if err == nil {
 		t.Error("Expected error for invalid URL, got nil")
 	}
 }
 
 func TestNewClient_EmptyURL(t *testing.T) {
-	_, err := NewClient("")
+	_, err := NewClient(Config{URL: ""})
 	if err == nil {
 		t.Error("Expected error for empty URL, got nil")
 	}
 }
 
+func TestConfig_URLs(t *testing.T) {
+	config := Config{URLs: []string{"amqp://a", " amqp://b ", ""}}
+	if got := config.urls(); !slices.Equal(got, []string{"amqp://a", "amqp://b"}) {
+		t.Errorf("unexpected URLs %q", got)
+	}
+
+	config.URL = "amqp://primary"
+	if got := config.urls(); !slices.Equal(got, []string{"amqp://primary", "amqp://a", "amqp://b"}) {
+		t.Errorf("unexpected URLs %q", got)
+	}
+}
+
 func TestClient_CloseWithoutConnection(t *testing.T) {
-	client := &Client{url: "amqp://test"}
+	client := &Client{endpoints: &endpointSet{urls: []string{"amqp://test"}}}
 	client.closed = true
 
 	// Should not panic
@@ -30,10 +46,40 @@ func TestClient_CloseWithoutConnection(t *testing.T) {
 }
 
 func TestClient_HealthCheck_NilConnection(t *testing.T) {
-	client := &Client{url: "amqp://test"}
+	client := &Client{endpoints: &endpointSet{urls: []string{"amqp://test"}}}
 
 	err := client.HealthCheck()
 	if err == nil {
 		t.Error("Expected error for health check with nil connection")
 	}
 }
+
+func TestPublishing_Properties(t *testing.T) {
+	msg := publishing(outboxRecord{
+		ID:   "msg-1",
+		Body: []byte("{}"),
+		Properties: event.Properties{
+			Expiration: 1500 * time.Microsecond,
+			Priority:   5,
+			Headers:    map[string]string{"namespace": "default"},
+		},
+	})
+
+	if msg.Expiration != "2" {
+		t.Errorf("expected expiration rounded up to 2ms, got %q", msg.Expiration)
+	}
+	if msg.Priority != 5 {
+		t.Errorf("expected priority 5, got %d", msg.Priority)
+	}
+	if msg.Headers["namespace"] != "default" {
+		t.Errorf("expected namespace header, got %v", msg.Headers)
+	}
+	if msg.MessageId != "msg-1" || msg.DeliveryMode != 2 {
+		t.Errorf("unexpected message: %+v", msg)
+	}
+
+	msg = publishing(outboxRecord{ID: "msg-2"})
+	if msg.Expiration != "" || msg.Headers != nil {
+		t.Errorf("expected no expiration or headers, got %q %v", msg.Expiration, msg.Headers)
+	}
+}
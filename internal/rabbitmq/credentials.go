@@ -0,0 +1,220 @@
+package rabbitmq
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// credentialResyncInterval is how often the credential files are re-read
+// even without a change notification, in case one was missed
+const credentialResyncInterval = time.Minute
+
+// credentialFiles are files, typically keys of a mounted Secret, supplying
+// the broker URLs or the credentials to use with them
+type credentialFiles struct {
+	urlFile      string
+	usernameFile string
+	passwordFile string
+}
+
+// enabled reports whether any credential file is configured
+func (f credentialFiles) enabled() bool {
+	return f.urlFile != "" || f.usernameFile != "" || f.passwordFile != ""
+}
+
+// paths lists the configured files
+func (f credentialFiles) paths() []string {
+	var paths []string
+	for _, path := range []string{f.urlFile, f.usernameFile, f.passwordFile} {
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// apply returns the broker URLs with the file contents applied. The URL file
+// replaces urls; the username and password files replace the credentials in
+// every URL. Errors never include the URLs or file contents.
+func (f credentialFiles) apply(urls []string) ([]string, error) {
+	if f.urlFile != "" {
+		content, err := readSecretFile(f.urlFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read RabbitMQ URL file: %w", err)
+		}
+		urls = strings.FieldsFunc(content, func(r rune) bool {
+			return r == ',' || r == '\n' || r == '\r' || r == ' ' || r == '\t'
+		})
+	}
+
+	if f.usernameFile == "" && f.passwordFile == "" {
+		return urls, nil
+	}
+
+	var username, password string
+	if f.usernameFile != "" {
+		content, err := readSecretFile(f.usernameFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read RabbitMQ username file: %w", err)
+		}
+		username = content
+	}
+	if f.passwordFile != "" {
+		content, err := readSecretFile(f.passwordFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read RabbitMQ password file: %w", err)
+		}
+		password = content
+	}
+
+	withCredentials := make([]string, 0, len(urls))
+	for _, raw := range urls {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		parsed, err := url.Parse(raw)
+		if err != nil {
+			// Unwrap to keep the URL, and any password in it, out of the error
+			return nil, fmt.Errorf("invalid RabbitMQ URL: %w", errors.Unwrap(err))
+		}
+
+		user := username
+		if user == "" {
+			user = parsed.User.Username()
+		}
+		if f.passwordFile != "" {
+			parsed.User = url.UserPassword(user, password)
+		} else if existing, ok := parsed.User.Password(); ok {
+			parsed.User = url.UserPassword(user, existing)
+		} else if user != "" {
+			parsed.User = url.User(user)
+		}
+		withCredentials = append(withCredentials, parsed.String())
+	}
+	return withCredentials, nil
+}
+
+// readSecretFile reads a file and trims surrounding whitespace, such as the
+// trailing newline many tools add. An empty file is an error, since it is
+// usually caught mid-update.
+func readSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	content := strings.TrimSpace(string(data))
+	if content == "" {
+		return "", fmt.Errorf("%s is empty", path)
+	}
+	return content, nil
+}
+
+// watchCredentials re-reads the credential files whenever they change and,
+// when the resulting URLs differ, switches the endpoints to them and asks the
+// supervisor for a graceful reconnect
+func (c *Client) watchCredentials(configured, applied []string) {
+	defer close(c.credentialsDone)
+
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		defer func() { _ = watcher.Close() }()
+		// Watch the directories rather than the files, so that atomic
+		// replacements (such as Secret volume updates) are noticed
+		dirs := make(map[string]bool)
+		for _, path := range c.credentials.paths() {
+			dirs[filepath.Dir(path)] = true
+		}
+		for dir := range dirs {
+			if err = watcher.Add(dir); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		// The periodic resync still picks up changes
+		credentialReloadsTotal.WithLabelValues("watch_error").Inc()
+	}
+
+	var events <-chan fsnotify.Event
+	if watcher != nil {
+		events = watcher.Events
+	}
+
+	ticker := time.NewTicker(credentialResyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-events:
+		case <-ticker.C:
+		}
+
+		urls, err := c.credentials.apply(configured)
+		if err != nil {
+			// Files are often briefly missing while being replaced; keep
+			// the current credentials until a complete set can be read
+			credentialReloadsTotal.WithLabelValues("error").Inc()
+			continue
+		}
+		if slices.Equal(urls, applied) {
+			continue
+		}
+
+		endpoints, err := newEndpointSet(urls, c.endpoints.srvName)
+		if err != nil {
+			credentialReloadsTotal.WithLabelValues("error").Inc()
+			continue
+		}
+		c.endpoints.replace(endpoints)
+		applied = urls
+		credentialReloadsTotal.WithLabelValues("success").Inc()
+
+		select {
+		case c.rotate <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// rotateConnection connects with the current endpoints and credentials and
+// switches publishing to the new connection. The old connection is closed
+// once in-flight publishes had time to be confirmed, so that a credential
+// change does not fail them. If the new connection cannot be established
+// the old one is kept.
+func (c *Client) rotateConnection() error {
+	old, err := c.connect()
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	topologyErr := c.topologyErr
+	c.mu.Unlock()
+
+	c.setState(connectedState(topologyErr), topologyErr)
+
+	if old != nil {
+		go func() {
+			timer := time.NewTimer(c.confirmTimeout)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+			case <-c.done:
+			}
+			_ = old.Close()
+		}()
+	}
+
+	return nil
+}
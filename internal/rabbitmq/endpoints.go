@@ -0,0 +1,261 @@
+package rabbitmq
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// endpointFailurePenalty is how long an endpoint that failed is tried only
+// after the healthy ones
+const endpointFailurePenalty = 30 * time.Second
+
+// lookupSRV resolves DNS SRV records; replaced in tests
+var lookupSRV = func(name string) ([]*net.SRV, error) {
+	_, records, err := net.LookupSRV("", "", name)
+	return records, err
+}
+
+// endpointSet chooses which broker URL to dial. Static URLs are shuffled
+// once, so replicas spread over the cluster, and then tried round-robin
+// starting after the last connected endpoint. Endpoints that failed
+// recently are tried last.
+type endpointSet struct {
+	mu       sync.Mutex
+	urls     []string
+	srvName  string
+	template *url.URL
+	last     string
+	current  string
+	failures map[string]time.Time
+}
+
+// newEndpointSet validates the configured URLs or SRV name
+func newEndpointSet(urls []string, srvName string) (*endpointSet, error) {
+	set := &endpointSet{srvName: srvName, failures: make(map[string]time.Time)}
+
+	seen := make(map[string]bool)
+	for _, raw := range urls {
+		raw = strings.TrimSpace(raw)
+		if raw == "" || seen[raw] {
+			continue
+		}
+		seen[raw] = true
+		if _, err := url.Parse(raw); err != nil {
+			// Unwrap to keep the URL, and any password in it, out of the error
+			return nil, fmt.Errorf("invalid RabbitMQ URL: %w", errors.Unwrap(err))
+		}
+		set.urls = append(set.urls, raw)
+	}
+
+	if srvName != "" {
+		// The URL supplies scheme, credentials and vhost for SRV targets
+		if len(set.urls) > 1 {
+			return nil, fmt.Errorf("an SRV name accepts at most one template URL")
+		}
+		template := "amqp://"
+		if len(set.urls) == 1 {
+			template = set.urls[0]
+		}
+		parsed, _ := url.Parse(template)
+		set.template = parsed
+		set.urls = nil
+		return set, nil
+	}
+
+	if len(set.urls) == 0 {
+		return nil, fmt.Errorf("no RabbitMQ URL configured")
+	}
+	rand.Shuffle(len(set.urls), func(i, j int) {
+		set.urls[i], set.urls[j] = set.urls[j], set.urls[i]
+	})
+	return set, nil
+}
+
+// replace swaps in the URLs or SRV template of other, e.g. after the
+// credentials changed, keeping the connection history
+func (e *endpointSet) replace(other *endpointSet) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.urls = other.urls
+	e.srvName = other.srvName
+	e.template = other.template
+}
+
+// schemes returns the URL schemes in use, for validating TLS options
+func (e *endpointSet) schemes() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.template != nil {
+		return []string{e.template.Scheme}
+	}
+
+	schemes := make([]string, 0, len(e.urls))
+	for _, raw := range e.urls {
+		parsed, _ := url.Parse(raw)
+		schemes = append(schemes, parsed.Scheme)
+	}
+	return schemes
+}
+
+// candidates returns the URLs to try, in order, for the next connection
+func (e *endpointSet) candidates() ([]string, error) {
+	e.mu.Lock()
+	urls, srvName, template := e.urls, e.srvName, e.template
+	e.mu.Unlock()
+
+	if srvName != "" {
+		resolved, err := resolve(srvName, template)
+		if err != nil {
+			return nil, err
+		}
+		urls = resolved
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	// Rotate to start after the endpoint we were last connected to
+	start := 0
+	for i, u := range urls {
+		if u == e.last {
+			start = (i + 1) % len(urls)
+			break
+		}
+	}
+
+	var healthy, failed []string
+	for i := range urls {
+		u := urls[(start+i)%len(urls)]
+		if failedAt, ok := e.failures[u]; ok && time.Since(failedAt) < endpointFailurePenalty {
+			failed = append(failed, u)
+		} else {
+			healthy = append(healthy, u)
+		}
+	}
+
+	return append(healthy, failed...), nil
+}
+
+// resolve looks up the SRV name and builds a URL per target from template.
+// Records are ordered by priority and shuffled by weight by the resolver.
+func resolve(srvName string, template *url.URL) ([]string, error) {
+	records, err := lookupSRV(srvName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve SRV name %s: %w", srvName, err)
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("SRV name %s has no targets", srvName)
+	}
+
+	urls := make([]string, 0, len(records))
+	for _, record := range records {
+		u := *template
+		u.Host = net.JoinHostPort(strings.TrimSuffix(record.Target, "."), strconv.Itoa(int(record.Port)))
+		urls = append(urls, u.String())
+	}
+	return urls, nil
+}
+
+// connected records a successful connection to u
+func (e *endpointSet) connected(u string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.current != "" {
+		connectedEndpoint.DeleteLabelValues(endpointName(e.current))
+	}
+	e.last = u
+	e.current = u
+	delete(e.failures, u)
+	connectedEndpoint.WithLabelValues(endpointName(u)).Set(1)
+}
+
+// failed records that u could not be reached or its connection was lost
+func (e *endpointSet) failed(u string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.failures[u] = time.Now()
+	e.clearCurrent(u)
+}
+
+// disconnected records that the connection to u was closed deliberately
+func (e *endpointSet) disconnected(u string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.clearCurrent(u)
+}
+
+// clearCurrent forgets u as the connected endpoint; e.mu must be held
+func (e *endpointSet) clearCurrent(u string) {
+	if e.current == u {
+		connectedEndpoint.DeleteLabelValues(endpointName(u))
+		e.current = ""
+	}
+}
+
+// connectedName returns the host and port of the connected endpoint, or ""
+// when disconnected
+func (e *endpointSet) connectedName() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.current == "" {
+		return ""
+	}
+	return endpointName(e.current)
+}
+
+// redactURL returns raw with any password replaced by "xxxxx"
+func redactURL(raw string) string {
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return "invalid-url"
+	}
+	return parsed.Redacted()
+}
+
+// redactedError hides the password of a URL in an error message while
+// keeping the original error for errors.Is and errors.As
+type redactedError struct {
+	message string
+	err     error
+}
+
+func (e *redactedError) Error() string { return e.message }
+func (e *redactedError) Unwrap() error { return e.err }
+
+// redactError replaces the URL raw, and its password, in the message of err
+func redactError(err error, raw string) error {
+	parsed, parseErr := url.Parse(raw)
+	if parseErr != nil {
+		return &redactedError{message: "invalid RabbitMQ URL", err: err}
+	}
+	password, ok := parsed.User.Password()
+	if !ok || password == "" {
+		return err
+	}
+
+	message := strings.ReplaceAll(err.Error(), raw, parsed.Redacted())
+	message = strings.ReplaceAll(message, password, "xxxxx")
+	return &redactedError{message: message, err: err}
+}
+
+// endpointName returns the host and port of a URL, leaving out credentials
+func endpointName(raw string) string {
+	parsed, err := url.Parse(raw)
+	if err != nil || parsed.Host == "" {
+		return "invalid-url"
+	}
+	return parsed.Host
+}
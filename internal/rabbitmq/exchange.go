@@ -0,0 +1,199 @@
+package rabbitmq
+
+import (
+	"fmt"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// DeclareMode controls how the client manages the exchanges it publishes to
+type DeclareMode string
+
+const (
+	// DeclareModeDeclare declares exchanges (once per connection) before use
+	DeclareModeDeclare DeclareMode = "declare"
+
+	// DeclareModePassive only verifies that exchanges exist, for service
+	// users without the configure permission
+	DeclareModePassive DeclareMode = "passive"
+
+	// DeclareModeSkip neither declares nor verifies exchanges
+	DeclareModeSkip DeclareMode = "skip"
+)
+
+// validExchangeTypes lists the exchange types the client can declare
+var validExchangeTypes = map[string]bool{
+	"topic":   true,
+	"headers": true,
+	"direct":  true,
+	"fanout":  true,
+}
+
+// exchangeCache remembers which exchanges have been declared or verified on
+// the current connection
+type exchangeCache struct {
+	mu    sync.Mutex
+	known map[string]bool
+}
+
+// has reports whether the exchange is already known
+func (e *exchangeCache) has(exchange string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.known[exchange]
+}
+
+// add records an exchange as known
+func (e *exchangeCache) add(exchange string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.known == nil {
+		e.known = make(map[string]bool)
+	}
+	e.known[exchange] = true
+}
+
+// reset forgets all exchanges, e.g. after reconnecting
+func (e *exchangeCache) reset() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.known = nil
+}
+
+// validateExchangeConfig checks the exchange type and declare mode
+func validateExchangeConfig(exchangeType string, mode DeclareMode) error {
+	if !validExchangeTypes[exchangeType] {
+		return fmt.Errorf("unsupported exchange type %q (expected topic, headers, direct or fanout)", exchangeType)
+	}
+	switch mode {
+	case DeclareModeDeclare, DeclareModePassive, DeclareModeSkip:
+		return nil
+	default:
+		return fmt.Errorf("unsupported declare mode %q (expected declare, passive or skip)", mode)
+	}
+}
+
+// exchangeArgs returns the arguments used when declaring publish exchanges
+func (c *Client) exchangeArgs() amqp.Table {
+	if len(c.exchangeArguments) == 0 && c.alternateExchange == "" {
+		return nil
+	}
+
+	args := amqp.Table{}
+	for k, v := range c.exchangeArguments {
+		args[k] = v
+	}
+	if c.alternateExchange != "" {
+		args["alternate-exchange"] = c.alternateExchange
+	}
+	return args
+}
+
+// ensureExchange declares or verifies an exchange on the slot's channel the
+// first time it is used on the current connection. An error closes the
+// channel, which is reopened the next time the slot is acquired.
+func (c *Client) ensureExchange(slot *channelSlot, exchange string) error {
+	if c.declareMode == DeclareModeSkip || exchange == "" || c.exchanges.has(exchange) {
+		return nil
+	}
+
+	if err := c.declareExchange(slot.channel, exchange); err != nil {
+		return err
+	}
+
+	c.exchanges.add(exchange)
+	return nil
+}
+
+// declareExchange declares (or passively verifies) a single exchange
+func (c *Client) declareExchange(channel *amqp.Channel, exchange string) error {
+	if c.declareMode == DeclareModePassive {
+		if err := channel.ExchangeDeclarePassive(exchange, c.exchangeType, true, false, false, false, nil); err != nil {
+			return fmt.Errorf("exchange %q is not available: %w", exchange, err)
+		}
+		return nil
+	}
+
+	if err := channel.ExchangeDeclare(
+		exchange,
+		c.exchangeType,
+		true,  // durable
+		false, // auto-deleted
+		false, // internal
+		false, // no-wait
+		c.exchangeArgs(),
+	); err != nil {
+		return fmt.Errorf("failed to declare exchange %q: %w", exchange, err)
+	}
+	return nil
+}
+
+// verifyTopology declares or verifies the alternate exchange, the
+// configured exchanges and the stream on a fresh connection. Each check uses its own
+// channel, because a failed declaration closes the channel it ran on.
+func (c *Client) verifyTopology(conn *amqp.Connection) error {
+	c.exchanges.reset()
+
+	if c.declareMode == DeclareModeSkip {
+		return nil
+	}
+
+	if c.alternateExchange != "" {
+		if err := withChannel(conn, c.declareAlternateExchange); err != nil {
+			return err
+		}
+	}
+
+	for _, exchange := range c.verifyExchanges {
+		err := withChannel(conn, func(channel *amqp.Channel) error {
+			return c.declareExchange(channel, exchange)
+		})
+		if err != nil {
+			return err
+		}
+		c.exchanges.add(exchange)
+	}
+
+	if c.stream != "" {
+		if err := withChannel(conn, c.declareStream); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// declareAlternateExchange declares the alternate exchange and a queue of the
+// same name bound to it, so that unroutable messages are retained. In
+// passive mode it only verifies that the exchange exists.
+func (c *Client) declareAlternateExchange(channel *amqp.Channel) error {
+	if c.declareMode == DeclareModePassive {
+		if err := channel.ExchangeDeclarePassive(c.alternateExchange, "fanout", true, false, false, false, nil); err != nil {
+			return fmt.Errorf("alternate exchange %q is not available: %w", c.alternateExchange, err)
+		}
+		return nil
+	}
+
+	if err := channel.ExchangeDeclare(c.alternateExchange, "fanout", true, false, false, false, nil); err != nil {
+		return fmt.Errorf("failed to declare alternate exchange: %w", err)
+	}
+	if _, err := channel.QueueDeclare(c.alternateExchange, true, false, false, false, nil); err != nil {
+		return fmt.Errorf("failed to declare alternate exchange queue: %w", err)
+	}
+	if err := channel.QueueBind(c.alternateExchange, "", c.alternateExchange, false, nil); err != nil {
+		return fmt.Errorf("failed to bind alternate exchange queue: %w", err)
+	}
+	return nil
+}
+
+// withChannel runs fn on a temporary channel of conn
+func withChannel(conn *amqp.Connection, fn func(*amqp.Channel) error) error {
+	channel, err := conn.Channel()
+	if err != nil {
+		return fmt.Errorf("failed to open channel: %w", err)
+	}
+	defer func() { _ = channel.Close() }()
+
+	return fn(channel)
+}
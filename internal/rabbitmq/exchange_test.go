@@ -0,0 +1,83 @@
+package rabbitmq
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateExchangeConfig(t *testing.T) {
+	tests := []struct {
+		name         string
+		exchangeType string
+		mode         DeclareMode
+		wantErr      bool
+	}{
+		{"topic declare", "topic", DeclareModeDeclare, false},
+		{"headers passive", "headers", DeclareModePassive, false},
+		{"fanout skip", "fanout", DeclareModeSkip, false},
+		{"unknown type", "x-delayed-message", DeclareModeDeclare, true},
+		{"unknown mode", "topic", DeclareMode("create"), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateExchangeConfig(tt.exchangeType, tt.mode)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestNewClient_InvalidExchangeType(t *testing.T) {
+	_, err := NewClient(Config{URL: "amqp://localhost", ExchangeType: "bogus"})
+	if err == nil || !strings.Contains(err.Error(), "unsupported exchange type") {
+		t.Errorf("expected unsupported exchange type error, got %v", err)
+	}
+}
+
+func TestClient_ExchangeArgs(t *testing.T) {
+	client := &Client{}
+	if args := client.exchangeArgs(); args != nil {
+		t.Errorf("expected no arguments, got %v", args)
+	}
+
+	client = &Client{
+		exchangeArguments: map[string]string{"x-custom": "value"},
+		alternateExchange: "unroutable",
+	}
+	args := client.exchangeArgs()
+	if args["x-custom"] != "value" {
+		t.Errorf("expected x-custom argument, got %v", args)
+	}
+	if args["alternate-exchange"] != "unroutable" {
+		t.Errorf("expected alternate-exchange argument, got %v", args)
+	}
+}
+
+func TestExchangeCache(t *testing.T) {
+	var cache exchangeCache
+
+	if cache.has("certificate-events") {
+		t.Error("expected empty cache")
+	}
+
+	cache.add("certificate-events")
+	if !cache.has("certificate-events") {
+		t.Error("expected exchange to be cached")
+	}
+
+	cache.reset()
+	if cache.has("certificate-events") {
+		t.Error("expected cache to be cleared")
+	}
+}
+
+func TestClient_EnsureExchangeSkipMode(t *testing.T) {
+	client := &Client{declareMode: DeclareModeSkip}
+
+	// No channel is needed when declarations are skipped
+	if err := client.ensureExchange(&channelSlot{}, "certificate-events"); err != nil {
+		t.Errorf("expected no error in skip mode, got %v", err)
+	}
+}
@@ -0,0 +1,137 @@
+package rabbitmq
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	publishConfirmsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rabbitmq_publish_confirms_total",
+		Help: "Total number of publisher confirms by exchange and outcome (ack, nack, timeout, canceled)",
+	}, []string{"exchange", "outcome"})
+
+	publishConfirmDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "rabbitmq_publish_confirm_duration_seconds",
+		Help:    "Time between publishing a message and receiving the broker confirm",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"exchange"})
+
+	unroutableTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rabbitmq_unroutable_total",
+		Help: "Total number of messages returned by the broker as unroutable",
+	}, []string{"exchange"})
+
+	channelsInUse = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "rabbitmq_channel_pool_in_use",
+		Help: "Number of pool channels currently acquired by publishers",
+	})
+
+	channelOpensTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "rabbitmq_channel_opens_total",
+		Help: "Total number of pool channels opened, including reopens after channel errors",
+	})
+
+	outboxDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "rabbitmq_outbox_depth",
+		Help: "Number of messages in the local outbox awaiting delivery",
+	})
+
+	outboxBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "rabbitmq_outbox_bytes",
+		Help: "Size in bytes of the messages in the local outbox awaiting delivery",
+	})
+
+	outboxOldestPendingAge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "rabbitmq_outbox_oldest_pending_age_seconds",
+		Help: "Age of the oldest message in the local outbox awaiting delivery",
+	})
+
+	outboxBackpressureTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "rabbitmq_outbox_backpressure_total",
+		Help: "Total number of times a publish waited for space in a full outbox",
+	})
+
+	outboxDroppedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rabbitmq_outbox_dropped_total",
+		Help: "Total number of outbox messages discarded as undeliverable by reason (unroutable, failed, expired)",
+	}, []string{"reason"})
+
+	outboxCorruptSegmentsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "rabbitmq_outbox_corrupt_segments_total",
+		Help: "Total number of outbox segments set aside after a corrupt record",
+	})
+
+	connectedEndpoint = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "rabbitmq_connected_endpoint",
+		Help: "Broker endpoint the client is connected to (1 for the current endpoint)",
+	}, []string{"endpoint"})
+
+	connectionAttemptsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rabbitmq_connection_attempts_total",
+		Help: "Total number of connection attempts by endpoint and result (success, failure)",
+	}, []string{"endpoint", "result"})
+
+	connectionState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "rabbitmq_connection_state",
+		Help: "Connection state of the client (1 for the current state)",
+	}, []string{"state"})
+
+	stateTransitionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rabbitmq_connection_state_transitions_total",
+		Help: "Total number of transitions into each connection state",
+	}, []string{"state"})
+
+	reconnectAttemptsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "rabbitmq_reconnect_attempts_total",
+		Help: "Total number of reconnect attempts after the connection was lost",
+	})
+
+	credentialReloadsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rabbitmq_credential_reloads_total",
+		Help: "Total number of credential file reloads by result (success, error, rejected, watch_error)",
+	}, []string{"result"})
+
+	channelClosesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rabbitmq_channel_closes_total",
+		Help: "Total number of pool channels closed by the broker, by AMQP reply code",
+	}, []string{"code"})
+
+	topologyReconcilesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rabbitmq_topology_reconciles_total",
+		Help: "Total number of topology reconciliations by result (success, drift, error)",
+	}, []string{"result"})
+
+	streamCopyFailuresTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "rabbitmq_stream_copy_failures_total",
+		Help: "Total number of messages published to their exchange whose copy to the stream failed",
+	})
+
+	topologyDrift = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "rabbitmq_topology_drift",
+		Help: "Number of topology objects whose broker settings differ from the topology file",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(publishConfirmsTotal)
+	prometheus.MustRegister(publishConfirmDuration)
+	prometheus.MustRegister(unroutableTotal)
+	prometheus.MustRegister(channelsInUse)
+	prometheus.MustRegister(channelOpensTotal)
+	prometheus.MustRegister(outboxDepth)
+	prometheus.MustRegister(outboxBytes)
+	prometheus.MustRegister(outboxOldestPendingAge)
+	prometheus.MustRegister(outboxBackpressureTotal)
+	prometheus.MustRegister(outboxDroppedTotal)
+	prometheus.MustRegister(outboxCorruptSegmentsTotal)
+	prometheus.MustRegister(connectedEndpoint)
+	prometheus.MustRegister(connectionAttemptsTotal)
+	prometheus.MustRegister(connectionState)
+	prometheus.MustRegister(stateTransitionsTotal)
+	prometheus.MustRegister(reconnectAttemptsTotal)
+	prometheus.MustRegister(credentialReloadsTotal)
+	prometheus.MustRegister(channelClosesTotal)
+	prometheus.MustRegister(topologyReconcilesTotal)
+	prometheus.MustRegister(topologyDrift)
+	prometheus.MustRegister(streamCopyFailuresTotal)
+}
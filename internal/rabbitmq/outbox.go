@@ -0,0 +1,687 @@
+package rabbitmq
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rossigee/cert-webhook-system/internal/event"
+)
+
+const (
+	defaultOutboxMaxBytes     = 64 << 20
+	defaultOutboxSegmentBytes = 4 << 20
+
+	outboxSegmentSuffix = ".seg"
+	outboxCorruptSuffix = ".corrupt"
+	outboxCursorFile    = "cursor"
+	outboxLockFile      = "lock"
+	outboxFrameHeader   = 8 // uint32 length + uint32 CRC-32
+)
+
+// ErrOutboxFull is returned when the outbox has no room for a message before
+// the caller's context expires
+var ErrOutboxFull = errors.New("outbox full")
+
+// ErrOutboxDisabled is returned by Enqueue when no outbox is configured
+var ErrOutboxDisabled = errors.New("outbox not enabled")
+
+// errOutboxCorrupt marks a record that fails its checksum, can't be decoded
+// or claims an impossible length
+var errOutboxCorrupt = errors.New("corrupt outbox record")
+
+// outboxRecord is a single message persisted in the outbox
+type outboxRecord struct {
+	ID         string           `json:"id"`
+	Exchange   string           `json:"exchange"`
+	RoutingKey string           `json:"routing_key"`
+	Body       []byte           `json:"body"`
+	Properties event.Properties `json:"properties,omitzero"`
+	EnqueuedAt time.Time        `json:"enqueued_at"`
+}
+
+// outboxCursor is the position of the oldest undelivered record
+type outboxCursor struct {
+	Segment int64 `json:"segment"`
+	Offset  int64 `json:"offset"`
+}
+
+// OutboxStats describes the messages waiting in the outbox
+type OutboxStats struct {
+	Depth         int
+	Bytes         int64
+	OldestPending time.Time
+}
+
+// Outbox is an on-disk write-ahead log of messages awaiting delivery to the
+// broker. Records are appended to numbered segment files and fsync'd before
+// Append returns; a cursor file records how far delivery has progressed, and
+// fully delivered segments are deleted. The directory is locked, so that only
+// one process uses it at a time.
+type Outbox struct {
+	mu           sync.Mutex
+	dir          string
+	maxBytes     int64
+	segmentBytes int64
+	lock         *os.File
+
+	// write side
+	writer      *os.File
+	writeSeg    int64
+	writeOffset int64
+
+	// read side
+	reader *os.File
+	cursor outboxCursor
+
+	depth int
+	bytes int64
+
+	// pending is signalled when a record is appended
+	pending chan struct{}
+	// space is closed and replaced whenever records are removed
+	space chan struct{}
+}
+
+// OpenOutbox opens (or creates) an outbox in dir, recovering any records
+// left by a previous process. A torn record at the end of the last segment
+// is truncated.
+func OpenOutbox(dir string, maxBytes, segmentBytes int64) (*Outbox, error) {
+	if maxBytes <= 0 {
+		maxBytes = defaultOutboxMaxBytes
+	}
+	if segmentBytes <= 0 {
+		segmentBytes = defaultOutboxSegmentBytes
+	}
+
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create outbox directory: %w", err)
+	}
+
+	lock, err := lockOutboxDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	o := &Outbox{
+		dir:          dir,
+		maxBytes:     maxBytes,
+		segmentBytes: segmentBytes,
+		lock:         lock,
+		pending:      make(chan struct{}, 1),
+		space:        make(chan struct{}),
+	}
+
+	if err := o.recover(); err != nil {
+		_ = o.Close()
+		return nil, err
+	}
+
+	o.updateMetrics()
+	return o, nil
+}
+
+// recover loads the cursor, scans pending records and opens the write segment
+func (o *Outbox) recover() error {
+	segments, err := o.listSegments()
+	if err != nil {
+		return err
+	}
+
+	cursor, err := o.loadCursor()
+	if err != nil {
+		return err
+	}
+
+	// Remove segments that were fully delivered before a crash
+	for len(segments) > 0 && segments[0] < cursor.Segment {
+		_ = os.Remove(o.segmentPath(segments[0]))
+		segments = segments[1:]
+	}
+
+	if len(segments) == 0 {
+		o.cursor = outboxCursor{Segment: cursor.Segment}
+		if o.cursor.Segment == 0 {
+			o.cursor.Segment = 1
+		}
+		o.cursor.Offset = 0
+		if err := o.openWriter(o.cursor.Segment); err != nil {
+			return err
+		}
+		return syncDir(o.dir)
+	}
+
+	if segments[0] != cursor.Segment {
+		cursor = outboxCursor{Segment: segments[0]}
+	}
+	o.cursor = cursor
+
+	for i, seg := range segments {
+		start := int64(0)
+		if seg == cursor.Segment {
+			start = cursor.Offset
+		}
+
+		depth, end, err := o.scanSegment(seg, start)
+		if err != nil {
+			return err
+		}
+		o.depth += depth
+		o.bytes += end - start
+
+		if i == len(segments)-1 {
+			if err := os.Truncate(o.segmentPath(seg), end); err != nil {
+				return fmt.Errorf("failed to truncate outbox segment: %w", err)
+			}
+		}
+	}
+
+	return o.openWriter(segments[len(segments)-1])
+}
+
+// scanSegment counts the valid records in a segment from offset start and
+// returns the offset just past the last valid record
+func (o *Outbox) scanSegment(seg, start int64) (int, int64, error) {
+	f, err := os.Open(o.segmentPath(seg))
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to open outbox segment: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		return 0, 0, fmt.Errorf("failed to seek outbox segment: %w", err)
+	}
+
+	count := 0
+	offset := start
+	for {
+		_, n, err := readOutboxFrame(f, o.maxBytes)
+		if err != nil {
+			return count, offset, nil
+		}
+		count++
+		offset += n
+	}
+}
+
+// openWriter opens segment seg for appending
+func (o *Outbox) openWriter(seg int64) error {
+	f, err := os.OpenFile(o.segmentPath(seg), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return fmt.Errorf("failed to open outbox segment: %w", err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to stat outbox segment: %w", err)
+	}
+
+	o.writer = f
+	o.writeSeg = seg
+	o.writeOffset = info.Size()
+	return nil
+}
+
+// Append durably writes a message to the outbox. If the outbox is full it
+// blocks until the relay frees space or ctx is done.
+func (o *Outbox) Append(ctx context.Context, record outboxRecord) error {
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to encode outbox record: %w", err)
+	}
+
+	frame := make([]byte, outboxFrameHeader+len(payload))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(payload))
+	copy(frame[outboxFrameHeader:], payload)
+	size := int64(len(frame))
+
+	if size > o.maxBytes {
+		return fmt.Errorf("%w: record of %d bytes exceeds outbox capacity", ErrOutboxFull, size)
+	}
+
+	o.mu.Lock()
+	for o.bytes+size > o.maxBytes {
+		space := o.space
+		o.mu.Unlock()
+
+		outboxBackpressureTotal.Inc()
+		select {
+		case <-space:
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %w", ErrOutboxFull, ctx.Err())
+		}
+
+		o.mu.Lock()
+	}
+	defer o.mu.Unlock()
+
+	if o.writer == nil {
+		return fmt.Errorf("outbox closed")
+	}
+
+	if o.writeOffset > 0 && o.writeOffset+size > o.segmentBytes {
+		if err := o.rotate(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := o.writer.Write(frame); err != nil {
+		_ = o.writer.Truncate(o.writeOffset)
+		return fmt.Errorf("failed to write outbox record: %w", err)
+	}
+	if err := o.writer.Sync(); err != nil {
+		_ = o.writer.Truncate(o.writeOffset)
+		return fmt.Errorf("failed to sync outbox segment: %w", err)
+	}
+
+	o.writeOffset += size
+	o.depth++
+	o.bytes += size
+	o.updateMetrics()
+
+	select {
+	case o.pending <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// rotate closes the current write segment and starts the next one
+func (o *Outbox) rotate() error {
+	if err := o.writer.Close(); err != nil {
+		return fmt.Errorf("failed to close outbox segment: %w", err)
+	}
+	if err := o.openWriter(o.writeSeg + 1); err != nil {
+		return err
+	}
+	return syncDir(o.dir)
+}
+
+// peek returns the oldest undelivered record without removing it
+func (o *Outbox) peek() (outboxRecord, bool, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	record, _, err := o.peekLocked()
+	if errors.Is(err, io.EOF) {
+		return outboxRecord{}, false, nil
+	}
+	if err != nil {
+		return outboxRecord{}, false, err
+	}
+	return record, true, nil
+}
+
+// peekLocked reads the record at the cursor, advancing past exhausted
+// segments. It returns io.EOF when no record is pending.
+func (o *Outbox) peekLocked() (outboxRecord, int64, error) {
+	for {
+		if o.depth == 0 {
+			return outboxRecord{}, 0, io.EOF
+		}
+
+		if o.reader == nil {
+			f, err := os.Open(o.segmentPath(o.cursor.Segment))
+			if err != nil {
+				return outboxRecord{}, 0, fmt.Errorf("failed to open outbox segment: %w", err)
+			}
+			o.reader = f
+		}
+
+		if _, err := o.reader.Seek(o.cursor.Offset, io.SeekStart); err != nil {
+			return outboxRecord{}, 0, fmt.Errorf("failed to seek outbox segment: %w", err)
+		}
+
+		record, n, err := readOutboxFrame(o.reader, o.maxBytes)
+		if err == nil {
+			return record, n, nil
+		}
+
+		if errors.Is(err, errOutboxCorrupt) {
+			return outboxRecord{}, 0, o.quarantine(err)
+		}
+
+		if o.cursor.Segment >= o.writeSeg {
+			return outboxRecord{}, 0, fmt.Errorf("failed to read outbox record: %w", err)
+		}
+
+		// End of a completed segment; move on to the next one
+		if err := o.advanceSegment(); err != nil {
+			return outboxRecord{}, 0, err
+		}
+	}
+}
+
+// advanceSegment deletes the segment under the cursor and moves to the next
+func (o *Outbox) advanceSegment() error {
+	_ = o.reader.Close()
+	o.reader = nil
+
+	done := o.cursor.Segment
+	o.cursor = outboxCursor{Segment: done + 1}
+	if err := o.saveCursor(); err != nil {
+		return err
+	}
+
+	if err := os.Remove(o.segmentPath(done)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove outbox segment: %w", err)
+	}
+	return nil
+}
+
+// quarantine sets the segment under the cursor aside after a corrupt record,
+// renaming it with the .corrupt suffix for inspection, and moves the cursor to
+// the next segment so that the relay is not wedged. The records after the
+// corrupt one in that segment are not delivered. It returns cause, wrapped
+// with the name of the quarantined file.
+func (o *Outbox) quarantine(cause error) error {
+	seg := o.cursor.Segment
+	if seg == o.writeSeg {
+		if err := o.rotate(); err != nil {
+			return err
+		}
+	}
+
+	_ = o.reader.Close()
+	o.reader = nil
+
+	o.cursor = outboxCursor{Segment: seg + 1}
+	if err := o.saveCursor(); err != nil {
+		return err
+	}
+
+	path := o.segmentPath(seg)
+	if err := os.Rename(path, path+outboxCorruptSuffix); err != nil {
+		return fmt.Errorf("failed to quarantine outbox segment: %w", err)
+	}
+	if err := syncDir(o.dir); err != nil {
+		return err
+	}
+	outboxCorruptSegmentsTotal.Inc()
+
+	if err := o.recount(); err != nil {
+		return err
+	}
+	return fmt.Errorf("quarantined outbox segment %s: %w", filepath.Base(path)+outboxCorruptSuffix, cause)
+}
+
+// recount recomputes the number and size of the pending records from the
+// segments at and after the cursor
+func (o *Outbox) recount() error {
+	segments, err := o.listSegments()
+	if err != nil {
+		return err
+	}
+
+	o.depth, o.bytes = 0, 0
+	for _, seg := range segments {
+		if seg < o.cursor.Segment {
+			continue
+		}
+		start := int64(0)
+		if seg == o.cursor.Segment {
+			start = o.cursor.Offset
+		}
+		depth, end, err := o.scanSegment(seg, start)
+		if err != nil {
+			return err
+		}
+		o.depth += depth
+		o.bytes += end - start
+	}
+	o.updateMetrics()
+
+	close(o.space)
+	o.space = make(chan struct{})
+	return nil
+}
+
+// commit removes the oldest record once it has been delivered
+func (o *Outbox) commit(id string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	record, n, err := o.peekLocked()
+	if err != nil {
+		return err
+	}
+	if record.ID != id {
+		return fmt.Errorf("outbox record %s is not at the head of the outbox", id)
+	}
+
+	o.cursor.Offset += n
+	if err := o.saveCursor(); err != nil {
+		o.cursor.Offset -= n
+		return err
+	}
+
+	o.depth--
+	o.bytes -= n
+	o.updateMetrics()
+
+	close(o.space)
+	o.space = make(chan struct{})
+
+	return nil
+}
+
+// Stats returns the number and size of pending records and the enqueue time
+// of the oldest one
+func (o *Outbox) Stats() OutboxStats {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return OutboxStats{Depth: o.depth, Bytes: o.bytes, OldestPending: o.oldestLocked()}
+}
+
+// oldestLocked returns the enqueue time of the record at the cursor. Unlike
+// peekLocked it reads through its own file handles and never advances the
+// cursor, so that health and metrics reads don't modify the outbox.
+func (o *Outbox) oldestLocked() time.Time {
+	if o.depth == 0 {
+		return time.Time{}
+	}
+
+	offset := o.cursor.Offset
+	for seg := o.cursor.Segment; seg <= o.writeSeg; seg++ {
+		f, err := os.Open(o.segmentPath(seg))
+		if err != nil {
+			return time.Time{}
+		}
+		var record outboxRecord
+		if _, err = f.Seek(offset, io.SeekStart); err == nil {
+			record, _, err = readOutboxFrame(f, o.maxBytes)
+		}
+		_ = f.Close()
+		if err == nil {
+			return record.EnqueuedAt
+		}
+		// The cursor is at the end of a completed segment
+		offset = 0
+	}
+	return time.Time{}
+}
+
+// Close closes the outbox files and releases the directory lock. Pending
+// records remain on disk.
+func (o *Outbox) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.lock != nil {
+		_ = o.lock.Close()
+		o.lock = nil
+	}
+	if o.reader != nil {
+		_ = o.reader.Close()
+		o.reader = nil
+	}
+	if o.writer == nil {
+		return nil
+	}
+
+	err := o.writer.Close()
+	o.writer = nil
+	return err
+}
+
+// updateMetrics publishes the depth and size gauges. Callers hold o.mu.
+func (o *Outbox) updateMetrics() {
+	outboxDepth.Set(float64(o.depth))
+	outboxBytes.Set(float64(o.bytes))
+}
+
+// loadCursor reads the persisted cursor, defaulting to the first segment
+func (o *Outbox) loadCursor() (outboxCursor, error) {
+	data, err := os.ReadFile(filepath.Join(o.dir, outboxCursorFile))
+	if os.IsNotExist(err) {
+		return outboxCursor{}, nil
+	}
+	if err != nil {
+		return outboxCursor{}, fmt.Errorf("failed to read outbox cursor: %w", err)
+	}
+
+	var cursor outboxCursor
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return outboxCursor{}, fmt.Errorf("failed to decode outbox cursor: %w", err)
+	}
+	return cursor, nil
+}
+
+// saveCursor atomically replaces the cursor file
+func (o *Outbox) saveCursor() error {
+	data, err := json.Marshal(o.cursor)
+	if err != nil {
+		return fmt.Errorf("failed to encode outbox cursor: %w", err)
+	}
+
+	tmp := filepath.Join(o.dir, outboxCursorFile+".tmp")
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o640)
+	if err != nil {
+		return fmt.Errorf("failed to write outbox cursor: %w", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to write outbox cursor: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to sync outbox cursor: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close outbox cursor: %w", err)
+	}
+
+	if err := os.Rename(tmp, filepath.Join(o.dir, outboxCursorFile)); err != nil {
+		return fmt.Errorf("failed to replace outbox cursor: %w", err)
+	}
+	return nil
+}
+
+// listSegments returns the segment numbers present in the outbox directory
+func (o *Outbox) listSegments() ([]int64, error) {
+	entries, err := os.ReadDir(o.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list outbox directory: %w", err)
+	}
+
+	var segments []int64
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), outboxSegmentSuffix)
+		if !ok {
+			continue
+		}
+		seg, err := strconv.ParseInt(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, seg)
+	}
+
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+// segmentPath returns the file name of segment seg
+func (o *Outbox) segmentPath(seg int64) string {
+	return filepath.Join(o.dir, fmt.Sprintf("%020d%s", seg, outboxSegmentSuffix))
+}
+
+// readOutboxFrame reads one length-prefixed, checksummed record of at most
+// maxBytes, the outbox capacity no record written can exceed. A short read is
+// io.EOF; an invalid record is errOutboxCorrupt.
+func readOutboxFrame(r io.Reader, maxBytes int64) (outboxRecord, int64, error) {
+	var header [outboxFrameHeader]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return outboxRecord{}, 0, io.EOF
+		}
+		return outboxRecord{}, 0, err
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	checksum := binary.BigEndian.Uint32(header[4:8])
+
+	// Checked before allocating, so that a corrupt header can't exhaust memory
+	if int64(outboxFrameHeader)+int64(length) > maxBytes {
+		return outboxRecord{}, 0, fmt.Errorf("%w: length %d exceeds the outbox capacity", errOutboxCorrupt, length)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return outboxRecord{}, 0, io.EOF
+	}
+	if crc32.ChecksumIEEE(payload) != checksum {
+		return outboxRecord{}, 0, fmt.Errorf("%w: checksum mismatch", errOutboxCorrupt)
+	}
+
+	var record outboxRecord
+	if err := json.Unmarshal(payload, &record); err != nil {
+		return outboxRecord{}, 0, fmt.Errorf("%w: %w", errOutboxCorrupt, err)
+	}
+
+	return record, int64(outboxFrameHeader) + int64(length), nil
+}
+
+// lockOutboxDir takes an exclusive lock on the outbox directory, so that two
+// processes sharing a volume can't interleave writes to the same segments.
+// The lock is released when the returned file is closed.
+func lockOutboxDir(dir string) (*os.File, error) {
+	f, err := os.OpenFile(filepath.Join(dir, outboxLockFile), os.O_CREATE|os.O_RDWR, 0o640)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open outbox lock: %w", err)
+	}
+	if err := lockFile(f); err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("outbox %s is in use by another process: %w", dir, err)
+	}
+	return f, nil
+}
+
+// syncDir fsyncs a directory so that file creations and renames are durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open outbox directory: %w", err)
+	}
+	defer func() { _ = d.Close() }()
+
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync outbox directory: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build unix
+
+package rabbitmq
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile takes an exclusive lock on f, failing if another process holds it
+func lockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+}
@@ -0,0 +1,505 @@
+package rabbitmq
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/rossigee/cert-webhook-system/internal/event"
+)
+
+func newTestRecord(i int) outboxRecord {
+	return outboxRecord{
+		ID:         fmt.Sprintf("msg-%d", i),
+		Exchange:   "certificate-events",
+		RoutingKey: "certificate.renewed",
+		Body:       []byte(fmt.Sprintf(`{"certificate":"cert-%d"}`, i)),
+		EnqueuedAt: time.Now(),
+	}
+}
+
+func drainOutbox(t *testing.T, o *Outbox) []string {
+	t.Helper()
+
+	var ids []string
+	for {
+		record, ok, err := o.peek()
+		if err != nil {
+			t.Fatalf("peek failed: %v", err)
+		}
+		if !ok {
+			return ids
+		}
+		if err := o.commit(record.ID); err != nil {
+			t.Fatalf("commit failed: %v", err)
+		}
+		ids = append(ids, record.ID)
+	}
+}
+
+func TestOutbox_AppendPeekCommit(t *testing.T) {
+	o, err := OpenOutbox(t.TempDir(), 0, 0)
+	if err != nil {
+		t.Fatalf("failed to open outbox: %v", err)
+	}
+	defer func() { _ = o.Close() }()
+
+	for i := range 3 {
+		if err := o.Append(context.Background(), newTestRecord(i)); err != nil {
+			t.Fatalf("append failed: %v", err)
+		}
+	}
+
+	stats := o.Stats()
+	if stats.Depth != 3 {
+		t.Errorf("expected depth 3, got %d", stats.Depth)
+	}
+	if stats.OldestPending.IsZero() {
+		t.Error("expected oldest pending time to be set")
+	}
+
+	ids := drainOutbox(t, o)
+	if len(ids) != 3 || ids[0] != "msg-0" || ids[2] != "msg-2" {
+		t.Errorf("expected records in order, got %v", ids)
+	}
+
+	stats = o.Stats()
+	if stats.Depth != 0 || stats.Bytes != 0 {
+		t.Errorf("expected empty outbox, got %+v", stats)
+	}
+}
+
+func TestOutbox_CommitOutOfOrder(t *testing.T) {
+	o, err := OpenOutbox(t.TempDir(), 0, 0)
+	if err != nil {
+		t.Fatalf("failed to open outbox: %v", err)
+	}
+	defer func() { _ = o.Close() }()
+
+	_ = o.Append(context.Background(), newTestRecord(0))
+	_ = o.Append(context.Background(), newTestRecord(1))
+
+	if err := o.commit("msg-1"); err == nil {
+		t.Error("expected error committing a record that is not at the head")
+	}
+}
+
+func TestOutbox_RecoversAfterReopen(t *testing.T) {
+	dir := t.TempDir()
+
+	o, err := OpenOutbox(dir, 0, 0)
+	if err != nil {
+		t.Fatalf("failed to open outbox: %v", err)
+	}
+	for i := range 3 {
+		_ = o.Append(context.Background(), newTestRecord(i))
+	}
+	record, _, _ := o.peek()
+	if err := o.commit(record.ID); err != nil {
+		t.Fatalf("commit failed: %v", err)
+	}
+	_ = o.Close()
+
+	o, err = OpenOutbox(dir, 0, 0)
+	if err != nil {
+		t.Fatalf("failed to reopen outbox: %v", err)
+	}
+	defer func() { _ = o.Close() }()
+
+	if depth := o.Stats().Depth; depth != 2 {
+		t.Fatalf("expected 2 pending records after reopen, got %d", depth)
+	}
+
+	ids := drainOutbox(t, o)
+	if len(ids) != 2 || ids[0] != "msg-1" || ids[1] != "msg-2" {
+		t.Errorf("expected remaining records in order, got %v", ids)
+	}
+}
+
+func TestOutbox_TruncatesTornRecord(t *testing.T) {
+	dir := t.TempDir()
+
+	o, err := OpenOutbox(dir, 0, 0)
+	if err != nil {
+		t.Fatalf("failed to open outbox: %v", err)
+	}
+	_ = o.Append(context.Background(), newTestRecord(0))
+	segment := o.segmentPath(o.writeSeg)
+	_ = o.Close()
+
+	// Simulate a crash part-way through writing a second record
+	f, err := os.OpenFile(segment, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("failed to open segment: %v", err)
+	}
+	_, _ = f.Write([]byte{0, 0, 1, 0, 1, 2})
+	_ = f.Close()
+
+	o, err = OpenOutbox(dir, 0, 0)
+	if err != nil {
+		t.Fatalf("failed to reopen outbox: %v", err)
+	}
+	defer func() { _ = o.Close() }()
+
+	if err := o.Append(context.Background(), newTestRecord(1)); err != nil {
+		t.Fatalf("append after recovery failed: %v", err)
+	}
+
+	ids := drainOutbox(t, o)
+	if len(ids) != 2 || ids[0] != "msg-0" || ids[1] != "msg-1" {
+		t.Errorf("expected torn record to be discarded, got %v", ids)
+	}
+}
+
+func TestOutbox_RotatesAndRemovesSegments(t *testing.T) {
+	dir := t.TempDir()
+
+	o, err := OpenOutbox(dir, 0, 256)
+	if err != nil {
+		t.Fatalf("failed to open outbox: %v", err)
+	}
+	defer func() { _ = o.Close() }()
+
+	for i := range 10 {
+		if err := o.Append(context.Background(), newTestRecord(i)); err != nil {
+			t.Fatalf("append failed: %v", err)
+		}
+	}
+
+	segments, _ := filepath.Glob(filepath.Join(dir, "*"+outboxSegmentSuffix))
+	if len(segments) < 2 {
+		t.Fatalf("expected multiple segments, got %d", len(segments))
+	}
+
+	ids := drainOutbox(t, o)
+	if len(ids) != 10 {
+		t.Fatalf("expected 10 records, got %d", len(ids))
+	}
+	for i, id := range ids {
+		if id != fmt.Sprintf("msg-%d", i) {
+			t.Errorf("expected msg-%d at position %d, got %s", i, i, id)
+		}
+	}
+
+	segments, _ = filepath.Glob(filepath.Join(dir, "*"+outboxSegmentSuffix))
+	if len(segments) != 1 {
+		t.Errorf("expected delivered segments to be removed, %d remain", len(segments))
+	}
+}
+
+func TestOutbox_BackPressure(t *testing.T) {
+	o, err := OpenOutbox(t.TempDir(), 300, 0)
+	if err != nil {
+		t.Fatalf("failed to open outbox: %v", err)
+	}
+	defer func() { _ = o.Close() }()
+
+	for i := 0; ; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		err := o.Append(ctx, newTestRecord(i))
+		cancel()
+		if errors.Is(err, ErrOutboxFull) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("append failed: %v", err)
+		}
+		if i > 100 {
+			t.Fatal("expected outbox to fill up")
+		}
+	}
+
+	// A blocked append proceeds once the relay frees space
+	done := make(chan error, 1)
+	go func() {
+		done <- o.Append(context.Background(), newTestRecord(99))
+	}()
+
+	record, _, _ := o.peek()
+	if err := o.commit(record.ID); err != nil {
+		t.Fatalf("commit failed: %v", err)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expected blocked append to succeed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("expected blocked append to resume after space was freed")
+	}
+}
+
+func TestRelayRecord_DropsExpired(t *testing.T) {
+	o, err := OpenOutbox(t.TempDir(), 0, 0)
+	if err != nil {
+		t.Fatalf("failed to open outbox: %v", err)
+	}
+	defer func() { _ = o.Close() }()
+
+	record := newTestRecord(0)
+	record.Properties = event.Properties{
+		Expiration: time.Minute,
+		Headers:    map[string]string{"event": "certificate.renewed"},
+	}
+	record.EnqueuedAt = time.Now().Add(-time.Hour)
+	if err := o.Append(context.Background(), record); err != nil {
+		t.Fatalf("append failed: %v", err)
+	}
+
+	stored, ok, err := o.peek()
+	if err != nil || !ok {
+		t.Fatalf("peek failed: %v", err)
+	}
+	if stored.Properties.Expiration != time.Minute || stored.Properties.Headers["event"] != "certificate.renewed" {
+		t.Errorf("expected properties to be stored, got %+v", stored.Properties)
+	}
+
+	// Not connected, so this only succeeds if the record is dropped
+	client := &Client{outbox: o, confirmTimeout: defaultConfirmTimeout}
+	if err := client.relayRecord(stored); err != nil {
+		t.Fatalf("expected expired record to be dropped, got %v", err)
+	}
+	if depth := o.Stats().Depth; depth != 0 {
+		t.Errorf("expected empty outbox, got depth %d", depth)
+	}
+}
+
+func TestRelayHead_RetriesTransientFailures(t *testing.T) {
+	o, err := OpenOutbox(t.TempDir(), 0, 0)
+	if err != nil {
+		t.Fatalf("failed to open outbox: %v", err)
+	}
+	defer func() { _ = o.Close() }()
+
+	if err := o.Append(context.Background(), newTestRecord(0)); err != nil {
+		t.Fatalf("append failed: %v", err)
+	}
+	record, _, _ := o.peek()
+	var failures relayFailures
+
+	client := &Client{outbox: o, confirmTimeout: defaultConfirmTimeout, outboxMaxAttempts: 2}
+	client.OnOutboxDrop(func(ctx context.Context, drop OutboxDrop) {
+		t.Errorf("expected no record to be dropped, got %+v", drop)
+	})
+
+	// Failures while disconnected never drop the record
+	for range 3 {
+		if err := client.relayHead(record, &failures); !errors.Is(err, ErrNotConnected) {
+			t.Fatalf("expected ErrNotConnected, got %v", err)
+		}
+	}
+
+	// Neither do confirms timing out while connected, e.g. during a broker
+	// resource alarm, nor channels closed by a reconnect
+	transient := []error{
+		fmt.Errorf("%w after %s", ErrConfirmTimeout, defaultConfirmTimeout),
+		fmt.Errorf("failed to publish message: %w", amqp.ErrClosed),
+	}
+	for _, cause := range transient {
+		for range 5 {
+			if err := client.relayFailed(record, cause, &failures); !errors.Is(err, cause) {
+				t.Fatalf("expected %v to be returned, got %v", cause, err)
+			}
+		}
+	}
+	if depth := o.Stats().Depth; depth != 1 {
+		t.Errorf("expected the record to survive transient failures, got depth %d", depth)
+	}
+}
+
+func TestRelayHead_DropsRejectedRecords(t *testing.T) {
+	o, err := OpenOutbox(t.TempDir(), 0, 0)
+	if err != nil {
+		t.Fatalf("failed to open outbox: %v", err)
+	}
+	defer func() { _ = o.Close() }()
+
+	for i := range 2 {
+		if err := o.Append(context.Background(), newTestRecord(i)); err != nil {
+			t.Fatalf("append failed: %v", err)
+		}
+	}
+
+	var drops []OutboxDrop
+	client := &Client{outbox: o, confirmTimeout: defaultConfirmTimeout, outboxMaxAttempts: 2}
+	client.OnOutboxDrop(func(ctx context.Context, drop OutboxDrop) {
+		drops = append(drops, drop)
+	})
+	var failures relayFailures
+
+	// Broker rejections count towards the limit
+	rejected := fmt.Errorf("%w: channel closed: %w", ErrNacked, &amqp.Error{Code: amqp.NotFound, Reason: "NOT_FOUND - no exchange"})
+	record, _, _ := o.peek()
+	if err := client.relayFailed(record, rejected, &failures); err == nil {
+		t.Fatal("expected the first rejection to be returned")
+	}
+	if depth := o.Stats().Depth; depth != 2 || len(drops) != 0 {
+		t.Fatalf("expected the record to be kept, got depth %d and %d drops", depth, len(drops))
+	}
+	if err := client.relayFailed(record, rejected, &failures); err != nil {
+		t.Fatalf("expected the record to be dropped, got %v", err)
+	}
+
+	// Unroutable records are dropped at once
+	record, _, _ = o.peek()
+	returned := &ReturnError{Exchange: record.Exchange, RoutingKey: record.RoutingKey, ReplyCode: 312, ReplyText: "NO_ROUTE"}
+	if err := client.relayFailed(record, returned, &failures); err != nil {
+		t.Fatalf("expected the unroutable record to be dropped, got %v", err)
+	}
+
+	if depth := o.Stats().Depth; depth != 0 {
+		t.Errorf("expected empty outbox, got depth %d", depth)
+	}
+	if len(drops) != 2 {
+		t.Fatalf("expected 2 drops, got %d", len(drops))
+	}
+	if drops[0].MessageID != "msg-0" || drops[0].Reason != "failed" || drops[0].Attempts != 2 {
+		t.Errorf("unexpected drop of the rejected record: %+v", drops[0])
+	}
+	if drops[1].MessageID != "msg-1" || drops[1].Reason != "unroutable" || !errors.Is(drops[1].Err, ErrUnroutable) {
+		t.Errorf("unexpected drop of the unroutable record: %+v", drops[1])
+	}
+	if string(drops[0].Body) != `{"certificate":"cert-0"}` {
+		t.Errorf("expected the drop to carry the body, got %s", drops[0].Body)
+	}
+}
+
+func TestOutbox_StatsHasNoSideEffects(t *testing.T) {
+	dir := t.TempDir()
+	o, err := OpenOutbox(dir, 0, 256)
+	if err != nil {
+		t.Fatalf("failed to open outbox: %v", err)
+	}
+	defer func() { _ = o.Close() }()
+
+	for i := range 10 {
+		record := newTestRecord(i)
+		record.EnqueuedAt = time.Unix(int64(i), 0)
+		if err := o.Append(context.Background(), record); err != nil {
+			t.Fatalf("append failed: %v", err)
+		}
+	}
+
+	// Deliver the records of the first segment, leaving the cursor at its end
+	first := o.cursor.Segment
+	info, err := os.Stat(o.segmentPath(first))
+	if err != nil {
+		t.Fatalf("failed to stat segment: %v", err)
+	}
+	for o.cursor.Offset < info.Size() {
+		record, _, _ := o.peek()
+		if err := o.commit(record.ID); err != nil {
+			t.Fatalf("commit failed: %v", err)
+		}
+	}
+
+	cursor := o.cursor
+	stats := o.Stats()
+	if stats.OldestPending.IsZero() || stats.Depth == 0 {
+		t.Fatalf("expected pending records, got %+v", stats)
+	}
+	if o.cursor != cursor {
+		t.Errorf("expected Stats not to move the cursor from %+v, got %+v", cursor, o.cursor)
+	}
+	if _, err := os.Stat(o.segmentPath(first)); err != nil {
+		t.Errorf("expected Stats not to remove the delivered segment: %v", err)
+	}
+}
+
+func TestOutbox_QuarantinesCorruptSegment(t *testing.T) {
+	dir := t.TempDir()
+	o, err := OpenOutbox(dir, 0, 512)
+	if err != nil {
+		t.Fatalf("failed to open outbox: %v", err)
+	}
+	defer func() { _ = o.Close() }()
+
+	for i := range 10 {
+		if err := o.Append(context.Background(), newTestRecord(i)); err != nil {
+			t.Fatalf("append failed: %v", err)
+		}
+	}
+
+	// Flip a payload byte of the second record of the first segment
+	segment := o.segmentPath(o.cursor.Segment)
+	data, err := os.ReadFile(segment)
+	if err != nil {
+		t.Fatalf("failed to read segment: %v", err)
+	}
+	second := outboxFrameHeader + int(binary.BigEndian.Uint32(data[0:4]))
+	if second+outboxFrameHeader >= len(data) {
+		t.Fatalf("expected several records in the first segment")
+	}
+	data[second+outboxFrameHeader] ^= 0xff
+	if err := os.WriteFile(segment, data, 0o640); err != nil {
+		t.Fatalf("failed to write segment: %v", err)
+	}
+
+	var ids []string
+	quarantined := false
+	for {
+		record, ok, err := o.peek()
+		if errors.Is(err, errOutboxCorrupt) && !quarantined {
+			quarantined = true
+			continue
+		}
+		if err != nil {
+			t.Fatalf("peek failed: %v", err)
+		}
+		if !ok {
+			break
+		}
+		if err := o.commit(record.ID); err != nil {
+			t.Fatalf("commit failed: %v", err)
+		}
+		ids = append(ids, record.ID)
+	}
+
+	if !quarantined || len(ids) < 2 || ids[0] != "msg-0" || ids[len(ids)-1] != "msg-9" {
+		t.Errorf("expected delivery to continue after the corrupt segment, got %v", ids)
+	}
+	if _, err := os.Stat(segment + outboxCorruptSuffix); err != nil {
+		t.Errorf("expected the corrupt segment to be kept aside: %v", err)
+	}
+	if stats := o.Stats(); stats.Depth != 0 || stats.Bytes != 0 {
+		t.Errorf("expected an empty outbox, got %+v", stats)
+	}
+}
+
+func TestReadOutboxFrame_RejectsOversizedLength(t *testing.T) {
+	var header [outboxFrameHeader]byte
+	binary.BigEndian.PutUint32(header[0:4], 0xfffffff0)
+
+	_, _, err := readOutboxFrame(bytes.NewReader(header[:]), defaultOutboxMaxBytes)
+	if !errors.Is(err, errOutboxCorrupt) {
+		t.Errorf("expected a corrupt record error, got %v", err)
+	}
+}
+
+func TestOpenOutbox_LocksDirectory(t *testing.T) {
+	dir := t.TempDir()
+	o, err := OpenOutbox(dir, 0, 0)
+	if err != nil {
+		t.Fatalf("failed to open outbox: %v", err)
+	}
+
+	if second, err := OpenOutbox(dir, 0, 0); err == nil {
+		_ = second.Close()
+		t.Fatal("expected the outbox directory to be locked")
+	}
+
+	_ = o.Close()
+	o, err = OpenOutbox(dir, 0, 0)
+	if err != nil {
+		t.Fatalf("expected the lock to be released on close: %v", err)
+	}
+	_ = o.Close()
+}
@@ -0,0 +1,155 @@
+package rabbitmq
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// defaultChannelPoolSize is the number of channels used when none is configured
+const defaultChannelPoolSize = 4
+
+// channelSlot holds one channel of the pool together with its return
+// tracking. A slot whose channel has closed (after a channel error or a
+// reconnect) is reopened the next time it is acquired, so a failure on one
+// channel does not affect publishes on the others.
+type channelSlot struct {
+	conn    *amqp.Connection
+	channel *amqp.Channel
+	returns chan amqp.Return
+	tracker *returnTracker
+	closed  *closeReason
+}
+
+// closeReason records why the broker closed a channel, so that publishes
+// left unconfirmed by the close can report the broker's error
+type closeReason struct {
+	mu     sync.Mutex
+	closes chan *amqp.Error
+	err    *amqp.Error
+}
+
+// get returns the error the broker closed the channel with, or nil while it
+// is open or if it was closed without one. The channel library sends the
+// error before failing the pending confirms, so it is available to
+// publishers as soon as their confirm fails.
+func (r *closeReason) get() *amqp.Error {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.err == nil {
+		select {
+		case err, ok := <-r.closes:
+			if ok {
+				r.err = err
+			}
+		default:
+		}
+	}
+	return r.err
+}
+
+// newChannelPool creates size empty slots; channels are opened on first use
+func newChannelPool(size int) chan *channelSlot {
+	if size <= 0 {
+		size = defaultChannelPoolSize
+	}
+
+	pool := make(chan *channelSlot, size)
+	for range size {
+		pool <- &channelSlot{tracker: newReturnTracker()}
+	}
+	return pool
+}
+
+// usable reports whether the slot holds an open channel on conn
+func (s *channelSlot) usable(conn *amqp.Connection) bool {
+	return s.channel != nil && !s.channel.IsClosed() && s.conn == conn
+}
+
+// open opens a new channel on conn in confirm mode
+func (s *channelSlot) open(conn *amqp.Connection) error {
+	channel, err := conn.Channel()
+	if err != nil {
+		return fmt.Errorf("failed to open channel: %w", err)
+	}
+
+	if err := channel.Confirm(false); err != nil {
+		_ = channel.Close()
+		return fmt.Errorf("failed to put channel in confirm mode: %w", err)
+	}
+
+	s.conn = conn
+	s.channel = channel
+	s.returns = channel.NotifyReturn(make(chan amqp.Return, returnBufferSize))
+	s.closed = &closeReason{closes: channel.NotifyClose(make(chan *amqp.Error, 1))}
+	return nil
+}
+
+// acquire takes a slot from the pool, reopening its channel if necessary.
+// A channel left on a replaced connection is abandoned rather than closed,
+// since publishes on it may still await their confirms; it is closed with
+// its connection. The slot must be handed back with release.
+func (c *Client) acquire(ctx context.Context) (*channelSlot, error) {
+	var slot *channelSlot
+	select {
+	case slot = <-c.pool:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("failed to acquire channel: %w", ctx.Err())
+	}
+	channelsInUse.Inc()
+
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+
+	if slot.usable(conn) {
+		return slot, nil
+	}
+
+	if conn == nil || conn.IsClosed() {
+		c.release(slot)
+		return nil, ErrNotConnected
+	}
+
+	if err := slot.open(conn); err != nil {
+		c.release(slot)
+		return nil, err
+	}
+	channelOpensTotal.Inc()
+	c.watchChannel(slot.channel)
+
+	return slot, nil
+}
+
+// watchChannel records why a pool channel was closed by the broker. The slot
+// itself recovers by reopening on next use; if the channel failed because
+// an exchange no longer exists, the exchange cache is also reset so that
+// the exchange is declared again.
+func (c *Client) watchChannel(channel *amqp.Channel) {
+	closeCh := channel.NotifyClose(make(chan *amqp.Error, 1))
+	go func() {
+		err, ok := <-closeCh
+		if !ok || err == nil {
+			return
+		}
+
+		channelClosesTotal.WithLabelValues(strconv.Itoa(err.Code)).Inc()
+		if err.Code == amqp.NotFound {
+			c.exchanges.reset()
+		}
+	}()
+}
+
+// release returns a slot to the pool
+func (c *Client) release(slot *channelSlot) {
+	channelsInUse.Dec()
+	c.pool <- slot
+}
@@ -0,0 +1,68 @@
+package rabbitmq
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestNewChannelPool_DefaultSize(t *testing.T) {
+	pool := newChannelPool(0)
+	if len(pool) != defaultChannelPoolSize {
+		t.Errorf("expected %d slots, got %d", defaultChannelPoolSize, len(pool))
+	}
+
+	pool = newChannelPool(8)
+	if len(pool) != 8 {
+		t.Errorf("expected 8 slots, got %d", len(pool))
+	}
+}
+
+func TestClient_AcquireWithoutConnection(t *testing.T) {
+	client := &Client{pool: newChannelPool(2)}
+
+	_, err := client.acquire(context.Background())
+	if err == nil {
+		t.Fatal("expected error acquiring a channel without a connection")
+	}
+
+	if len(client.pool) != 2 {
+		t.Errorf("expected slot to be returned to the pool, %d of 2 available", len(client.pool))
+	}
+}
+
+func TestClient_AcquireRespectsContext(t *testing.T) {
+	client := &Client{pool: newChannelPool(1)}
+	slot := <-client.pool
+	defer func() { client.pool <- slot }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if _, err := client.acquire(ctx); err == nil {
+		t.Error("expected error when no channel becomes available")
+	}
+}
+
+func TestCloseReason(t *testing.T) {
+	closes := make(chan *amqp.Error, 1)
+	reason := &closeReason{closes: closes}
+	if err := reason.get(); err != nil {
+		t.Fatalf("expected no reason while open, got %v", err)
+	}
+
+	// The library sends the error, then closes the notification channel
+	closes <- &amqp.Error{Code: amqp.NotFound, Reason: "NOT_FOUND - no exchange"}
+	close(closes)
+	for range 2 {
+		if err := reason.get(); err == nil || err.Code != amqp.NotFound {
+			t.Errorf("expected the close error to be kept, got %v", err)
+		}
+	}
+
+	if err := (*closeReason)(nil).get(); err != nil {
+		t.Errorf("expected no reason without a channel, got %v", err)
+	}
+}
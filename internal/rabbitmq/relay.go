@@ -0,0 +1,228 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/rossigee/cert-webhook-system/internal/event"
+)
+
+// outboxAgeInterval is how often the oldest-pending-age gauge is refreshed
+// while the relay is idle or waiting to retry
+const outboxAgeInterval = 5 * time.Second
+
+// relayOutbox delivers outbox records to the broker in order until the
+// client is closed. Transient failures are retried with exponential backoff;
+// records the broker can never route, or keeps rejecting, are dropped and
+// handed to the OnOutboxDrop handlers.
+func (c *Client) relayOutbox() {
+	defer close(c.relayDone)
+
+	ticker := time.NewTicker(outboxAgeInterval)
+	defer ticker.Stop()
+
+	backoff := initialBackoff
+	var failures relayFailures
+
+	for {
+		c.updateOutboxAge()
+
+		record, ok, err := c.outbox.peek()
+		if errors.Is(err, errOutboxCorrupt) {
+			// The outbox has set the corrupt records aside; carry on
+			c.logger.Error(err, "Skipped corrupt outbox records")
+			continue
+		}
+		if err == nil && !ok {
+			select {
+			case <-c.outbox.pending:
+			case <-ticker.C:
+			case <-c.done:
+				return
+			}
+			continue
+		}
+
+		if err == nil {
+			err = c.relayHead(record, &failures)
+		}
+
+		if err == nil {
+			backoff = initialBackoff
+			continue
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-c.done:
+			timer.Stop()
+			return
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// relayFailures counts the rejected deliveries of the head record
+type relayFailures struct {
+	id    string
+	count int
+}
+
+// OutboxDrop describes a message the relay removed from the outbox without
+// the broker accepting it
+type OutboxDrop struct {
+	MessageID  string
+	Exchange   string
+	RoutingKey string
+	Body       []byte
+	Properties event.Properties
+	// Reason is "unroutable" or "failed", as in rabbitmq_outbox_dropped_total
+	Reason string
+	// Attempts is the number of deliveries the broker rejected
+	Attempts int
+	// Err is the error of the last delivery
+	Err error
+}
+
+// OnOutboxDrop registers fn to receive the messages the relay drops as
+// unroutable or after exhausting OutboxMaxAttempts, so that they can be
+// dead-lettered. Handlers run on the relay goroutine with a context bounded
+// by the confirm timeout, and the message is removed from the outbox once
+// they return.
+func (c *Client) OnOutboxDrop(fn func(ctx context.Context, drop OutboxDrop)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dropHandlers = append(c.dropHandlers, fn)
+}
+
+// relayHead delivers the head record
+func (c *Client) relayHead(record outboxRecord, failures *relayFailures) error {
+	return c.relayFailed(record, c.relayRecord(record), failures)
+}
+
+// relayFailed decides what happens to the head record after a delivery.
+// Unroutable records are dropped at once, since retrying cannot succeed.
+// Only permanent broker rejections count as attempts, and the record is
+// dropped once it was rejected outboxMaxAttempts times. Anything else, such
+// as a disconnect, a confirm timeout while the broker blocks publishers on a
+// resource alarm or a channel closed by a reconnect, says nothing about the
+// record and is retried indefinitely.
+func (c *Client) relayFailed(record outboxRecord, err error, failures *relayFailures) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, ErrUnroutable) {
+		return c.dropRecord(record, "unroutable", 1, err)
+	}
+	if !permanentError(err) {
+		return err
+	}
+
+	if failures.id != record.ID {
+		*failures = relayFailures{id: record.ID}
+	}
+	failures.count++
+	if failures.count < c.outboxMaxAttempts {
+		return err
+	}
+
+	return c.dropRecord(record, "failed", failures.count, err)
+}
+
+// permanentError reports whether err is a broker rejection that retrying
+// the same message cannot fix: a missing exchange, refused access or a
+// conflicting exchange declaration
+func permanentError(err error) bool {
+	var amqpErr *amqp.Error
+	if !errors.As(err, &amqpErr) {
+		return false
+	}
+
+	switch amqpErr.Code {
+	case amqp.NotFound, amqp.AccessRefused, amqp.PreconditionFailed:
+		return true
+	default:
+		return false
+	}
+}
+
+// dropRecord hands an undeliverable record to the drop handlers and removes
+// it from the outbox
+func (c *Client) dropRecord(record outboxRecord, reason string, attempts int, cause error) error {
+	outboxDroppedTotal.WithLabelValues(reason).Inc()
+	c.logger.Error(cause, "Dropping undeliverable outbox message",
+		"reason", reason,
+		"attempts", attempts,
+		"exchange", record.Exchange,
+		"routing_key", record.RoutingKey,
+		"message_id", record.ID,
+	)
+
+	c.mu.Lock()
+	handlers := c.dropHandlers
+	c.mu.Unlock()
+
+	drop := OutboxDrop{
+		MessageID:  record.ID,
+		Exchange:   record.Exchange,
+		RoutingKey: record.RoutingKey,
+		Body:       record.Body,
+		Properties: record.Properties,
+		Reason:     reason,
+		Attempts:   attempts,
+		Err:        cause,
+	}
+	for _, fn := range handlers {
+		ctx, cancel := context.WithTimeout(context.Background(), c.confirmTimeout)
+		fn(ctx, drop)
+		cancel()
+	}
+
+	return c.outbox.commit(record.ID)
+}
+
+// relayRecord delivers a single record and removes it from the outbox once
+// the broker has confirmed it. A record's expiration counts from when it was
+// enqueued: records that expired while waiting are dropped and the rest are
+// sent with the time they have left.
+func (c *Client) relayRecord(record outboxRecord) error {
+	if ttl := record.Properties.Expiration; ttl > 0 {
+		remaining := ttl - time.Since(record.EnqueuedAt)
+		if remaining <= 0 {
+			outboxDroppedTotal.WithLabelValues("expired").Inc()
+			return c.outbox.commit(record.ID)
+		}
+		record.Properties.Expiration = remaining
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.confirmTimeout*2)
+	defer cancel()
+
+	// Stop promptly if the client is closed mid-delivery
+	go func() {
+		select {
+		case <-c.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	if err := c.deliver(ctx, record); err != nil {
+		return err
+	}
+
+	return c.outbox.commit(record.ID)
+}
+
+// updateOutboxAge refreshes the oldest-pending-age gauge
+func (c *Client) updateOutboxAge() {
+	stats := c.outbox.Stats()
+	if stats.OldestPending.IsZero() {
+		outboxOldestPendingAge.Set(0)
+		return
+	}
+	outboxOldestPendingAge.Set(time.Since(stats.OldestPending).Seconds())
+}
@@ -0,0 +1,120 @@
+package rabbitmq
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/rossigee/cert-webhook-system/internal/sink"
+)
+
+// returnBufferSize is the capacity of the basic.return notification channel.
+// Returns are drained by publishers after their confirm arrives, so the buffer
+// only needs to hold returns for in-flight publishes.
+const returnBufferSize = 1024
+
+// ErrUnroutable is returned when a mandatory message could not be routed to
+// any queue and was returned by the broker
+var ErrUnroutable = sink.ErrUnroutable
+
+// ReturnError describes a message returned by the broker via basic.return
+type ReturnError struct {
+	Exchange   string
+	RoutingKey string
+	ReplyCode  uint16
+	ReplyText  string
+}
+
+// Error implements the error interface
+func (e *ReturnError) Error() string {
+	return fmt.Sprintf("message returned by broker for exchange %q with routing key %q: %d %s",
+		e.Exchange, e.RoutingKey, e.ReplyCode, e.ReplyText)
+}
+
+// Is allows errors.Is(err, ErrUnroutable) to match a ReturnError
+func (e *ReturnError) Is(target error) bool {
+	return target == ErrUnroutable
+}
+
+// returnTracker maps basic.return notifications back to the publish that
+// caused them using the exchange and message ID. The exchange is part of the
+// key because a message is published twice, to its exchange and to the
+// stream, when a stream is configured.
+//
+// The broker sends basic.return before the basic.ack for the same message and
+// the client library dispatches them in that order, so once a publisher has
+// seen its ack any return for it is already in the notification channel.
+// Draining the channel at that point is therefore enough to detect it without
+// racing a separate consumer goroutine.
+type returnTracker struct {
+	mu      sync.Mutex
+	pending map[returnKey]*amqp.Return
+}
+
+// returnKey identifies a tracked publish
+type returnKey struct {
+	exchange  string
+	messageID string
+}
+
+// newReturnTracker creates an empty return tracker
+func newReturnTracker() *returnTracker {
+	return &returnTracker{pending: make(map[returnKey]*amqp.Return)}
+}
+
+// register records a message published to exchange as awaiting its confirm
+func (t *returnTracker) register(exchange, messageID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pending[returnKey{exchange, messageID}] = nil
+}
+
+// forget drops a message without checking for a return
+func (t *returnTracker) forget(exchange, messageID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.pending, returnKey{exchange, messageID})
+}
+
+// resolve drains any queued returns and reports whether the message
+// published to exchange was returned. It is no longer tracked afterwards.
+func (t *returnTracker) resolve(exchange, messageID string, returns <-chan amqp.Return) *amqp.Return {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.drain(returns)
+
+	key := returnKey{exchange, messageID}
+	ret := t.pending[key]
+	delete(t.pending, key)
+	return ret
+}
+
+// drain moves queued returns for tracked messages into the pending map.
+// Returns for messages that are no longer tracked are discarded.
+func (t *returnTracker) drain(returns <-chan amqp.Return) {
+	for {
+		select {
+		case ret, ok := <-returns:
+			if !ok {
+				return
+			}
+			key := returnKey{ret.Exchange, ret.MessageId}
+			if _, tracked := t.pending[key]; tracked {
+				t.pending[key] = &ret
+			}
+		default:
+			return
+		}
+	}
+}
+
+// newMessageID returns a random identifier used to correlate returns and
+// confirms with the originating publish
+func newMessageID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
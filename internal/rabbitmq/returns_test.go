@@ -0,0 +1,105 @@
+package rabbitmq
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestReturnTracker_ResolveReturned(t *testing.T) {
+	tracker := newReturnTracker()
+	returns := make(chan amqp.Return, 4)
+
+	tracker.register("certificate-events", "a")
+	tracker.register("certificate-events", "b")
+	returns <- amqp.Return{Exchange: "certificate-events", MessageId: "b", ReplyCode: 312, ReplyText: "NO_ROUTE"}
+
+	if ret := tracker.resolve("certificate-events", "a", returns); ret != nil {
+		t.Errorf("expected no return for message a, got %+v", ret)
+	}
+
+	ret := tracker.resolve("certificate-events", "b", returns)
+	if ret == nil {
+		t.Fatal("expected return for message b")
+	}
+	if ret.ReplyCode != 312 {
+		t.Errorf("expected reply code 312, got %d", ret.ReplyCode)
+	}
+
+	if len(tracker.pending) != 0 {
+		t.Errorf("expected no pending messages, got %d", len(tracker.pending))
+	}
+}
+
+func TestReturnTracker_DiscardsUntracked(t *testing.T) {
+	tracker := newReturnTracker()
+	returns := make(chan amqp.Return, 4)
+
+	tracker.register("certificate-events", "a")
+	tracker.forget("certificate-events", "a")
+	returns <- amqp.Return{Exchange: "certificate-events", MessageId: "a"}
+
+	tracker.register("certificate-events", "b")
+	if ret := tracker.resolve("certificate-events", "b", returns); ret != nil {
+		t.Errorf("expected no return for message b, got %+v", ret)
+	}
+	if len(tracker.pending) != 0 {
+		t.Errorf("expected stale return to be discarded, got %d pending", len(tracker.pending))
+	}
+}
+
+func TestReturnTracker_KeysByExchange(t *testing.T) {
+	tracker := newReturnTracker()
+	returns := make(chan amqp.Return, 4)
+
+	tracker.register("certificate-events", "a")
+	tracker.register("", "a")
+	returns <- amqp.Return{Exchange: "", RoutingKey: "certificate-history", MessageId: "a", ReplyCode: 312}
+
+	if ret := tracker.resolve("certificate-events", "a", returns); ret != nil {
+		t.Errorf("expected no return for the exchange publish, got %+v", ret)
+	}
+	if ret := tracker.resolve("", "a", returns); ret == nil {
+		t.Error("expected return for the stream publish")
+	}
+}
+
+func TestReturnTracker_ClosedChannel(t *testing.T) {
+	tracker := newReturnTracker()
+	returns := make(chan amqp.Return)
+	close(returns)
+
+	tracker.register("certificate-events", "a")
+	if ret := tracker.resolve("certificate-events", "a", returns); ret != nil {
+		t.Errorf("expected no return, got %+v", ret)
+	}
+}
+
+func TestReturnError_IsUnroutable(t *testing.T) {
+	err := fmt.Errorf("failed to publish: %w", &ReturnError{
+		Exchange:   "certificate-events",
+		RoutingKey: "certificate.renwed",
+		ReplyCode:  312,
+		ReplyText:  "NO_ROUTE",
+	})
+
+	if !errors.Is(err, ErrUnroutable) {
+		t.Error("expected error to match ErrUnroutable")
+	}
+
+	var returnErr *ReturnError
+	if !errors.As(err, &returnErr) {
+		t.Fatal("expected error to unwrap to ReturnError")
+	}
+	if returnErr.RoutingKey != "certificate.renwed" {
+		t.Errorf("expected routing key 'certificate.renwed', got %q", returnErr.RoutingKey)
+	}
+}
+
+func TestNewMessageID_Unique(t *testing.T) {
+	if newMessageID() == newMessageID() {
+		t.Error("expected unique message IDs")
+	}
+}
@@ -0,0 +1,198 @@
+package rabbitmq
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// State is the connection state of a Client
+type State string
+
+const (
+	// StateReconnecting means there is no usable connection and the client
+	// is trying to (re)connect. This is also the state before the first
+	// connection succeeds.
+	StateReconnecting State = "reconnecting"
+
+	// StateConnected means the client is connected and the configured
+	// exchanges were declared or verified
+	StateConnected State = "connected"
+
+	// StateDegraded means the client is connected but the topology check
+	// failed, so publishes to the affected exchanges are likely to fail
+	StateDegraded State = "degraded"
+
+	// StateClosed means the client has been closed
+	StateClosed State = "closed"
+)
+
+// allStates lists every state, for resetting the state gauge
+var allStates = []State{StateReconnecting, StateConnected, StateDegraded, StateClosed}
+
+// ErrNotConnected is returned when publishing while the client has no
+// usable connection
+var ErrNotConnected = errors.New("not connected to RabbitMQ")
+
+// stateTracker holds the current state and the registered listeners
+type stateTracker struct {
+	mu        sync.Mutex
+	state     State
+	lastErr   error
+	listeners []func(from, to State)
+}
+
+// OnStateChange registers fn to be called after every state transition.
+// Listeners run synchronously on the goroutine making the transition, so
+// they must not block.
+func (c *Client) OnStateChange(fn func(from, to State)) {
+	c.state.mu.Lock()
+	defer c.state.mu.Unlock()
+	c.state.listeners = append(c.state.listeners, fn)
+}
+
+// State returns the current connection state
+func (c *Client) State() State {
+	c.state.mu.Lock()
+	defer c.state.mu.Unlock()
+
+	if c.state.state == "" {
+		return StateReconnecting
+	}
+	return c.state.state
+}
+
+// setState records a transition and notifies listeners. lastErr is the
+// reason for leaving the connected state, reported by HealthCheck.
+func (c *Client) setState(to State, lastErr error) {
+	c.state.mu.Lock()
+	from := c.state.state
+	if from == "" {
+		from = StateReconnecting
+	}
+	c.state.state = to
+	c.state.lastErr = lastErr
+	if from == to {
+		c.state.mu.Unlock()
+		return
+	}
+	listeners := append([]func(from, to State){}, c.state.listeners...)
+	c.state.mu.Unlock()
+
+	for _, state := range allStates {
+		value := 0.0
+		if state == to {
+			value = 1
+		}
+		connectionState.WithLabelValues(string(state)).Set(value)
+	}
+	stateTransitionsTotal.WithLabelValues(string(to)).Inc()
+
+	for _, listener := range listeners {
+		listener(from, to)
+	}
+}
+
+// connectedState returns the state matching the outcome of the topology
+// check on a new connection
+func connectedState(topologyErr error) State {
+	if topologyErr != nil {
+		return StateDegraded
+	}
+	return StateConnected
+}
+
+// superviseConnection owns the connection lifecycle until the client is
+// closed: it waits for the connection to drop and then reconnects with
+// jittered exponential backoff, without giving up. When the credentials
+// change it replaces the connection gracefully.
+func (c *Client) superviseConnection() {
+	defer close(c.supervisorDone)
+
+	// The close notification is registered once per connection, as
+	// amqp091-go keeps every registered channel until the connection closes
+	var watched *amqp.Connection
+	var closeCh chan *amqp.Error
+	for {
+		c.mu.Lock()
+		conn, connURL := c.conn, c.connURL
+		c.mu.Unlock()
+
+		if conn != nil && !conn.IsClosed() {
+			if conn != watched {
+				watched = conn
+				closeCh = conn.NotifyClose(make(chan *amqp.Error, 1))
+			}
+			select {
+			case err := <-closeCh:
+				// Prefer the other endpoints when reconnecting
+				c.endpoints.failed(connURL)
+				if err == nil {
+					err = amqp.ErrClosed
+				}
+				c.setState(StateReconnecting, fmt.Errorf("connection lost: %w", err))
+			case <-c.rotate:
+				if err := c.rotateConnection(); err != nil {
+					// Keep publishing on the old connection
+					credentialReloadsTotal.WithLabelValues("rejected").Inc()
+				}
+				continue
+			case <-c.done:
+				return
+			}
+		}
+
+		if !c.reconnectLoop() {
+			return
+		}
+	}
+}
+
+// reconnectLoop retries connecting until it succeeds (returning true) or the
+// client is closed (returning false)
+func (c *Client) reconnectLoop() bool {
+	for attempt := 0; ; attempt++ {
+		timer := time.NewTimer(backoffDelay(attempt))
+		select {
+		case <-timer.C:
+		case <-c.rotate:
+			// New credentials may fix the failure, so try them right away
+			timer.Stop()
+		case <-c.done:
+			timer.Stop()
+			return false
+		}
+
+		reconnectAttemptsTotal.Inc()
+
+		old, err := c.connect()
+		if err != nil {
+			c.setState(StateReconnecting, err)
+			continue
+		}
+		if old != nil {
+			_ = old.Close()
+		}
+
+		c.mu.Lock()
+		topologyErr := c.topologyErr
+		c.mu.Unlock()
+		c.setState(connectedState(topologyErr), topologyErr)
+		return true
+	}
+}
+
+// backoffDelay returns the delay before reconnect attempt n: exponential,
+// capped at maxBackoff, with half of it randomised so that replicas don't
+// reconnect in lockstep
+func backoffDelay(attempt int) time.Duration {
+	delay := maxBackoff
+	if attempt < 16 {
+		delay = min(initialBackoff<<attempt, maxBackoff)
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
@@ -0,0 +1,184 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	for attempt := range 100 {
+		delay := backoffDelay(attempt)
+		ceiling := min(initialBackoff<<min(attempt, 16), maxBackoff)
+		if delay < ceiling/2 || delay > ceiling {
+			t.Errorf("attempt %d: delay %s outside [%s, %s]", attempt, delay, ceiling/2, ceiling)
+		}
+	}
+}
+
+func TestClient_StateTransitions(t *testing.T) {
+	client := &Client{}
+	if state := client.State(); state != StateReconnecting {
+		t.Errorf("expected initial state %s, got %s", StateReconnecting, state)
+	}
+
+	var transitions []string
+	client.OnStateChange(func(from, to State) {
+		transitions = append(transitions, string(from)+"->"+string(to))
+	})
+
+	client.setState(StateConnected, nil)
+	client.setState(StateConnected, nil)
+	client.setState(StateReconnecting, errors.New("connection lost"))
+	client.setState(StateDegraded, errors.New("exchange missing"))
+	client.setState(StateClosed, nil)
+
+	expected := []string{
+		"reconnecting->connected",
+		"connected->reconnecting",
+		"reconnecting->degraded",
+		"degraded->closed",
+	}
+	if strings.Join(transitions, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected transitions %v, got %v", expected, transitions)
+	}
+}
+
+func TestClient_HealthCheckReportsState(t *testing.T) {
+	tests := []struct {
+		state   State
+		lastErr error
+		want    string
+	}{
+		{state: StateConnected},
+		{state: StateDegraded, lastErr: errors.New("exchange missing"), want: "topology check failed: exchange missing"},
+		{state: StateReconnecting, lastErr: errors.New("dial tcp: refused"), want: "connection is reconnecting: dial tcp: refused"},
+		{state: StateClosed, want: "client is closed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.state), func(t *testing.T) {
+			client := &Client{}
+			client.setState(tt.state, tt.lastErr)
+
+			err := client.HealthCheck()
+			if tt.want == "" {
+				if err != nil {
+					t.Errorf("expected healthy, got %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("expected %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestClient_PublishWhileReconnecting(t *testing.T) {
+	client := &Client{confirmTimeout: defaultConfirmTimeout}
+
+	err := client.deliver(t.Context(), outboxRecord{ID: "id", Exchange: "certificate-events", RoutingKey: "certificate.renewed", Body: []byte("{}")})
+	if !errors.Is(err, ErrNotConnected) {
+		t.Errorf("expected ErrNotConnected, got %v", err)
+	}
+}
+
+func TestClient_ConnectDoesNotBlockPublishes(t *testing.T) {
+	// The listener accepts connections but never completes the handshake,
+	// so dialing it hangs until the connection is closed
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer func() { _ = listener.Close() }()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+
+	endpoints, err := newEndpointSet([]string{"amqp://" + listener.Addr().String()}, "")
+	if err != nil {
+		t.Fatalf("failed to create endpoints: %v", err)
+	}
+	client := &Client{endpoints: endpoints}
+
+	connected := make(chan error, 1)
+	go func() {
+		_, err := client.connect()
+		connected <- err
+	}()
+
+	var conn net.Conn
+	select {
+	case conn = <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the dial")
+	}
+
+	checked := make(chan error, 1)
+	go func() {
+		_, err := client.requireConnection()
+		checked <- err
+	}()
+	select {
+	case err := <-checked:
+		if !errors.Is(err, ErrNotConnected) {
+			t.Errorf("expected ErrNotConnected, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("expected requireConnection not to wait for the dial")
+	}
+
+	_ = conn.Close()
+	if err := <-connected; err == nil {
+		t.Error("expected the dial to fail")
+	}
+}
+
+func TestClient_WaitForConfirmCanceled(t *testing.T) {
+	client := &Client{confirmTimeout: defaultConfirmTimeout, verifyExchanges: []string{"certificate-events"}}
+	pending := &pendingPublish{
+		messageID:    "id",
+		exchange:     "certificate-events",
+		confirmation: &amqp.DeferredConfirmation{},
+		tracker:      newReturnTracker(),
+	}
+
+	canceled := testutil.ToFloat64(publishConfirmsTotal.WithLabelValues("certificate-events", "canceled"))
+	timeouts := testutil.ToFloat64(publishConfirmsTotal.WithLabelValues("certificate-events", "timeout"))
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	if err := client.waitForConfirm(ctx, pending); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if got := testutil.ToFloat64(publishConfirmsTotal.WithLabelValues("certificate-events", "canceled")); got != canceled+1 {
+		t.Errorf("expected the cancellation to be counted as canceled")
+	}
+	if got := testutil.ToFloat64(publishConfirmsTotal.WithLabelValues("certificate-events", "timeout")); got != timeouts {
+		t.Errorf("expected the cancellation not to be counted as a timeout")
+	}
+}
+
+func TestClient_ExchangeLabel(t *testing.T) {
+	client := &Client{alternateExchange: "unroutable", verifyExchanges: []string{"certificate-events"}}
+	for exchange, want := range map[string]string{
+		"certificate-events": "certificate-events",
+		"unroutable":         "unroutable",
+		"":                   "",
+		"typo-events":        otherExchange,
+	} {
+		if got := client.exchangeLabel(exchange); got != want {
+			t.Errorf("exchange %q: expected label %q, got %q", exchange, want, got)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package rabbitmq
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// StreamRetention limits how much history a stream keeps. Zero fields leave
+// the broker default; segments are only discarded once they are full, so the
+// limits are approximate.
+type StreamRetention struct {
+	// MaxAge discards messages older than this
+	MaxAge time.Duration
+	// MaxLengthBytes bounds the total size of the stream
+	MaxLengthBytes int64
+	// MaxSegmentSizeBytes is the size of the segment files retention is
+	// applied to
+	MaxSegmentSizeBytes int64
+}
+
+// arguments builds the stream declaration arguments
+func (r StreamRetention) arguments() amqp.Table {
+	args := amqp.Table{"x-queue-type": "stream"}
+	if r.MaxAge > 0 {
+		// The broker accepts Y, M, D, h, m and s units
+		args["x-max-age"] = fmt.Sprintf("%ds", int64(r.MaxAge.Seconds()))
+	}
+	if r.MaxLengthBytes > 0 {
+		args["x-max-length-bytes"] = r.MaxLengthBytes
+	}
+	if r.MaxSegmentSizeBytes > 0 {
+		args["x-stream-max-segment-size-bytes"] = r.MaxSegmentSizeBytes
+	}
+	return args
+}
+
+// declareStream declares the stream with the configured retention, or only
+// verifies that it exists when no retention is configured (the stream is then
+// owned by another client, typically the controller) or in passive mode
+func (c *Client) declareStream(channel *amqp.Channel) error {
+	if c.streamRetention == nil || c.declareMode == DeclareModePassive {
+		if _, err := channel.QueueDeclarePassive(c.stream, true, false, false, false, nil); err != nil {
+			return fmt.Errorf("stream %q is not available: %w", c.stream, err)
+		}
+		return nil
+	}
+
+	if _, err := channel.QueueDeclare(c.stream, true, false, false, false, c.streamRetention.arguments()); err != nil {
+		return fmt.Errorf("failed to declare stream %q: %w", c.stream, err)
+	}
+	return nil
+}
+
+// publishToStream appends a copy of the record to the stream through the
+// default exchange. The copy keeps the message ID and carries the original
+// exchange and routing key as headers, so replaying consumers can filter
+// without parsing the body.
+func (c *Client) publishToStream(ctx context.Context, slot *channelSlot, record outboxRecord) (*pendingPublish, error) {
+	msg := publishing(record)
+	// Streams don't expire individual messages; retention applies instead
+	msg.Expiration = ""
+	if msg.Headers == nil {
+		msg.Headers = amqp.Table{}
+	}
+	msg.Headers["exchange"] = record.Exchange
+	msg.Headers["routing-key"] = record.RoutingKey
+
+	slot.tracker.register("", record.ID)
+
+	confirmation, err := slot.channel.PublishWithDeferredConfirmWithContext(ctx, "", c.stream, true, false, msg)
+	if err != nil {
+		slot.tracker.forget("", record.ID)
+		return nil, fmt.Errorf("failed to publish message to stream %q: %w", c.stream, err)
+	}
+
+	return &pendingPublish{
+		messageID:    record.ID,
+		routingKey:   c.stream,
+		confirmation: confirmation,
+		returns:      slot.returns,
+		tracker:      slot.tracker,
+		closed:       slot.closed,
+		stream:       true,
+	}, nil
+}
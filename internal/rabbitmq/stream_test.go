@@ -0,0 +1,32 @@
+package rabbitmq
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStreamRetention_Arguments(t *testing.T) {
+	args := StreamRetention{
+		MaxAge:              7 * 24 * time.Hour,
+		MaxLengthBytes:      5 << 30,
+		MaxSegmentSizeBytes: 100 << 20,
+	}.arguments()
+
+	if args["x-queue-type"] != "stream" {
+		t.Errorf("expected stream queue type, got %v", args["x-queue-type"])
+	}
+	if args["x-max-age"] != "604800s" {
+		t.Errorf("expected max age 604800s, got %v", args["x-max-age"])
+	}
+	if args["x-max-length-bytes"] != int64(5<<30) {
+		t.Errorf("expected max length bytes, got %v", args["x-max-length-bytes"])
+	}
+	if args["x-stream-max-segment-size-bytes"] != int64(100<<20) {
+		t.Errorf("expected segment size, got %v", args["x-stream-max-segment-size-bytes"])
+	}
+
+	args = StreamRetention{}.arguments()
+	if len(args) != 1 {
+		t.Errorf("expected only the queue type without limits, got %v", args)
+	}
+}
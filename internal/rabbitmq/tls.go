@@ -0,0 +1,82 @@
+package rabbitmq
+
+import (
+	"crypto/tls"
+	"fmt"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/rossigee/cert-webhook-system/internal/tlsconfig"
+)
+
+// tlsSettings holds the TLS and SASL options applied on every dial
+type tlsSettings struct {
+	caFile       string
+	saslExternal bool
+	// base is the TLS configuration cloned for every dial. Its client
+	// certificate is reloaded when the files change.
+	base *tls.Config
+}
+
+// newTLSSettings validates the TLS options against the URL schemes of the
+// configured endpoints, returning nil when no options are set.
+// The CA bundle and client certificate are loaded once up front so that
+// mistakes are reported at startup rather than on the first connection.
+func newTLSSettings(config Config, schemes []string) (*tlsSettings, error) {
+	if config.TLSCAFile == "" && config.TLSCertFile == "" && config.TLSKeyFile == "" &&
+		config.TLSServerName == "" && !config.SASLExternal {
+		return nil, nil
+	}
+
+	for _, scheme := range schemes {
+		if scheme != "amqps" {
+			return nil, fmt.Errorf("TLS options require amqps:// URLs")
+		}
+	}
+	if config.SASLExternal && config.TLSCertFile == "" {
+		return nil, fmt.Errorf("SASL EXTERNAL authentication requires a TLS client certificate")
+	}
+
+	base, err := tlsconfig.New(tlsconfig.Config{
+		Enabled:    true,
+		CAFile:     config.TLSCAFile,
+		CertFile:   config.TLSCertFile,
+		KeyFile:    config.TLSKeyFile,
+		ServerName: config.TLSServerName,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &tlsSettings{
+		caFile:       config.TLSCAFile,
+		saslExternal: config.SASLExternal,
+		base:         base,
+	}, nil
+}
+
+// dialConfig builds the connection options for a new connection. The CA
+// bundle is re-read on every dial, so a rotated CA is picked up on reconnect.
+func (s *tlsSettings) dialConfig() (amqp.Config, error) {
+	config := amqp.Config{}
+	if s == nil {
+		return config, nil
+	}
+
+	// Dialing sets the server name from the URL when none is configured, so
+	// each dial gets its own copy
+	tlsConfig := s.base.Clone()
+	if s.caFile != "" {
+		pool, err := tlsconfig.LoadCertPool(s.caFile)
+		if err != nil {
+			return config, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	config.TLSClientConfig = tlsConfig
+	if s.saslExternal {
+		config.SASL = []amqp.Authentication{&amqp.ExternalAuth{}}
+	}
+
+	return config, nil
+}
@@ -0,0 +1,138 @@
+package rabbitmq
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// writeTestCertificate writes a self-signed certificate and key with the
+// given common name, returning their paths
+func writeTestCertificate(t *testing.T, dir, commonName string) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("failed to write certificate: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatalf("failed to write key: %v", err)
+	}
+	return certFile, keyFile
+}
+
+func schemeOf(rawURL string) string {
+	scheme, _, _ := strings.Cut(rawURL, "://")
+	return scheme
+}
+
+func TestNewTLSSettings_Validation(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCertificate(t, dir, "client")
+
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr bool
+	}{
+		{name: "no TLS options", config: Config{URL: "amqp://localhost"}},
+		{name: "plain URL with CA", config: Config{URL: "amqp://localhost", TLSCAFile: certFile}, wantErr: true},
+		{name: "cert without key", config: Config{URL: "amqps://localhost", TLSCertFile: certFile}, wantErr: true},
+		{name: "external without cert", config: Config{URL: "amqps://localhost", SASLExternal: true}, wantErr: true},
+		{name: "missing CA file", config: Config{URL: "amqps://localhost", TLSCAFile: filepath.Join(dir, "missing")}, wantErr: true},
+		{name: "CA file without certificates", config: Config{URL: "amqps://localhost", TLSCAFile: keyFile}, wantErr: true},
+		{
+			name: "mutual TLS with EXTERNAL",
+			config: Config{
+				URL:          "amqps://localhost",
+				TLSCAFile:    certFile,
+				TLSCertFile:  certFile,
+				TLSKeyFile:   keyFile,
+				SASLExternal: true,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newTLSSettings(tt.config, []string{schemeOf(tt.config.URL)})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestTLSSettings_DialConfig(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t, t.TempDir(), "client")
+
+	settings, err := newTLSSettings(Config{
+		TLSCAFile:     certFile,
+		TLSCertFile:   certFile,
+		TLSKeyFile:    keyFile,
+		TLSServerName: "rabbitmq.internal",
+		SASLExternal:  true,
+	}, []string{"amqps"})
+	if err != nil {
+		t.Fatalf("failed to create TLS settings: %v", err)
+	}
+
+	config, err := settings.dialConfig()
+	if err != nil {
+		t.Fatalf("failed to build dial config: %v", err)
+	}
+
+	if config.TLSClientConfig == nil || config.TLSClientConfig.RootCAs == nil {
+		t.Fatal("expected TLS config with the CA bundle")
+	}
+	if config.TLSClientConfig.ServerName != "rabbitmq.internal" {
+		t.Errorf("expected server name override, got %q", config.TLSClientConfig.ServerName)
+	}
+	if config.TLSClientConfig.GetClientCertificate == nil {
+		t.Error("expected a client certificate callback")
+	}
+	if len(config.SASL) != 1 || config.SASL[0].Mechanism() != (&amqp.ExternalAuth{}).Mechanism() {
+		t.Errorf("expected SASL EXTERNAL, got %v", config.SASL)
+	}
+
+	var none *tlsSettings
+	if config, _ := none.dialConfig(); config.TLSClientConfig != nil || config.SASL != nil {
+		t.Error("expected default dial config without TLS settings")
+	}
+}
@@ -0,0 +1,344 @@
+package rabbitmq
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"sigs.k8s.io/yaml"
+)
+
+// Topology describes exchanges, queues and bindings that are provisioned on
+// the broker. Each downstream consumer (typically one Docker host) is a
+// single queue stanza with its bindings.
+type Topology struct {
+	Exchanges []ExchangeSpec `json:"exchanges,omitempty"`
+	Queues    []QueueSpec    `json:"queues,omitempty"`
+}
+
+// ExchangeSpec describes an exchange to declare
+type ExchangeSpec struct {
+	Name string `json:"name"`
+	// Type is topic (default), headers, direct or fanout
+	Type      string         `json:"type,omitempty"`
+	Arguments map[string]any `json:"arguments,omitempty"`
+}
+
+// QueueSpec describes a durable queue and its bindings
+type QueueSpec struct {
+	Name string `json:"name"`
+	// Type is classic (default) or quorum
+	Type                 string `json:"type,omitempty"`
+	DeadLetterExchange   string `json:"deadLetterExchange,omitempty"`
+	DeadLetterRoutingKey string `json:"deadLetterRoutingKey,omitempty"`
+	// MessageTTL is a duration such as 72h after which messages expire
+	MessageTTL string `json:"messageTTL,omitempty"`
+	MaxLength  int64  `json:"maxLength,omitempty"`
+	// Arguments are passed as-is and override the fields above
+	Arguments map[string]any `json:"arguments,omitempty"`
+	Bindings  []BindingSpec  `json:"bindings,omitempty"`
+}
+
+// BindingSpec binds a queue to an exchange with a routing-key pattern
+type BindingSpec struct {
+	Exchange   string         `json:"exchange"`
+	RoutingKey string         `json:"routingKey"`
+	Arguments  map[string]any `json:"arguments,omitempty"`
+}
+
+// TopologyReport summarises a topology reconciliation
+type TopologyReport struct {
+	AppliedAt time.Time `json:"appliedAt"`
+	// Applied lists the objects declared or bound
+	Applied []string `json:"applied"`
+	// Drift lists objects that exist on the broker with different settings
+	// and were left untouched
+	Drift []string `json:"drift"`
+	// Removed lists bindings dropped from the topology and unbound
+	Removed []string `json:"removed"`
+	// Errors lists objects that could not be reconciled
+	Errors []string `json:"errors"`
+}
+
+// LoadTopology reads and validates a topology file. Unknown fields are
+// rejected so that typos don't silently drop settings.
+func LoadTopology(path string) (*Topology, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read topology file: %w", err)
+	}
+	return ParseTopology(data)
+}
+
+// ParseTopology parses and validates the content of a topology file
+func ParseTopology(data []byte) (*Topology, error) {
+	var topology Topology
+	if err := yaml.UnmarshalStrict(data, &topology, useNumber); err != nil {
+		return nil, fmt.Errorf("failed to parse topology file: %w", err)
+	}
+	if err := topology.Validate(); err != nil {
+		return nil, err
+	}
+	return &topology, nil
+}
+
+// useNumber keeps integer arguments such as x-max-length as integers
+func useNumber(d *json.Decoder) *json.Decoder {
+	d.UseNumber()
+	return d
+}
+
+// Validate checks the topology for missing names and unsupported settings
+func (t *Topology) Validate() error {
+	exchanges := make(map[string]bool)
+	for _, exchange := range t.Exchanges {
+		if exchange.Name == "" {
+			return fmt.Errorf("topology exchange without a name")
+		}
+		if exchanges[exchange.Name] {
+			return fmt.Errorf("topology exchange %q is defined more than once", exchange.Name)
+		}
+		exchanges[exchange.Name] = true
+		if exchange.Type != "" && !validExchangeTypes[exchange.Type] {
+			return fmt.Errorf("topology exchange %q has unsupported type %q", exchange.Name, exchange.Type)
+		}
+	}
+
+	queues := make(map[string]bool)
+	for _, queue := range t.Queues {
+		if queue.Name == "" {
+			return fmt.Errorf("topology queue without a name")
+		}
+		if queues[queue.Name] {
+			return fmt.Errorf("topology queue %q is defined more than once", queue.Name)
+		}
+		queues[queue.Name] = true
+		switch queue.Type {
+		case "", "classic", "quorum":
+		default:
+			return fmt.Errorf("topology queue %q has unsupported type %q (expected classic or quorum)", queue.Name, queue.Type)
+		}
+		if queue.MessageTTL != "" {
+			if ttl, err := time.ParseDuration(queue.MessageTTL); err != nil || ttl <= 0 {
+				return fmt.Errorf("topology queue %q has invalid messageTTL %q", queue.Name, queue.MessageTTL)
+			}
+		}
+		for _, binding := range queue.Bindings {
+			if binding.Exchange == "" {
+				return fmt.Errorf("topology queue %q has a binding without an exchange", queue.Name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// arguments builds the queue declaration arguments
+func (q QueueSpec) arguments() amqp.Table {
+	args := amqp.Table{}
+	if q.Type != "" {
+		args["x-queue-type"] = q.Type
+	}
+	if q.DeadLetterExchange != "" {
+		args["x-dead-letter-exchange"] = q.DeadLetterExchange
+	}
+	if q.DeadLetterRoutingKey != "" {
+		args["x-dead-letter-routing-key"] = q.DeadLetterRoutingKey
+	}
+	if q.MessageTTL != "" {
+		ttl, _ := time.ParseDuration(q.MessageTTL)
+		args["x-message-ttl"] = ttl.Milliseconds()
+	}
+	if q.MaxLength > 0 {
+		args["x-max-length"] = q.MaxLength
+	}
+	for k, v := range tableFromSpec(q.Arguments) {
+		args[k] = v
+	}
+
+	if len(args) == 0 {
+		return nil
+	}
+	return args
+}
+
+// tableFromSpec converts decoded YAML arguments into AMQP table values
+func tableFromSpec(args map[string]any) amqp.Table {
+	if len(args) == 0 {
+		return nil
+	}
+
+	table := amqp.Table{}
+	for k, v := range args {
+		table[k] = tableValue(v)
+	}
+	return table
+}
+
+// tableValue converts JSON numbers to int64 or float64, recursing into
+// nested values
+func tableValue(v any) any {
+	switch value := v.(type) {
+	case json.Number:
+		if i, err := value.Int64(); err == nil {
+			return i
+		}
+		f, _ := value.Float64()
+		return f
+	case map[string]any:
+		return tableFromSpec(value)
+	case []any:
+		values := make([]any, len(value))
+		for i, item := range value {
+			values[i] = tableValue(item)
+		}
+		return values
+	default:
+		return v
+	}
+}
+
+// bindingKey identifies a binding for comparing topologies
+type bindingKey struct {
+	queue      string
+	exchange   string
+	routingKey string
+	arguments  string
+}
+
+func (b bindingKey) String() string {
+	return fmt.Sprintf("binding %s -> %s (%s)", b.exchange, b.queue, b.routingKey)
+}
+
+// bindings lists every binding in the topology
+func (t *Topology) bindings() map[bindingKey]BindingSpec {
+	bindings := make(map[bindingKey]BindingSpec)
+	if t == nil {
+		return bindings
+	}
+
+	for _, queue := range t.Queues {
+		for _, binding := range queue.Bindings {
+			args, _ := json.Marshal(binding.Arguments)
+			bindings[bindingKey{
+				queue:      queue.Name,
+				exchange:   binding.Exchange,
+				routingKey: binding.RoutingKey,
+				arguments:  string(args),
+			}] = binding
+		}
+	}
+	return bindings
+}
+
+// ApplyTopology declares the exchanges, queues and bindings in topology and
+// unbinds bindings that were in previous (the last applied topology) but are
+// no longer wanted. Queues removed from the topology are never deleted, since
+// they may still hold messages.
+//
+// Objects that already exist with different settings are reported as drift
+// rather than changed, because RabbitMQ cannot alter queue arguments in
+// place. The returned error is non-nil if any object could not be reconciled.
+func (c *Client) ApplyTopology(topology, previous *Topology) (*TopologyReport, error) {
+	conn, err := c.requireConnection()
+	if err != nil {
+		topologyReconcilesTotal.WithLabelValues("error").Inc()
+		return nil, err
+	}
+
+	report := &TopologyReport{
+		AppliedAt: time.Now(),
+		Applied:   []string{},
+		Drift:     []string{},
+		Removed:   []string{},
+		Errors:    []string{},
+	}
+	var errs []error
+
+	// Each operation runs on its own channel, because a failed declaration
+	// closes the channel it ran on
+	apply := func(object string, fn func(*amqp.Channel) error) bool {
+		channel, err := conn.Channel()
+		if err == nil {
+			err = fn(channel)
+			_ = channel.Close()
+		}
+
+		var amqpErr *amqp.Error
+		switch {
+		case err == nil:
+			report.Applied = append(report.Applied, object)
+			return true
+		case errors.As(err, &amqpErr) && amqpErr.Code == amqp.PreconditionFailed:
+			report.Drift = append(report.Drift, fmt.Sprintf("%s: %s", object, amqpErr.Reason))
+			return true
+		default:
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", object, err))
+			errs = append(errs, fmt.Errorf("%s: %w", object, err))
+			return false
+		}
+	}
+
+	for _, exchange := range topology.Exchanges {
+		exchangeType := exchange.Type
+		if exchangeType == "" {
+			exchangeType = "topic"
+		}
+		apply("exchange "+exchange.Name, func(channel *amqp.Channel) error {
+			return channel.ExchangeDeclare(exchange.Name, exchangeType, true, false, false, false, tableFromSpec(exchange.Arguments))
+		})
+	}
+
+	for _, queue := range topology.Queues {
+		declared := apply("queue "+queue.Name, func(channel *amqp.Channel) error {
+			_, err := channel.QueueDeclare(queue.Name, true, false, false, false, queue.arguments())
+			return err
+		})
+		if !declared {
+			continue
+		}
+
+		for _, binding := range queue.Bindings {
+			key := bindingKey{queue: queue.Name, exchange: binding.Exchange, routingKey: binding.RoutingKey}
+			apply(key.String(), func(channel *amqp.Channel) error {
+				return channel.QueueBind(queue.Name, binding.RoutingKey, binding.Exchange, false, tableFromSpec(binding.Arguments))
+			})
+		}
+	}
+
+	wanted := topology.bindings()
+	for key, binding := range previous.bindings() {
+		if _, ok := wanted[key]; ok {
+			continue
+		}
+
+		channel, err := conn.Channel()
+		if err == nil {
+			err = channel.QueueUnbind(key.queue, key.routingKey, key.exchange, tableFromSpec(binding.Arguments))
+			_ = channel.Close()
+		}
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", key, err))
+			errs = append(errs, fmt.Errorf("failed to remove %s: %w", key, err))
+			continue
+		}
+		report.Removed = append(report.Removed, key.String())
+	}
+	sort.Strings(report.Removed)
+
+	topologyDrift.Set(float64(len(report.Drift)))
+	switch {
+	case len(errs) > 0:
+		topologyReconcilesTotal.WithLabelValues("error").Inc()
+	case len(report.Drift) > 0:
+		topologyReconcilesTotal.WithLabelValues("drift").Inc()
+	default:
+		topologyReconcilesTotal.WithLabelValues("success").Inc()
+	}
+
+	return report, errors.Join(errs...)
+}
@@ -0,0 +1,139 @@
+package rabbitmq
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testTopology = `
+exchanges:
+  - name: certificate-events.dlx
+    type: fanout
+queues:
+  - name: docker-web01
+    type: quorum
+    deadLetterExchange: certificate-events.dlx
+    messageTTL: 72h
+    maxLength: 1000
+    arguments:
+      x-delivery-limit: 5
+    bindings:
+      - exchange: certificate-events
+        routingKey: certificate.renewed.web01.#
+`
+
+func writeTopology(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "topology.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write topology file: %v", err)
+	}
+	return path
+}
+
+func TestLoadTopology(t *testing.T) {
+	topology, err := LoadTopology(writeTopology(t, testTopology))
+	if err != nil {
+		t.Fatalf("failed to load topology: %v", err)
+	}
+
+	if len(topology.Exchanges) != 1 || topology.Exchanges[0].Type != "fanout" {
+		t.Errorf("unexpected exchanges: %+v", topology.Exchanges)
+	}
+	if len(topology.Queues) != 1 {
+		t.Fatalf("expected 1 queue, got %d", len(topology.Queues))
+	}
+
+	args := topology.Queues[0].arguments()
+	expected := map[string]any{
+		"x-queue-type":           "quorum",
+		"x-dead-letter-exchange": "certificate-events.dlx",
+		"x-message-ttl":          int64(72 * 60 * 60 * 1000),
+		"x-max-length":           int64(1000),
+		"x-delivery-limit":       int64(5),
+	}
+	for k, v := range expected {
+		if args[k] != v {
+			t.Errorf("expected %s = %v (%T), got %v (%T)", k, v, v, args[k], args[k])
+		}
+	}
+}
+
+func TestLoadTopology_Invalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{
+			name:    "unknown field",
+			content: "queues:\n  - name: q\n    ttl: 1h\n",
+			want:    "unknown field",
+		},
+		{
+			name:    "unsupported queue type",
+			content: "queues:\n  - name: q\n    type: lazy\n",
+			want:    "unsupported type",
+		},
+		{
+			name:    "invalid ttl",
+			content: "queues:\n  - name: q\n    messageTTL: soon\n",
+			want:    "invalid messageTTL",
+		},
+		{
+			name:    "duplicate queue",
+			content: "queues:\n  - name: q\n  - name: q\n",
+			want:    "more than once",
+		},
+		{
+			name:    "binding without exchange",
+			content: "queues:\n  - name: q\n    bindings:\n      - routingKey: a.b\n",
+			want:    "without an exchange",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadTopology(writeTopology(t, tt.content))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("expected error containing %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestTopology_RemovedBindings(t *testing.T) {
+	previous := &Topology{Queues: []QueueSpec{{
+		Name: "docker-web01",
+		Bindings: []BindingSpec{
+			{Exchange: "certificate-events", RoutingKey: "certificate.renewed.web01.#"},
+			{Exchange: "certificate-events", RoutingKey: "certificate.renewed.legacy"},
+		},
+	}}}
+	current := &Topology{Queues: []QueueSpec{{
+		Name: "docker-web01",
+		Bindings: []BindingSpec{
+			{Exchange: "certificate-events", RoutingKey: "certificate.renewed.web01.#"},
+		},
+	}}}
+
+	wanted := current.bindings()
+	var removed []string
+	for key := range previous.bindings() {
+		if _, ok := wanted[key]; !ok {
+			removed = append(removed, key.routingKey)
+		}
+	}
+
+	if len(removed) != 1 || removed[0] != "certificate.renewed.legacy" {
+		t.Errorf("expected only the legacy binding to be removed, got %v", removed)
+	}
+
+	var none *Topology
+	if len(none.bindings()) != 0 {
+		t.Error("expected no bindings for a nil topology")
+	}
+}
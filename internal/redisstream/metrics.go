@@ -0,0 +1,23 @@
+package redisstream
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	publishesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "redis_stream_publishes_total",
+		Help: "Total number of Redis stream appends by result (success, error)",
+	}, []string{"result"})
+
+	publishDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "redis_stream_publish_duration_seconds",
+		Help:    "Duration of Redis stream appends",
+		Buckets: prometheus.DefBuckets,
+	})
+)
+
+func init() {
+	prometheus.MustRegister(publishesTotal)
+	prometheus.MustRegister(publishDuration)
+}
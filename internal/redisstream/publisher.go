@@ -0,0 +1,193 @@
+package redisstream
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/rossigee/cert-webhook-system/internal/event"
+	"github.com/rossigee/cert-webhook-system/internal/tlsconfig"
+)
+
+const (
+	defaultStreamKey      = "{exchange}"
+	defaultMaxLen         = 10000
+	defaultPublishTimeout = 5 * time.Second
+	healthCheckTimeout    = 2 * time.Second
+)
+
+// Config holds the configuration for the Redis Streams publisher
+type Config struct {
+	// URL is the Redis URL, redis:// or rediss:// for TLS
+	URL string
+	// PasswordFile holds the password, replacing any in the URL. It is
+	// re-read for every new connection.
+	PasswordFile string
+
+	// StreamKey is the stream name template; {exchange} and {routing_key}
+	// are replaced with the event's exchange and routing key (default
+	// {exchange})
+	StreamKey string
+	// MaxLen trims each stream to about this many entries (default 10000,
+	// negative disables trimming)
+	MaxLen int64
+
+	// PublishTimeout bounds each XADD (default 5s)
+	PublishTimeout time.Duration
+
+	// TLS overrides the TLS settings of rediss:// URLs, e.g. for a private
+	// CA or client certificates
+	TLS tlsconfig.Config
+}
+
+// Publisher appends events to Redis streams with XADD
+type Publisher struct {
+	client         *redis.Client
+	streamKey      string
+	maxLen         int64
+	publishTimeout time.Duration
+}
+
+// NewPublisher creates a publisher. Connections are made on first use.
+func NewPublisher(config Config) (*Publisher, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("Redis URL is required")
+	}
+
+	options, err := redis.ParseURL(config.URL)
+	if err != nil {
+		// The error can include the URL, and the password in it
+		return nil, fmt.Errorf("invalid Redis URL")
+	}
+
+	tlsConfig, err := tlsconfig.New(config.TLS)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		if tlsConfig.ServerName == "" && options.TLSConfig != nil {
+			// Keep verifying against the host of a rediss:// URL
+			tlsConfig.ServerName = options.TLSConfig.ServerName
+		}
+		options.TLSConfig = tlsConfig
+	}
+
+	if config.PasswordFile != "" {
+		if _, err := readPassword(config.PasswordFile); err != nil {
+			return nil, err
+		}
+		username := options.Username
+		options.CredentialsProvider = func() (string, string) {
+			// A failed read is reported by Redis rejecting the login
+			password, _ := readPassword(config.PasswordFile)
+			return username, password
+		}
+	}
+
+	streamKey := config.StreamKey
+	if streamKey == "" {
+		streamKey = defaultStreamKey
+	}
+	maxLen := config.MaxLen
+	if maxLen == 0 {
+		maxLen = defaultMaxLen
+	}
+	publishTimeout := config.PublishTimeout
+	if publishTimeout <= 0 {
+		publishTimeout = defaultPublishTimeout
+	}
+
+	return &Publisher{
+		client:         redis.NewClient(options),
+		streamKey:      streamKey,
+		maxLen:         maxLen,
+		publishTimeout: publishTimeout,
+	}, nil
+}
+
+// readPassword reads the password file
+func readPassword(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read Redis password file: %w", err)
+	}
+	password := strings.TrimSpace(string(data))
+	if password == "" {
+		return "", fmt.Errorf("Redis password file %s is empty", path)
+	}
+	return password, nil
+}
+
+// Name identifies the publisher in logs and errors
+func (p *Publisher) Name() string {
+	return "redis"
+}
+
+// Publish appends a message to its stream. The entry holds the JSON body in
+// the payload field, the exchange and routing key, and the message headers
+// as header.<name> fields. Redis has no per-entry expiration or priority, so
+// those properties are not sent.
+func (p *Publisher) Publish(ctx context.Context, exchange, routingKey string, message any, props event.Properties) error {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+
+	stream := p.stream(exchange, routingKey)
+
+	values := []any{
+		"payload", body,
+		"exchange", exchange,
+		"routing_key", routingKey,
+	}
+	for name, value := range props.Headers {
+		values = append(values, "header."+name, value)
+	}
+
+	args := &redis.XAddArgs{Stream: stream, Values: values}
+	if p.maxLen > 0 {
+		// Approximate trimming lets Redis drop whole macro nodes, which is
+		// much cheaper than trimming exactly
+		args.MaxLen = p.maxLen
+		args.Approx = true
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.publishTimeout)
+	defer cancel()
+
+	start := time.Now()
+	err = p.client.XAdd(ctx, args).Err()
+	publishDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		publishesTotal.WithLabelValues("error").Inc()
+		return fmt.Errorf("failed to add to stream %q: %w", stream, err)
+	}
+
+	publishesTotal.WithLabelValues("success").Inc()
+	return nil
+}
+
+// stream returns the stream name of an event
+func (p *Publisher) stream(exchange, routingKey string) string {
+	return strings.NewReplacer("{exchange}", exchange, "{routing_key}", routingKey).Replace(p.streamKey)
+}
+
+// HealthCheck pings the Redis server
+func (p *Publisher) HealthCheck() error {
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+
+	if err := p.client.Ping(ctx).Err(); err != nil {
+		return fmt.Errorf("Redis is not reachable: %w", err)
+	}
+	return nil
+}
+
+// Close closes the Redis connections
+func (p *Publisher) Close() error {
+	return p.client.Close()
+}
@@ -0,0 +1,88 @@
+package redisstream
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/rossigee/cert-webhook-system/internal/event"
+)
+
+func TestNewPublisher_Validation(t *testing.T) {
+	if _, err := NewPublisher(Config{}); err == nil {
+		t.Error("expected error for empty URL")
+	}
+	if _, err := NewPublisher(Config{URL: "http://localhost:6379"}); err == nil {
+		t.Error("expected error for a non-Redis URL")
+	}
+	if _, err := NewPublisher(Config{URL: "redis://localhost:6379", PasswordFile: filepath.Join(t.TempDir(), "missing")}); err == nil {
+		t.Error("expected error for a missing password file")
+	}
+}
+
+func TestPublisher_Publish(t *testing.T) {
+	server := miniredis.RunT(t)
+
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(passwordFile, []byte("s3cret\n"), 0o600); err != nil {
+		t.Fatalf("failed to write password: %v", err)
+	}
+	server.RequireAuth("s3cret")
+
+	publisher, err := NewPublisher(Config{
+		URL:          "redis://" + server.Addr(),
+		PasswordFile: passwordFile,
+		StreamKey:    "{exchange}:{routing_key}",
+		MaxLen:       2,
+	})
+	if err != nil {
+		t.Fatalf("failed to create publisher: %v", err)
+	}
+	defer func() { _ = publisher.Close() }()
+
+	if err := publisher.HealthCheck(); err != nil {
+		t.Fatalf("expected healthy publisher, got %v", err)
+	}
+
+	props := event.Properties{Headers: map[string]string{event.HeaderNamespace: "default"}}
+	for range 3 {
+		if err := publisher.Publish(t.Context(), event.DefaultExchange, "certificate.renewed", map[string]string{"event": "certificate.renewed"}, props); err != nil {
+			t.Fatalf("failed to publish: %v", err)
+		}
+	}
+
+	entries, err := server.Stream("certificate-events:certificate.renewed")
+	if err != nil {
+		t.Fatalf("failed to read stream: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("expected the stream to be trimmed to 2 entries, got %d", len(entries))
+	}
+
+	fields := map[string]string{}
+	values := entries[len(entries)-1].Values
+	for i := 0; i+1 < len(values); i += 2 {
+		fields[values[i]] = values[i+1]
+	}
+	if fields["payload"] != `{"event":"certificate.renewed"}` || fields["routing_key"] != "certificate.renewed" || fields["header.namespace"] != "default" {
+		t.Errorf("unexpected entry %v", fields)
+	}
+}
+
+func TestPublisher_Unreachable(t *testing.T) {
+	server := miniredis.RunT(t)
+	publisher, err := NewPublisher(Config{URL: "redis://" + server.Addr()})
+	if err != nil {
+		t.Fatalf("failed to create publisher: %v", err)
+	}
+	defer func() { _ = publisher.Close() }()
+
+	server.Close()
+	if err := publisher.HealthCheck(); err == nil {
+		t.Error("expected unhealthy publisher")
+	}
+	if err := publisher.Publish(t.Context(), event.DefaultExchange, "certificate.renewed", map[string]string{}, event.Properties{}); err == nil {
+		t.Error("expected publish to fail")
+	}
+}
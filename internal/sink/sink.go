@@ -0,0 +1,54 @@
+package sink
+
+import (
+	"context"
+	"errors"
+
+	"github.com/rossigee/cert-webhook-system/internal/event"
+)
+
+// ErrUnroutable is returned when the destination accepted a message but has
+// nowhere to deliver it, such as a RabbitMQ exchange without a matching
+// binding or a NATS subject without a JetStream stream. Retrying cannot
+// succeed until the destination is reconfigured.
+var ErrUnroutable = errors.New("message unroutable")
+
+// Publisher publishes certificate events. The exchange and routing key come
+// from the certificate annotations; publishers without those concepts map
+// them onto their own addressing, such as a subject or topic.
+type Publisher interface {
+	// Name identifies the publisher in health responses, logs and metrics
+	Name() string
+	// Publish delivers message, returning once the destination has
+	// durably accepted it
+	Publish(ctx context.Context, exchange, routingKey string, message any, props event.Properties) error
+	// HealthCheck reports an error while events cannot be published
+	HealthCheck() error
+	// Close releases the connection to the destination
+	Close() error
+}
+
+// As finds the first publisher among p and the publishers it wraps that is
+// a T, like errors.As. Publishers wrapping another implement
+// Unwrap() Publisher; publishers fanning out to several implement
+// Unwrap() []Publisher, which are searched depth-first in order.
+func As[T any](p Publisher) (T, bool) {
+	var zero T
+	if p == nil {
+		return zero, false
+	}
+	if target, ok := p.(T); ok {
+		return target, true
+	}
+	switch wrapper := p.(type) {
+	case interface{ Unwrap() Publisher }:
+		return As[T](wrapper.Unwrap())
+	case interface{ Unwrap() []Publisher }:
+		for _, inner := range wrapper.Unwrap() {
+			if target, ok := As[T](inner); ok {
+				return target, true
+			}
+		}
+	}
+	return zero, false
+}
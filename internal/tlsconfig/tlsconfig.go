@@ -0,0 +1,124 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Config holds the TLS options of a client connection
+type Config struct {
+	// Enabled turns on TLS with the system roots when no file is set
+	Enabled bool
+	// CAFile is a PEM CA bundle trusted instead of the system roots
+	CAFile string
+	// CertFile and KeyFile are a client certificate for mutual TLS,
+	// reloaded when they change
+	CertFile string
+	KeyFile  string
+	// ServerName overrides the name used to verify the server certificate
+	ServerName string
+}
+
+// enabled reports whether TLS is requested
+func (c Config) enabled() bool {
+	return c.Enabled || c.CAFile != "" || c.CertFile != "" || c.KeyFile != "" || c.ServerName != ""
+}
+
+// New builds a client TLS configuration, returning nil when TLS is not
+// enabled. The CA bundle and client certificate are loaded up front so that
+// mistakes are reported at startup rather than on the first connection.
+func New(config Config) (*tls.Config, error) {
+	if !config.enabled() {
+		return nil, nil
+	}
+	if (config.CertFile == "") != (config.KeyFile == "") {
+		return nil, fmt.Errorf("a TLS client certificate requires both a cert and a key file")
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: config.ServerName,
+	}
+
+	if config.CAFile != "" {
+		pool, err := LoadCertPool(config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.CertFile != "" {
+		reloader := &certReloader{certFile: config.CertFile, keyFile: config.KeyFile}
+		if _, err := reloader.GetClientCertificate(nil); err != nil {
+			return nil, err
+		}
+		tlsConfig.GetClientCertificate = reloader.GetClientCertificate
+	}
+
+	return tlsConfig, nil
+}
+
+// LoadCertPool reads a PEM CA bundle
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in CA bundle %s", path)
+	}
+	return pool, nil
+}
+
+// certReloader serves the client certificate, reloading it from disk when
+// the files change (for example when cert-manager renews the secret). The
+// certificate is only presented during the TLS handshake, so established
+// connections keep running and new ones use the renewed certificate.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu          sync.Mutex
+	certificate *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+}
+
+// GetClientCertificate implements tls.Config.GetClientCertificate. If a
+// renewed certificate cannot be loaded (e.g. the cert and key were caught
+// mid-update), the previously loaded certificate is used.
+func (r *certReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	certInfo, certErr := os.Stat(r.certFile)
+	keyInfo, keyErr := os.Stat(r.keyFile)
+	if certErr == nil && keyErr == nil &&
+		r.certificate != nil &&
+		certInfo.ModTime().Equal(r.certModTime) &&
+		keyInfo.ModTime().Equal(r.keyModTime) {
+		return r.certificate, nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		if r.certificate != nil {
+			return r.certificate, nil
+		}
+		return nil, fmt.Errorf("failed to load TLS client certificate: %w", err)
+	}
+
+	r.certificate = &certificate
+	if certErr == nil && keyErr == nil {
+		r.certModTime = certInfo.ModTime()
+		r.keyModTime = keyInfo.ModTime()
+	}
+	return r.certificate, nil
+}
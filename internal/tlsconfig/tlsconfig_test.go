@@ -0,0 +1,123 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCertificate writes a self-signed certificate and key, returning
+// their paths
+func writeTestCertificate(t *testing.T, dir string) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "cert-webhook"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("failed to write certificate: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatalf("failed to write key: %v", err)
+	}
+	return certFile, keyFile
+}
+
+func TestNew(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t, t.TempDir())
+
+	config, err := New(Config{})
+	if err != nil || config != nil {
+		t.Errorf("expected no TLS without options, got %v, %v", config, err)
+	}
+
+	config, err = New(Config{Enabled: true})
+	if err != nil || config == nil || config.RootCAs != nil {
+		t.Errorf("expected TLS with system roots, got %v, %v", config, err)
+	}
+
+	if _, err := New(Config{CertFile: certFile}); err == nil {
+		t.Error("expected error for a certificate without a key")
+	}
+
+	if _, err := New(Config{CAFile: keyFile}); err == nil {
+		t.Error("expected error for a CA bundle without certificates")
+	}
+
+	config, err = New(Config{CAFile: certFile, CertFile: certFile, KeyFile: keyFile, ServerName: "broker"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if config.RootCAs == nil || config.GetClientCertificate == nil || config.ServerName != "broker" {
+		t.Errorf("unexpected TLS config: %+v", config)
+	}
+}
+
+func TestCertReloader_ReloadsRenewedCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCertificate(t, dir)
+
+	reloader := &certReloader{certFile: certFile, keyFile: keyFile}
+	first, err := reloader.GetClientCertificate(nil)
+	if err != nil {
+		t.Fatalf("failed to load certificate: %v", err)
+	}
+
+	// Simulate a renewal, making sure the modification time changes
+	writeTestCertificate(t, dir)
+	later := time.Now().Add(time.Minute)
+	_ = os.Chtimes(certFile, later, later)
+	_ = os.Chtimes(keyFile, later, later)
+
+	second, err := reloader.GetClientCertificate(nil)
+	if err != nil {
+		t.Fatalf("failed to reload certificate: %v", err)
+	}
+	if string(second.Certificate[0]) == string(first.Certificate[0]) {
+		t.Error("expected the renewed certificate to be loaded")
+	}
+
+	// A broken renewal keeps serving the last good certificate
+	_ = os.WriteFile(keyFile, []byte("garbage"), 0o600)
+	evenLater := later.Add(time.Minute)
+	_ = os.Chtimes(keyFile, evenLater, evenLater)
+
+	third, err := reloader.GetClientCertificate(nil)
+	if err != nil {
+		t.Fatalf("expected last good certificate, got error: %v", err)
+	}
+	if third != second {
+		t.Error("expected the previous certificate to be kept")
+	}
+}
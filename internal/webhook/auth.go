@@ -0,0 +1,374 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-logr/logr"
+	"github.com/rossigee/cert-webhook-system/internal/event"
+	"sigs.k8s.io/yaml"
+)
+
+// Headers of signed requests. The signature is sha256=<hex HMAC-SHA256> of
+// "<timestamp>.<nonce>.<body>" keyed with the credential's secret. Nonces
+// may not contain ".", so the signed string splits into its fields one way.
+const (
+	HeaderKeyID     = "X-Webhook-Key-Id"
+	HeaderTimestamp = "X-Webhook-Timestamp"
+	HeaderNonce     = "X-Webhook-Nonce"
+	HeaderSignature = "X-Webhook-Signature"
+)
+
+const (
+	defaultMaxSkew = 5 * time.Minute
+	// maxBodyBytes bounds the body read to verify a signature
+	maxBodyBytes = 1 << 20
+	// credentialKey is the gin context key of the authenticated credential
+	credentialKey = "credential"
+)
+
+// Reasons requests are rejected, as reported by webhook_auth_failures_total
+const (
+	reasonMissing   = "missing"
+	reasonToken     = "invalid_token"
+	reasonSignature = "invalid_signature"
+	reasonTimestamp = "invalid_timestamp"
+	reasonReplayed  = "replayed"
+	reasonNamespace = "forbidden_namespace"
+)
+
+// authError is an authentication failure and the metric reason for it
+type authError struct {
+	reason string
+	err    error
+}
+
+func (e *authError) Error() string { return e.err.Error() }
+func (e *authError) Unwrap() error { return e.err }
+
+func newAuthError(reason, format string, args ...any) error {
+	return &authError{reason: reason, err: fmt.Errorf(format, args...)}
+}
+
+// Credential is a client allowed to post certificate webhooks, with either
+// a bearer token or an HMAC secret
+type Credential struct {
+	// Name identifies the credential in logs, and is the key ID of signed
+	// requests
+	Name string `json:"name"`
+	// TokenFile holds the bearer token. Like HMACSecretFile it is read for
+	// every request, so a rotated secret is used immediately.
+	TokenFile      string `json:"tokenFile,omitempty"`
+	HMACSecretFile string `json:"hmacSecretFile,omitempty"`
+	// Namespaces are glob patterns of the certificate namespaces the
+	// credential may post webhooks for, matched like the metadata filter
+	// patterns; * allows all
+	Namespaces []string `json:"namespaces"`
+}
+
+// Allows reports whether the credential may post webhooks for namespace
+func (c *Credential) Allows(namespace string) bool {
+	return slices.ContainsFunc(c.Namespaces, func(pattern string) bool {
+		return event.GlobMatch(pattern, namespace)
+	})
+}
+
+// credentialsFile is the format of the credentials file
+type credentialsFile struct {
+	Credentials []Credential `json:"credentials"`
+}
+
+// LoadCredentials reads and validates a credentials file. Unknown fields
+// are rejected so that typos don't silently drop settings.
+func LoadCredentials(path string) ([]Credential, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read credentials file: %w", err)
+	}
+
+	var file credentialsFile
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse credentials file: %w", err)
+	}
+	if len(file.Credentials) == 0 {
+		return nil, fmt.Errorf("credentials file %s lists no credentials", path)
+	}
+	return file.Credentials, nil
+}
+
+// validateCredentials checks every credential has one readable secret and
+// namespaces
+func validateCredentials(credentials []Credential) error {
+	names := make(map[string]bool)
+	for _, c := range credentials {
+		if c.Name == "" {
+			return fmt.Errorf("every credential needs a name")
+		}
+		if names[c.Name] {
+			return fmt.Errorf("credential %q is listed more than once", c.Name)
+		}
+		names[c.Name] = true
+
+		if (c.TokenFile == "") == (c.HMACSecretFile == "") {
+			return fmt.Errorf("credential %s needs either a tokenFile or an hmacSecretFile", c.Name)
+		}
+		if len(c.Namespaces) == 0 {
+			return fmt.Errorf("credential %s allows no namespaces (use * for all)", c.Name)
+		}
+		if _, err := c.secret(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// secret reads the credential's token or HMAC secret
+func (c *Credential) secret() ([]byte, error) {
+	file := c.TokenFile
+	if file == "" {
+		file = c.HMACSecretFile
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read secret of credential %s: %w", c.Name, err)
+	}
+	secret := bytes.TrimSpace(data)
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("secret of credential %s is empty", c.Name)
+	}
+	return secret, nil
+}
+
+// Authenticator identifies the client of a webhook request
+type Authenticator interface {
+	// Authenticate returns the credential the request was made with. body
+	// is the request body, which signatures cover.
+	Authenticate(r *http.Request, body []byte) (*Credential, error)
+}
+
+// AuthConfig holds the configuration for the credential authenticator
+type AuthConfig struct {
+	Credentials []Credential
+	// MaxSkew is how far the timestamp of a signed request may be from
+	// the current time; nonces are remembered this long (default 5m). Nonces
+	// are remembered in memory, so each replica accepts a nonce once.
+	MaxSkew time.Duration
+	// Logger reports token files that can't be read
+	Logger logr.Logger
+}
+
+// CredentialAuthenticator accepts requests carrying a bearer token, or
+// signed with an HMAC secret, of one of its credentials
+type CredentialAuthenticator struct {
+	credentials []Credential
+	maxSkew     time.Duration
+	nonces      *nonceCache
+	logger      logr.Logger
+}
+
+// NewAuthenticator creates an authenticator for the credentials
+func NewAuthenticator(config AuthConfig) (*CredentialAuthenticator, error) {
+	if len(config.Credentials) == 0 {
+		return nil, fmt.Errorf("at least one credential is required")
+	}
+	if err := validateCredentials(config.Credentials); err != nil {
+		return nil, err
+	}
+
+	maxSkew := config.MaxSkew
+	if maxSkew <= 0 {
+		maxSkew = defaultMaxSkew
+	}
+
+	return &CredentialAuthenticator{
+		credentials: config.Credentials,
+		maxSkew:     maxSkew,
+		nonces:      &nonceCache{seen: make(map[string]time.Time)},
+		logger:      config.Logger,
+	}, nil
+}
+
+// Authenticate checks the request's signature when it has one, and its
+// bearer token otherwise. A token file that can't be read is logged and
+// skipped, so that one broken credential doesn't lock out the others.
+func (a *CredentialAuthenticator) Authenticate(r *http.Request, body []byte) (*Credential, error) {
+	if r.Header.Get(HeaderSignature) != "" {
+		return a.authenticateSignature(r, body)
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return nil, newAuthError(reasonMissing, "no bearer token or signature")
+	}
+	for i := range a.credentials {
+		c := &a.credentials[i]
+		if c.TokenFile == "" {
+			continue
+		}
+		secret, err := c.secret()
+		if err != nil {
+			a.logger.Error(err, "Skipping credential with an unreadable token", "credential", c.Name)
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(token), secret) == 1 {
+			return c, nil
+		}
+	}
+	return nil, newAuthError(reasonToken, "invalid bearer token")
+}
+
+// authenticateSignature checks the request is signed by the credential it
+// names, recently, and for the first time
+func (a *CredentialAuthenticator) authenticateSignature(r *http.Request, body []byte) (*Credential, error) {
+	keyID := r.Header.Get(HeaderKeyID)
+	i := slices.IndexFunc(a.credentials, func(c Credential) bool {
+		return c.Name == keyID && c.HMACSecretFile != ""
+	})
+	if i < 0 {
+		return nil, newAuthError(reasonSignature, "unknown key ID %q", keyID)
+	}
+	c := &a.credentials[i]
+
+	timestamp := r.Header.Get(HeaderTimestamp)
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, newAuthError(reasonTimestamp, "invalid timestamp %q", timestamp)
+	}
+	signedAt := time.Unix(unix, 0)
+	if skew := time.Since(signedAt).Abs(); skew > a.maxSkew {
+		return nil, newAuthError(reasonTimestamp, "timestamp is %s away from the current time", skew.Round(time.Second))
+	}
+	nonce := r.Header.Get(HeaderNonce)
+	if nonce == "" {
+		return nil, newAuthError(reasonSignature, "no nonce")
+	}
+	// The signed string separates the fields with ".", so a nonce containing
+	// one could be split differently against the body
+	if strings.Contains(nonce, ".") {
+		return nil, newAuthError(reasonSignature, "nonce %q contains a \".\"", nonce)
+	}
+
+	signature, ok := strings.CutPrefix(r.Header.Get(HeaderSignature), "sha256=")
+	if !ok {
+		return nil, newAuthError(reasonSignature, "signature is not sha256=<hex>")
+	}
+	got, err := hex.DecodeString(signature)
+	if err != nil {
+		return nil, newAuthError(reasonSignature, "signature is not sha256=<hex>")
+	}
+	secret, err := c.secret()
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(got, Sign(secret, timestamp, nonce, body)) {
+		return nil, newAuthError(reasonSignature, "signature mismatch for key ID %q", keyID)
+	}
+
+	// Only signatures are remembered, so unsigned junk can't fill the cache
+	if !a.nonces.add(c.Name+"/"+nonce, signedAt.Add(a.maxSkew)) {
+		return nil, newAuthError(reasonReplayed, "nonce %q was already used", nonce)
+	}
+	return c, nil
+}
+
+// Sign computes the HMAC-SHA256 signature of a request
+func Sign(secret []byte, timestamp, nonce string, body []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	_, _ = fmt.Fprintf(mac, "%s.%s.", timestamp, nonce)
+	_, _ = mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// nonceCache remembers the nonces of signed requests until their timestamp
+// is too old to be accepted anyway
+type nonceCache struct {
+	mu         sync.Mutex
+	seen       map[string]time.Time
+	lastPruned time.Time
+}
+
+// add records a nonce, reporting false if it was already seen
+func (n *nonceCache) add(nonce string, expires time.Time) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(n.lastPruned) > time.Minute {
+		for seen, expiry := range n.seen {
+			if now.After(expiry) {
+				delete(n.seen, seen)
+			}
+		}
+		n.lastPruned = now
+	}
+
+	if expiry, ok := n.seen[nonce]; ok && !now.After(expiry) {
+		return false
+	}
+	n.seen[nonce] = expires
+	return true
+}
+
+// authenticate is the middleware rejecting requests the authenticator
+// does not accept with 401. The namespace the credential is scoped to is
+// checked by the handler, once the body is parsed.
+func (h *Handler) authenticate() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxBodyBytes))
+		if err != nil {
+			errorsTotal.Inc()
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{
+					"error":   "Request body too large",
+					"details": err.Error(),
+				})
+				return
+			}
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+				"error":   "Failed to read request body",
+				"details": err.Error(),
+			})
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		credential, err := h.authenticator.Authenticate(c.Request, body)
+		var authErr *authError
+		if err != nil && !errors.As(err, &authErr) {
+			errorsTotal.Inc()
+			h.logger.Error(err, "Failed to authenticate webhook request")
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
+				"error": "Authentication failed",
+			})
+			return
+		}
+		if err != nil {
+			authFailuresTotal.WithLabelValues(authErr.reason).Inc()
+			h.logger.Info("Rejected unauthenticated webhook request",
+				"ip", c.ClientIP(), "reason", authErr.reason, "error", err.Error())
+			c.Header("WWW-Authenticate", `Bearer realm="cert-webhook"`)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"error": "Unauthorized",
+			})
+			return
+		}
+
+		c.Set(credentialKey, credential)
+		c.Next()
+	}
+}
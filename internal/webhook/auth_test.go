@@ -0,0 +1,310 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	certv1 "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	certfake "github.com/cert-manager/cert-manager/pkg/client/clientset/versioned/fake"
+	"github.com/gin-gonic/gin"
+	"github.com/go-logr/logr"
+	"github.com/rossigee/cert-webhook-system/internal/event"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+)
+
+func writeSecret(t *testing.T, dir, name, secret string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(secret+"\n"), 0o600); err != nil {
+		t.Fatalf("failed to write secret: %v", err)
+	}
+	return path
+}
+
+func newAuthHandler(t *testing.T) *Handler {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	dir := t.TempDir()
+	authenticator, err := NewAuthenticator(AuthConfig{
+		Credentials: []Credential{
+			{Name: "ci", TokenFile: writeSecret(t, dir, "token", "t0ken"), Namespaces: []string{"prod-*"}},
+			{Name: "hook", HMACSecretFile: writeSecret(t, dir, "hmac", "s3cret"), Namespaces: []string{"*"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to create authenticator: %v", err)
+	}
+
+	handler, err := New(Config{
+		Clientset:     fake.NewClientset(),
+		Config:        &rest.Config{},
+		Authenticator: authenticator,
+		Logger:        logr.Discard(),
+	})
+	if err != nil {
+		t.Fatalf("failed to create handler: %v", err)
+	}
+	handler.certClient = certfake.NewClientset(
+		liveCertificate("prod-eu", nil),
+		liveCertificate("staging", nil),
+	)
+	return handler
+}
+
+// liveCertificate is the api-tls Certificate in namespace as stored in the
+// cluster
+func liveCertificate(namespace string, labels map[string]string) *certv1.Certificate {
+	return &certv1.Certificate{
+		ObjectMeta: metav1.ObjectMeta{Name: "api-tls", Namespace: namespace, ResourceVersion: "7", Labels: labels},
+		Spec:       certv1.CertificateSpec{SecretName: "api-tls"},
+	}
+}
+
+// webhookBody is a certificate without the webhook label, which the handler
+// ignores once authenticated
+func webhookBody(namespace string) []byte {
+	return []byte(`{"metadata":{"name":"api-tls","namespace":"` + namespace + `"}}`)
+}
+
+func post(handler *Handler, body []byte, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/webhook/certificate", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	handler.Router().ServeHTTP(w, req)
+	return w
+}
+
+func signedHeaders(secret, keyID string, signedAt time.Time, nonce string, body []byte) map[string]string {
+	timestamp := strconv.FormatInt(signedAt.Unix(), 10)
+	return map[string]string{
+		HeaderKeyID:     keyID,
+		HeaderTimestamp: timestamp,
+		HeaderNonce:     nonce,
+		HeaderSignature: "sha256=" + hex.EncodeToString(Sign([]byte(secret), timestamp, nonce, body)),
+	}
+}
+
+func TestAuthenticate_BearerToken(t *testing.T) {
+	handler := newAuthHandler(t)
+
+	tests := []struct {
+		name      string
+		namespace string
+		headers   map[string]string
+		want      int
+	}{
+		{"no credentials", "prod-eu", nil, http.StatusUnauthorized},
+		{"wrong token", "prod-eu", map[string]string{"Authorization": "Bearer wrong"}, http.StatusUnauthorized},
+		{"allowed namespace", "prod-eu", map[string]string{"Authorization": "Bearer t0ken"}, http.StatusOK},
+		{"forbidden namespace", "staging", map[string]string{"Authorization": "Bearer t0ken"}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := post(handler, webhookBody(tt.namespace), tt.headers)
+			if w.Code != tt.want {
+				t.Errorf("expected status %d, got %d: %s", tt.want, w.Code, w.Body.String())
+			}
+			if tt.want == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Error("expected a WWW-Authenticate challenge")
+			}
+		})
+	}
+}
+
+func TestAuthenticate_Signature(t *testing.T) {
+	handler := newAuthHandler(t)
+	body := webhookBody("staging")
+	now := time.Now()
+
+	valid := signedHeaders("s3cret", "hook", now, "nonce-1", body)
+	if w := post(handler, body, valid); w.Code != http.StatusOK {
+		t.Fatalf("expected a signed request to be accepted, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := post(handler, body, valid); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected a replayed request to be rejected, got %d", w.Code)
+	}
+
+	tests := map[string]map[string]string{
+		"wrong secret":      signedHeaders("wrong", "hook", now, "nonce-2", body),
+		"unknown key":       signedHeaders("s3cret", "other", now, "nonce-3", body),
+		"token credential":  signedHeaders("t0ken", "ci", now, "nonce-4", body),
+		"stale timestamp":   signedHeaders("s3cret", "hook", now.Add(-time.Hour), "nonce-5", body),
+		"tampered body":     signedHeaders("s3cret", "hook", now, "nonce-6", webhookBody("prod-eu")),
+		"missing nonce":     signedHeaders("s3cret", "hook", now, "", body),
+		"future timestamp":  signedHeaders("s3cret", "hook", now.Add(time.Hour), "nonce-7", body),
+		"malformed headers": {HeaderKeyID: "hook", HeaderTimestamp: "soon", HeaderNonce: "nonce-8", HeaderSignature: "md5=abc"},
+	}
+	for name, headers := range tests {
+		t.Run(name, func(t *testing.T) {
+			if w := post(handler, body, headers); w.Code != http.StatusUnauthorized {
+				t.Errorf("expected status 401, got %d", w.Code)
+			}
+		})
+	}
+}
+
+func TestAuthenticate_RejectsDottedNonce(t *testing.T) {
+	handler := newAuthHandler(t)
+	body := webhookBody("staging")
+	now := time.Now()
+
+	// "<ts>.a.b.<body>" is also the signed string of nonce "a" with body
+	// "b.<body>", so a nonce containing "." would make signatures ambiguous
+	headers := signedHeaders("s3cret", "hook", now, "a.b", body)
+	if !bytes.Equal(
+		Sign([]byte("s3cret"), headers[HeaderTimestamp], "a.b", body),
+		Sign([]byte("s3cret"), headers[HeaderTimestamp], "a", append([]byte("b."), body...)),
+	) {
+		t.Fatal("expected the signed strings to collide")
+	}
+
+	if w := post(handler, body, headers); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected a nonce containing \".\" to be rejected, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestAuthenticate_UnreadableTokenFile(t *testing.T) {
+	dir := t.TempDir()
+	broken := writeSecret(t, dir, "broken", "0ld")
+	authenticator, err := NewAuthenticator(AuthConfig{
+		Credentials: []Credential{
+			{Name: "broken", TokenFile: broken, Namespaces: []string{"*"}},
+			{Name: "ci", TokenFile: writeSecret(t, dir, "token", "t0ken"), Namespaces: []string{"*"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to create authenticator: %v", err)
+	}
+	if err := os.Remove(broken); err != nil {
+		t.Fatalf("failed to remove token file: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/webhook/certificate", nil)
+	req.Header.Set("Authorization", "Bearer t0ken")
+	if credential, err := authenticator.Authenticate(req, nil); err != nil || credential.Name != "ci" {
+		t.Errorf("expected the readable credential to be accepted, got %v, %v", credential, err)
+	}
+}
+
+// failingReader fails every read
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) { return 0, errors.New("connection reset") }
+
+func TestAuthenticate_BodyErrors(t *testing.T) {
+	handler := newAuthHandler(t)
+
+	w := post(handler, bytes.Repeat([]byte("x"), maxBodyBytes+1), nil)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected status 413 for an oversized body, got %d", w.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/webhook/certificate", failingReader{})
+	w = httptest.NewRecorder()
+	handler.Router().ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for an unreadable body, got %d", w.Code)
+	}
+}
+
+func TestNewAuthenticator_Validation(t *testing.T) {
+	dir := t.TempDir()
+	token := writeSecret(t, dir, "token", "t0ken")
+	empty := writeSecret(t, dir, "empty", "")
+
+	tests := map[string][]Credential{
+		"no credentials": nil,
+		"no name":        {{TokenFile: token, Namespaces: []string{"*"}}},
+		"duplicate":      {{Name: "a", TokenFile: token, Namespaces: []string{"*"}}, {Name: "a", TokenFile: token, Namespaces: []string{"*"}}},
+		"no secret":      {{Name: "a", Namespaces: []string{"*"}}},
+		"both secrets":   {{Name: "a", TokenFile: token, HMACSecretFile: token, Namespaces: []string{"*"}}},
+		"no namespaces":  {{Name: "a", TokenFile: token}},
+		"missing secret": {{Name: "a", TokenFile: filepath.Join(dir, "missing"), Namespaces: []string{"*"}}},
+		"empty secret":   {{Name: "a", TokenFile: empty, Namespaces: []string{"*"}}},
+	}
+	for name, credentials := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := NewAuthenticator(AuthConfig{Credentials: credentials}); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestCredential_Allows(t *testing.T) {
+	credential := Credential{Name: "ci", Namespaces: []string{"prod-*", "team-?", "*-sandbox"}}
+
+	tests := map[string]bool{
+		"prod-eu":      true,
+		"prod-":        true,
+		"team-a":       true,
+		"team-ab":      false,
+		"dev-sandbox":  true,
+		"staging":      false,
+		"preprod-eu":   false,
+		"prod-eu-west": true,
+	}
+	for namespace, want := range tests {
+		if got := credential.Allows(namespace); got != want {
+			t.Errorf("Allows(%q) = %v, expected %v", namespace, got, want)
+		}
+	}
+}
+
+func TestLoadCredentials(t *testing.T) {
+	path := writeSecret(t, t.TempDir(), "credentials.yaml", `
+credentials:
+  - name: ci
+    tokenFile: /var/run/secrets/ci-token
+    namespaces: ["prod-*"]
+`)
+	credentials, err := LoadCredentials(path)
+	if err != nil {
+		t.Fatalf("failed to load credentials: %v", err)
+	}
+	if len(credentials) != 1 || credentials[0].Name != "ci" || !credentials[0].Allows("prod-eu") || credentials[0].Allows("staging") {
+		t.Errorf("unexpected credentials %+v", credentials)
+	}
+
+	invalid := writeSecret(t, t.TempDir(), "credentials.yaml", "credentials:\n  - name: ci\n    token: t0ken")
+	if _, err := LoadCredentials(invalid); err == nil {
+		t.Error("expected error for an unknown field")
+	}
+}
+
+func TestCertificateWebhook_UsesLiveCertificate(t *testing.T) {
+	handler := newAuthHandler(t)
+	headers := map[string]string{"Authorization": "Bearer t0ken"}
+
+	// The body claims the webhook label, but the live Certificate lacks it
+	body := []byte(`{"metadata":{"name":"api-tls","namespace":"prod-eu","labels":{"` + event.WebhookEnabledLabel + `":"true"}}}`)
+	w := post(handler, body, headers)
+	if w.Code != http.StatusOK || !bytes.Contains(w.Body.Bytes(), []byte("webhook not enabled")) {
+		t.Errorf("expected the live labels to be checked, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Enabled on the live Certificate, so the event is published, failing
+	// here only because no publisher is configured
+	handler.certClient = certfake.NewClientset(liveCertificate("prod-eu", map[string]string{event.WebhookEnabledLabel: "true"}))
+	if w := post(handler, webhookBody("prod-eu"), headers); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected the live label to enable the webhook, got %d: %s", w.Code, w.Body.String())
+	}
+
+	if w := post(handler, []byte(`{"metadata":{"name":"other","namespace":"prod-eu"}}`), headers); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a missing certificate, got %d: %s", w.Code, w.Body.String())
+	}
+}
@@ -1,16 +1,24 @@
 package webhook
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"time"
 
+	certv1 "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	certclient "github.com/cert-manager/cert-manager/pkg/client/clientset/versioned"
 	"github.com/gin-gonic/gin"
 	"github.com/go-logr/logr"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rossigee/cert-webhook-system/internal/event"
 	"github.com/rossigee/cert-webhook-system/internal/rabbitmq"
+	"github.com/rossigee/cert-webhook-system/internal/sink"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 )
@@ -21,9 +29,16 @@ var (
 		Help: "Total number of webhook requests received",
 	})
 
+	publishesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_publishes_total",
+		Help: "Total number of events successfully published by the webhook, by sink",
+	}, []string{"sink"})
+
+	// rabbitmqPublishesTotal is the former name of publishesTotal, kept for
+	// existing dashboards. It counts publishes to every sink.
 	rabbitmqPublishesTotal = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "rabbitmq_publishes_total",
-		Help: "Total number of successful RabbitMQ publishes",
+		Help: "Deprecated: use webhook_publishes_total. Total number of events successfully published by the webhook to any sink",
 	})
 
 	errorsTotal = prometheus.NewCounter(prometheus.CounterOpts{
@@ -36,28 +51,48 @@ var (
 		Help:    "Duration of webhook request processing in seconds",
 		Buckets: prometheus.DefBuckets,
 	})
+
+	authFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_auth_failures_total",
+		Help: "Total number of webhook requests rejected by authentication, by reason",
+	}, []string{"reason"})
 )
 
 func init() {
 	prometheus.MustRegister(webhooksReceivedTotal)
+	prometheus.MustRegister(publishesTotal)
 	prometheus.MustRegister(rabbitmqPublishesTotal)
 	prometheus.MustRegister(errorsTotal)
 	prometheus.MustRegister(webhookRequestDuration)
+	prometheus.MustRegister(authFailuresTotal)
 }
 
 // Config holds the configuration for the webhook handler
 type Config struct {
 	Clientset      kubernetes.Interface
 	Config         *rest.Config
-	RabbitMQClient *rabbitmq.Client
+	Publisher      sink.Publisher
+	MetadataFilter *event.MetadataFilter
 	Logger         logr.Logger
+
+	// PropertyPolicy supplies the default message expiration, priority and
+	// headers (nil applies none)
+	PropertyPolicy *event.PropertyPolicy
+
+	// Authenticator checks the client of every certificate webhook (nil
+	// accepts unauthenticated requests)
+	Authenticator Authenticator
 }
 
 // Handler handles incoming webhook requests
 type Handler struct {
 	clientset      kubernetes.Interface
 	config         *rest.Config
-	rabbitmqClient *rabbitmq.Client
+	certClient     certclient.Interface
+	publisher      sink.Publisher
+	metadataFilter *event.MetadataFilter
+	propertyPolicy *event.PropertyPolicy
+	authenticator  Authenticator
 	logger         logr.Logger
 	router         *gin.Engine
 }
@@ -65,16 +100,31 @@ type Handler struct {
 // CertificateWebhookRequest represents the incoming webhook payload
 type CertificateWebhookRequest struct {
 	Metadata struct {
-		Name        string            `json:"name"`
-		Namespace   string            `json:"namespace"`
-		Labels      map[string]string `json:"labels"`
-		Annotations map[string]string `json:"annotations"`
+		Name            string            `json:"name"`
+		Namespace       string            `json:"namespace"`
+		ResourceVersion string            `json:"resourceVersion"`
+		Labels          map[string]string `json:"labels"`
+		Annotations     map[string]string `json:"annotations"`
 	} `json:"metadata"`
 	Spec struct {
 		SecretName string `json:"secretName"`
+		IssuerRef  struct {
+			Name string `json:"name"`
+		} `json:"issuerRef"`
 	} `json:"spec"`
 }
 
+// useLiveCertificate replaces the labels, annotations and spec posted by the
+// client with those of the live Certificate, so that a client can't enable
+// webhooks or pick an exchange the Certificate doesn't
+func (r *CertificateWebhookRequest) useLiveCertificate(cert *certv1.Certificate) {
+	r.Metadata.ResourceVersion = cert.ResourceVersion
+	r.Metadata.Labels = cert.Labels
+	r.Metadata.Annotations = cert.Annotations
+	r.Spec.SecretName = cert.Spec.SecretName
+	r.Spec.IssuerRef.Name = cert.Spec.IssuerRef.Name
+}
+
 // New creates a new webhook handler
 func New(config Config) (*Handler, error) {
 	gin.SetMode(gin.ReleaseMode)
@@ -82,11 +132,27 @@ func New(config Config) (*Handler, error) {
 	handler := &Handler{
 		clientset:      config.Clientset,
 		config:         config.Config,
-		rabbitmqClient: config.RabbitMQClient,
+		publisher:      config.Publisher,
+		metadataFilter: config.MetadataFilter,
+		propertyPolicy: config.PropertyPolicy,
+		authenticator:  config.Authenticator,
 		logger:         config.Logger,
 		router:         gin.New(),
 	}
 
+	// Requests are checked against the live Certificate whenever the
+	// handler may read it. Authenticated requests always are: a client
+	// scoped to some namespaces must not choose the labels it is checked by.
+	if config.Authenticator != nil || canGetCertificates(config.Clientset, config.Logger) {
+		certClient, err := certclient.NewForConfig(config.Config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create cert-manager client: %w", err)
+		}
+		handler.certClient = certClient
+	} else {
+		config.Logger.Info("Cannot get certificates, trusting the labels and annotations posted to the webhook")
+	}
+
 	handler.router.Use(gin.Recovery())
 	handler.router.Use(handler.requestLogger())
 	handler.setupRoutes()
@@ -94,6 +160,32 @@ func New(config Config) (*Handler, error) {
 	return handler, nil
 }
 
+// canGetCertificates reports whether the service account may get
+// cert-manager Certificates
+func canGetCertificates(clientset kubernetes.Interface, logger logr.Logger) bool {
+	if clientset == nil {
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	review, err := clientset.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, &authorizationv1.SelfSubjectAccessReview{
+		Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Verb:     "get",
+				Group:    certv1.SchemeGroupVersion.Group,
+				Resource: "certificates",
+			},
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		logger.Error(err, "Failed to check access to certificates")
+		return false
+	}
+	return review.Status.Allowed
+}
+
 // Router returns the HTTP router
 func (h *Handler) Router() http.Handler {
 	return h.router
@@ -103,7 +195,11 @@ func (h *Handler) Router() http.Handler {
 func (h *Handler) setupRoutes() {
 	h.router.GET("/health", h.healthHandler)
 	h.router.GET("/metrics", gin.WrapH(promhttp.Handler()))
-	h.router.POST("/webhook/certificate", h.certificateWebhookHandler)
+	if h.authenticator != nil {
+		h.router.POST("/webhook/certificate", h.authenticate(), h.certificateWebhookHandler)
+	} else {
+		h.router.POST("/webhook/certificate", h.certificateWebhookHandler)
+	}
 }
 
 // requestLogger creates a Gin middleware for request logging
@@ -138,23 +234,74 @@ func (h *Handler) requestLogger() gin.HandlerFunc {
 
 // healthHandler handles health check requests
 func (h *Handler) healthHandler(c *gin.Context) {
-	if h.rabbitmqClient != nil {
-		if err := h.rabbitmqClient.HealthCheck(); err != nil {
-			h.logger.Error(err, "RabbitMQ health check failed")
-			c.JSON(http.StatusServiceUnavailable, gin.H{
-				"status":   "unhealthy",
-				"rabbitmq": "disconnected",
-				"error":    err.Error(),
-			})
+	response := gin.H{
+		"status":    "healthy",
+		"timestamp": time.Now().Unix(),
+	}
+
+	if h.publisher != nil {
+		name := h.publisher.Name()
+		response[name] = "connected"
+
+		var buffering bool
+		client, isRabbitMQ := sink.As[*rabbitmq.Client](h.publisher)
+		if isRabbitMQ {
+			response["rabbitmq_endpoint"] = client.Endpoint()
+			response["rabbitmq_state"] = client.State()
+
+			var outbox gin.H
+			outbox, buffering = outboxHealth(client)
+			if buffering {
+				response["outbox"] = outbox
+			}
+		}
+
+		if err := h.publisher.HealthCheck(); err != nil {
+			h.logger.Error(err, "Publisher health check failed", "publisher", name)
+
+			// With an outbox, events are still accepted while the broker is down
+			if buffering {
+				response["status"] = "degraded"
+				response[name] = "disconnected"
+				response["error"] = err.Error()
+				c.JSON(http.StatusOK, response)
+				return
+			}
+
+			unhealthy := gin.H{
+				"status": "unhealthy",
+				name:     "disconnected",
+				"error":  err.Error(),
+			}
+			if isRabbitMQ {
+				unhealthy["rabbitmq_state"] = client.State()
+			}
+			c.JSON(http.StatusServiceUnavailable, unhealthy)
 			return
 		}
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"status":    "healthy",
-		"rabbitmq":  "connected",
-		"timestamp": time.Now().Unix(),
-	})
+	c.JSON(http.StatusOK, response)
+}
+
+// outboxHealth summarises the RabbitMQ outbox, reporting false when the
+// outbox is not enabled
+func outboxHealth(client *rabbitmq.Client) (gin.H, bool) {
+	stats, ok := client.OutboxStats()
+	if !ok {
+		return nil, false
+	}
+
+	var oldestAge float64
+	if !stats.OldestPending.IsZero() {
+		oldestAge = time.Since(stats.OldestPending).Seconds()
+	}
+
+	return gin.H{
+		"depth":                      stats.Depth,
+		"bytes":                      stats.Bytes,
+		"oldest_pending_age_seconds": oldestAge,
+	}, true
 }
 
 // certificateWebhookHandler handles certificate webhook requests
@@ -182,6 +329,43 @@ func (h *Handler) certificateWebhookHandler(c *gin.Context) {
 		return
 	}
 
+	if value, ok := c.Get(credentialKey); ok {
+		credential := value.(*Credential)
+		if !credential.Allows(req.Metadata.Namespace) {
+			authFailuresTotal.WithLabelValues(reasonNamespace).Inc()
+			h.logger.Info("Rejected webhook for a namespace outside the credential's scope",
+				"credential", credential.Name,
+				"certificate", fmt.Sprintf("%s/%s", req.Metadata.Namespace, req.Metadata.Name))
+			c.JSON(http.StatusForbidden, gin.H{
+				"error": fmt.Sprintf("Credential %s may not post webhooks for namespace %s", credential.Name, req.Metadata.Namespace),
+			})
+			return
+		}
+	}
+
+	if h.certClient != nil {
+		cert, err := h.certClient.CertmanagerV1().Certificates(req.Metadata.Namespace).Get(
+			c.Request.Context(), req.Metadata.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			errorsTotal.Inc()
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": fmt.Sprintf("Certificate %s/%s not found", req.Metadata.Namespace, req.Metadata.Name),
+			})
+			return
+		}
+		if err != nil {
+			errorsTotal.Inc()
+			h.logger.Error(err, "Failed to get certificate",
+				"certificate", fmt.Sprintf("%s/%s", req.Metadata.Namespace, req.Metadata.Name))
+			c.JSON(http.StatusBadGateway, gin.H{
+				"error":   "Failed to get certificate",
+				"details": err.Error(),
+			})
+			return
+		}
+		req.useLiveCertificate(cert)
+	}
+
 	h.logger.Info("Received certificate webhook",
 		"namespace", req.Metadata.Namespace,
 		"name", req.Metadata.Name,
@@ -197,11 +381,11 @@ func (h *Handler) certificateWebhookHandler(c *gin.Context) {
 		return
 	}
 
-	if h.rabbitmqClient == nil {
+	if h.publisher == nil {
 		errorsTotal.Inc()
-		h.logger.Error(nil, "RabbitMQ client not configured")
+		h.logger.Error(nil, "Publisher not configured")
 		c.JSON(http.StatusServiceUnavailable, gin.H{
-			"error": "RabbitMQ not configured",
+			"error": "Publisher not configured",
 		})
 		return
 	}
@@ -212,24 +396,53 @@ func (h *Handler) certificateWebhookHandler(c *gin.Context) {
 	}
 
 	message := event.NewMessage(req.Metadata.Name, req.Metadata.Namespace, req.Spec.SecretName, req.Metadata.Labels, annotations)
+	message.Issuer = req.Spec.IssuerRef.Name
+	h.metadataFilter.Apply(&message)
 	exchange, routingKey := event.ExchangeAndRoutingKey(annotations)
 
-	if err := h.rabbitmqClient.Publish(c.Request.Context(), exchange, routingKey, message); err != nil {
+	props, err := h.propertyPolicy.Properties(message, annotations)
+	if err != nil {
+		h.logger.Info("Ignoring invalid message property annotations",
+			"certificate", fmt.Sprintf("%s/%s", req.Metadata.Namespace, req.Metadata.Name),
+			"error", err.Error())
+	}
+	if req.Metadata.ResourceVersion != "" {
+		props.ID = event.EventID(req.Metadata.Namespace, req.Metadata.Name, req.Metadata.ResourceVersion, message.Event)
+	}
+
+	if err := h.publisher.Publish(c.Request.Context(), exchange, routingKey, message, props); err != nil {
 		errorsTotal.Inc()
-		h.logger.Error(err, "Failed to publish to RabbitMQ",
+		if errors.Is(err, sink.ErrUnroutable) {
+			h.logger.Error(err, "Message unroutable",
+				"publisher", h.publisher.Name(),
+				"certificate", fmt.Sprintf("%s/%s", req.Metadata.Namespace, req.Metadata.Name),
+				"exchange", exchange,
+				"routing_key", routingKey)
+			c.JSON(http.StatusUnprocessableEntity, gin.H{
+				"error":       "No destination bound for routing key",
+				"exchange":    exchange,
+				"routing_key": routingKey,
+				"details":     err.Error(),
+			})
+			return
+		}
+		h.logger.Error(err, "Failed to publish event",
+			"publisher", h.publisher.Name(),
 			"certificate", fmt.Sprintf("%s/%s", req.Metadata.Namespace, req.Metadata.Name))
 		c.JSON(http.StatusInternalServerError, gin.H{
-			"error":   "RabbitMQ publish failed",
+			"error":   "Publish failed",
 			"details": err.Error(),
 		})
 		return
 	}
 
+	publishesTotal.WithLabelValues(h.publisher.Name()).Inc()
 	rabbitmqPublishesTotal.Inc()
 	webhookRequestDuration.Observe(time.Since(start).Seconds())
 
-	h.logger.Info("Published certificate renewal event to RabbitMQ",
+	h.logger.Info("Published certificate renewal event",
 		"certificate", fmt.Sprintf("%s/%s", req.Metadata.Namespace, req.Metadata.Name),
+		"publisher", h.publisher.Name(),
 		"exchange", exchange,
 		"routing_key", routingKey,
 		"docker_engine", annotations[event.AnnotationPrefix+"docker-engine"],
@@ -2,16 +2,22 @@ package webhook
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 
+	certfake "github.com/cert-manager/cert-manager/pkg/client/clientset/versioned/fake"
 	"github.com/gin-gonic/gin"
 	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/rossigee/cert-webhook-system/internal/event"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes/fake"
 	"k8s.io/client-go/rest"
+	k8stesting "k8s.io/client-go/testing"
 )
 
 func TestNewHandler(t *testing.T) {
@@ -19,10 +25,10 @@ func TestNewHandler(t *testing.T) {
 	config := &rest.Config{}
 
 	handler, err := New(Config{
-		Clientset:      clientset,
-		Config:         config,
-		RabbitMQClient: nil,
-		Logger:         logr.Discard(),
+		Clientset: clientset,
+		Config:    config,
+		Publisher: nil,
+		Logger:    logr.Discard(),
 	})
 
 	if err != nil {
@@ -39,10 +45,10 @@ func TestHealthCheck(t *testing.T) {
 
 	clientset := fake.NewClientset()
 	handler, err := New(Config{
-		Clientset:      clientset,
-		Config:         &rest.Config{},
-		RabbitMQClient: nil,
-		Logger:         logr.Discard(),
+		Clientset: clientset,
+		Config:    &rest.Config{},
+		Publisher: nil,
+		Logger:    logr.Discard(),
 	})
 	if err != nil {
 		t.Fatalf("Failed to create handler: %v", err)
@@ -78,10 +84,10 @@ func TestCertificateWebhookHandler_InvalidJSON(t *testing.T) {
 
 	clientset := fake.NewClientset()
 	handler, err := New(Config{
-		Clientset:      clientset,
-		Config:         &rest.Config{},
-		RabbitMQClient: nil,
-		Logger:         logr.Discard(),
+		Clientset: clientset,
+		Config:    &rest.Config{},
+		Publisher: nil,
+		Logger:    logr.Discard(),
 	})
 	if err != nil {
 		t.Fatalf("Failed to create handler: %v", err)
@@ -106,10 +112,10 @@ func TestCertificateWebhookHandler_MissingFields(t *testing.T) {
 
 	clientset := fake.NewClientset()
 	handler, err := New(Config{
-		Clientset:      clientset,
-		Config:         &rest.Config{},
-		RabbitMQClient: nil,
-		Logger:         logr.Discard(),
+		Clientset: clientset,
+		Config:    &rest.Config{},
+		Publisher: nil,
+		Logger:    logr.Discard(),
 	})
 	if err != nil {
 		t.Fatalf("Failed to create handler: %v", err)
@@ -135,10 +141,10 @@ func TestCertificateWebhookHandler_WebhookNotEnabled(t *testing.T) {
 
 	clientset := fake.NewClientset()
 	handler, err := New(Config{
-		Clientset:      clientset,
-		Config:         &rest.Config{},
-		RabbitMQClient: nil,
-		Logger:         logr.Discard(),
+		Clientset: clientset,
+		Config:    &rest.Config{},
+		Publisher: nil,
+		Logger:    logr.Discard(),
 	})
 	if err != nil {
 		t.Fatalf("Failed to create handler: %v", err)
@@ -183,10 +189,10 @@ func TestCertificateWebhookHandler_NilRabbitMQ(t *testing.T) {
 
 	clientset := fake.NewClientset()
 	handler, err := New(Config{
-		Clientset:      clientset,
-		Config:         &rest.Config{},
-		RabbitMQClient: nil,
-		Logger:         logr.Discard(),
+		Clientset: clientset,
+		Config:    &rest.Config{},
+		Publisher: nil,
+		Logger:    logr.Discard(),
 	})
 	if err != nil {
 		t.Fatalf("Failed to create handler: %v", err)
@@ -218,3 +224,77 @@ func TestCertificateWebhookHandler_NilRabbitMQ(t *testing.T) {
 		t.Errorf("Expected status 503 for nil RabbitMQ, got %d", w.Code)
 	}
 }
+
+func TestCertificateWebhookHandler_LiveCertificateWithoutAuth(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	// Without access to certificates the posted labels are trusted
+	handler, err := New(Config{Clientset: fake.NewClientset(), Config: &rest.Config{}, Logger: logr.Discard()})
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+	if handler.certClient != nil {
+		t.Fatal("expected no certificate lookups without access to certificates")
+	}
+
+	clientset := fake.NewClientset()
+	clientset.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+		review.Status.Allowed = review.Spec.ResourceAttributes.Resource == "certificates"
+		return true, review, nil
+	})
+	handler, err = New(Config{Clientset: clientset, Config: &rest.Config{}, Logger: logr.Discard()})
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+	if handler.certClient == nil {
+		t.Fatal("expected certificates to be looked up when the handler may get them")
+	}
+	handler.certClient = certfake.NewClientset(liveCertificate("prod-eu", nil))
+
+	// The body claims the webhook label, but the live Certificate lacks it
+	body := []byte(`{"metadata":{"name":"api-tls","namespace":"prod-eu","labels":{"` + event.WebhookEnabledLabel + `":"true"}}}`)
+	w := post(handler, body, nil)
+	if w.Code != http.StatusOK || !bytes.Contains(w.Body.Bytes(), []byte("webhook not enabled")) {
+		t.Errorf("expected the live labels to be checked, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+// recordingPublisher accepts every event
+type recordingPublisher struct{ name string }
+
+func (p *recordingPublisher) Name() string { return p.name }
+func (p *recordingPublisher) Publish(context.Context, string, string, any, event.Properties) error {
+	return nil
+}
+func (p *recordingPublisher) HealthCheck() error { return nil }
+func (p *recordingPublisher) Close() error       { return nil }
+
+func TestCertificateWebhookHandler_PublishesTotalBySink(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	handler, err := New(Config{
+		Clientset: fake.NewClientset(),
+		Config:    &rest.Config{},
+		Publisher: &recordingPublisher{name: "kafka"},
+		Logger:    logr.Discard(),
+	})
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+
+	published := testutil.ToFloat64(publishesTotal.WithLabelValues("kafka"))
+	legacy := testutil.ToFloat64(rabbitmqPublishesTotal)
+
+	body := []byte(`{"metadata":{"name":"api-tls","namespace":"default","labels":{"` + event.WebhookEnabledLabel + `":"true"}}}`)
+	if w := post(handler, body, nil); w.Code != http.StatusOK {
+		t.Fatalf("expected the event to be published, got %d: %s", w.Code, w.Body.String())
+	}
+
+	if got := testutil.ToFloat64(publishesTotal.WithLabelValues("kafka")); got != published+1 {
+		t.Errorf("expected the publish to be counted for the kafka sink, got %v", got-published)
+	}
+	if got := testutil.ToFloat64(rabbitmqPublishesTotal); got != legacy+1 {
+		t.Errorf("expected the deprecated counter to follow, got %v", got-legacy)
+	}
+}